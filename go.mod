@@ -9,6 +9,7 @@ require (
 	github.com/orcaman/concurrent-map v1.0.0
 	golang.org/x/crypto v0.11.0
 	golang.org/x/net v0.12.0
+	golang.org/x/sys v0.10.0
 	golang.org/x/time v0.3.0
 	gopkg.in/ini.v1 v1.67.0
 )
@@ -25,6 +25,7 @@ func main() {
 	printVersion := flag.Bool("version", false, "Print the version")
 	configFile := flag.String("config", "config.conf", "Config file location")
 	startSection := flag.String("run", "gateway", "What type of server to run")
+	serviceCmd := flag.String("service", "", "Windows only. 'install' or 'uninstall' the webircgateway service")
 	flag.Parse()
 
 	if *printVersion {
@@ -34,11 +35,40 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *startSection != "gateway" && *startSection != "proxy" {
-		fmt.Println("-run can either be 'gateway' or 'proxy'")
+	// webircgateway ctl <command> [args]
+	if flag.Arg(0) == "ctl" {
+		runCtl(*configFile, flag.Args()[1:])
+		return
+	}
+
+	if *startSection != "gateway" && *startSection != "proxy" && *startSection != "replay" {
+		fmt.Println("-run can either be 'gateway', 'proxy' or 'replay'")
 		os.Exit(1)
 	}
 
+	// webircgateway -run=replay <capture file>
+	if *startSection == "replay" {
+		runReplay(*configFile, flag.Arg(0))
+		return
+	}
+
+	if *serviceCmd != "" {
+		err := serviceCommand(*serviceCmd, *configFile, *startSection)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if runningAsService() {
+		err := runService(*configFile, *startSection)
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	runGateway(*configFile, *startSection)
 }
 
@@ -56,10 +86,21 @@ func runGateway(configFile string, function string) {
 	gateway.Config.SetConfigFile(configFile)
 	log.Printf("Using config %s", gateway.Config.CurrentConfigFile())
 
+	pluginsQuit, startErr := startGateway(gateway)
+	if startErr != nil {
+		log.Printf("Error starting: %s", startErr.Error())
+		os.Exit(1)
+	}
+
+	pluginsQuit.Wait()
+	gateway.WaitClose()
+}
+
+// startGateway - Load the config and plugins then start the gateway
+func startGateway(gateway *webircgateway.Gateway) (*sync.WaitGroup, error) {
 	configErr := gateway.Config.Load()
 	if configErr != nil {
-		log.Printf("Config file error: %s", configErr.Error())
-		os.Exit(1)
+		return nil, fmt.Errorf("Config file error: %s", configErr.Error())
 	}
 
 	pluginsQuit := &sync.WaitGroup{}
@@ -67,22 +108,111 @@ func runGateway(configFile string, function string) {
 
 	gateway.Start()
 
-	pluginsQuit.Wait()
-	gateway.WaitClose()
+	// Servers are listening so privileged ports are no longer needed
+	err := dropPrivileges(gateway.Config.RunAsUser, gateway.Config.RunAsGroup, gateway.ControlSocketFile())
+	if err != nil {
+		return nil, fmt.Errorf("Could not switch to user %q group %q: %s", gateway.Config.RunAsUser, gateway.Config.RunAsGroup, err.Error())
+	}
+	if gateway.Config.RunAsUser != "" || gateway.Config.RunAsGroup != "" {
+		gateway.Log(2, "Running as uid %d gid %d", os.Getuid(), os.Getgid())
+	}
+
+	return pluginsQuit, nil
+}
+
+// runReplay - Replay a traffic capture file through the gateway line processing and print the result
+func runReplay(configFile string, captureFile string) {
+	if captureFile == "" {
+		fmt.Println("Usage: webircgateway [-config=config.conf] -run=replay <capture file>")
+		os.Exit(1)
+	}
+
+	gateway := webircgateway.NewGateway("replay")
+	log.SetOutput(os.Stderr)
+	go printLogOutput(gateway)
+
+	gateway.Config.SetConfigFile(configFile)
+	configErr := gateway.Config.Load()
+	if configErr != nil {
+		fmt.Fprintf(os.Stderr, "Config file error: %s\n", configErr.Error())
+		os.Exit(1)
+	}
+
+	file, err := os.Open(captureFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	err = gateway.Replay(file, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+// runCtl - Send a command to an already running gateway over its control socket
+func runCtl(configFile string, args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: webircgateway [-config=config.conf] ctl <command> [args]")
+		fmt.Println("Run 'webircgateway ctl help' for a list of commands")
+		os.Exit(1)
+	}
+
+	// The config is only loaded to find the control socket location
+	gateway := webircgateway.NewGateway("ctl")
+	go func() {
+		for range gateway.LogOutput {
+		}
+	}()
+
+	gateway.Config.SetConfigFile(configFile)
+	configErr := gateway.Config.Load()
+	if configErr != nil {
+		fmt.Printf("Config file error: %s\n", configErr.Error())
+		os.Exit(1)
+	}
+
+	if gateway.Config.ControlSocket == "" {
+		fmt.Println("No control socket has been configured")
+		os.Exit(1)
+	}
+
+	out, err := webircgateway.SendControlCommand(gateway.Config.ControlSocket, args)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Print(out)
 }
 
 func watchForSignals(gateway *webircgateway.Gateway) {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP, syscall.SIGINT)
+	signal.Notify(c, append([]os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM}, maintenanceSignals...)...)
 
+	shuttingDown := false
 	for {
 		switch sig := <-c; sig {
-		case syscall.SIGINT:
-			fmt.Println("Received SIGINT, shutting down webircgateway")
-			gateway.Close()
+		case syscall.SIGINT, syscall.SIGTERM:
+			if shuttingDown {
+				fmt.Printf("Received %s while shutting down, exiting now\n", sig)
+				os.Exit(1)
+			}
+			shuttingDown = true
+			fmt.Printf("Received %s, shutting down webircgateway\n", sig)
+			// Draining clients may take a while, keep listening for a second signal meanwhile
+			go gateway.Close()
 		case syscall.SIGHUP:
 			fmt.Println("Recieved SIGHUP, reloading config file")
-			gateway.Config.Load()
+			if err := gateway.Config.Load(); err != nil {
+				fmt.Printf("Config file error: %s\n", err.Error())
+			}
+		default:
+			inMaintenance := !gateway.IsInMaintenance()
+			fmt.Printf("Received %s, setting maintenance mode %t\n", sig, inMaintenance)
+			gateway.SetMaintenance(inMaintenance)
 		}
 	}
 }
@@ -1,22 +1,42 @@
 package identd
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"net"
-	"net/textproto"
 	"sync"
+	"time"
 )
 
+// The longest request line accepted. "65535 , 65535" plus some whitespace
+const maxRequestLength = 100
+
 // Server - An IdentD server
 type Server struct {
 	Entries     map[string]string
 	EntriesLock sync.Mutex
+	// ListenAddrs - Addresses to listen on. Eg. "0.0.0.0:113" and "[::]:113"
+	ListenAddrs []string
+	// ReadTimeout - How long a client has to send its request before being disconnected
+	ReadTimeout time.Duration
+	// MaxConnections - The number of lookups that may be handled at once. 0 for no limit
+	MaxConnections int
+	// OS and Charset - The operating system and optional charset fields of responses
+	OS      string
+	Charset string
+
+	connSlots chan struct{}
 }
 
 // NewIdentdServer - Create a new IdentdServer instance
 func NewIdentdServer() Server {
 	return Server{
-		Entries: make(map[string]string),
+		Entries:        make(map[string]string),
+		ListenAddrs:    []string{":113"},
+		ReadTimeout:    time.Second * 10,
+		MaxConnections: 100,
+		OS:             "UNIX",
 	}
 }
 
@@ -36,12 +56,25 @@ func (i *Server) RemoveIdent(localPort, remotePort int, iface string) {
 
 // Run - Start listening for ident lookups
 func (i *Server) Run() error {
-	serv, err := net.Listen("tcp", ":113")
-	if err != nil {
-		return err
+	if i.MaxConnections > 0 {
+		i.connSlots = make(chan struct{}, i.MaxConnections)
+	}
+
+	listeners := []net.Listener{}
+	for _, addr := range i.ListenAddrs {
+		serv, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, serv)
 	}
 
-	go i.ListenForRequests(&serv)
+	for idx := range listeners {
+		go i.ListenForRequests(&listeners[idx])
+	}
 	return nil
 }
 
@@ -54,29 +87,62 @@ func (i *Server) ListenForRequests(serverSocket *net.Listener) {
 			break
 		}
 
-		go func(conn net.Conn) {
-			tc := textproto.NewConn(conn)
+		// Drop connections over the limit rather than letting slow clients queue up
+		if i.connSlots != nil {
+			select {
+			case i.connSlots <- struct{}{}:
+			default:
+				client.Close()
+				continue
+			}
+		}
 
-			line, err := tc.ReadLine()
-			if err != nil {
+		go func(conn net.Conn) {
+			defer func() {
 				conn.Close()
+				if i.connSlots != nil {
+					<-i.connSlots
+				}
+			}()
+
+			if i.ReadTimeout > 0 {
+				conn.SetDeadline(time.Now().Add(i.ReadTimeout))
+			}
+
+			reader := bufio.NewReader(io.LimitReader(conn, maxRequestLength))
+			line, err := reader.ReadString('\n')
+			if err != nil && line == "" {
 				return
 			}
 
 			var localPort, remotePort int
-			fmt.Sscanf(line, "%d, %d", &localPort, &remotePort)
-			if localPort > 0 && remotePort > 0 {
-				i.EntriesLock.Lock()
-				ident, ok := i.Entries[fmt.Sprintf("%d-%d", localPort, remotePort)]
-				i.EntriesLock.Unlock()
-				if !ok {
-					fmt.Fprintf(conn, "%d, %d : ERROR : NO-USER\r\n", localPort, remotePort)
-				} else {
-					fmt.Fprintf(conn, "%d, %d : USERID : UNIX : %s\r\n", localPort, remotePort, ident)
-				}
+			fmt.Sscanf(line, "%d , %d", &localPort, &remotePort)
+			if localPort < 1 || localPort > 65535 || remotePort < 1 || remotePort > 65535 {
+				fmt.Fprintf(conn, "%d, %d : ERROR : INVALID-PORT\r\n", localPort, remotePort)
+				return
 			}
 
-			conn.Close()
+			i.EntriesLock.Lock()
+			ident, ok := i.Entries[fmt.Sprintf("%d-%d", localPort, remotePort)]
+			i.EntriesLock.Unlock()
+			if !ok {
+				fmt.Fprintf(conn, "%d, %d : ERROR : NO-USER\r\n", localPort, remotePort)
+			} else {
+				fmt.Fprintf(conn, "%d, %d : USERID : %s : %s\r\n", localPort, remotePort, i.osField(), ident)
+			}
 		}(client)
 	}
 }
+
+// osField - The opsys field of a response, including the charset if set
+func (i *Server) osField() string {
+	os := i.OS
+	if os == "" {
+		os = "UNIX"
+	}
+	if i.Charset != "" {
+		os += " , " + i.Charset
+	}
+
+	return os
+}
@@ -0,0 +1,45 @@
+package irc
+
+import "strings"
+
+const (
+	// CaseMappingASCII - Only A-Z are considered uppercase versions of a-z
+	CaseMappingASCII = "ascii"
+	// CaseMappingRFC1459 - As ascii, plus []\^ are the uppercase versions of {}|~
+	CaseMappingRFC1459 = "rfc1459"
+	// CaseMappingStrictRFC1459 - As rfc1459, but without ^ and ~
+	CaseMappingStrictRFC1459 = "strict-rfc1459"
+)
+
+// CaseFold - Convert s to its lowercase form using the given CASEMAPPING. Unknown
+// mappings are treated as rfc1459 which is the default when an IRCd does not advertise one
+func CaseFold(s string, caseMapping string) string {
+	switch strings.ToLower(caseMapping) {
+	case CaseMappingASCII:
+		return toLowerASCII(s, 'Z')
+	case CaseMappingStrictRFC1459:
+		return toLowerASCII(s, ']')
+	default:
+		return toLowerASCII(s, '^')
+	}
+}
+
+// toLowerASCII - Lowercase A-Z and any characters up to maxUpper, which are 32 below their
+// lowercase forms in the ASCII table
+func toLowerASCII(s string, maxUpper byte) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= maxUpper {
+			if b == nil {
+				b = []byte(s)
+			}
+			b[i] = c + 32
+		}
+	}
+
+	if b == nil {
+		return s
+	}
+	return string(b)
+}
@@ -1,6 +1,7 @@
 package irc
 
 import (
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -47,6 +48,131 @@ func (m *ISupport) GetToken(key string) (val string) {
 	return
 }
 
+// CaseMapping - The CASEMAPPING advertised by the IRCd, defaulting to rfc1459
+func (m *ISupport) CaseMapping() string {
+	caseMapping := m.GetToken("CASEMAPPING")
+	if caseMapping == "" {
+		caseMapping = CaseMappingRFC1459
+	}
+	return caseMapping
+}
+
+// CaseFold - Lowercase a nick or channel name using the IRCds CASEMAPPING
+func (m *ISupport) CaseFold(s string) string {
+	return CaseFold(s, m.CaseMapping())
+}
+
+// Equals - Compare two nicks or channel names using the IRCds CASEMAPPING
+func (m *ISupport) Equals(a string, b string) bool {
+	return m.CaseFold(a) == m.CaseFold(b)
+}
+
+// PrefixModes - The channel membership modes and their matching prefix symbols from the
+// PREFIX token, in order of rank. Eg. PREFIX=(ov)@+ returns "ov" and "@+"
+func (m *ISupport) PrefixModes() (modes string, symbols string) {
+	prefix := "(ov)@+"
+	if m.HasToken("PREFIX") {
+		prefix = m.GetToken("PREFIX")
+	}
+
+	end := strings.Index(prefix, ")")
+	if !strings.HasPrefix(prefix, "(") || end == -1 || len(prefix)-end-1 != end-1 {
+		return "", ""
+	}
+
+	return prefix[1:end], prefix[end+1:]
+}
+
+// ModeChange - A single mode being set or unset by a MODE command
+type ModeChange struct {
+	Adding bool
+	Mode   string
+	Param  string
+}
+
+// ChanModes - The A, B, C and D classes of channel modes from the CHANMODES token. A modes are
+// lists and B modes always take a parameter. C modes only take one when being set and D modes
+// never take one
+func (m *ISupport) ChanModes() (listModes string, paramModes string, setParamModes string, flagModes string) {
+	chanModes := "beI,k,l,imnpst"
+	if m.HasToken("CHANMODES") {
+		chanModes = m.GetToken("CHANMODES")
+	}
+
+	classes := strings.SplitN(chanModes, ",", 4)
+	for len(classes) < 4 {
+		classes = append(classes, "")
+	}
+	return classes[0], classes[1], classes[2], classes[3]
+}
+
+// ParseModeChanges - Split a channel mode string and its parameters, eg. "+ov-k" with
+// ["nick1", "nick2", "key"], into each of the modes being changed. Membership modes from
+// PREFIX and the CHANMODES classes decide which modes take a parameter. Modes the server did
+// not advertise are assumed to not take one
+func (m *ISupport) ParseModeChanges(modes string, params []string) []ModeChange {
+	prefixModes, _ := m.PrefixModes()
+	listModes, paramModes, setParamModes, _ := m.ChanModes()
+
+	changes := []ModeChange{}
+	adding := true
+	for _, mode := range modes {
+		switch mode {
+		case '+':
+			adding = true
+			continue
+		case '-':
+			adding = false
+			continue
+		}
+
+		change := ModeChange{Adding: adding, Mode: string(mode)}
+		takesParam := strings.ContainsRune(prefixModes, mode) ||
+			strings.ContainsRune(listModes, mode) ||
+			strings.ContainsRune(paramModes, mode) ||
+			(adding && strings.ContainsRune(setParamModes, mode))
+		if takesParam && len(params) > 0 {
+			change.Param = params[0]
+			params = params[1:]
+		}
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// ChanTypes - The prefixes that channel names start with from the CHANTYPES token. Servers
+// that do not send it are assumed to support the RFC1459 # and & channels
+func (m *ISupport) ChanTypes() string {
+	if !m.HasToken("CHANTYPES") {
+		return "#&"
+	}
+	return m.GetToken("CHANTYPES")
+}
+
+// ChannelLen - The longest channel name allowed from the CHANNELLEN token, 0 if unlimited
+func (m *ISupport) ChannelLen() int {
+	if !m.HasToken("CHANNELLEN") {
+		return 200
+	}
+	channelLen, err := strconv.Atoi(m.GetToken("CHANNELLEN"))
+	if err != nil || channelLen < 0 {
+		return 0
+	}
+	return channelLen
+}
+
+// IsChannel - Check if target is a valid channel name on this IRCd
+func (m *ISupport) IsChannel(target string) bool {
+	if target == "" || !strings.ContainsRune(m.ChanTypes(), rune(target[0])) {
+		return false
+	}
+	if channelLen := m.ChannelLen(); channelLen > 0 && len(target) > channelLen {
+		return false
+	}
+	return !strings.ContainsAny(target, " ,\x07")
+}
+
 func (m *ISupport) addToken(tokenPair string) {
 	kv := strings.Split(tokenPair, "=")
 	if len(kv) == 1 {
@@ -2,9 +2,21 @@ package irc
 
 import (
 	"errors"
+	"sort"
 	"strings"
 )
 
+// MaxTagsLength - The maximum size of the tags section of a line, including the leading @
+// and the trailing space, as defined by the message-tags specification
+const MaxTagsLength = 8191
+
+// MaxClientTagsLength - The maximum size of the tag data a client may send, excluding the
+// leading @ and the trailing space
+const MaxClientTagsLength = 4094
+
+// ErrTagsTooLong - The tags section of a line is longer than MaxTagsLength
+var ErrTagsTooLong = errors.New("Message tags too long")
+
 type Mask struct {
 	Nick     string
 	Username string
@@ -42,19 +54,25 @@ func (m *Message) GetParamU(idx int, def string) string {
 
 // ToLine - Convert the Message struct to its raw IRC line
 func (m *Message) ToLine() string {
-	line := ""
+	var line strings.Builder
 
 	if len(m.Tags) > 0 {
-		line += "@"
-		tagCount := 0
-		for tagName, tagVal := range m.Tags {
-			tagCount++
-			line += tagName
-			if tagVal != "" {
-				line += "=" + tagVal
+		// Sort the tags so that the same message always produces the same line
+		tagNames := make([]string, 0, len(m.Tags))
+		for tagName := range m.Tags {
+			tagNames = append(tagNames, tagName)
+		}
+		sort.Strings(tagNames)
+
+		line.WriteString("@")
+		for idx, tagName := range tagNames {
+			if idx > 0 {
+				line.WriteString(";")
 			}
-			if tagCount < len(m.Tags) {
-				line += ";"
+			line.WriteString(tagName)
+			if tagVal := m.Tags[tagName]; tagVal != "" {
+				line.WriteString("=")
+				line.WriteString(EscapeTagValue(tagVal))
 			}
 		}
 	}
@@ -73,34 +91,101 @@ func (m *Message) ToLine() string {
 		}
 
 		if m.Prefix.Hostname != "" && prefix != "" {
-			prefix += "@" + m.Prefix.Username
+			prefix += "@" + m.Prefix.Hostname
 		} else if m.Prefix.Hostname != "" {
 			prefix += m.Prefix.Hostname
 		}
 
-		if line != "" {
-			line += " :" + prefix
-		} else {
-			line += ":" + prefix
+		if line.Len() > 0 {
+			line.WriteString(" ")
 		}
+		line.WriteString(":" + prefix)
 	}
 
-	if line != "" {
-		line += " " + m.Command
-	} else {
-		line += m.Command
+	if line.Len() > 0 {
+		line.WriteString(" ")
 	}
+	line.WriteString(m.Command)
 
 	paramLen := len(m.Params)
 	for idx, param := range m.Params {
-		if idx == paramLen-1 && (strings.Contains(param, " ") || strings.HasPrefix(param, ":")) {
-			line += " :" + param
-		} else {
-			line += " " + param
+		line.WriteString(" ")
+		if idx == paramLen-1 && (param == "" || strings.Contains(param, " ") || strings.HasPrefix(param, ":")) {
+			line.WriteString(":")
+		}
+		line.WriteString(param)
+	}
+
+	return line.String()
+}
+
+// EscapeTagValue - Escape a message tag value as per the message-tags specification
+func EscapeTagValue(val string) string {
+	if !strings.ContainsAny(val, "; \\\r\n") {
+		return val
+	}
+
+	var escaped strings.Builder
+	for i := 0; i < len(val); i++ {
+		switch val[i] {
+		case ';':
+			escaped.WriteString("\\:")
+		case ' ':
+			escaped.WriteString("\\s")
+		case '\\':
+			escaped.WriteString("\\\\")
+		case '\r':
+			escaped.WriteString("\\r")
+		case '\n':
+			escaped.WriteString("\\n")
+		default:
+			escaped.WriteByte(val[i])
+		}
+	}
+
+	return escaped.String()
+}
+
+// UnescapeTagValue - Unescape a raw message tag value as per the message-tags specification
+func UnescapeTagValue(val string) string {
+	if !strings.Contains(val, "\\") {
+		return val
+	}
+
+	var unescaped strings.Builder
+	for i := 0; i < len(val); i++ {
+		if val[i] != '\\' {
+			unescaped.WriteByte(val[i])
+			continue
+		}
+
+		// A trailing lone \ is dropped
+		if i == len(val)-1 {
+			break
+		}
+
+		i++
+		switch val[i] {
+		case ':':
+			unescaped.WriteByte(';')
+		case 's':
+			unescaped.WriteByte(' ')
+		case 'r':
+			unescaped.WriteByte('\r')
+		case 'n':
+			unescaped.WriteByte('\n')
+		default:
+			// Includes \\. Any other escaped character is kept as is
+			unescaped.WriteByte(val[i])
 		}
 	}
 
-	return line
+	return unescaped.String()
+}
+
+// ParseMask - Split a nick!user@host mask into its parts
+func ParseMask(maskStr string) *Mask {
+	return createMask(maskStr)
 }
 
 func createMask(maskStr string) *Mask {
@@ -128,6 +213,37 @@ func createMask(maskStr string) *Mask {
 	return mask
 }
 
+// TagsLength - The length of the tags section at the start of a line, including the leading @
+// and the trailing space. 0 if the line has no tags
+func TagsLength(line string) int {
+	line = strings.TrimLeft(line, " ")
+	if !strings.HasPrefix(line, "@") {
+		return 0
+	}
+
+	spaceIdx := strings.Index(line, " ")
+	if spaceIdx == -1 {
+		return len(line) + 1
+	}
+
+	return spaceIdx + 1
+}
+
+// StripTags - Remove the tags section from the start of a line
+func StripTags(line string) string {
+	line = strings.TrimLeft(line, " ")
+	if !strings.HasPrefix(line, "@") {
+		return line
+	}
+
+	spaceIdx := strings.Index(line, " ")
+	if spaceIdx == -1 {
+		return ""
+	}
+
+	return strings.TrimLeft(line[spaceIdx+1:], " ")
+}
+
 // ParseLine - Turn a raw IRC line into a message
 func ParseLine(input string) (*Message, error) {
 	line := strings.Trim(input, "\r\n")
@@ -135,38 +251,42 @@ func ParseLine(input string) (*Message, error) {
 	message := NewMessage()
 	message.Raw = line
 
+	// Check the size before anything is split so that hostile lines are not parsed at all
+	if TagsLength(line) > MaxTagsLength {
+		return message, ErrTagsTooLong
+	}
+
 	token := ""
 	rest := ""
 
-	token, rest = nextToken(line, false)
+	token, rest = nextToken(line)
 	if token == "" {
 		return message, errors.New("Empty line")
 	}
 
 	// Tags. Starts with "@"
 	if token[0] == 64 {
-		tagsRaw := token[1:]
-		tags := strings.Split(tagsRaw, ";")
-		for _, tag := range tags {
-			parts := strings.Split(tag, "=")
-			if len(parts) > 0 && parts[0] == "" {
+		for _, tag := range strings.Split(token[1:], ";") {
+			// Only split on the first = as any following are part of the value
+			tagName, tagVal := tag, ""
+			if eqPos := strings.Index(tag, "="); eqPos > -1 {
+				tagName, tagVal = tag[:eqPos], tag[eqPos+1:]
+			}
+			if tagName == "" {
 				continue
 			}
 
-			if len(parts) == 1 {
-				message.Tags[parts[0]] = ""
-			} else {
-				message.Tags[parts[0]] = parts[1]
-			}
+			// Duplicate tags are allowed, the last one takes precedence
+			message.Tags[tagName] = UnescapeTagValue(tagVal)
 		}
 
-		token, rest = nextToken(rest, false)
+		token, rest = nextToken(rest)
 	}
 
 	// Prefix. Starts with ":"
 	if token != "" && token[0] == 58 {
 		message.Prefix = createMask(token[1:])
-		token, rest = nextToken(rest, false)
+		token, rest = nextToken(rest)
 	} else {
 		message.Prefix = createMask("")
 	}
@@ -180,29 +300,31 @@ func ParseLine(input string) (*Message, error) {
 
 	// Params
 	for {
-		token, rest = nextToken(rest, true)
-		if token == "" {
+		rest = strings.TrimLeft(rest, " ")
+		if rest == "" {
+			break
+		}
+
+		// The trailing param may be empty or contain spaces
+		if rest[0] == 58 {
+			message.Params = append(message.Params, rest[1:])
 			break
 		}
 
+		token, rest = nextToken(rest)
 		message.Params = append(message.Params, token)
 	}
 
 	return message, nil
 }
 
-func nextToken(s string, allowTrailing bool) (string, string) {
+func nextToken(s string) (string, string) {
 	s = strings.TrimLeft(s, " ")
 
 	if len(s) == 0 {
 		return "", ""
 	}
 
-	// The last token (trailing) start with :
-	if allowTrailing && s[0] == 58 {
-		return s[1:], ""
-	}
-
 	token := ""
 	spaceIdx := strings.Index(s, " ")
 	if spaceIdx > -1 {
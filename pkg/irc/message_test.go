@@ -0,0 +1,242 @@
+package irc_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// lineWithTagData - A PRIVMSG line whose tag data, excluding the leading @ and the trailing space,
+// is dataLen bytes long
+func lineWithTagData(dataLen int) string {
+	return "@a=" + strings.Repeat("x", dataLen-2) + " PRIVMSG #chan :hello"
+}
+
+func TestEscapeTagValue(t *testing.T) {
+	tests := []struct {
+		value   string
+		escaped string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{"a;b", `a\:b`},
+		{"a b", `a\sb`},
+		{`a\b`, `a\\b`},
+		{"a\rb", `a\rb`},
+		{"a\nb", `a\nb`},
+		{"; \\\r\n", `\:\s\\\r\n`},
+		{`\s`, `\\s`},
+	}
+
+	for _, test := range tests {
+		if escaped := irc.EscapeTagValue(test.value); escaped != test.escaped {
+			t.Errorf("EscapeTagValue(%q) = %q, expected %q", test.value, escaped, test.escaped)
+		}
+	}
+}
+
+func TestUnescapeTagValue(t *testing.T) {
+	tests := []struct {
+		raw   string
+		value string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{`a\:b`, "a;b"},
+		{`a\sb`, "a b"},
+		{`a\\b`, `a\b`},
+		{`a\rb`, "a\rb"},
+		{`a\nb`, "a\nb"},
+		{`\:\s\\\r\n`, "; \\\r\n"},
+		// A trailing lone backslash is dropped
+		{`abc\`, "abc"},
+		{`\`, ""},
+		{`a\\\`, `a\`},
+		// Unknown escapes keep the escaped character
+		{`a\bc`, "abc"},
+	}
+
+	for _, test := range tests {
+		if value := irc.UnescapeTagValue(test.raw); value != test.value {
+			t.Errorf("UnescapeTagValue(%q) = %q, expected %q", test.raw, value, test.value)
+		}
+	}
+}
+
+func TestTagValueRoundTrip(t *testing.T) {
+	values := []string{
+		"",
+		"plain",
+		";",
+		" ",
+		`\`,
+		"\r",
+		"\n",
+		`\:`,
+		`\s`,
+		`\\`,
+		`ends with \`,
+		"a;b c\\d\re\nf",
+		"héllo wörld",
+	}
+
+	for _, value := range values {
+		if roundTripped := irc.UnescapeTagValue(irc.EscapeTagValue(value)); roundTripped != value {
+			t.Errorf("%q became %q after escaping and unescaping", value, roundTripped)
+		}
+
+		line := "@+example.com/tag=" + irc.EscapeTagValue(value) + " PRIVMSG #chan :hello"
+		msg, err := irc.ParseLine(line)
+		if err != nil {
+			t.Errorf("ParseLine(%q) failed: %s", line, err.Error())
+			continue
+		}
+		if msg.Tags["+example.com/tag"] != value {
+			t.Errorf("ParseLine(%q) tag value = %q, expected %q", line, msg.Tags["+example.com/tag"], value)
+		}
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		tags    map[string]string
+		nick    string
+		command string
+		params  []string
+	}{
+		{
+			line:    "PING :server",
+			tags:    map[string]string{},
+			command: "PING",
+			params:  []string{"server"},
+		},
+		{
+			line:    ":nick!user@host PRIVMSG #chan :hello world\r\n",
+			tags:    map[string]string{},
+			nick:    "nick",
+			command: "PRIVMSG",
+			params:  []string{"#chan", "hello world"},
+		},
+		{
+			line:    `@a=1;b;c=x\sy;d=e=f :nick PRIVMSG #chan :`,
+			tags:    map[string]string{"a": "1", "b": "", "c": "x y", "d": "e=f"},
+			nick:    "nick",
+			command: "PRIVMSG",
+			params:  []string{"#chan", ""},
+		},
+		{
+			// The last of a duplicated tag takes precedence and empty tag names are ignored
+			line:    "@a=1;;a=2 TAGMSG #chan",
+			tags:    map[string]string{"a": "2"},
+			command: "TAGMSG",
+			params:  []string{"#chan"},
+		},
+		{
+			line:    `@a=trailing\ NOTICE   nick   :text`,
+			tags:    map[string]string{"a": "trailing"},
+			command: "NOTICE",
+			params:  []string{"nick", "text"},
+		},
+	}
+
+	for _, test := range tests {
+		msg, err := irc.ParseLine(test.line)
+		if err != nil {
+			t.Errorf("ParseLine(%q) failed: %s", test.line, err.Error())
+			continue
+		}
+
+		if len(msg.Tags) != len(test.tags) {
+			t.Errorf("ParseLine(%q) tags = %v, expected %v", test.line, msg.Tags, test.tags)
+		}
+		for name, value := range test.tags {
+			if got, ok := msg.Tags[name]; !ok || got != value {
+				t.Errorf("ParseLine(%q) tag %s = %q, expected %q", test.line, name, got, value)
+			}
+		}
+		if msg.Prefix.Nick != test.nick {
+			t.Errorf("ParseLine(%q) nick = %q, expected %q", test.line, msg.Prefix.Nick, test.nick)
+		}
+		if msg.Command != test.command {
+			t.Errorf("ParseLine(%q) command = %q, expected %q", test.line, msg.Command, test.command)
+		}
+		if strings.Join(msg.Params, "\x00") != strings.Join(test.params, "\x00") || len(msg.Params) != len(test.params) {
+			t.Errorf("ParseLine(%q) params = %q, expected %q", test.line, msg.Params, test.params)
+		}
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	for _, line := range []string{"", "\r\n", "   ", "@a=1", "@a=1 :nick!user@host"} {
+		if _, err := irc.ParseLine(line); err == nil {
+			t.Errorf("ParseLine(%q) did not fail", line)
+		}
+	}
+}
+
+func TestClientTagsLengthLimit(t *testing.T) {
+	tests := []struct {
+		dataLen int
+		tooLong bool
+	}{
+		{irc.MaxClientTagsLength - 1, false},
+		{irc.MaxClientTagsLength, false},
+		{irc.MaxClientTagsLength + 1, true},
+	}
+
+	for _, test := range tests {
+		line := lineWithTagData(test.dataLen)
+		// Clients are limited on their tag data, without the leading @ and the trailing space
+		tagsLength := irc.TagsLength(line)
+		if tagsLength != test.dataLen+2 {
+			t.Errorf("TagsLength of %d bytes of tag data = %d, expected %d", test.dataLen, tagsLength, test.dataLen+2)
+		}
+		if tooLong := tagsLength-2 > irc.MaxClientTagsLength; tooLong != test.tooLong {
+			t.Errorf("%d bytes of client tag data over the limit = %v, expected %v", test.dataLen, tooLong, test.tooLong)
+		}
+
+		// Client tags within the client limit are still well within the limit of ParseLine
+		if _, err := irc.ParseLine(line); err != nil {
+			t.Errorf("ParseLine of %d bytes of tag data failed: %s", test.dataLen, err.Error())
+		}
+	}
+}
+
+func TestParseLineTagsLengthLimit(t *testing.T) {
+	tests := []struct {
+		// The length of the tags section including the leading @ and the trailing space
+		tagsLength int
+		err        error
+	}{
+		{irc.MaxTagsLength - 1, nil},
+		{irc.MaxTagsLength, nil},
+		{irc.MaxTagsLength + 1, irc.ErrTagsTooLong},
+		{irc.MaxTagsLength * 2, irc.ErrTagsTooLong},
+	}
+
+	for _, test := range tests {
+		line := lineWithTagData(test.tagsLength - 2)
+		msg, err := irc.ParseLine(line)
+		if err != test.err {
+			t.Errorf("ParseLine with a %d byte tags section returned error %v, expected %v", test.tagsLength, err, test.err)
+			continue
+		}
+		if err != nil {
+			if len(msg.Tags) != 0 || msg.Command != "" {
+				t.Errorf("ParseLine with a %d byte tags section parsed the line after failing", test.tagsLength)
+			}
+			continue
+		}
+		if msg.Command != "PRIVMSG" || len(msg.Tags["a"]) != test.tagsLength-4 {
+			t.Errorf("ParseLine with a %d byte tags section did not parse the full line", test.tagsLength)
+		}
+	}
+
+	// A line that is nothing but tags is measured as if it had a trailing space
+	line := "@a=" + strings.Repeat("x", irc.MaxTagsLength-3)
+	if _, err := irc.ParseLine(line); err != irc.ErrTagsTooLong {
+		t.Errorf("ParseLine of a %d byte line of only tags returned error %v, expected %v", len(line), err, irc.ErrTagsTooLong)
+	}
+}
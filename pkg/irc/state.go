@@ -1,7 +1,7 @@
 package irc
 
 import (
-	"strings"
+	"sort"
 	"sync"
 	"time"
 )
@@ -14,6 +14,13 @@ type State struct {
 	RealName   string
 	Password   string
 	Account    string
+
+	// The username and hostname that the IRCd shows to other users, which may differ from
+	// the ones we connected with due to ident lookups or host cloaking
+	DisplayedUsername string
+	DisplayedHostname string
+
+	modesMutex sync.Mutex
 	Modes      map[string]string
 
 	channelsMutex sync.Mutex
@@ -29,6 +36,7 @@ type StateChannel struct {
 
 func NewState() *State {
 	return &State{
+		Modes:    make(map[string]string),
 		Channels: make(map[string]*StateChannel),
 		ISupport: &ISupport{
 			tokens: make(map[string]string),
@@ -44,29 +52,98 @@ func NewStateChannel(name string) *StateChannel {
 	}
 }
 
+// SetDisplayedMask - Update the username and hostname that the IRCd shows to other users.
+// An empty username leaves the current one as it is
+func (m *State) SetDisplayedMask(username string, hostname string) {
+	if username != "" {
+		m.DisplayedUsername = username
+	}
+	if hostname != "" {
+		m.DisplayedHostname = hostname
+	}
+}
+
+// IsOwnNick - Check if nick is our current nick using the IRCds CASEMAPPING
+func (m *State) IsOwnNick(nick string) bool {
+	return m.ISupport.Equals(nick, m.Nick)
+}
+
+// ApplyUserModes - Update our user modes from a mode string such as "+iw-x"
+func (m *State) ApplyUserModes(modes string) {
+	m.modesMutex.Lock()
+	adding := true
+	for _, mode := range modes {
+		switch mode {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		default:
+			if adding {
+				m.Modes[string(mode)] = ""
+			} else {
+				delete(m.Modes, string(mode))
+			}
+		}
+	}
+	m.modesMutex.Unlock()
+}
+
+// SetUserModes - Replace all of our user modes, as given by RPL_UMODEIS
+func (m *State) SetUserModes(modes string) {
+	m.modesMutex.Lock()
+	m.Modes = make(map[string]string)
+	m.modesMutex.Unlock()
+	m.ApplyUserModes(modes)
+}
+
+// UserModes - A sorted list of our current user modes
+func (m *State) UserModes() []string {
+	m.modesMutex.Lock()
+	modes := make([]string, 0, len(m.Modes))
+	for mode := range m.Modes {
+		modes = append(modes, mode)
+	}
+	m.modesMutex.Unlock()
+
+	sort.Strings(modes)
+	return modes
+}
+
 func (m *State) HasChannel(name string) (ok bool) {
 	m.channelsMutex.Lock()
-	_, ok = m.Channels[strings.ToLower(name)]
+	_, ok = m.Channels[m.ISupport.CaseFold(name)]
 	m.channelsMutex.Unlock()
 	return
 }
 
 func (m *State) GetChannel(name string) (channel *StateChannel) {
 	m.channelsMutex.Lock()
-	channel = m.Channels[strings.ToLower(name)]
+	channel = m.Channels[m.ISupport.CaseFold(name)]
 	m.channelsMutex.Unlock()
 	return
 }
 
+// ChannelNames - A snapshot of the names of the channels we are in
+func (m *State) ChannelNames() []string {
+	m.channelsMutex.Lock()
+	names := make([]string, 0, len(m.Channels))
+	for _, channel := range m.Channels {
+		names = append(names, channel.Name)
+	}
+	m.channelsMutex.Unlock()
+	return names
+}
+
 func (m *State) SetChannel(channel *StateChannel) {
 	m.channelsMutex.Lock()
-	m.Channels[strings.ToLower(channel.Name)] = channel
+	m.Channels[m.ISupport.CaseFold(channel.Name)] = channel
 	m.channelsMutex.Unlock()
 }
 
 func (m *State) RemoveChannel(name string) {
 	m.channelsMutex.Lock()
-	delete(m.Channels, strings.ToLower(name))
+	delete(m.Channels, m.ISupport.CaseFold(name))
 	m.channelsMutex.Unlock()
 }
 
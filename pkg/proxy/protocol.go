@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Version 2 of the handshake adds the version, type and authentication fields. Proxies that
+// only understand version 1 ignore the extra fields
+const ProtocolVersion = 2
+
+const (
+	// HandshakeTypeConnect - Connect to the destination and pipe data to and from it
+	HandshakeTypeConnect = "connect"
+	// HandshakeTypeStatus - Reply with a ServerStatus line and close the connection
+	HandshakeTypeStatus = "status"
+)
+
+// How far the handshake time may be from the proxies clock when authenticating
+const handshakeMaxSkew = time.Minute
+
+// How long a peer has to send its handshake, and the longest handshake line accepted
+const (
+	handshakeTimeout   = time.Second * 10
+	handshakeMaxLength = 4096
+)
+
+// ServerStatus - The reply to a status handshake
+type ServerStatus struct {
+	Version     int    `json:"version"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	Connections int64  `json:"connections"`
+	Uptime      int64  `json:"uptime"`
+}
+
+// signHandshake - The HMAC of the handshake fields using the shared secret
+func signHandshake(secret string, meta *HandshakeMeta) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d\n%d\n%s\n%s\n%s\n%d\n%t\n%s\n%s",
+		meta.Version,
+		meta.Time,
+		meta.Nonce,
+		meta.Type,
+		meta.Host,
+		meta.Port,
+		meta.TLS,
+		meta.Username,
+		meta.Interface,
+	)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticate - Add the version 2 fields to a handshake, signing it if secret is set
+func (meta *HandshakeMeta) authenticate(secret string) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+
+	meta.Version = ProtocolVersion
+	meta.Time = time.Now().Unix()
+	meta.Nonce = hex.EncodeToString(nonce)
+	if secret != "" {
+		meta.Auth = signHandshake(secret, meta)
+	}
+}
+
+// verifyAuth - Check a handshake was signed with secret recently
+func (meta *HandshakeMeta) verifyAuth(secret string) error {
+	if meta.Version < 2 || meta.Auth == "" || meta.Nonce == "" {
+		return errors.New("handshake is not authenticated")
+	}
+
+	skew := time.Since(time.Unix(meta.Time, 0))
+	if skew > handshakeMaxSkew || skew < -handshakeMaxSkew {
+		return errors.New("handshake time is too far from the current time")
+	}
+
+	expected := signHandshake(secret, meta)
+	if !hmac.Equal([]byte(expected), []byte(meta.Auth)) {
+		return errors.New("handshake authentication failed")
+	}
+
+	return nil
+}
+
+// useNonce - Record the nonce of an authenticated handshake. Returns false if it has been seen
+// already, ie. the handshake is being replayed. Nonces are kept for as long as a handshake using
+// them could still be accepted
+func (s *KiwiProxyServer) useNonce(nonce string) bool {
+	s.nonceMu.Lock()
+	defer s.nonceMu.Unlock()
+
+	now := time.Now()
+	for seen, expires := range s.nonces {
+		if now.After(expires) {
+			delete(s.nonces, seen)
+		}
+	}
+
+	if _, seen := s.nonces[nonce]; seen {
+		return false
+	}
+	if s.nonces == nil {
+		s.nonces = make(map[string]time.Time)
+	}
+	s.nonces[nonce] = now.Add(handshakeMaxSkew * 2)
+	return true
+}
+
+// dialProxy - Connect to a proxy server, using TLS if tlsConfig is set
+func dialProxy(proxyServerAddr string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if tlsConfig == nil {
+		return dialer.Dial("tcp", proxyServerAddr)
+	}
+
+	if tlsConfig.ServerName == "" {
+		host, _, _ := net.SplitHostPort(proxyServerAddr)
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	return tls.DialWithDialer(dialer, "tcp", proxyServerAddr, tlsConfig)
+}
+
+// FetchStatus - Check the health of a proxy server
+func FetchStatus(proxyServerAddr string, tlsConfig *tls.Config, secret string, timeout time.Duration) (*ServerStatus, error) {
+	conn, err := dialProxy(proxyServerAddr, tlsConfig, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	meta := &HandshakeMeta{Type: HandshakeTypeStatus}
+	meta.authenticate(secret)
+	handshake, _ := json.Marshal(meta)
+	_, err = conn.Write(append(handshake, '\n'))
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(first) == ResponseForbidden {
+		return nil, errors.New("the proxy did not accept the authentication")
+	}
+
+	// Version 1 proxies reply with a single response code instead of a status
+	if first[0] != '{' {
+		code, _ := strconv.Atoi(string(first))
+		return nil, fmt.Errorf("proxy does not support status requests (response %d)", code)
+	}
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ServerStatus{}
+	err = json.Unmarshal(line, status)
+	if err != nil {
+		return nil, err
+	}
+	if status.Status != "ok" {
+		return status, fmt.Errorf("proxy status %s: %s", status.Status, status.Error)
+	}
+
+	return status, nil
+}
+
+func (s *KiwiProxyServer) status() *ServerStatus {
+	return &ServerStatus{
+		Version:     ProtocolVersion,
+		Status:      "ok",
+		Connections: s.ConnectionCount(),
+		Uptime:      int64(time.Since(s.started).Seconds()),
+	}
+}
@@ -1,10 +1,12 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"io"
 	"net"
+	"time"
 )
 
 type KiwiProxyState int
@@ -29,8 +31,15 @@ type KiwiProxyConnection struct {
 	DestHost       string
 	DestPort       int
 	DestTLS        bool
-	State          KiwiProxyState
-	Conn           *net.Conn
+	// TLSConfig - Connect to the proxy server with TLS. Include a client certificate for
+	// proxies that require mutual TLS
+	TLSConfig *tls.Config
+	// Secret - Sign the handshake with a secret shared with the proxy server
+	Secret string
+	// Timeout - How long to wait while connecting to the proxy server. 0 for no timeout
+	Timeout time.Duration
+	State   KiwiProxyState
+	Conn    *net.Conn
 }
 
 func MakeKiwiProxyConnection() *KiwiProxyConnection {
@@ -54,21 +63,25 @@ func (c *KiwiProxyConnection) Dial(proxyServerAddr string) error {
 
 	c.State = KiwiProxyStateConnecting
 
-	conn, err := net.Dial("tcp", proxyServerAddr)
+	conn, err := dialProxy(proxyServerAddr, c.TLSConfig, c.Timeout)
 	if err != nil {
+		c.State = KiwiProxyStateClosed
 		return err
 	}
 
 	c.Conn = &conn
 	c.State = KiwiProxyStateHandshaking
 
-	meta, _ := json.Marshal(map[string]interface{}{
-		"username":  c.Username,
-		"interface": c.ProxyInterface,
-		"host":      c.DestHost,
-		"port":      c.DestPort,
-		"ssl":       c.DestTLS,
-	})
+	handshake := &HandshakeMeta{
+		Type:      HandshakeTypeConnect,
+		Username:  c.Username,
+		Interface: c.ProxyInterface,
+		Host:      c.DestHost,
+		Port:      c.DestPort,
+		TLS:       c.DestTLS,
+	}
+	handshake.authenticate(c.Secret)
+	meta, _ := json.Marshal(handshake)
 
 	(*c.Conn).Write(append(meta, byte('\n')))
 
@@ -102,6 +115,10 @@ func (c *KiwiProxyConnection) Dial(proxyServerAddr string) error {
 			return &ConnError{Msg: "Host not found", Type: "not_found"}
 		case '5':
 			return &ConnError{Msg: "Connection timed out", Type: "conn_timeout"}
+		case '6':
+			return &ConnError{Msg: "Not allowed by the proxy", Type: "forbidden"}
+		default:
+			return errors.New("The proxy could not connect to the destination")
 		}
 	}
 
@@ -10,6 +10,7 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -23,17 +24,68 @@ const (
 	ResponseRefused     = "3"
 	ResponseUnknownHost = "4"
 	ResponseTimeout     = "5"
+	ResponseForbidden   = "6"
 )
 
 var identdRpc *identd.RpcClient
 var Server net.Listener
 
+// ServerConfig - Options for a KiwiProxyServer
+type ServerConfig struct {
+	// ListenAddrs - Addresses to listen on. Eg. "0.0.0.0:7999"
+	ListenAddrs []string
+	// TLSConfig - Listen with TLS if set
+	TLSConfig *tls.Config
+	// AllowUsername - Check if a username may use the proxy. All usernames are allowed if nil
+	AllowUsername func(username string) bool
+	// AllowDestination - Check if a connection may be made to host:port. All are allowed if nil
+	AllowDestination func(host string, port int) bool
+	// AddIdent and RemoveIdent - Record the username of upstream connections for identd lookups
+	AddIdent    func(localPort int, remotePort int, username string, iface string)
+	RemoveIdent func(localPort int, remotePort int, username string, iface string)
+	// Secret - If set, handshakes must be signed with this shared secret
+	Secret string
+	// LogConnections - Log each proxied connection, not only errors
+	LogConnections bool
+	// Log - Log output, levels as used by the gateway. log.Printf is used if nil
+	Log func(level int, format string, args ...interface{})
+}
+
+// KiwiProxyServer - Accepts connections from gateways and connects them to their destinations
+type KiwiProxyServer struct {
+	Config    ServerConfig
+	listeners []net.Listener
+	mu        sync.Mutex
+	started   time.Time
+	// The number of connections currently being proxied. Accessed atomically
+	connections int64
+	// Nonces of recent authenticated handshakes, mapped to when they may be forgotten
+	nonceMu sync.Mutex
+	nonces  map[string]time.Time
+}
+
+// NewKiwiProxyServer - Create a proxy server. Call Listen to start accepting connections
+func NewKiwiProxyServer(config ServerConfig) *KiwiProxyServer {
+	return &KiwiProxyServer{Config: config, started: time.Now()}
+}
+
+// ConnectionCount - The number of connections currently being proxied
+func (s *KiwiProxyServer) ConnectionCount() int64 {
+	return atomic.LoadInt64(&s.connections)
+}
+
 type HandshakeMeta struct {
 	Host      string `json:"host"`
 	Port      int    `json:"port"`
 	TLS       bool   `json:"ssl"`
 	Username  string `json:"username"`
 	Interface string `json:"interface"`
+	// Version 2 fields
+	Version int    `json:"version,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Time    int64  `json:"time,omitempty"`
+	Nonce   string `json:"nonce,omitempty"`
+	Auth    string `json:"auth,omitempty"`
 }
 
 func MakeClient(conn net.Conn) *Client {
@@ -43,6 +95,8 @@ func MakeClient(conn net.Conn) *Client {
 }
 
 type Client struct {
+	Server       *KiwiProxyServer
+	Type         string
 	Client       net.Conn
 	Upstream     net.Conn
 	UpstreamAddr *net.TCPAddr
@@ -56,26 +110,58 @@ func (c *Client) Run() {
 
 	err = c.Handshake()
 	if err != nil {
-		log.Println(err.Error())
+		c.log(3, "Proxy handshake error from %s: %s", c.Client.RemoteAddr(), err.Error())
+		c.Client.Close()
+		return
+	}
+
+	if c.Type == HandshakeTypeStatus {
+		status, _ := json.Marshal(c.Server.status())
+		c.Client.Write(append(status, '\n'))
+		c.Client.Close()
 		return
 	}
 
 	err = c.ConnectUpstream()
 	if err != nil {
-		log.Println(err.Error())
+		c.log(3, "Proxy error connecting %s to %s: %s", c.Username, c.UpstreamAddr, err.Error())
+		c.Client.Close()
 		return
 	}
 
+	if c.Server != nil && c.Server.Config.LogConnections {
+		c.log(2, "Proxy connected %s from %s to %s", c.Username, c.Client.RemoteAddr(), c.UpstreamAddr)
+	}
+
+	if c.Server != nil {
+		atomic.AddInt64(&c.Server.connections, 1)
+		defer atomic.AddInt64(&c.Server.connections, -1)
+	}
+
 	c.Pipe()
 }
 
+func (c *Client) log(level int, format string, args ...interface{}) {
+	if c.Server != nil {
+		c.Server.log(level, format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
 func (c *Client) Handshake() error {
-	// Read the first line - it should be JSON
-	reader := bufio.NewReader(c.Client)
+	// Read the first line - it should be JSON. Peers that do not send it promptly or send too
+	// much are dropped before they have authenticated
+	c.Client.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	reader := bufio.NewReader(io.LimitReader(c.Client, handshakeMaxLength))
 	line, readErr := reader.ReadBytes('\n')
+	if readErr == io.EOF && len(line) >= handshakeMaxLength {
+		return fmt.Errorf("handshake longer than %d bytes", handshakeMaxLength)
+	}
 	if readErr != nil {
 		return readErr
 	}
+	c.Client.SetReadDeadline(time.Time{})
 
 	var meta = HandshakeMeta{
 		Username:  "user",
@@ -88,6 +174,28 @@ func (c *Client) Handshake() error {
 		return unmarshalErr
 	}
 
+	if c.Server != nil && c.Server.Config.Secret != "" {
+		if err := meta.verifyAuth(c.Server.Config.Secret); err != nil {
+			c.Client.Write([]byte(ResponseForbidden))
+			return err
+		}
+		if !c.Server.useNonce(meta.Nonce) {
+			c.Client.Write([]byte(ResponseForbidden))
+			return fmt.Errorf("handshake nonce has already been used")
+		}
+	}
+
+	c.Type = meta.Type
+	if c.Type == "" {
+		c.Type = HandshakeTypeConnect
+	}
+	if c.Type == HandshakeTypeStatus && c.Server != nil {
+		return nil
+	} else if c.Type != HandshakeTypeConnect {
+		c.Client.Write([]byte(ResponseError))
+		return fmt.Errorf("unknown handshake type %s", c.Type)
+	}
+
 	if meta.Host == "" || meta.Port == 0 || meta.Username == "" || meta.Interface == "" {
 		c.Client.Write([]byte(ResponseError))
 		return fmt.Errorf("missing args")
@@ -96,6 +204,15 @@ func (c *Client) Handshake() error {
 	c.Username = meta.Username
 	c.TLS = meta.TLS
 
+	if c.Server != nil && c.Server.Config.AllowUsername != nil && !c.Server.Config.AllowUsername(meta.Username) {
+		c.Client.Write([]byte(ResponseForbidden))
+		return fmt.Errorf("username %s is not allowed", meta.Username)
+	}
+	if c.Server != nil && c.Server.Config.AllowDestination != nil && !c.Server.Config.AllowDestination(meta.Host, meta.Port) {
+		c.Client.Write([]byte(ResponseForbidden))
+		return fmt.Errorf("destination %s:%d is not allowed", meta.Host, meta.Port)
+	}
+
 	bindAddr, bindAddrErr := net.ResolveTCPAddr("tcp", meta.Interface+":")
 	if bindAddrErr != nil {
 		c.Client.Write([]byte(ResponseError))
@@ -136,10 +253,10 @@ func (c *Client) ConnectUpstream() error {
 		return err
 	}
 
-	if identdRpc != nil {
+	if addIdent := c.addIdentFunc(); addIdent != nil {
 		lAddr, lPortStr, _ := net.SplitHostPort(conn.LocalAddr().String())
 		lPort, _ := strconv.Atoi(lPortStr)
-		identdRpc.AddIdent(lPort, c.UpstreamAddr.Port, c.Username, lAddr)
+		addIdent(lPort, c.UpstreamAddr.Port, c.Username, lAddr)
 	}
 
 	if c.TLS {
@@ -178,10 +295,95 @@ func (c *Client) Pipe() {
 
 	wg.Wait()
 
-	if identdRpc != nil {
+	if removeIdent := c.removeIdentFunc(); removeIdent != nil {
 		lAddr, lPortStr, _ := net.SplitHostPort(c.Upstream.LocalAddr().String())
 		lPort, _ := strconv.Atoi(lPortStr)
-		identdRpc.RemoveIdent(lPort, c.UpstreamAddr.Port, c.Username, lAddr)
+		removeIdent(lPort, c.UpstreamAddr.Port, c.Username, lAddr)
+	}
+}
+
+func (c *Client) addIdentFunc() func(int, int, string, string) {
+	if c.Server != nil {
+		return c.Server.Config.AddIdent
+	}
+	if identdRpc != nil {
+		return identdRpc.AddIdent
+	}
+	return nil
+}
+
+func (c *Client) removeIdentFunc() func(int, int, string, string) {
+	if c.Server != nil {
+		return c.Server.Config.RemoveIdent
+	}
+	if identdRpc != nil {
+		return identdRpc.RemoveIdent
+	}
+	return nil
+}
+
+// Listen - Start listening on all configured addresses. Connections are accepted in the background
+func (s *KiwiProxyServer) Listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	listeners := []net.Listener{}
+	for _, addr := range s.Config.ListenAddrs {
+		var l net.Listener
+		var err error
+		if s.Config.TLSConfig != nil {
+			l, err = tls.Listen("tcp", addr, s.Config.TLSConfig)
+		} else {
+			l, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+
+		s.log(2, "Kiwi proxy listening on %s", l.Addr().String())
+		listeners = append(listeners, l)
+	}
+
+	s.listeners = listeners
+	for _, l := range listeners {
+		go s.accept(l)
+	}
+
+	return nil
+}
+
+// Close - Stop accepting connections. Connections already proxied stay open
+func (s *KiwiProxyServer) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+}
+
+func (s *KiwiProxyServer) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			break
+		}
+
+		c := MakeClient(conn)
+		c.Server = s
+		go c.Run()
+	}
+}
+
+func (s *KiwiProxyServer) log(level int, format string, args ...interface{}) {
+	if s.Config.Log != nil {
+		s.Config.Log(level, format, args...)
+	} else {
+		log.Printf(format, args...)
 	}
 }
 
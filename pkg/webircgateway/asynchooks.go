@@ -0,0 +1,156 @@
+package webircgateway
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+var hooksRegisteredAsync = make(map[string][]interface{})
+
+// HookRegisterAsync - Register a hook callback that runs in the background after the hook has
+// been dispatched, off the path of the clients lines. It is given a copy of the hook taken once
+// the other callbacks have run, so it cannot change the line, halt the hook or hold up the
+// client. Suits callbacks that only report what happened, eg. logging or sending to another
+// service. Fields such as Client are shared and must only be read
+func HookRegisterAsync(hookName string, p interface{}) {
+	hooksRegisteredAsync[hookName] = append(hooksRegisteredAsync[hookName], p)
+}
+
+var messageType = reflect.TypeOf(&irc.Message{})
+
+// dispatchAsync - Queue the async callbacks of a hook that has just been dispatched
+func dispatchAsync(eventType string, hook interface{}) {
+	callbacks := hooksRegisteredAsync[eventType]
+	if len(callbacks) == 0 {
+		return
+	}
+
+	hookValue := reflect.ValueOf(hook)
+	for _, p := range callbacks {
+		callback := reflect.ValueOf(p)
+		if callback.Kind() != reflect.Func || callback.Type().NumIn() != 1 || callback.Type().In(0) != hookValue.Type() {
+			continue
+		}
+
+		hookCopy := copyHook(hookValue)
+		if !asyncHooks.queue(func() {
+			timeHook(eventType, p, func() { callback.Call([]reflect.Value{hookCopy}) })
+		}) {
+			asyncHooks.dropped(eventType)
+		}
+	}
+}
+
+// copyHook - Copy a hook struct for an async callback. Messages are copied too as the line
+// pipeline carries on changing them
+func copyHook(hookValue reflect.Value) reflect.Value {
+	hookCopy := reflect.New(hookValue.Type().Elem())
+	hookCopy.Elem().Set(hookValue.Elem())
+
+	fields := hookCopy.Elem()
+	for idx := 0; idx < fields.NumField(); idx++ {
+		field := fields.Field(idx)
+		if field.Type() != messageType || field.IsNil() || !field.CanSet() {
+			continue
+		}
+
+		message := *field.Interface().(*irc.Message)
+		message.Params = append([]string{}, message.Params...)
+		message.Tags = make(map[string]string)
+		for name, val := range field.Interface().(*irc.Message).Tags {
+			message.Tags[name] = val
+		}
+		field.Set(reflect.ValueOf(&message))
+	}
+
+	return hookCopy
+}
+
+// asyncHookRunner - The workers that run async hook callbacks. With a single worker callbacks run
+// in the order their hooks were dispatched
+type asyncHookRunner struct {
+	startOnce sync.Once
+	jobs      chan func()
+
+	mu            sync.Mutex
+	gateway       *Gateway
+	droppedSince  uint64
+	lastDropWarn  time.Time
+	droppedByHook map[string]uint64
+}
+
+// Hooks are registered globally so their workers are too
+var asyncHooks = &asyncHookRunner{droppedByHook: make(map[string]uint64)}
+
+// start - Start the workers. Only the first call has any effect so changes need a restart
+func (r *asyncHookRunner) start(gateway *Gateway, workers int, queueSize int) {
+	r.startOnce.Do(func() {
+		if workers < 1 {
+			workers = 1
+		}
+		if queueSize < 1 {
+			queueSize = 1
+		}
+
+		r.mu.Lock()
+		r.gateway = gateway
+		r.mu.Unlock()
+
+		jobs := make(chan func(), queueSize)
+		for i := 0; i < workers; i++ {
+			go func() {
+				for job := range jobs {
+					job()
+				}
+			}()
+		}
+
+		r.mu.Lock()
+		r.jobs = jobs
+		r.mu.Unlock()
+	})
+}
+
+// queue - Queue a job for the workers. Returns false if the queue is full or the workers have
+// not been started
+func (r *asyncHookRunner) queue(job func()) bool {
+	r.mu.Lock()
+	jobs := r.jobs
+	r.mu.Unlock()
+	if jobs == nil {
+		return false
+	}
+
+	select {
+	case jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// dropped - Count an async callback that could not be queued, warning at most once a minute
+func (r *asyncHookRunner) dropped(eventType string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.droppedByHook[eventType]++
+	r.droppedSince++
+	if r.gateway == nil || time.Since(r.lastDropWarn) < slowHookWarningInterval {
+		return
+	}
+
+	r.gateway.Log(3, "Async hook queue is full, %d callbacks dropped since the last warning", r.droppedSince)
+	r.lastDropWarn = time.Now()
+	r.droppedSince = 0
+}
+
+// droppedCount - The number of async callbacks of a hook type that were dropped
+func (r *asyncHookRunner) droppedCount(eventType string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.droppedByHook[eventType]
+}
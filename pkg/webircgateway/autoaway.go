@@ -0,0 +1,88 @@
+package webircgateway
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// clientAutoAway - Marks browser clients away upstream once they have gone quiet, as sleeping
+// browser tabs keep their connection open without telling IRC that nobody is there
+type clientAutoAway struct {
+	timer *time.Timer
+	// The gateway marked the client as away and should bring it back on activity
+	away bool
+	// The client set its own away message which is left alone
+	userAway bool
+}
+
+// startAutoAwayTimer - Start waiting for the client to go idle once registered. Clients of tcp:
+// servers are normal IRC clients that manage their own away status
+func (c *Client) startAutoAwayTimer() {
+	if c.UpstreamConfig.AutoAway <= 0 || c.transport == "tcp" {
+		return
+	}
+
+	idle := time.Second * time.Duration(c.UpstreamConfig.AutoAway)
+	if c.autoAway.timer == nil {
+		c.autoAway.timer = time.NewTimer(idle)
+		return
+	}
+	if !c.autoAway.timer.Stop() {
+		select {
+		case <-c.autoAway.timer.C:
+		default:
+		}
+	}
+	c.autoAway.timer.Reset(idle)
+}
+
+// autoAwayTimeout - Fires once the client has been idle for too long. nil when auto away is not
+// enabled, which never fires in a select
+func (c *Client) autoAwayTimeout() <-chan time.Time {
+	if c.autoAway.timer == nil {
+		return nil
+	}
+	return c.autoAway.timer.C
+}
+
+// handleAutoAway - Mark the idle client as away upstream unless it already is
+func (c *Client) handleAutoAway() {
+	if c.autoAway.away || c.autoAway.userAway || c.State() != ClientStateConnected {
+		return
+	}
+
+	c.Log(1, "Client idle for %ds, marking as away", c.UpstreamConfig.AutoAway)
+	c.autoAway.away = true
+	c.processLineToUpstream("AWAY :" + c.UpstreamConfig.AutoAwayMessage)
+}
+
+// autoAwayActivity - A line from the client. Brings it back from being auto away and restarts
+// the idle timer. PINGs are sent by clients in the background so are not counted as activity
+func (c *Client) autoAwayActivity(line string) {
+	if c.autoAway.timer == nil {
+		return
+	}
+
+	message, err := irc.ParseLine(line)
+	if err != nil {
+		return
+	}
+	command := strings.ToUpper(message.Command)
+	if command == "PING" || command == "PONG" {
+		return
+	}
+
+	if command == "AWAY" {
+		// The clients own AWAY replaces whatever away status the gateway set
+		c.autoAway.userAway = len(message.Params) > 0 && message.Params[0] != ""
+		c.autoAway.away = false
+	} else if c.autoAway.away {
+		c.Log(1, "Client active again, no longer away")
+		c.autoAway.away = false
+		c.processLineToUpstream("AWAY")
+	}
+
+	c.startAutoAwayTimer()
+}
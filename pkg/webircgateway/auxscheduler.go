@@ -0,0 +1,162 @@
+package webircgateway
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/dnsbl"
+)
+
+// errAuxBackoff - A lookup was skipped because its target failed recently
+var errAuxBackoff = errors.New("Skipped while backing off after earlier failures")
+
+// auxBackoff - The failures of one lookup target, eg. a DNSBL server or webhook URL
+type auxBackoff struct {
+	failures int
+	until    time.Time
+}
+
+// auxScheduler - Runs the outbound lookups made for clients (DNSBL, reverse DNS, webhooks and
+// cluster peer checks) so that a burst of client connections can't turn in to a flood of DNS or
+// HTTP requests. Only so many lookups run at once, each starts after a random delay, and targets
+// that fail are left alone for a while
+type auxScheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running int
+	backoff map[string]*auxBackoff
+}
+
+func newAuxScheduler() *auxScheduler {
+	sched := &auxScheduler{
+		backoff: make(map[string]*auxBackoff),
+	}
+	sched.cond = sync.NewCond(&sched.mu)
+	return sched
+}
+
+// acquire - Wait until fewer than limit lookups are running. 0 for no limit
+func (sched *auxScheduler) acquire(limit int) {
+	sched.mu.Lock()
+	for limit > 0 && sched.running >= limit {
+		sched.cond.Wait()
+	}
+	sched.running++
+	sched.mu.Unlock()
+}
+
+func (sched *auxScheduler) release() {
+	sched.mu.Lock()
+	sched.running--
+	sched.mu.Unlock()
+	sched.cond.Signal()
+}
+
+// backingOff - Check if a target is still being left alone after failing
+func (sched *auxScheduler) backingOff(target string) bool {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+
+	backoff, exists := sched.backoff[target]
+	return exists && time.Now().Before(backoff.until)
+}
+
+// record - Note the result of a lookup. Each failure in a row doubles the time the target is
+// left alone for, up to maxDelay, with half of it randomised so that targets don't all come back
+// at the same moment
+func (sched *auxScheduler) record(target string, failed bool, baseDelay time.Duration, maxDelay time.Duration) {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+
+	if !failed {
+		delete(sched.backoff, target)
+		return
+	}
+
+	backoff, exists := sched.backoff[target]
+	if !exists {
+		backoff = &auxBackoff{}
+		sched.backoff[target] = backoff
+	}
+	backoff.failures++
+
+	delay := baseDelay
+	for i := 1; i < backoff.failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+	}
+	backoff.until = time.Now().Add(delay)
+}
+
+// runAux - Run an outbound lookup through the scheduler. A lookup returning an error counts as a
+// failure of target. Targets that fail are skipped with errAuxBackoff until their backoff ends.
+// An empty target is never backed off, eg. for reverse DNS where failing is normal
+func (s *Gateway) runAux(target string, lookup func() error) error {
+	sched := s.auxScheduler
+	if target != "" && sched.backingOff(target) {
+		return errAuxBackoff
+	}
+
+	if jitter := s.Config.AuxJitter; jitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(time.Millisecond) * int64(jitter))))
+	}
+
+	sched.acquire(s.Config.AuxMaxConcurrent)
+	err := lookup()
+	sched.release()
+
+	if target != "" {
+		baseDelay := time.Second * time.Duration(s.Config.AuxBackoff)
+		maxDelay := time.Second * time.Duration(s.Config.AuxBackoffMax)
+		if baseDelay > 0 {
+			sched.record(target, err != nil, baseDelay, maxDelay)
+		}
+	}
+
+	return err
+}
+
+// dnsblLookup - Check an address against each DNSBL server. Servers that are failing are
+// skipped, so the address counts as not listed on them
+func (s *Gateway) dnsblLookup(addr string) dnsbl.ResultList {
+	result := dnsbl.ResultList{}
+	for _, server := range s.Config.DnsblServers {
+		err := s.runAux("dnsbl:"+server, func() error {
+			serverResult := dnsbl.Lookup([]string{server}, addr)
+			result.Results = append(result.Results, serverResult.Results...)
+			if serverResult.Listed {
+				result.Listed = true
+			}
+			return dnsblServerError(serverResult)
+		})
+		if err == errAuxBackoff {
+			s.Log(1, "Skipping DNSBL %s while it is failing", server)
+		}
+	}
+
+	return result
+}
+
+// dnsblServerError - The error of a DNSBL lookup that failed, rather than the address simply not
+// being listed
+func dnsblServerError(result dnsbl.ResultList) error {
+	for _, res := range result.Results {
+		if !res.Error {
+			continue
+		}
+		if dnsErr, ok := res.ErrorType.(*net.DNSError); ok && dnsErr.IsNotFound {
+			continue
+		}
+		return res.ErrorType
+	}
+
+	return nil
+}
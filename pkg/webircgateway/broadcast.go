@@ -0,0 +1,87 @@
+package webircgateway
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+const (
+	// BroadcastNotice - Send the broadcast as a NOTICE. Clients stay connected
+	BroadcastNotice = "notice"
+	// BroadcastError - Send the broadcast as an ERROR and disconnect the clients
+	BroadcastError = "error"
+)
+
+// BroadcastFilter - Limit a broadcast to some clients. Empty fields match all clients
+type BroadcastFilter struct {
+	// Upstream - Glob matched against the IRC server hostname
+	Upstream string
+	// Nick - Glob matched against the clients nick
+	Nick string
+}
+
+func (f BroadcastFilter) compile() (upstream glob.Glob, nick glob.Glob, err error) {
+	if f.Upstream != "" {
+		upstream, err = glob.Compile(strings.ToLower(f.Upstream))
+		if err != nil {
+			return
+		}
+	}
+	if f.Nick != "" {
+		nick, err = glob.Compile(strings.ToLower(f.Nick))
+	}
+	return
+}
+
+// Broadcast - Send a message to all clients matching filter. Returns the number of clients
+// the message was sent to
+func (s *Gateway) Broadcast(broadcastType string, message string, filter BroadcastFilter) (int, error) {
+	if broadcastType != BroadcastNotice && broadcastType != BroadcastError {
+		return 0, errors.New("Broadcast type must be notice or error")
+	}
+	message = stripLineBreaks(message)
+	if message == "" {
+		return 0, errors.New("Missing broadcast message")
+	}
+
+	upstreamMatch, nickMatch, err := filter.compile()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, c := range s.AllClients() {
+		if upstreamMatch != nil && !upstreamMatch.Match(strings.ToLower(c.UpstreamConfig.Hostname)) {
+			continue
+		}
+		if nickMatch != nil && !nickMatch.Match(strings.ToLower(c.IrcState.Nick)) {
+			continue
+		}
+
+		if broadcastType == BroadcastError {
+			c.SendIrcError(message)
+			c.SendClientSignal("state", "closed", "broadcast")
+			c.StartShutdown("broadcast")
+		} else {
+			target := c.IrcState.Nick
+			if target == "" {
+				target = "*"
+			}
+			c.SendClientSignal("data", ":"+s.serverName()+" NOTICE "+target+" :"+message)
+		}
+		sent++
+	}
+
+	s.Log(2, "Broadcast %s sent to %d clients: %s", broadcastType, sent, message)
+	return sent, nil
+}
+
+// serverName - The server name used as the prefix of messages from the gateway itself
+func (s *Gateway) serverName() string {
+	if s.Config.GatewayName != "" {
+		return s.Config.GatewayName
+	}
+	return "webircgateway"
+}
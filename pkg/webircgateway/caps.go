@@ -0,0 +1,227 @@
+package webircgateway
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// capName - The name of a capability without any value or modifier. "-sasl=PLAIN" gives "sasl"
+func capName(cap string) string {
+	cap = strings.TrimLeft(cap, "-~=")
+	if eqPos := strings.Index(cap, "="); eqPos > -1 {
+		cap = cap[:eqPos]
+	}
+	return strings.ToLower(cap)
+}
+
+// filterUpstreamCapList - Hide the upstreams strip_caps and advertise its add_caps in a CAP LS or
+// CAP NEW line from the upstream. Returns true if the message was modified
+func (c *Client) filterUpstreamCapList(m *irc.Message) bool {
+	subCommand := m.GetParamU(1, "")
+	if len(m.Params) < 3 || (subCommand != "LS" && subCommand != "NEW") {
+		return false
+	}
+
+	// Multi-line LS replies have a * param before the list of caps
+	lastLine := len(m.Params) == 3 || m.Params[2] != "*"
+	capsIdx := len(m.Params) - 1
+
+	if c.upstreamCaps == nil {
+		c.upstreamCaps = make(map[string]bool)
+	}
+
+	changed := false
+	caps := []string{}
+	for _, cap := range strings.Split(m.Params[capsIdx], " ") {
+		if cap == "" {
+			continue
+		}
+		c.upstreamCaps[capName(cap)] = true
+
+		if c.isCapStripped(cap) {
+			changed = true
+			continue
+		}
+		caps = append(caps, cap)
+	}
+
+	if subCommand == "LS" && lastLine {
+		for _, cap := range c.UpstreamConfig.AddCaps {
+			if !c.upstreamCaps[capName(cap)] {
+				caps = append(caps, cap)
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		m.Params[capsIdx] = strings.Join(caps, " ")
+	}
+	return changed
+}
+
+func (c *Client) isCapStripped(cap string) bool {
+	name := capName(cap)
+	// The gateway has logged in for the client
+	if name == "sasl" && c.sasl != nil {
+		return true
+	}
+	for _, stripped := range c.UpstreamConfig.StripCaps {
+		if capName(stripped) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isCapAddedLocally - Check if a cap is one of the add_caps that the upstream doesn't support itself
+func (c *Client) isCapAddedLocally(cap string) bool {
+	name := capName(cap)
+	if c.upstreamCaps[name] {
+		return false
+	}
+
+	for _, added := range c.UpstreamConfig.AddCaps {
+		if capName(added) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// takeLocalCapRequests - Remove any add_caps from a client CAP REQ so that the gateway can ACK them
+// itself. Returns the caps left to send upstream
+func (c *Client) takeLocalCapRequests(reqCaps string) string {
+	caps := []string{}
+	for _, cap := range strings.Split(reqCaps, " ") {
+		if cap == "" {
+			continue
+		}
+
+		if c.isCapAddedLocally(cap) {
+			c.localCapsRequested = append(c.localCapsRequested, cap)
+		} else {
+			caps = append(caps, cap)
+		}
+	}
+
+	return strings.Join(caps, " ")
+}
+
+// appendLocalCapReplies - Add any caps the gateway handles to an ACK or NAK from the upstream, which
+// was the reply to a REQ that contained them
+func (c *Client) appendLocalCapReplies(m *irc.Message) bool {
+	subCommand := m.GetParamU(1, "")
+	if len(c.localCapsRequested) == 0 || len(m.Params) < 3 || (subCommand != "ACK" && subCommand != "NAK") {
+		return false
+	}
+
+	capsIdx := len(m.Params) - 1
+	m.Params[capsIdx] = strings.TrimSpace(m.Params[capsIdx] + " " + strings.Join(c.localCapsRequested, " "))
+	c.localCapsRequested = nil
+	return true
+}
+
+// downgradeCapLs - Limit the version in a CAP LS line to the upstreams max_cap_version. Older IRC
+// servers may not understand CAP LS 302 so versions below 302 remove the version completely
+func (c *Client) downgradeCapLs(line string) string {
+	maxVersion := c.UpstreamConfig.MaxCapVersion
+	parts := strings.Fields(line)
+	if len(parts) < 3 {
+		return line
+	}
+
+	version, err := strconv.Atoi(strings.TrimPrefix(parts[2], ":"))
+	if err != nil || version <= maxVersion {
+		return line
+	}
+
+	if maxVersion < 302 {
+		c.Log(1, "Removing CAP LS version %d for this upstream", version)
+		return "CAP LS"
+	}
+
+	c.Log(1, "Lowering CAP LS version %d to %d for this upstream", version, maxVersion)
+	return "CAP LS " + strconv.Itoa(maxVersion)
+}
+
+// isCapRejectedReply - Check if a line from the upstream is an old IRC server rejecting the CAP
+// command altogether, eg. :server 421 * CAP :Unknown command
+func isCapRejectedReply(m *irc.Message) bool {
+	return (m.Command == "421" || m.Command == "451") && m.GetParamU(1, "") == "CAP"
+}
+
+// localCapLsReply - The reply to CAP LS when the upstream does not support CAP, listing only the
+// caps that the gateway provides itself
+func (c *Client) localCapLsReply() string {
+	caps := []string{}
+	for _, cap := range c.UpstreamConfig.AddCaps {
+		if !c.isCapStripped(cap) {
+			caps = append(caps, cap)
+		}
+	}
+	if c.Features.Messagetags {
+		caps = append(caps, "message-tags")
+	}
+
+	return c.localCapReply("LS", caps)
+}
+
+func (c *Client) localCapReply(subCommand string, caps []string) string {
+	nick := c.IrcState.Nick
+	if nick == "" {
+		nick = "*"
+	}
+
+	m := irc.Message{
+		Prefix:  &c.ServerMessagePrefix,
+		Command: "CAP",
+		Params:  []string{nick, subCommand, strings.Join(caps, " ")},
+	}
+	return m.ToLine()
+}
+
+// handleCapWithoutUpstream - Answer a CAP command from the client when the upstream does not
+// support CAP. Only the caps the gateway provides itself can be enabled
+func (c *Client) handleCapWithoutUpstream(m *irc.Message) {
+	switch m.GetParamU(0, "") {
+	case "LS":
+		c.SendClientSignal("data", c.localCapLsReply())
+
+	case "LIST":
+		c.SendClientSignal("data", c.localCapReply("LIST", c.localCapsEnabled))
+
+	case "REQ":
+		reqCaps := strings.Fields(m.GetParam(1, ""))
+		for _, cap := range reqCaps {
+			name := capName(cap)
+			available := (name == "message-tags" && c.Features.Messagetags) ||
+				(c.isCapAddedLocally(cap) && !c.isCapStripped(cap))
+			if !available {
+				c.SendClientSignal("data", c.localCapReply("NAK", reqCaps))
+				return
+			}
+		}
+
+		for _, cap := range reqCaps {
+			enabled := []string{}
+			for _, existing := range c.localCapsEnabled {
+				if capName(existing) != capName(cap) {
+					enabled = append(enabled, existing)
+				}
+			}
+			if !strings.HasPrefix(cap, "-") {
+				enabled = append(enabled, capName(cap))
+			}
+			c.localCapsEnabled = enabled
+		}
+		c.SendClientSignal("data", c.localCapReply("ACK", reqCaps))
+
+	case "END":
+		if !stringInSlice("message-tags", c.localCapsEnabled) {
+			c.Features.Messagetags = false
+		}
+	}
+}
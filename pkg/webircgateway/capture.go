@@ -0,0 +1,115 @@
+package webircgateway
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxCaptureDuration - The longest time a single traffic capture may run for
+var MaxCaptureDuration = time.Hour
+
+type trafficCapture struct {
+	file  *os.File
+	timer *time.Timer
+}
+
+func init() {
+	ControlCommandRegister("capture", controlCapture)
+}
+
+// StartCapture - Record all raw traffic for this client, both to/from the client and upstream,
+// to a file for the given duration
+func (c *Client) StartCapture(fileName string, duration time.Duration) error {
+	if duration <= 0 || duration > MaxCaptureDuration {
+		return fmt.Errorf("Capture duration must be between 1 second and %s", MaxCaptureDuration)
+	}
+
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	c.captureLock.Lock()
+	defer c.captureLock.Unlock()
+
+	if c.capture != nil {
+		file.Close()
+		return errors.New("A capture is already running for this client")
+	}
+
+	c.capture = &trafficCapture{
+		file:  file,
+		timer: time.AfterFunc(duration, c.StopCapture),
+	}
+	c.Log(2, "Capturing traffic to %s for %s", fileName, duration)
+
+	return nil
+}
+
+// StopCapture - Stop any running traffic capture for this client
+func (c *Client) StopCapture() {
+	c.captureLock.Lock()
+	defer c.captureLock.Unlock()
+
+	if c.capture == nil {
+		return
+	}
+
+	c.capture.timer.Stop()
+	c.capture.file.Close()
+	c.capture = nil
+	c.Log(2, "Traffic capture stopped")
+}
+
+// captureTraffic - Write a line to the running traffic capture, if any
+func (c *Client) captureTraffic(label string, line string) {
+	c.captureLock.Lock()
+	defer c.captureLock.Unlock()
+
+	if c.capture == nil {
+		return
+	}
+
+	fmt.Fprintf(
+		c.capture.file,
+		"%s %s %s\n",
+		time.Now().UTC().Format(time.RFC3339Nano),
+		label,
+		strings.TrimRight(line, "\r\n"),
+	)
+}
+
+// capture <client id> <seconds> [file]
+func controlCapture(gateway *Gateway, args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errors.New("Usage: capture <client id> <seconds> [file]")
+	}
+
+	item, exists := gateway.Clients.Get(args[0])
+	if !exists {
+		return "", fmt.Errorf("No client with ID %s", args[0])
+	}
+	c := item.(*Client)
+
+	seconds, err := strconv.Atoi(args[1])
+	if err != nil {
+		return "", errors.New("Usage: capture <client id> <seconds> [file]")
+	}
+
+	fileName := fmt.Sprintf("capture_%d_%d.log", c.Id, time.Now().Unix())
+	if len(args) > 2 {
+		fileName = args[2]
+	}
+	fileName = gateway.Config.ResolvePath(fileName)
+
+	err = c.StartCapture(fileName, time.Duration(seconds)*time.Second)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Capturing client %d to %s\n", c.Id, fileName), nil
+}
@@ -0,0 +1,194 @@
+package webircgateway
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CertFPStore - Generates and persists a TLS client keypair for each verified account so that
+// users keep the same CertFP fingerprint on upstream networks between connections
+type CertFPStore struct {
+	mu    sync.Mutex
+	dir   string
+	certs map[string]*tls.Certificate
+}
+
+func NewCertFPStore(dir string) *CertFPStore {
+	return &CertFPStore{
+		dir:   dir,
+		certs: make(map[string]*tls.Certificate),
+	}
+}
+
+// Get - Load the keypair for an account, creating it if it does not exist yet
+func (store *CertFPStore) Get(account string) (*tls.Certificate, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if cert, exists := store.certs[account]; exists {
+		return cert, nil
+	}
+
+	// Account names may contain anything so hash them for the file name
+	accountHash := sha256.Sum256([]byte(account))
+	fileName := filepath.Join(store.dir, hex.EncodeToString(accountHash[:])+".pem")
+
+	pemData, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		pemData, err = generateCertFPKeypair(account)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.MkdirAll(store.dir, 0700)
+		if err == nil {
+			err = ioutil.WriteFile(fileName, pemData, 0600)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(pemData, pemData)
+	if err != nil {
+		return nil, err
+	}
+
+	store.certs[account] = &cert
+	return &cert, nil
+}
+
+// generateCertFPKeypair - Create a long lived self signed certificate and key, PEM encoded
+func generateCertFPKeypair(account string) ([]byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: account},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(20, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer})
+	pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...)
+	return pemData, nil
+}
+
+// upstreamTLSConfig - The TLS config for connecting to the clients upstream, presenting its
+// certfp certificate, the upstreams tls_cert, or whichever certificate the irc.certificate hook
+// picked for it
+func (c *Client) upstreamTLSConfig() *tls.Config {
+	upstreamCert := c.UpstreamConfig.TLSCertificate
+	tlsConfig := c.Gateway.upstreamTLSConfig(c.UpstreamConfig)
+
+	hook := &HookIrcClientCertificate{
+		Client:         c,
+		UpstreamConfig: c.UpstreamConfig,
+		Certificate:    upstreamCert,
+	}
+	if clientCert := c.certFPCertificate(); clientCert != nil {
+		hook.Certificate = clientCert
+	}
+	hook.Dispatch("irc.certificate")
+	if hook.Halt {
+		hook.Certificate = nil
+	}
+
+	if hook.Certificate != upstreamCert {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.Certificates = nil
+		if hook.Certificate != nil {
+			tlsConfig.Certificates = []tls.Certificate{*hook.Certificate}
+		}
+		// A resumed session would skip sending the certificate and keep the identity of
+		// whoever created the session
+		tlsConfig.ClientSessionCache = nil
+	}
+	return tlsConfig
+}
+
+// loadUpstreamCertificate - Load the client certificate for an upstream. The key may be in the
+// certificate file if keyFile is empty
+func (c *Config) loadUpstreamCertificate(certFile string, keyFile string) (*tls.Certificate, error) {
+	if keyFile == "" {
+		keyFile = certFile
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.ResolvePath(certFile), c.ResolvePath(keyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+// certFPCertificate - The client certificate to present upstream for this clients verified
+// account, or nil if there isn't one
+func (c *Client) certFPCertificate() *tls.Certificate {
+	if c.Identity == nil || c.Identity.Account == "" {
+		return nil
+	}
+	store := c.Gateway.certFPKeypairs()
+	if store == nil {
+		return nil
+	}
+
+	cert, err := store.Get(c.Identity.Account)
+	if err != nil {
+		c.Log(3, "Error loading the CertFP keypair for %s. %s", c.Identity.Account, err.Error())
+		return nil
+	}
+
+	return cert
+}
+
+// certFPKeypairs - The keypair store for the configured directory, or nil if disabled
+func (s *Gateway) certFPKeypairs() *CertFPStore {
+	dir := s.Config.ClientCertFPDir
+	if dir == "" {
+		return nil
+	}
+
+	s.certFPStoreMu.Lock()
+	defer s.certFPStoreMu.Unlock()
+
+	// The directory may have changed after a config reload
+	if s.certFPStore == nil || s.certFPStore.dir != dir {
+		s.certFPStore = NewCertFPStore(dir)
+	}
+
+	return s.certFPStore
+}
@@ -0,0 +1,111 @@
+package webircgateway
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the certificate files of TLS servers are checked for changes during handshakes
+const certificateCheckInterval = time.Second * 10
+
+// certificateReloader - The certificate of a TLS server, read again from its files when they
+// change so that renewed certificates are used by new connections without a restart. Connected
+// clients keep their connections
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mu           sync.Mutex
+	cert         *tls.Certificate
+	certModified time.Time
+	keyModified  time.Time
+	checked      time.Time
+}
+
+// newCertificateReloader - Load a certificate and key, keeping them up to date with the files
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	reloader := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	_, err := reloader.reload(true)
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetCertificate - Used as the GetCertificate callback of the servers tls.Config
+func (r *certificateReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	checkFiles := time.Since(r.checked) >= certificateCheckInterval
+	r.mu.Unlock()
+
+	if checkFiles {
+		// A broken certificate mid-renewal leaves the previous one in use
+		r.reload(false)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+// reload - Read the certificate files again if they have changed since they were last read, or
+// always if force is set. Returns true if a new certificate was loaded
+func (r *certificateReloader) reload(force bool) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checked = time.Now()
+
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	if !force && certInfo.ModTime().Equal(r.certModified) && keyInfo.ModTime().Equal(r.keyModified) {
+		return false, nil
+	}
+
+	keyPair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.cert = &keyPair
+	r.certModified = certInfo.ModTime()
+	r.keyModified = keyInfo.ModTime()
+	return true, nil
+}
+
+// addCertificateReloader - Keep track of a servers certificate so that it is reloaded along with
+// the config
+func (s *Gateway) addCertificateReloader(reloader *certificateReloader) {
+	s.certReloadersMu.Lock()
+	s.certReloaders = append(s.certReloaders, reloader)
+	s.certReloadersMu.Unlock()
+}
+
+// ReloadCertificates - Read the certificates of all TLS servers again. Called when the config is
+// reloaded, eg. on SIGHUP
+func (s *Gateway) ReloadCertificates() {
+	s.certReloadersMu.Lock()
+	reloaders := s.certReloaders
+	s.certReloadersMu.Unlock()
+
+	for _, reloader := range reloaders {
+		reloaded, err := reloader.reload(true)
+		if err != nil {
+			s.Log(3, "Failed to reload TLS certificate %s, still using the previous one: %s", reloader.certFile, err.Error())
+		} else if reloaded {
+			s.Log(2, "Reloaded TLS certificate %s", reloader.certFile)
+		}
+	}
+}
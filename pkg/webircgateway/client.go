@@ -3,7 +3,6 @@ package webircgateway
 import (
 	"bufio"
 	"crypto/tls"
-	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -15,9 +14,9 @@ import (
 	"syscall"
 	"time"
 
+	"golang.org/x/net/html/charset"
 	"golang.org/x/time/rate"
 
-	"github.com/kiwiirc/webircgateway/pkg/dnsbl"
 	"github.com/kiwiirc/webircgateway/pkg/irc"
 	"github.com/kiwiirc/webircgateway/pkg/proxy"
 )
@@ -31,20 +30,32 @@ const (
 	ClientStateRegistering = "registering"
 	// ClientStateConnected - Connected upstream
 	ClientStateConnected = "connected"
+	// ClientStateDetached - The client has disconnected but its session is kept for resuming
+	ClientStateDetached = "detached"
 	// ClientStateEnding - Client is ending its connection
 	ClientStateEnding = "ending"
 )
 
 type ClientSignal [3]string
 
+// ClientIdentity - A user identity that has been verified outside of IRC, eg. by a plugin
+type ClientIdentity struct {
+	// Account - A unique account name for the user
+	Account string
+	// Data - Any extra information about the user, eg. email or roles
+	Data map[string]string
+}
+
 // Client - Connecting client struct
 type Client struct {
 	Gateway          *Gateway
 	Id               uint64
-	State            string
+	state            string
+	stateLock        sync.Mutex
 	EndWG            sync.WaitGroup
 	shuttingDownLock sync.Mutex
 	shuttingDown     bool
+	shutdownReason   string
 	SeenQuit         bool
 	Recv             chan string
 	ThrottledRecv    *ThrottledStringChannel
@@ -61,12 +72,30 @@ type Client struct {
 	DestTLS          bool
 	IrcState         *irc.State
 	Encoding         string
+	// RawEncoding - The client handles character encodings itself. Lines are not converted
+	// to or from UTF-8
+	RawEncoding bool
 	// Tags get passed upstream via the WEBIRC command
 	Tags map[string]string
+	// Identity - The verified identity of the user, if known. Set by plugins or gateway auth
+	Identity *ClientIdentity
+	// Tenant - The site the client connected for, if any
+	Tenant *ConfigTenant
 	// Captchas may be needed to verify a client
 	RequiresVerification bool
 	Verified             bool
-	SentPass             bool
+	// Abuse checks may wait until registration or a SASL login when identified users skip them
+	abuseChecksDeferred bool
+	inVerifyGrace       bool
+	verifyGraceTimer    *time.Timer
+	SentPass            bool
+	// Set to 1 while lines to the upstream are held until a captcha requested mid-session is
+	// completed. Accessed atomically
+	verifyHold      int32
+	verifyHoldLines []string
+	verifyHoldTimer *time.Timer
+	// Captchas requested mid-session by other goroutines, handled on the line worker
+	verifyRequests chan string
 	// Signals for the transport to make use of (data, connection state, etc)
 	Signals  chan ClientSignal
 	Features struct {
@@ -76,8 +105,74 @@ type Client struct {
 	}
 	// The specific message-tags CAP that the client has requested if we are wrapping it
 	RequestedMessageTagsCap string
+	// Set once the upstream has ACKed message-tags itself so that client tags reach the client natively
+	upstreamMessageTags bool
+	// Caps advertised by the upstream, and add_caps requested by the client that the gateway ACKs
+	upstreamCaps       map[string]bool
+	localCapsRequested []string
+	// Set when the upstream does not support CAP at all, along with the caps the gateway enabled
+	upstreamNoCaps   bool
+	localCapsEnabled []string
+	// Times registration with the upstream, and the lines sent during it for retrying registration
+	// on another upstream
+	registrationTimer *time.Timer
+	registrationLines []string
+	triedUpstreams    map[string]bool
+	// Attempts made to connect to another upstream after failing to connect, and the next
+	// attempt waiting to be made
+	connectRetries      int
+	upstreamRetryTimer  *time.Timer
+	upstreamRetryConfig ConfigUpstream
+	// Registration moved to another upstream. The lines sent during it are sent again once
+	// connected
+	registrationRetrying   bool
+	registrationRetryLines []string
+	// The client asked for a plaintext destination with tls=0 in its query string
+	destPlaintextRequested bool
+	// The SASL login the gateway is performing with the upstream for the client, if any, and
+	// whether the client is in the middle of its own CAP negotiation
+	sasl                 *gatewaySasl
+	clientCapNegotiating bool
+	// Alternative nicks tried when upstream rejects the nick during registration
+	nickFallbackAttempts int
+	nickFallbackBase     string
+	// Per-target rate limiters for messages sent by the client. Locked as a migrated session has
+	// its new connection throttled while the previous one may still be draining
+	targetLimiters     map[string]*rate.Limiter
+	targetLimitersLock sync.Mutex
+	// The throttle tier last applied to the upstream throttle
+	currentThrottleTier string
 	// Prefix used by the server when sending its own messages
 	ServerMessagePrefix irc.Mask
+	// Unix time in nanoseconds of the last line sent by the client. Accessed atomically
+	lastActivity int64
+	// A running traffic capture for debugging this client
+	captureLock sync.Mutex
+	capture     *trafficCapture
+	// The kiwi proxy and its interface that the upstream connection is counted against
+	proxyAddr      string
+	proxyInterface string
+	// Fields asked for by the clients WHOX requests, keyed by their query token
+	whoxRequests map[string]string
+	// Nicks being watched for the client with MONITOR or ISON
+	presence *clientPresence
+	// Round-trip time in nanoseconds of the last timed PING to the upstream. Accessed atomically
+	upstreamLatency int64
+	// The transport the client connected over and when, for the transport metrics
+	transport string
+	startedAt time.Time
+	// Keeps the session for resuming once the client disconnects
+	resume clientResume
+	// The LIST reply being collected for the LIST cache
+	listCollect *listCollector
+	// The USERHOST requests sent upstream in order while the nick cache is enabled
+	userhostRequests []*userhostRequest
+	// The users own NickServ password from a credential provider, sent once registered
+	nickservPassword string
+	// Marks the client as away upstream while it is idle
+	autoAway clientAutoAway
+	// The Origin header the client connected with, lowercased. Empty for TCP clients
+	origin string
 }
 
 var nextClientID uint64 = 1
@@ -90,22 +185,29 @@ func NewClient(gateway *Gateway) *Client {
 	c := &Client{
 		Gateway:        gateway,
 		Id:             thisID,
-		State:          ClientStateIdle,
+		state:          ClientStateIdle,
 		Recv:           recv,
 		ThrottledRecv:  NewThrottledStringChannel(recv, rate.NewLimiter(rate.Inf, 1)),
 		UpstreamSend:   make(chan string, 50),
 		UpstreamRecv:   make(chan string, 50),
 		Encoding:       "UTF-8",
 		Signals:        make(chan ClientSignal, 50),
+		verifyRequests: make(chan string, 1),
 		Tags:           make(map[string]string),
 		IrcState:       irc.NewState(),
 		UpstreamConfig: &ConfigUpstream{},
+		presence:       newClientPresence(),
 	}
 
 	// Auto enable some features by default. They may be disabled later on
 	c.Features.ExtJwt = true
 
 	c.RequiresVerification = gateway.Config.RequiresVerification
+	c.startedAt = time.Now()
+	c.lastActivity = c.startedAt.UnixNano()
+	c.ThrottledRecv.Delay = c.targetThrottleDelay
+	c.ThrottledRecv.Dropped = c.targetThrottleDropped
+	c.ThrottledRecv.Weight = c.throttleWeight
 
 	// Handles data to/from the client and upstreams
 	go c.clientLineWorker()
@@ -120,6 +222,12 @@ func NewClient(gateway *Gateway) *Client {
 	go func() {
 		c.EndWG.Wait()
 		gateway.Clients.Remove(strconv.FormatUint(c.Id, 10))
+		gateway.clientIndex.RemoveClient(c)
+		c.StopCapture()
+		gateway.sendWebhook(WebhookClientDisconnect, c, c.shutdownReason)
+		if c.transport != "" {
+			gateway.transportMetrics.clientEnded(c.transport, time.Since(c.startedAt))
+		}
 
 		hook := &HookClientState{
 			Client:    c,
@@ -156,31 +264,50 @@ func (c *Client) TrafficLog(isUpstream bool, toGateway bool, traffic string) {
 		label = "->Client"
 	}
 	c.Log(1, "Traffic (%s) %s", label, traffic)
+	c.captureTraffic(label, traffic)
 }
 
 func (c *Client) Ready() {
-	dnsblAction := c.Gateway.Config.DnsblAction
-	validAction := dnsblAction == "verify" || dnsblAction == "deny"
-	dnsblTookAction := ""
+	c.Gateway.sendWebhook(WebhookClientConnect, c, "")
+	c.sendWelcomeLines()
 
-	if len(c.Gateway.Config.DnsblServers) > 0 && c.RemoteAddr != "" && !c.Verified && validAction {
-		dnsblTookAction = c.checkDnsBl()
+	// A plugin may have already set a verified identity
+	if !c.CheckAccountQuota() {
+		return
 	}
 
-	if dnsblTookAction == "" && c.Gateway.Config.RequiresVerification && !c.Verified {
-		c.SendClientSignal("data", "CAPTCHA NEEDED")
+	if c.Gateway.Config.VerifySkipIdentified && !c.isIdentified() {
+		// Wait until the client registers so that it has a chance to identify itself first
+		c.abuseChecksDeferred = true
+		return
+	}
+
+	c.runAbuseChecks()
+}
+
+// sendWelcomeLines - Send the configured welcome lines to a newly connected client
+func (c *Client) sendWelcomeLines() {
+	prefix := c.Gateway.Config.WelcomePrefix
+	if prefix == "" {
+		prefix = c.Gateway.serverName()
+	}
+
+	for _, line := range c.Gateway.Config.WelcomeLines {
+		c.SendClientSignal("data", ":"+prefix+" "+makeClientReplacements(line, c))
 	}
 }
 
 func (c *Client) checkDnsBl() (tookAction string) {
-	dnsResult := dnsbl.Lookup(c.Gateway.Config.DnsblServers, c.RemoteAddr)
+	dnsResult := c.Gateway.dnsblLookup(c.RemoteAddr)
 	if dnsResult.Listed && c.Gateway.Config.DnsblAction == "deny" {
-		c.SendIrcError("Blocked by DNSBL")
+		c.Gateway.sendWebhook(WebhookVerificationFailed, c, "dnsbl_listed")
+		c.SendGatewayError(FailDnsblBlocked, "Blocked by DNSBL")
 		c.SendClientSignal("state", "closed", "dnsbl_listed")
 		c.StartShutdown("dnsbl")
 		tookAction = "deny"
 	} else if dnsResult.Listed && c.Gateway.Config.DnsblAction == "verify" {
 		c.RequiresVerification = true
+		c.SendClientSignal("data", gatewayFailLine(FailVerificationNeeded, "Complete the captcha to connect"))
 		c.SendClientSignal("data", "CAPTCHA NEEDED")
 		tookAction = "verify"
 	}
@@ -196,31 +323,50 @@ func (c *Client) IsShuttingDown() bool {
 
 func (c *Client) StartShutdown(reason string) {
 	c.shuttingDownLock.Lock()
-	defer c.shuttingDownLock.Unlock()
-
 	c.Log(1, "StartShutdown(%s) ShuttingDown=%t", reason, c.shuttingDown)
-	if !c.shuttingDown {
-		c.shuttingDown = true
-		c.State = ClientStateEnding
-
-		switch reason {
-		case "upstream_closed":
-			c.Log(2, "Upstream closed the connection")
-		case "err_connecting_upstream":
-		case "err_no_upstream":
-			// Error has been logged already
-		case "client_closed":
-			c.Log(2, "Client disconnected")
-		default:
-			c.Log(2, "Closed: %s", reason)
-		}
+	alreadyShuttingDown := c.shuttingDown
+	c.shuttingDown = true
+	if !alreadyShuttingDown {
+		c.shutdownReason = reason
+	}
+	c.shuttingDownLock.Unlock()
+
+	if alreadyShuttingDown {
+		return
+	}
 
-		close(c.Signals)
-		c.EndWG.Done()
+	// No more signals are sent once shuttingDown is set so Signals may be closed without the
+	// lock. The state change hook is dispatched without it so that plugins may use the client
+	c.setState(ClientStateEnding)
+	c.endResume(reason)
+
+	switch reason {
+	case "upstream_closed":
+		c.Log(2, "Upstream closed the connection")
+	case "err_connecting_upstream":
+	case "err_no_upstream":
+		// Error has been logged already
+	case "client_closed":
+		c.Log(2, "Client disconnected")
+	default:
+		c.Log(2, "Closed: %s", reason)
 	}
+
+	close(c.Signals)
+	c.EndWG.Done()
 }
 
 func (c *Client) SendClientSignal(signal string, args ...string) {
+	// A resumable session may have no transport of its own or be relayed through another client
+	if c.divertClientSignal(signal, args) {
+		return
+	}
+	c.sendTransportSignal(signal, args...)
+}
+
+// sendTransportSignal - Send a signal to the clients own transport, even if the session is being
+// relayed through another client
+func (c *Client) sendTransportSignal(signal string, args ...string) {
 	c.shuttingDownLock.Lock()
 	defer c.shuttingDownLock.Unlock()
 
@@ -229,6 +375,9 @@ func (c *Client) SendClientSignal(signal string, args ...string) {
 		case 0:
 			c.Signals <- ClientSignal{signal}
 		case 1:
+			if signal == "data" {
+				c.captureTraffic("->Client", args[0])
+			}
 			c.Signals <- ClientSignal{signal, args[0]}
 		case 2:
 			c.Signals <- ClientSignal{signal, args[0], args[1]}
@@ -258,26 +407,41 @@ func (c *Client) connectUpstream() {
 	if client.DestHost == "" {
 		client.Log(2, "Using configured upstream")
 		var err error
-		upstreamConfig, err = c.Gateway.findUpstream()
+		upstreamConfig, err = c.Gateway.findUpstream(c)
 		if err != nil {
-			client.Log(3, "No upstreams available")
-			client.SendIrcError("The server has not been configured")
+			client.Log(3, "%s", err.Error())
+			client.SendGatewayError(FailNoUpstream, "The server has not been configured")
 			client.StartShutdown("err_no_upstream")
 			return
 		}
 	} else {
 		if !c.Gateway.isIrcAddressAllowed(client.DestHost) {
-			client.Log(2, "Server %s is not allowed. Closing connection", client.DestHost)
-			client.SendIrcError("Not allowed to connect to " + client.DestHost)
+			client.logDeniedDestination()
+			client.SendGatewayError(FailForbiddenHost, "Not allowed to connect to "+client.DestHost)
 			client.SendClientSignal("state", "closed", "err_forbidden")
 			client.StartShutdown("err_no_upstream")
 			return
 		}
 
+		if !client.checkDestinationTLS() {
+			return
+		}
+
 		client.Log(2, "Using client given upstream")
 		upstreamConfig = c.configureUpstream()
 	}
 
+	if client.openUpstream(upstreamConfig) {
+		client.SendClientSignal("state", "connected")
+	}
+}
+
+// openUpstream - Connect to an upstream and start registering. Returns false if the connection
+// failed, in which case the client has already been closed or is waiting to try another upstream
+func (c *Client) openUpstream(upstreamConfig ConfigUpstream) bool {
+	client := c
+	client.applyTenant(&upstreamConfig)
+	client.applyUserCredentials(&upstreamConfig)
 	c.UpstreamConfig = &upstreamConfig
 
 	hook := &HookIrcConnectionPre{
@@ -288,32 +452,77 @@ func (c *Client) connectUpstream() {
 	if hook.Halt {
 		client.SendClientSignal("state", "closed", "err_forbidden")
 		client.StartShutdown("err_connecting_upstream")
-		return
+		return false
 	}
 
-	client.State = ClientStateConnecting
+	if !client.setState(ClientStateConnecting) {
+		return false
+	}
 
+	connectStarted := time.Now()
 	upstream, upstreamErr := client.makeUpstreamConnection()
+	postHook := &HookIrcConnectionPost{
+		Client:         client,
+		UpstreamConfig: &upstreamConfig,
+		Duration:       time.Since(connectStarted),
+	}
 	if upstreamErr != nil {
-		// Error handling was already managed in makeUpstreamConnection()
-		return
+		postHook.Error = upstreamErr
+	}
+	postHook.Dispatch("irc.connection.post")
+	if upstreamErr != nil {
+		client.failoverUpstream(upstreamErr)
+		return false
 	}
 
-	client.State = ClientStateRegistering
+	if !client.setState(ClientStateRegistering) {
+		upstream.Close()
+		return false
+	}
+	client.setThrottle(false)
+	client.startRegistrationTimer()
 
 	client.upstream = upstream
 	client.readUpstream()
 	client.writeWebircLines(upstream)
 	client.maybeSendPass(upstream)
-	client.SendClientSignal("state", "connected")
+	client.startGatewaySasl()
+	return true
 }
 
-func (c *Client) makeUpstreamConnection() (io.ReadWriteCloser, error) {
+// upstreamConnectError - Connecting to the upstream failed. closeReason is sent to the client
+// with the closed state if it is not moved to another upstream
+type upstreamConnectError struct {
+	closeReason string
+}
+
+func (e *upstreamConnectError) Error() string {
+	return "error connecting upstream"
+}
+
+// makeUpstreamConnection - Connect to the clients upstream. The client is left open if it fails
+// so that another upstream may be tried
+func (c *Client) makeUpstreamConnection() (io.ReadWriteCloser, *upstreamConnectError) {
 	client := c
 	upstreamConfig := c.UpstreamConfig
 
 	var connection io.ReadWriteCloser
 
+	// Protocols other than TCP and unix sockets, such as websockets
+	if dialUpstream, exists := upstreamDialers[upstreamConfig.Protocol]; exists && upstreamConfig.Proxy == nil {
+		conn, err := dialUpstream(c, upstreamConfig)
+		if err != nil {
+			client.Log(3, "Error connecting to the upstream IRCd. %s", err.Error())
+			errString := ""
+			if errString = typeOfErr(err); errString != "" {
+				errString = "err_" + errString
+			}
+			return nil, &upstreamConnectError{closeReason: errString}
+		}
+
+		return conn, nil
+	}
+
 	if upstreamConfig.Proxy == nil {
 		// Connect directly to the IRCd
 		dialer := net.Dialer{}
@@ -336,7 +545,7 @@ func (c *Client) makeUpstreamConnection() (io.ReadWriteCloser, error) {
 		if upstreamConfig.Protocol == "unix" {
 			conn, connErr = dialer.Dial("unix", upstreamConfig.Hostname)
 		} else {
-			upstreamStr := fmt.Sprintf("%s:%d", upstreamConfig.Hostname, upstreamConfig.Port)
+			upstreamStr := net.JoinHostPort(upstreamConfig.Hostname, strconv.Itoa(upstreamConfig.Port))
 			conn, connErr = dialer.Dial(upstreamConfig.Protocol, upstreamStr)
 		}
 
@@ -346,9 +555,7 @@ func (c *Client) makeUpstreamConnection() (io.ReadWriteCloser, error) {
 			if errString = typeOfErr(connErr); errString != "" {
 				errString = "err_" + errString
 			}
-			client.SendClientSignal("state", "closed", errString)
-			client.StartShutdown("err_connecting_upstream")
-			return nil, errors.New("error connecting upstream")
+			return nil, &upstreamConnectError{closeReason: errString}
 		}
 
 		// Add the ports into the identd before possible TLS handshaking. If we do it after then
@@ -363,15 +570,45 @@ func (c *Client) makeUpstreamConnection() (io.ReadWriteCloser, error) {
 			c.Gateway.identdServ.AddIdent(client.IrcState.LocalPort, client.IrcState.RemotePort, client.IrcState.Username, "")
 		}
 
-		if upstreamConfig.TLS {
-			tlsConfig := &tls.Config{InsecureSkipVerify: true}
-			tlsConn := tls.Client(conn, tlsConfig)
+		// Close the connection again if it can not be used, as another upstream may be tried
+		connectFailed := func(closeReason string) *upstreamConnectError {
+			conn.Close()
+			if c.Gateway.Config.Identd {
+				c.Gateway.identdServ.RemoveIdent(client.IrcState.LocalPort, client.IrcState.RemotePort, "")
+			}
+			return &upstreamConnectError{closeReason: closeReason}
+		}
+
+		// The PROXY protocol header comes before any TLS handshake
+		if upstreamConfig.ProxyProtocol != "" {
+			err := c.writeProxyProtocolHeader(conn)
+			if err != nil {
+				client.Log(3, "Error sending the PROXY protocol header to the upstream IRCd. %s", err.Error())
+				return nil, connectFailed("err_proxy_protocol")
+			}
+		}
+
+		if upstreamConfig.StartTLS && !upstreamConfig.TLS {
+			err := upstreamStartTLS(conn, dialer.Timeout)
+			if err != nil {
+				client.Log(3, "Error starting TLS with the upstream IRCd. %s", err.Error())
+				return nil, connectFailed("err_tls")
+			}
+		}
+
+		if upstreamConfig.TLS || upstreamConfig.StartTLS {
+			tlsConn := tls.Client(conn, c.upstreamTLSConfig())
 			err := tlsConn.Handshake()
 			if err != nil {
 				client.Log(3, "Error connecting to the upstream IRCd. %s", err.Error())
-				client.SendClientSignal("state", "closed", "err_tls")
-				client.StartShutdown("err_connecting_upstream")
-				return nil, errors.New("error connecting upstream")
+				return nil, connectFailed("err_tls")
+			}
+			if len(upstreamConfig.ALPN) > 0 {
+				negotiated := tlsConn.ConnectionState().NegotiatedProtocol
+				if negotiated == "" {
+					negotiated = "none"
+				}
+				client.Log(2, "Upstream TLS ALPN protocol: %s (offered %s)", negotiated, strings.Join(upstreamConfig.ALPN, ","))
 			}
 
 			conn = net.Conn(tlsConn)
@@ -387,13 +624,24 @@ func (c *Client) makeUpstreamConnection() (io.ReadWriteCloser, error) {
 		conn.DestPort = upstreamConfig.Port
 		conn.DestTLS = upstreamConfig.TLS
 		conn.Username = upstreamConfig.Proxy.Username
-		conn.ProxyInterface = upstreamConfig.Proxy.Interface
-
-		dialErr := conn.Dial(fmt.Sprintf(
-			"%s:%d",
-			upstreamConfig.Proxy.Hostname,
-			upstreamConfig.Proxy.Port,
-		))
+		conn.Secret = upstreamConfig.Proxy.Secret
+		conn.Timeout = time.Second * time.Duration(upstreamConfig.Timeout)
+		proxyAddr := net.JoinHostPort(upstreamConfig.Proxy.Hostname, strconv.Itoa(upstreamConfig.Proxy.Port))
+
+		interfaces, dialErr := upstreamConfig.Proxy.interfacePool()
+		if dialErr == nil {
+			conn.ProxyInterface = c.Gateway.proxyInterfaces.acquire(proxyAddr, interfaces)
+			conn.TLSConfig, dialErr = upstreamConfig.Proxy.dialTLSConfig(c.Gateway.Config)
+			if dialErr == nil {
+				dialErr = conn.Dial(proxyAddr)
+			}
+			if dialErr != nil {
+				c.Gateway.proxyInterfaces.release(proxyAddr, conn.ProxyInterface)
+			} else {
+				client.proxyAddr = proxyAddr
+				client.proxyInterface = conn.ProxyInterface
+			}
+		}
 
 		if dialErr != nil {
 			errString := ""
@@ -409,9 +657,7 @@ func (c *Client) makeUpstreamConnection() (io.ReadWriteCloser, error) {
 				dialErr.Error(),
 			)
 
-			client.SendClientSignal("state", "closed", errString)
-			client.StartShutdown("err_connecting_upstream")
-			return nil, errors.New("error connecting upstream")
+			return nil, &upstreamConnectError{closeReason: errString}
 		}
 
 		connection = conn
@@ -441,8 +687,8 @@ func (c *Client) writeWebircLines(upstream io.ReadWriteCloser) {
 	}
 
 	clientHostname := c.RemoteHostname
-	if c.Gateway.Config.ClientHostname != "" {
-		clientHostname = makeClientReplacements(c.Gateway.Config.ClientHostname, c)
+	if _, _, hostnameTemplate := c.clientTemplates(); hostnameTemplate != "" {
+		clientHostname = makeClientReplacements(hostnameTemplate, c)
 	}
 
 	remoteAddr := c.RemoteAddr
@@ -493,6 +739,8 @@ func (c *Client) processLineToUpstream(data string) {
 		)
 	} else if strings.HasPrefix(strings.ToUpper(data), "QUIT ") {
 		client.SeenQuit = true
+	} else if strings.HasPrefix(strings.ToUpper(data), "CAP LS ") && upstreamConfig.MaxCapVersion > 0 {
+		data = client.downgradeCapLs(data)
 	}
 
 	message, _ := irc.ParseLine(data)
@@ -510,22 +758,49 @@ func (c *Client) processLineToUpstream(data string) {
 	}
 
 	// Plugins may have modified the data
-	data = hook.Line
+	if hook.Line != data {
+		data = hook.Line
+		message, _ = irc.ParseLine(data)
+	}
+
+	if message != nil {
+		data = c.presenceLineToUpstream(message, data)
+		if data == "" {
+			return
+		}
+		data = c.userhostLineToUpstream(message, data)
+		if data == "" {
+			return
+		}
+	}
 
 	c.TrafficLog(true, false, data)
-	data = utf8ToOther(data, client.Encoding)
-	if data == "" {
-		client.Log(1, "Failed to encode into '%s'. Dropping data", c.Encoding)
-		return
+	if !client.RawEncoding {
+		data = utf8ToOther(data, client.Encoding)
+		if data == "" {
+			client.Log(1, "Failed to encode into '%s'. Dropping data", c.Encoding)
+			return
+		}
 	}
 
-	if client.upstream != nil {
-		client.upstream.Write([]byte(data + "\r\n"))
+	if client.writeUpstream(data) {
+		client.trackRegistrationLine(data)
 	} else {
 		client.Log(2, "Tried sending data upstream before connected")
 	}
 }
 
+// writeUpstream - Write a line to the upstream connection. Only the line worker writes to the
+// upstream, as it also handles every line read from it. Returns false if there is no connection
+func (c *Client) writeUpstream(line string) bool {
+	if c.upstream == nil {
+		return false
+	}
+
+	c.upstream.Write([]byte(line + "\r\n"))
+	return true
+}
+
 func (c *Client) handleLineFromUpstream(data string) {
 	client := c
 	upstreamConfig := c.UpstreamConfig
@@ -551,16 +826,21 @@ func (c *Client) handleLineFromUpstream(data string) {
 		return
 	}
 
-	data = ensureUtf8(data, client.Encoding)
-	if data == "" {
-		client.Log(1, "Failed to decode as 'UTF-8'. Dropping data")
-		return
+	if !client.RawEncoding {
+		data = decodeToUtf8(data, client.Encoding, client.UpstreamConfig.EncodingFallback)
+		if data == "" {
+			client.Log(1, "Failed to decode as 'UTF-8'. Dropping data")
+			return
+		}
 	}
 
 	data = client.ProcessLineFromUpstream(data)
-	if data == "" {
+	if data == "" || client.answerDetachedPing(data) {
 		return
 	}
+	if !client.IrcState.ISupport.Injected {
+		client.recordResumeWelcome(data)
+	}
 
 	client.SendClientSignal("data", data)
 }
@@ -585,6 +865,8 @@ func typeOfErr(err error) string {
 			return "unknown_host"
 		case "conn_timeout":
 			return "timeout"
+		case "forbidden":
+			return "forbidden"
 		default:
 			return ""
 		}
@@ -608,25 +890,38 @@ func typeOfErr(err error) string {
 func (c *Client) readUpstream() {
 	client := c
 
+	// The client may move to another upstream if registration stalls so keep hold of the details
+	// of this connection
+	upstream := client.upstream
+	upstreamRecv := client.UpstreamRecv
+	localPort, remotePort := client.IrcState.LocalPort, client.IrcState.RemotePort
+	proxyAddr, proxyInterface := client.proxyAddr, client.proxyInterface
+
+	downstreamLimiter := client.newDownstreamLimiter()
+
 	// Data from upstream to client
 	go func() {
-		reader := bufio.NewReader(client.upstream)
+		reader := bufio.NewReader(upstream)
 		for {
 			data, err := reader.ReadString('\n')
 			if err != nil {
 				break
 			}
 
+			waitDownstream(downstreamLimiter, data)
 			data = strings.Trim(data, "\n\r")
-			client.UpstreamRecv <- data
+			upstreamRecv <- data
 		}
 
-		close(client.UpstreamRecv)
-		client.upstream.Close()
-		client.upstream = nil
+		// The line worker forgets the connection once it sees upstreamRecv close
+		close(upstreamRecv)
+		upstream.Close()
 
-		if client.IrcState.RemotePort > 0 {
-			c.Gateway.identdServ.RemoveIdent(client.IrcState.LocalPort, client.IrcState.RemotePort, "")
+		if remotePort > 0 {
+			c.Gateway.identdServ.RemoveIdent(localPort, remotePort, "")
+		}
+		if proxyAddr != "" {
+			c.Gateway.proxyInterfaces.release(proxyAddr, proxyInterface)
 		}
 	}()
 }
@@ -662,11 +957,19 @@ func (c *Client) handleDataLine() (shouldQuit bool, hadErr bool) {
 	}
 
 	select {
-	case clientData, ok := <-c.ThrottledRecv.Output:
+	case clientData, ok := <-c.clientLines():
 		if !ok {
 			c.Log(1, "client.Recv closed")
-			if !c.SeenQuit && c.Gateway.Config.SendQuitOnClientClose != "" && c.State == ClientStateEnding {
-				c.processLineToUpstream("QUIT :" + c.Gateway.Config.SendQuitOnClientClose)
+			if c.resume.send != nil {
+				c.endRelay()
+				c.StartShutdown("client_closed")
+				return true, false
+			}
+			if c.detachSession() {
+				return false, false
+			}
+			if quitMessage := c.quitMessage(); !c.SeenQuit && quitMessage != "" && c.State() == ClientStateEnding {
+				c.processLineToUpstream("QUIT :" + quitMessage)
 			}
 
 			c.StartShutdown("client_closed")
@@ -677,10 +980,15 @@ func (c *Client) handleDataLine() (shouldQuit bool, hadErr bool) {
 			return true, false
 		}
 		c.Log(1, "in c.ThrottledRecv.Output")
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
 		c.TrafficLog(false, true, clientData)
+		c.autoAwayActivity(clientData)
+		if c.relayLine(clientData) {
+			return false, false
+		}
 
 		clientLine, err := c.ProcessLineFromClient(clientData)
-		if err == nil && clientLine != "" {
+		if err == nil && clientLine != "" && !c.holdForVerification(clientLine) {
 			c.UpstreamSend <- clientLine
 		}
 
@@ -692,9 +1000,34 @@ func (c *Client) handleDataLine() (shouldQuit bool, hadErr bool) {
 		c.Log(1, "in .UpstreamSend")
 		c.processLineToUpstream(line)
 
+	case <-c.registrationTimeout():
+		return c.handleRegistrationTimeout(), false
+
+	case req := <-c.resumeAttach():
+		c.attachRelay(req)
+
+	case <-c.resumeGraceExpired():
+		return c.handleResumeExpired(), false
+
+	case <-c.autoAwayTimeout():
+		c.handleAutoAway()
+
+	case <-c.verifyGraceTimeout():
+		return c.handleVerifyGraceTimeout(), false
+
+	case reason := <-c.verifyRequests:
+		c.handleRequireVerification(reason)
+
+	case <-c.verifyHoldTimeout():
+		return c.handleVerifyHoldTimeout(), false
+
+	case <-c.upstreamRetryTimeout():
+		return c.handleUpstreamRetry(), false
+
 	case upstreamData, ok := <-c.UpstreamRecv:
 		if !ok {
 			c.Log(1, "client.UpstreamRecv closed")
+			c.upstream = nil
 			c.SendClientSignal("state", "closed")
 			c.StartShutdown("upstream_closed")
 			return true, false
@@ -708,6 +1041,57 @@ func (c *Client) handleDataLine() (shouldQuit bool, hadErr bool) {
 	return false, false
 }
 
+// setDestination - Parse a "host:port" destination given by the client into the c.Dest* vars. A +
+// before the port signifies TLS
+func (c *Client) setDestination(addr string) {
+	var err error
+
+	portSep := strings.LastIndex(addr, ":")
+	if portSep == -1 {
+		c.DestHost = addr
+		c.DestPort = 6667
+		c.DestTLS = false
+	} else {
+		c.DestHost = addr[0:portSep]
+		portParam := addr[portSep+1:]
+		if len(portParam) > 0 && portParam[0:1] == "+" {
+			c.DestTLS = true
+			c.DestPort, err = strconv.Atoi(portParam[1:])
+			if err != nil {
+				c.DestPort = 6697
+			}
+		} else {
+			c.DestPort, err = strconv.Atoi(portParam[0:])
+			if err != nil {
+				c.DestPort = 6667
+			}
+		}
+	}
+}
+
+// logDeniedDestination - Log a destination refused by gateway.whitelist along with who asked for
+// it, so that attempts to reach other networks through the gateway can be audited
+func (c *Client) logDeniedDestination() {
+	origin := c.origin
+	if origin == "" {
+		origin = "none"
+	}
+	c.Log(3, "Denied connection to %s:%d for %s (%s) origin=%s", c.DestHost, c.DestPort, c.RemoteAddr, c.RemoteHostname, origin)
+}
+
+// setEncoding - Use the named encoding for lines to and from the IRC server if it is known
+func (c *Client) setEncoding(name string) bool {
+	encoding, _ := charset.Lookup(name)
+	if encoding == nil {
+		c.Log(1, "Requested unknown encoding, %s", name)
+		return false
+	}
+
+	c.Encoding = name
+	c.Log(1, "Set encoding to %s", name)
+	return true
+}
+
 // configureUpstream - Generate an upstream configuration from the information set on the client instance
 func (c *Client) configureUpstream() ConfigUpstream {
 	upstreamConfig := ConfigUpstream{}
@@ -716,26 +1100,98 @@ func (c *Client) configureUpstream() ConfigUpstream {
 	upstreamConfig.TLS = c.DestTLS
 	upstreamConfig.Timeout = c.Gateway.Config.GatewayTimeout
 	upstreamConfig.Throttle = c.Gateway.Config.GatewayThrottle
+	upstreamConfig.ThrottleBurst = c.Gateway.Config.GatewayThrottleBurst
+	upstreamConfig.ThrottleWeights = c.Gateway.Config.GatewayThrottleWeights
+	upstreamConfig.RegistrationThrottle = c.Gateway.Config.GatewayRegThrottle
+	upstreamConfig.RegistrationThrottleBurst = c.Gateway.Config.GatewayRegThrottleBurst
+	upstreamConfig.MaxCapVersion = c.Gateway.findMaxCapVersion(c.DestHost)
+	upstreamConfig.StripCaps = c.Gateway.Config.GatewayStripCaps
+	upstreamConfig.AddCaps = c.Gateway.Config.GatewayAddCaps
+	upstreamConfig.EncodingFallback = c.Gateway.Config.GatewayEncodingFallback
 	upstreamConfig.WebircPassword = c.Gateway.findWebircPassword(c.DestHost)
 	upstreamConfig.Protocol = c.Gateway.Config.GatewayProtocol
 	upstreamConfig.LocalAddr = c.Gateway.Config.GatewayLocalAddr
+	upstreamConfig.SendQuitOnClientClose = c.Gateway.Config.SendQuitOnClientClose
+	upstreamConfig.RegistrationTimeout = c.Gateway.Config.GatewayRegTimeout
+	upstreamConfig.ListCacheTTL = c.Gateway.Config.GatewayListCacheTTL
+	upstreamConfig.NickCacheTTL = c.Gateway.Config.GatewayNickCacheTTL
 
 	return upstreamConfig
 }
 
+// quitMessage - The QUIT message to send upstream when the client closes, with the client
+// replacements and %r for the reason the client is closing
+func (c *Client) quitMessage() string {
+	if c.UpstreamConfig == nil || c.UpstreamConfig.SendQuitOnClientClose == "" {
+		return ""
+	}
+
+	message := makeClientReplacements(c.UpstreamConfig.SendQuitOnClientClose, c)
+	return strings.Replace(message, "%r", c.shutdownReason, -1)
+}
+
+// networkNameToken - The NETWORK ISUPPORT token for the upstreams network_name. Spaces are
+// escaped as ISUPPORT values may not contain them
+func (c *Client) networkNameToken() string {
+	return "NETWORK=" + strings.Replace(c.UpstreamConfig.NetworkName, " ", "\\x20", -1)
+}
+
+// configuredISupportTokens - The global and upstream ISUPPORT tokens to send to the client. Upstream
+// tokens replace global tokens of the same name
+func (c *Client) configuredISupportTokens() []string {
+	tokens := []string{}
+	tokenIdx := make(map[string]int)
+	allTokens := append([]string{}, c.Gateway.Config.ISupportTokens...)
+	allTokens = append(allTokens, c.UpstreamConfig.ISupport...)
+
+	for _, token := range allTokens {
+		if token == "" {
+			continue
+		}
+
+		tokenName := strings.ToUpper(strings.SplitN(token, "=", 2)[0])
+		if idx, exists := tokenIdx[tokenName]; exists {
+			tokens[idx] = token
+		} else {
+			tokenIdx[tokenName] = len(tokens)
+			tokens = append(tokens, token)
+		}
+	}
+
+	return tokens
+}
+
 func (c *Client) buildWebircTags() string {
 	str := ""
-	for key, val := range c.Tags {
+	for _, tag := range c.webircTags() {
 		if str != "" {
 			str += " "
 		}
 
-		if val == "" {
-			str += key
+		if tag[1] == "" {
+			str += tag[0]
 		} else {
-			str += key + "=" + val
+			str += tag[0] + "=" + tag[1]
 		}
 	}
 
 	return str
 }
+
+// nextFallbackNick - The next nick to try after upstream rejected our nick during registration.
+// Returns an empty string once the configured number of attempts have been used
+func (c *Client) nextFallbackNick() string {
+	format := c.Gateway.Config.ClientNickFallback
+	if format == "" || c.nickFallbackAttempts >= c.Gateway.Config.ClientNickFallbackMax {
+		return ""
+	}
+
+	if c.nickFallbackBase == "" {
+		c.nickFallbackBase = c.IrcState.Nick
+	}
+	c.nickFallbackAttempts++
+
+	format = strings.Replace(format, "%n", c.nickFallbackBase, -1)
+	format = strings.Replace(format, "%d", strconv.Itoa(c.nickFallbackAttempts), -1)
+	return makeClientReplacements(format, c)
+}
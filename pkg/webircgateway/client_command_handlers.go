@@ -2,19 +2,19 @@ package webircgateway
 
 import (
 	"errors"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/kiwiirc/webircgateway/pkg/irc"
-	"github.com/kiwiirc/webircgateway/pkg/recaptcha"
-	"golang.org/x/net/html/charset"
-	"golang.org/x/time/rate"
 )
 
 var MAX_EXTJWT_SIZE = 200
 
+// Servers send at most 13 ISUPPORT tokens per 005 line
+const maxISupportTokensPerLine = 13
+
 /*
  * ProcessLineFromUpstream
  * Processes and makes any changes to a line of data sent from an upstream
@@ -23,26 +23,101 @@ func (c *Client) ProcessLineFromUpstream(data string) string {
 	client := c
 
 	m, parseErr := irc.ParseLine(data)
+	if parseErr == irc.ErrTagsTooLong {
+		// Clients may not be able to handle the line at all. Keep the message but drop its tags
+		c.Log(2, "Upstream sent a line with %d bytes of tags. Removing the tags", irc.TagsLength(data))
+		data = irc.StripTags(data)
+		m, parseErr = irc.ParseLine(data)
+	}
 	if parseErr != nil {
 		return data
 	}
 
 	pLen := len(m.Params)
 
-	if pLen > 0 && m.Command == "NICK" && m.Prefix.Nick == c.IrcState.Nick {
+	// Replies to the gateways own latency PINGs are not meant for the client
+	if pLen > 0 && m.Command == "PONG" && c.handleLatencyPong(m.Params[pLen-1]) {
+		return ""
+	}
+
+	// Old IRC servers that do not know CAP register the client without it. The gateway answers
+	// the clients CAP negotiation from then on
+	if isCapRejectedReply(m) {
+		if c.upstreamNoCaps {
+			return ""
+		}
+		c.Log(2, "Upstream does not support CAP, negotiating caps locally")
+		c.upstreamNoCaps = true
+		if c.ServerMessagePrefix.Nick == "" && m.Prefix != nil {
+			c.ServerMessagePrefix = *m.Prefix
+		}
+		return c.localCapLsReply()
+	}
+
+	data = c.saslLineFromUpstream(m, data)
+	if data == "" {
+		return ""
+	}
+
+	c.trackOwnMask(m)
+	c.listLineFromUpstream(m)
+
+	data = c.presenceLineFromUpstream(m, data)
+	if data == "" {
+		return ""
+	}
+	data = c.userhostLineFromUpstream(m, data)
+
+	if pLen > 0 && m.Command == "NICK" && c.IrcState.IsOwnNick(m.Prefix.Nick) {
 		client.IrcState.Nick = m.Params[0]
+		client.Gateway.clientIndex.SetNick(client, m.Params[0])
 	}
 	if pLen > 0 && m.Command == "001" {
 		client.IrcState.Nick = m.Params[0]
-		client.State = ClientStateConnected
+		client.Gateway.clientIndex.SetNick(client, m.Params[0])
+		client.setState(ClientStateConnected)
 		client.ServerMessagePrefix = *m.Prefix
+		client.stopRegistrationTimer()
+
+		// Registration is complete so switch over to the normal throttle
+		client.setThrottle(true)
+		client.identifyWithNickserv()
+		client.startAutoAwayTimer()
 
-		// Throttle writes if configured, but only after registration is complete. Typical IRCd
-		// behavior is to not throttle registration commands.
-		client.ThrottledRecv.Limiter = rate.NewLimiter(rate.Limit(client.UpstreamConfig.Throttle), 1)
+		if len(client.UpstreamConfig.Autojoin) > 0 {
+			client.processLineToUpstream("JOIN " + strings.Join(client.UpstreamConfig.Autojoin, ","))
+		}
+	}
+	// :server.com 433 * nick :Nickname is already in use
+	// :server.com 432 * nick :Erroneous nickname
+	if (m.Command == "433" || m.Command == "432") && client.State() == ClientStateRegistering {
+		fallbackNick := client.nextFallbackNick()
+		if fallbackNick != "" {
+			rejectedNick := client.IrcState.Nick
+			client.Log(1, "Nick %s rejected during registration, trying %s", rejectedNick, fallbackNick)
+			client.IrcState.Nick = fallbackNick
+			client.processLineToUpstream("NICK " + fallbackNick)
+
+			// Pass on the rejection and tell the client which nick is being tried in its place
+			client.SendClientSignal("data", data)
+			nickMessage := irc.Message{
+				Prefix:  &irc.Mask{Nick: rejectedNick},
+				Command: "NICK",
+				Params:  []string{fallbackNick},
+			}
+			return nickMessage.ToLine()
+		}
 	}
 	if pLen > 0 && m.Command == "005" {
 		tokenPairs := m.Params[1 : pLen-1]
+		if client.UpstreamConfig.NetworkName != "" {
+			for idx, token := range tokenPairs {
+				if strings.HasPrefix(strings.ToUpper(token), "NETWORK=") {
+					tokenPairs[idx] = client.networkNameToken()
+					data = m.ToLine()
+				}
+			}
+		}
 		iSupport := c.IrcState.ISupport
 		iSupport.Received = true
 		iSupport.Tags = m.Tags
@@ -66,66 +141,144 @@ func (c *Client) ProcessLineFromUpstream(data string) string {
 			iSupport.AddToken("EXTJWT=1")
 		}
 
-		msg.Params = append(msg.Params, "are supported by this server")
+		if !iSupport.HasToken("NETWORK") && client.UpstreamConfig.NetworkName != "" {
+			msg.Params = append(msg.Params, client.networkNameToken())
+			iSupport.AddToken(client.networkNameToken())
+		}
+
+		// Tokens from the config, unless the upstream already sent them
+		for _, token := range c.configuredISupportTokens() {
+			tokenName := strings.SplitN(token, "=", 2)[0]
+			if iSupport.HasToken(tokenName) {
+				continue
+			}
+			msg.Params = append(msg.Params, token)
+			iSupport.AddToken(token)
+		}
+
 		if timeTag, ok := c.IrcState.ISupport.Tags["time"]; ok {
 			msg.Tags["time"] = timeTag
 		}
-		if len(msg.Params) > 2 {
-			// Extra tokens were added, send the line
-			c.SendClientSignal("data", msg.ToLine())
+
+		// Extra tokens were added, send them on as many lines as needed
+		tokens := msg.Params[1:]
+		for len(tokens) > 0 {
+			lineTokens := tokens
+			if len(lineTokens) > maxISupportTokensPerLine {
+				lineTokens = lineTokens[:maxISupportTokensPerLine]
+			}
+			tokens = tokens[len(lineTokens):]
+
+			lineMsg := *msg
+			lineMsg.Params = append([]string{c.IrcState.Nick}, lineTokens...)
+			lineMsg.Params = append(lineMsg.Params, "are supported by this server")
+			c.SendClientSignal("data", lineMsg.ToLine())
+			c.recordResumeWelcome(lineMsg.ToLine())
 		}
+
+		// Registration is complete so the session may now be resumed if the client disconnects
+		c.issueResumeToken()
 	}
-	if pLen > 0 && m.Command == "JOIN" && m.Prefix.Nick == c.IrcState.Nick {
+	if pLen > 0 && m.Command == "JOIN" && c.IrcState.IsOwnNick(m.Prefix.Nick) {
 		channel := irc.NewStateChannel(m.GetParam(0, ""))
 		c.IrcState.SetChannel(channel)
+		c.Gateway.clientIndex.AddChannel(c, channel.Name)
+	}
+	if pLen > 0 && m.Command == "PART" && c.IrcState.IsOwnNick(m.Prefix.Nick) {
+		c.IrcState.RemoveChannel(m.GetParam(0, ""))
+		c.Gateway.clientIndex.RemoveChannel(c, m.GetParam(0, ""))
 	}
-	if pLen > 0 && m.Command == "PART" && m.Prefix.Nick == c.IrcState.Nick {
+	// :op!u@h KICK #channel m :reason
+	if pLen > 1 && m.Command == "KICK" && c.IrcState.IsOwnNick(m.GetParam(1, "")) {
 		c.IrcState.RemoveChannel(m.GetParam(0, ""))
+		c.Gateway.clientIndex.RemoveChannel(c, m.GetParam(0, ""))
 	}
-	if pLen > 0 && m.Command == "QUIT" && m.Prefix.Nick == c.IrcState.Nick {
+	if pLen > 0 && m.Command == "QUIT" && c.IrcState.IsOwnNick(m.Prefix.Nick) {
 		c.IrcState.ClearChannels()
+		c.Gateway.clientIndex.ClearChannels(c)
+	}
+	// :server.com 353 m = #channel :@m +other third
+	if pLen > 3 && m.Command == "353" {
+		channel := c.IrcState.GetChannel(m.GetParam(2, ""))
+		if channel != nil {
+			prefixModes, prefixSymbols := c.IrcState.ISupport.PrefixModes()
+			for _, name := range strings.Split(m.GetParam(3, ""), " ") {
+				// Multiple prefixes may be given with multi-prefix, and a full mask with userhost-in-names
+				nick := strings.TrimLeft(name, prefixSymbols)
+				symbols := name[:len(name)-len(nick)]
+				if bangIdx := strings.Index(nick, "!"); bangIdx > -1 {
+					nick = nick[:bangIdx]
+				}
+				if nick == "" || !c.IrcState.IsOwnNick(nick) {
+					continue
+				}
+
+				for _, mode := range prefixModes {
+					delete(channel.Modes, string(mode))
+				}
+				for _, symbol := range symbols {
+					if symbolIdx := strings.IndexRune(prefixSymbols, symbol); symbolIdx > -1 {
+						channel.Modes[string(prefixModes[symbolIdx])] = ""
+					}
+				}
+			}
+		}
 	}
 	// :server.com 900 m m!m@irc-3jg.1ab.j4ep8h.IP prawnsalad :You are now logged in as prawnsalad
 	if pLen > 0 && m.Command == "900" {
 		c.IrcState.Account = m.GetParam(2, "")
+		if c.Gateway.Config.VerifySkipIdentified {
+			c.identifiedDuringGrace()
+		}
+		c.updateThrottleTier()
+		c.CheckAccountQuota()
 	}
 	// :server.com 901 itsonlybinary itsonlybinary!itsonlybina@user/itsonlybinary :You are now logged out
 	if m.Command == "901" {
 		c.IrcState.Account = ""
+		c.updateThrottleTier()
+		c.Gateway.clientIndex.SetAccount(c, c.accountQuotaKey())
 	}
 	// :prawnsalad!prawn@kiwiirc/prawnsalad MODE #kiwiirc-dev +oo notprawn kiwi-n75
 	if pLen > 0 && m.Command == "MODE" {
-		if strings.HasPrefix(m.GetParam(0, ""), "#") {
+		if c.IrcState.ISupport.IsChannel(m.GetParam(0, "")) {
 			channelName := m.GetParam(0, "")
 			modes := m.GetParam(1, "")
 
 			channel := c.IrcState.GetChannel(channelName)
-			if channel != nil {
+			if channel == nil {
 				channel = irc.NewStateChannel(channelName)
 				c.IrcState.SetChannel(channel)
 			}
+			modeParams := []string{}
+			if pLen > 2 {
+				modeParams = m.Params[2:]
+			}
+			prefixModes, _ := c.IrcState.ISupport.PrefixModes()
 
-			adding := false
-			paramIdx := 1
-			for i := 0; i < len(modes); i++ {
-				mode := string(modes[i])
-
-				if mode == "+" {
-					adding = true
-				} else if mode == "-" {
-					adding = false
+			for _, change := range c.IrcState.ISupport.ParseModeChanges(modes, modeParams) {
+				if !strings.Contains(prefixModes, change.Mode) || !c.IrcState.IsOwnNick(change.Param) {
+					continue
+				}
+				if change.Adding {
+					channel.Modes[change.Mode] = ""
 				} else {
-					paramIdx++
-					param := m.GetParam(paramIdx, "")
-					if strings.EqualFold(param, c.IrcState.Nick) {
-						if adding {
-							channel.Modes[mode] = ""
-						} else {
-							delete(channel.Modes, mode)
-						}
-					}
+					delete(channel.Modes, change.Mode)
 				}
 			}
+		} else if c.IrcState.IsOwnNick(m.GetParam(0, "")) {
+			// :prawnsalad MODE prawnsalad :+iw
+			c.IrcState.ApplyUserModes(m.GetParam(1, ""))
+		}
+	}
+	// :server.com 221 prawnsalad +iw
+	if pLen > 1 && m.Command == "221" {
+		c.IrcState.SetUserModes(m.GetParam(1, ""))
+	}
+
+	if pLen >= 3 && strings.ToUpper(m.Command) == "CAP" {
+		if client.filterUpstreamCapList(m) || client.appendLocalCapReplies(m) {
+			data = m.ToLine()
 		}
 	}
 
@@ -168,16 +321,41 @@ func (c *Client) ProcessLineFromUpstream(data string) string {
 		client.RequestedMessageTagsCap = ""
 	}
 
-	if m != nil && client.Features.Messagetags && c.Gateway.messageTags.CanMessageContainClientTags(m) {
-		// If we have any message tags stored for this message from a previous PRIVMSG sent
-		// by a client, add them back in
-		mTags, mTagsExists := c.Gateway.messageTags.GetTagsFromMessage(client, m.Prefix.Nick, m)
-		if mTagsExists {
+	// Keep track of the upstream enabling message-tags itself, in which case client tags are passed
+	// through the IRC server and only the identity tags need restoring
+	if m != nil &&
+		!client.Features.Messagetags &&
+		strings.ToUpper(m.Command) == "CAP" &&
+		m.GetParamU(1, "") == "ACK" {
+		for _, cap := range strings.Fields(m.GetParamU(len(m.Params)-1, "")) {
+			if cap == "MESSAGE-TAGS" || cap == "DRAFT/MESSAGE-TAGS-0.2" {
+				client.upstreamMessageTags = true
+			} else if cap == "-MESSAGE-TAGS" || cap == "-DRAFT/MESSAGE-TAGS-0.2" {
+				client.upstreamMessageTags = false
+			}
+		}
+	}
+
+	if m != nil && m.Prefix != nil && c.Gateway.messageTags.CanMessageContainClientTags(m) {
+		// Identity tags are only trusted when restored from messages sent through this gateway
+		identityTagsRemoved := c.Gateway.removeIdentityTags(m)
+
+		if client.Features.Messagetags {
+			// Add back any message tags stored for this message from a previous PRIVMSG sent
+			// by a client, along with a msgid that is shared between all recipients
+			mTags := c.Gateway.messageTags.GetOrCreateTags(client, m.Prefix.Nick, m)
 			for k, v := range mTags.Tags {
-				m.Tags[k] = v
+				if _, exists := m.Tags[k]; !exists {
+					m.Tags[k] = v
+				}
 			}
 
 			data = m.ToLine()
+		} else {
+			identityTagsRestored := client.upstreamMessageTags && c.restoreIdentityTags(m)
+			if identityTagsRestored || identityTagsRemoved {
+				data = m.ToLine()
+			}
 		}
 	}
 
@@ -189,6 +367,23 @@ func (c *Client) ProcessLineFromUpstream(data string) string {
  * Processes and makes any changes to a line of data sent from a client
  */
 func (c *Client) ProcessLineFromClient(line string) (string, error) {
+	// Clients may only send 4094 bytes of tag data. Such lines are rejected with
+	// ERR_INPUTTOOLONG as required by the message-tags specification
+	if tagsLength := irc.TagsLength(line); tagsLength-2 > irc.MaxClientTagsLength {
+		c.Log(2, "Client sent a line with %d bytes of tags. Rejecting it", tagsLength)
+		currentNick := c.IrcState.Nick
+		if currentNick == "" {
+			currentNick = "*"
+		}
+		errMessage := irc.Message{
+			Command: "417", // ERR_INPUTTOOLONG
+			Prefix:  &c.ServerMessagePrefix,
+			Params:  []string{currentNick, "Input line was too long"},
+		}
+		c.SendClientSignal("data", errMessage.ToLine())
+		return "", nil
+	}
+
 	message, err := irc.ParseLine(line)
 	// Just pass any random data upstream
 	if err != nil {
@@ -196,8 +391,15 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 	}
 
 	maybeConnectUpstream := func() {
+		if !c.UpstreamStarted && c.IrcState.Username != "" && c.IrcState.Nick != "" && c.abuseChecksDeferred {
+			c.abuseChecksDeferred = false
+			if !c.startDeferredAbuseChecks() {
+				return
+			}
+		}
+
 		verified := false
-		if c.RequiresVerification && !c.Verified {
+		if c.RequiresVerification && !c.Verified && !c.inVerifyGrace {
 			verified = false
 		} else {
 			verified = true
@@ -208,29 +410,79 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 		}
 	}
 
+	// Commands meant for the gateway, such as HOST, sent once the upstream connection has started
+	if reservedLine, handled := c.checkReservedCommand(message, line); handled {
+		return reservedLine, nil
+	}
+
+	if c.isResumeCommand(message) {
+		if strings.ToUpper(message.Command) == "MIGRATE" {
+			c.migrateSession(message.GetParam(0, ""))
+		} else {
+			c.resumeSession(message.GetParam(0, ""))
+		}
+		return "", nil
+	}
+
+	if !c.UpstreamStarted && strings.ToUpper(message.Command) == "AUTHTOKEN" && c.Gateway.Config.VerifyAuthTokenSecret != "" {
+		identity, err := parseGatewayAuthToken(c.Gateway.Config.VerifyAuthTokenSecret, message.GetParam(0, ""))
+		if err != nil {
+			c.Log(2, "Invalid gateway auth token: %s", err.Error())
+			c.SendIrcFail("AUTHTOKEN", "INVALID_TOKEN", "Invalid auth token")
+			return "", nil
+		}
+
+		c.Log(2, "Identified with a gateway auth token as %s", identity.Account)
+		c.Identity = identity
+		c.CheckAccountQuota()
+		return "", nil
+	}
+
 	if !c.Verified && strings.ToUpper(message.Command) == "CAPTCHA" {
 		verified := false
 		if len(message.Params) >= 1 {
-			captcha := recaptcha.R{
-				URL:    c.Gateway.Config.ReCaptchaURL,
-				Secret: c.Gateway.Config.ReCaptchaSecret,
-			}
-
+			captcha := c.reCaptcha()
 			verified = captcha.VerifyResponse(message.Params[0])
 		}
 
 		if !verified {
-			c.SendIrcError("Invalid captcha")
+			c.Gateway.sendWebhook(WebhookVerificationFailed, c, "bad_captcha")
+			c.SendGatewayError(FailInvalidCaptcha, "Invalid captcha")
 			c.SendClientSignal("state", "closed", "bad_captcha")
-			c.StartShutdown("unverifed")
+			c.StartShutdown("unverified")
 		} else {
 			c.Verified = true
+			c.releaseVerificationHold()
+			c.updateThrottleTier()
 			maybeConnectUpstream()
 		}
 
 		return "", nil
 	}
 
+	// Enforce the nick policy before the nick goes anywhere else
+	if strings.ToUpper(message.Command) == "NICK" && len(message.Params) > 0 {
+		nick := c.Gateway.formatNick(message.Params[0])
+		if c.Gateway.isNickBlocked(message.Params[0]) || c.Gateway.isNickBlocked(nick) {
+			currentNick := c.IrcState.Nick
+			if currentNick == "" || c.State() != ClientStateConnected {
+				currentNick = "*"
+			}
+			errMessage := irc.Message{
+				Command: "432", // ERR_ERRONEUSNICKNAME
+				Prefix:  &c.ServerMessagePrefix,
+				Params:  []string{currentNick, message.Params[0], "Nickname is reserved"},
+			}
+			c.SendClientSignal("data", errMessage.ToLine())
+			return "", nil
+		}
+
+		if nick != message.Params[0] {
+			message.Params[0] = nick
+			line = message.ToLine()
+		}
+	}
+
 	// NICK <nickname>
 	if strings.ToUpper(message.Command) == "NICK" && !c.UpstreamStarted {
 		if len(message.Params) > 0 {
@@ -248,11 +500,12 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 			return line, errors.New("Invalid USER line")
 		}
 
-		if c.Gateway.Config.ClientUsername != "" {
-			message.Params[0] = makeClientReplacements(c.Gateway.Config.ClientUsername, c)
+		usernameTemplate, realnameTemplate, _ := c.clientTemplates()
+		if usernameTemplate != "" {
+			message.Params[0] = makeClientReplacements(usernameTemplate, c)
 		}
-		if c.Gateway.Config.ClientRealname != "" {
-			message.Params[3] = makeClientReplacements(c.Gateway.Config.ClientRealname, c)
+		if realnameTemplate != "" {
+			message.Params[3] = makeClientReplacements(realnameTemplate, c)
 		}
 
 		line = message.ToLine()
@@ -265,13 +518,7 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 
 	if strings.ToUpper(message.Command) == "ENCODING" {
 		if len(message.Params) > 0 {
-			encoding, _ := charset.Lookup(message.Params[0])
-			if encoding == nil {
-				c.Log(1, "Requested unknown encoding, %s", message.Params[0])
-			} else {
-				c.Encoding = message.Params[0]
-				c.Log(1, "Set encoding to %s", message.Params[0])
-			}
+			c.setEncoding(message.Params[0])
 		}
 
 		// Don't send the ENCODING command upstream
@@ -292,33 +539,12 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 
 		addr := message.Params[0]
 		if addr == "" {
-			c.SendIrcError("Missing host")
+			c.SendGatewayError(FailMissingHost, "Missing host")
 			c.StartShutdown("missing_host")
 			return "", nil
 		}
 
-		// Parse host:+port into the c.dest* vars
-		portSep := strings.LastIndex(addr, ":")
-		if portSep == -1 {
-			c.DestHost = addr
-			c.DestPort = 6667
-			c.DestTLS = false
-		} else {
-			c.DestHost = addr[0:portSep]
-			portParam := addr[portSep+1:]
-			if len(portParam) > 0 && portParam[0:1] == "+" {
-				c.DestTLS = true
-				c.DestPort, err = strconv.Atoi(portParam[1:])
-				if err != nil {
-					c.DestPort = 6697
-				}
-			} else {
-				c.DestPort, err = strconv.Atoi(portParam[0:])
-				if err != nil {
-					c.DestPort = 6667
-				}
-			}
-		}
+		c.setDestination(addr)
 
 		// Don't send the HOST command upstream
 		return "", nil
@@ -332,6 +558,29 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 		c.Features.Messagetags = true
 	}
 
+	if c.upstreamNoCaps && strings.ToUpper(message.Command) == "CAP" {
+		c.handleCapWithoutUpstream(message)
+		return "", nil
+	}
+
+	if !c.saslLineFromClient(message) {
+		return "", nil
+	}
+
+	// Caps from add_caps that the upstream doesn't support are ACKed by the gateway
+	if strings.ToUpper(message.Command) == "CAP" && message.GetParamU(0, "") == "REQ" && len(message.Params) >= 2 {
+		reqCaps := c.takeLocalCapRequests(message.Params[1])
+		if reqCaps == "" {
+			c.SendClientSignal("data", "CAP * ACK :"+strings.Join(c.localCapsRequested, " "))
+			c.localCapsRequested = nil
+			return "", nil
+		}
+		if reqCaps != message.Params[1] {
+			message.Params[1] = reqCaps
+			line = message.ToLine()
+		}
+	}
+
 	// If we are wrapping the Messagetags feature, make sure the clients REQ message-tags doesn't
 	// get sent upstream
 	if c.Features.Messagetags && strings.ToUpper(message.Command) == "CAP" && message.GetParamU(0, "") == "REQ" {
@@ -353,7 +602,9 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 			if len(newCaps) == 0 {
 				// The only requested CAP was our emulated message-tags
 				// the server will not be sending an ACK so we need to send our own
-				c.SendClientSignal("data", "CAP * ACK :"+c.RequestedMessageTagsCap)
+				ackCaps := append([]string{c.RequestedMessageTagsCap}, c.localCapsRequested...)
+				c.localCapsRequested = nil
+				c.SendClientSignal("data", "CAP * ACK :"+strings.Join(ackCaps, " "))
 				return "", nil
 			}
 			message.Params[1] = strings.Join(newCaps, " ")
@@ -364,27 +615,33 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 		}
 	}
 
+	identityTagged := c.applyIdentityTags(message)
+
 	if c.Features.Messagetags && message.Command == "TAGMSG" {
 		if len(message.Params) == 0 {
 			return "", nil
 		}
 
-		// We can't be 100% sure what this users correct mask is, so just send the nick
+		// Use the mask the IRCd shows for this user once it is known, otherwise just send the nick
 		message.Prefix.Nick = c.IrcState.Nick
 		message.Prefix.Hostname = ""
 		message.Prefix.Username = ""
+		if c.IrcState.DisplayedHostname != "" {
+			message.Prefix.Hostname = c.IrcState.DisplayedHostname
+			message.Prefix.Username = c.IrcState.DisplayedUsername
+		}
 
-		thisHost := strings.ToLower(c.UpstreamConfig.Hostname)
-		target := message.Params[0]
-		for val := range c.Gateway.Clients.IterBuffered() {
-			curClient := val.Val.(*Client)
-			sameHost := strings.ToLower(curClient.UpstreamConfig.Hostname) == thisHost
-			if !sameHost {
-				continue
-			}
+		// All recipients share the same msgid so that replies and reactions can reference it
+		message.Tags["msgid"] = newMsgID()
 
+		target := message.Params[0]
+		for _, curClient := range c.Gateway.clientIndex.ClientsForTarget(c.UpstreamConfig.Hostname, target) {
 			// Only send the message on to either the target nick, or the clients in a set channel
-			if !strings.EqualFold(target, curClient.IrcState.Nick) && !curClient.IrcState.HasChannel(target) {
+			if curClient.IrcState.ISupport.IsChannel(target) {
+				if !curClient.IrcState.HasChannel(target) {
+					continue
+				}
+			} else if !curClient.IrcState.IsOwnNick(target) {
 				continue
 			}
 
@@ -394,8 +651,30 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 		return "", nil
 	}
 
-	// Check for any client message tags so that we can store them for replaying to other clients
-	if c.Features.Messagetags && c.Gateway.messageTags.CanMessageContainClientTags(message) {
+	command := strings.ToUpper(message.Command)
+	if command == "WHO" {
+		c.trackWhoxRequest(message)
+	}
+	if command == "LIST" && c.listFromCache(message) {
+		return "", nil
+	}
+	if (command == "PRIVMSG" || command == "NOTICE") && len(message.Params) >= 2 {
+		text := message.Params[1]
+		if !c.filterMessage(message) {
+			return "", nil
+		}
+		if message.Params[1] != text {
+			line = message.ToLine()
+		}
+	}
+
+	// Check for any client message tags so that we can store them for replaying to other clients.
+	// Identity tags are stored even if the client does not use message tags itself, and when the
+	// upstream passes client tags on natively they are the only ones kept back from it
+	if !c.Features.Messagetags && identityTagged {
+		c.storeIdentityTags(message)
+		line = message.ToLine()
+	} else if c.Features.Messagetags && c.Gateway.messageTags.CanMessageContainClientTags(message) {
 		c.Gateway.messageTags.AddTagsFromMessage(c, c.IrcState.Nick, message)
 		// Prevent any client tags heading upstream
 		for k := range message.Tags {
@@ -419,7 +698,7 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 			"iss":     c.UpstreamConfig.Hostname,
 			"sub":     c.IrcState.Nick,
 			"account": c.IrcState.Account,
-			"umodes":  []string{},
+			"umodes":  c.IrcState.UserModes(),
 
 			// Channel specific claims
 			"channel": "",
@@ -436,7 +715,10 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 		if tokenTarget == "" || tokenTarget == "*" {
 			tokenM.Params = append(tokenM.Params, "*")
 		} else {
-			targetChan := c.IrcState.GetChannel(tokenTarget)
+			var targetChan *irc.StateChannel
+			if c.IrcState.ISupport.IsChannel(tokenTarget) {
+				targetChan = c.IrcState.GetChannel(tokenTarget)
+			}
 			if targetChan == nil {
 				// Channel does not exist in IRC State, send so such channel message
 				failMessage := irc.Message{
@@ -457,6 +739,7 @@ func (c *Client) ProcessLineFromClient(line string) (string, error) {
 			for mode := range targetChan.Modes {
 				modes = append(modes, mode)
 			}
+			sort.Strings(modes)
 			tokenData["cmodes"] = modes
 		}
 
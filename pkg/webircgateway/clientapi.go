@@ -0,0 +1,163 @@
+package webircgateway
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Safe ways for plugins and other goroutines to interact with a client. Writing to the client
+// channels directly may block forever or panic once the client has started shutting down
+
+var (
+	// ErrClientNotFound - No connected client has the given ID
+	ErrClientNotFound = errors.New("client not found")
+	// ErrClientShuttingDown - The client is disconnecting and no longer accepts lines
+	ErrClientShuttingDown = errors.New("client is shutting down")
+	// ErrSendQueueFull - The client is not keeping up with the lines being sent to it
+	ErrSendQueueFull = errors.New("send queue is full")
+)
+
+// GetClient - Find a connected client by its ID
+func (s *Gateway) GetClient(id uint64) (*Client, bool) {
+	item, exists := s.Clients.Get(strconv.FormatUint(id, 10))
+	if !exists {
+		return nil, false
+	}
+	return item.(*Client), true
+}
+
+// AllClients - A snapshot of all connected clients
+func (s *Gateway) AllClients() []*Client {
+	clients := make([]*Client, 0, s.Clients.Count())
+	for item := range s.Clients.IterBuffered() {
+		clients = append(clients, item.Val.(*Client))
+	}
+	return clients
+}
+
+// ClientsByNick - A snapshot of the clients using nick on the network with the given hostname
+func (s *Gateway) ClientsByNick(network string, nick string) []*Client {
+	clients := []*Client{}
+	for c, clientNick := range s.clientIndex.NickClients(network, nick) {
+		// The index folds names with the widest casemapping so check against the networks own
+		if c.IrcState.ISupport.Equals(clientNick, nick) {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// ClientsByIP - A snapshot of the clients connecting from ip
+func (s *Gateway) ClientsByIP(ip string) []*Client {
+	parsedIP := net.ParseIP(ip)
+	clients := []*Client{}
+	for _, c := range s.AllClients() {
+		if c.RemoteAddr == ip || (parsedIP != nil && parsedIP.Equal(net.ParseIP(c.RemoteAddr))) {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// ClientsByUpstream - A snapshot of the clients connected to the IRC server with hostname host
+func (s *Gateway) ClientsByUpstream(host string) []*Client {
+	clients := []*Client{}
+	for _, c := range s.AllClients() {
+		if strings.EqualFold(c.UpstreamConfig.Hostname, host) {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// SendToClient - Send a raw IRC line to a client as if it came from the IRC server
+func (s *Gateway) SendToClient(id uint64, line string) error {
+	c, exists := s.GetClient(id)
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	return c.sendClientLine(line)
+}
+
+// SendToUpstream - Send a raw IRC line to the IRC server of a client as if the client sent it.
+// Lines sent before the upstream connection is made are queued until it is ready
+func (s *Gateway) SendToUpstream(id uint64, line string) error {
+	c, exists := s.GetClient(id)
+	if !exists {
+		return ErrClientNotFound
+	}
+
+	return c.sendUpstreamLine(line)
+}
+
+// CloseClient - Disconnect a client, showing it reason as an ERROR first if given
+func (s *Gateway) CloseClient(id uint64, reason string) error {
+	c, exists := s.GetClient(id)
+	if !exists {
+		return ErrClientNotFound
+	}
+	if c.IsShuttingDown() {
+		return ErrClientShuttingDown
+	}
+
+	if reason != "" {
+		c.SendIrcError(stripLineBreaks(reason))
+	}
+	c.SendClientSignal("state", "closed", "kicked")
+	c.StartShutdown("kicked")
+	return nil
+}
+
+func (c *Client) sendClientLine(line string) error {
+	line = stripLineBreaks(line)
+
+	if c.IsShuttingDown() {
+		return ErrClientShuttingDown
+	}
+	// Detached sessions buffer the line for replay and resumed sessions pass it to their relay
+	if c.divertClientSignal("data", []string{line}) {
+		return nil
+	}
+
+	c.shuttingDownLock.Lock()
+	defer c.shuttingDownLock.Unlock()
+
+	if c.shuttingDown {
+		return ErrClientShuttingDown
+	}
+
+	select {
+	case c.Signals <- ClientSignal{"data", line}:
+		c.captureTraffic("->Client", line)
+		return nil
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+func (c *Client) sendUpstreamLine(line string) error {
+	line = stripLineBreaks(line)
+
+	// Holding the lock stops the client from shutting down while the line is queued
+	c.shuttingDownLock.Lock()
+	defer c.shuttingDownLock.Unlock()
+
+	if c.shuttingDown {
+		return ErrClientShuttingDown
+	}
+
+	select {
+	case c.UpstreamSend <- line:
+		return nil
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+// stripLineBreaks - Stop a single line from being sent as multiple IRC lines
+func stripLineBreaks(line string) string {
+	return strings.NewReplacer("\r", "", "\n", " ").Replace(line)
+}
@@ -0,0 +1,229 @@
+package webircgateway
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// clientSet - Clients keyed by their ID
+type clientSet map[uint64]*Client
+
+// clientIndex - Connected clients indexed by network, nick and channel so that messages can be
+// routed to other clients without scanning every connected client. Names are folded with the
+// widest casemapping so lookups return candidates that should still be checked against the
+// clients own IRC state
+type clientIndex struct {
+	mu sync.RWMutex
+	// network > nick > clients
+	nicks map[string]map[string]clientSet
+	// network > channel > clients
+	channels map[string]map[string]clientSet
+	// What each client is currently indexed under so that it can be removed again
+	clientNetwork  map[uint64]string
+	clientNick     map[uint64]string
+	clientChannels map[uint64]map[string]bool
+	// The exact nick each client was last indexed with, as other goroutines may not read its
+	// IRC state
+	clientExactNick map[uint64]string
+	// account quota key > clients, for the per-account connection limit
+	accounts      map[string]clientSet
+	clientAccount map[uint64]string
+}
+
+func newClientIndex() *clientIndex {
+	return &clientIndex{
+		nicks:           make(map[string]map[string]clientSet),
+		channels:        make(map[string]map[string]clientSet),
+		clientNetwork:   make(map[uint64]string),
+		clientNick:      make(map[uint64]string),
+		clientChannels:  make(map[uint64]map[string]bool),
+		clientExactNick: make(map[uint64]string),
+		accounts:        make(map[string]clientSet),
+		clientAccount:   make(map[uint64]string),
+	}
+}
+
+func clientIndexNetwork(c *Client) string {
+	return strings.ToLower(c.UpstreamConfig.Hostname)
+}
+
+func clientIndexName(name string) string {
+	return irc.CaseFold(name, irc.CaseMappingRFC1459)
+}
+
+func indexAdd(index map[string]map[string]clientSet, network string, name string, c *Client) {
+	names, ok := index[network]
+	if !ok {
+		names = make(map[string]clientSet)
+		index[network] = names
+	}
+	clients, ok := names[name]
+	if !ok {
+		clients = make(clientSet)
+		names[name] = clients
+	}
+	clients[c.Id] = c
+}
+
+func indexRemove(index map[string]map[string]clientSet, network string, name string, c *Client) {
+	names, ok := index[network]
+	if !ok {
+		return
+	}
+	clients, ok := names[name]
+	if !ok {
+		return
+	}
+	delete(clients, c.Id)
+	if len(clients) == 0 {
+		delete(names, name)
+	}
+	if len(names) == 0 {
+		delete(index, network)
+	}
+}
+
+// SetNick - Index the client under its current nick on its network
+func (i *clientIndex) SetNick(c *Client, nick string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	network := clientIndexNetwork(c)
+	i.clientNetwork[c.Id] = network
+	if oldNick, ok := i.clientNick[c.Id]; ok {
+		indexRemove(i.nicks, network, oldNick, c)
+	}
+
+	name := clientIndexName(nick)
+	i.clientNick[c.Id] = name
+	i.clientExactNick[c.Id] = nick
+	indexAdd(i.nicks, network, name, c)
+}
+
+// AddChannel - Index the client as a member of channel
+func (i *clientIndex) AddChannel(c *Client, channel string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	network := clientIndexNetwork(c)
+	i.clientNetwork[c.Id] = network
+	name := clientIndexName(channel)
+	if i.clientChannels[c.Id] == nil {
+		i.clientChannels[c.Id] = make(map[string]bool)
+	}
+	i.clientChannels[c.Id][name] = true
+	indexAdd(i.channels, network, name, c)
+}
+
+// RemoveChannel - Remove the client from the members of channel
+func (i *clientIndex) RemoveChannel(c *Client, channel string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	name := clientIndexName(channel)
+	delete(i.clientChannels[c.Id], name)
+	indexRemove(i.channels, i.clientNetwork[c.Id], name, c)
+}
+
+// ClearChannels - Remove the client from all channels
+func (i *clientIndex) ClearChannels(c *Client) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.clearChannels(c)
+}
+
+func (i *clientIndex) clearChannels(c *Client) {
+	network := i.clientNetwork[c.Id]
+	for name := range i.clientChannels[c.Id] {
+		indexRemove(i.channels, network, name, c)
+	}
+	delete(i.clientChannels, c.Id)
+}
+
+// RemoveClient - Remove all entries for a client, eg. once it has disconnected
+func (i *clientIndex) RemoveClient(c *Client) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.clearChannels(c)
+	if nick, ok := i.clientNick[c.Id]; ok {
+		indexRemove(i.nicks, i.clientNetwork[c.Id], nick, c)
+	}
+	delete(i.clientNick, c.Id)
+	delete(i.clientExactNick, c.Id)
+	delete(i.clientNetwork, c.Id)
+	i.setAccount(c, "")
+}
+
+// SetAccount - Index the client under its account quota key, or remove it if key is empty. The
+// key is worked out by the client itself as other goroutines may not read its IRC state
+func (i *clientIndex) SetAccount(c *Client, key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.setAccount(c, key)
+}
+
+func (i *clientIndex) setAccount(c *Client, key string) {
+	if oldKey, ok := i.clientAccount[c.Id]; ok {
+		delete(i.accounts[oldKey], c.Id)
+		if len(i.accounts[oldKey]) == 0 {
+			delete(i.accounts, oldKey)
+		}
+		delete(i.clientAccount, c.Id)
+	}
+	if key == "" {
+		return
+	}
+
+	if i.accounts[key] == nil {
+		i.accounts[key] = make(clientSet)
+	}
+	i.accounts[key][c.Id] = c
+	i.clientAccount[c.Id] = key
+}
+
+// AccountClients - Clients indexed under an account quota key
+func (i *clientIndex) AccountClients(key string) []*Client {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	found := []*Client{}
+	for _, c := range i.accounts[key] {
+		found = append(found, c)
+	}
+	return found
+}
+
+// NickClients - Clients on network indexed under nick, with the exact nick each was indexed with
+func (i *clientIndex) NickClients(network string, nick string) map[*Client]string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	found := make(map[*Client]string)
+	for _, c := range i.nicks[strings.ToLower(network)][clientIndexName(nick)] {
+		found[c] = i.clientExactNick[c.Id]
+	}
+	return found
+}
+
+// ClientsForTarget - Clients on network using target as their nick or that are in the target channel
+func (i *clientIndex) ClientsForTarget(network string, target string) []*Client {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	network = strings.ToLower(network)
+	name := clientIndexName(target)
+	found := []*Client{}
+	for _, c := range i.nicks[network][name] {
+		found = append(found, c)
+	}
+	for _, c := range i.channels[network][name] {
+		if _, isNick := i.nicks[network][name][c.Id]; !isNick {
+			found = append(found, c)
+		}
+	}
+
+	return found
+}
@@ -0,0 +1,48 @@
+package webircgateway
+
+// clientStateTransitions - The states a client may move to from each state. Registering may go
+// back to connecting when registration is retried on another upstream, and a detached session
+// is connected again once it is resumed
+var clientStateTransitions = map[string][]string{
+	ClientStateIdle:        {ClientStateConnecting, ClientStateEnding},
+	ClientStateConnecting:  {ClientStateRegistering, ClientStateEnding},
+	ClientStateRegistering: {ClientStateConnected, ClientStateConnecting, ClientStateEnding},
+	ClientStateConnected:   {ClientStateDetached, ClientStateEnding},
+	ClientStateDetached:    {ClientStateConnected, ClientStateEnding},
+	ClientStateEnding:      {},
+}
+
+// State - The current state of the client. Safe to call from any goroutine
+func (c *Client) State() string {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.state
+}
+
+// setState - Move the client to a new state and dispatch the client.statechange hook. Returns
+// false if the client may not move to the state from its current state, eg. an upstream reply
+// arriving after the client started ending
+func (c *Client) setState(newState string) bool {
+	c.stateLock.Lock()
+	oldState := c.state
+	if oldState == newState {
+		c.stateLock.Unlock()
+		return true
+	}
+	if !stringInSlice(newState, clientStateTransitions[oldState]) {
+		c.stateLock.Unlock()
+		c.Log(1, "Ignoring state change from %s to %s", oldState, newState)
+		return false
+	}
+	c.state = newState
+	c.stateLock.Unlock()
+
+	c.Log(1, "State changed from %s to %s", oldState, newState)
+	hook := &HookClientStateChange{
+		Client:   c,
+		OldState: oldState,
+		NewState: newState,
+	}
+	hook.Dispatch("client.statechange")
+	return true
+}
@@ -0,0 +1,371 @@
+package webircgateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clusterDiscovery - Cluster peers that are not in [cluster.peers] but were found through the
+// announcements that instances with an advertise URL send to each other
+type clusterDiscovery struct {
+	mu    sync.Mutex
+	peers map[string]*discoveredPeer
+}
+
+type discoveredPeer struct {
+	// When the peer was first heard of from another instance
+	learned time.Time
+	// When the peer last announced itself to us or answered our announcement. Only peers heard
+	// from directly are passed on to others so that a peer that has gone is forgotten everywhere
+	seen time.Time
+}
+
+func newClusterDiscovery() *clusterDiscovery {
+	return &clusterDiscovery{peers: make(map[string]*discoveredPeer)}
+}
+
+// sawPeer - Record that a peer was heard from directly
+func (d *clusterDiscovery) sawPeer(peer string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := d.peers[peer]; ok {
+		existing.seen = now
+		return
+	}
+	d.peers[peer] = &discoveredPeer{learned: now, seen: now}
+}
+
+// learnPeer - Record a peer that another instance has heard from
+func (d *clusterDiscovery) learnPeer(peer string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.peers[peer]; !ok {
+		d.peers[peer] = &discoveredPeer{learned: time.Now()}
+	}
+}
+
+// livePeers - Forget the peers not heard of within ttl and return the rest. direct only returns
+// the peers that were heard from directly
+func (d *clusterDiscovery) livePeers(ttl time.Duration, direct bool) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	peers := []string{}
+	for peer, info := range d.peers {
+		if time.Since(info.learned) > ttl && time.Since(info.seen) > ttl {
+			delete(d.peers, peer)
+			continue
+		}
+		if direct && time.Since(info.seen) > ttl {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+// normalizePeerURL - Trim a peer URL so that the same peer is not listed twice
+func normalizePeerURL(peer string) string {
+	return strings.TrimRight(strings.TrimSpace(peer), "/")
+}
+
+func isValidPeerURL(peer string) bool {
+	peerURL, err := url.Parse(peer)
+	if err != nil {
+		return false
+	}
+	return (peerURL.Scheme == "http" || peerURL.Scheme == "https") && peerURL.Host != ""
+}
+
+// clusterPeerTTL - How long a discovered peer is kept without hearing from it
+func (s *Gateway) clusterPeerTTL() time.Duration {
+	return time.Second * time.Duration(s.Config.ClusterAnnounceInterval*3)
+}
+
+// clusterPeers - The configured and discovered cluster peers, without this instance
+func (s *Gateway) clusterPeers() []string {
+	return s.knownClusterPeers(false, false)
+}
+
+// knownClusterPeers - The configured and discovered cluster peers. direct only includes the
+// discovered peers that were heard from directly
+func (s *Gateway) knownClusterPeers(direct bool, includeSelf bool) []string {
+	self := s.Config.ClusterAdvertise
+	seen := make(map[string]bool)
+	peers := []string{}
+	add := func(peer string) {
+		peer = normalizePeerURL(peer)
+		if peer == "" || seen[peer] || (peer == self && !includeSelf) {
+			return
+		}
+		seen[peer] = true
+		peers = append(peers, peer)
+	}
+
+	for _, peer := range s.Config.ClusterPeers {
+		add(peer)
+	}
+	for _, peer := range s.clusterDiscovery.livePeers(s.clusterPeerTTL(), direct) {
+		add(peer)
+	}
+	if includeSelf && self != "" {
+		add(self)
+	}
+
+	return peers
+}
+
+func (s *Gateway) initClusterRoutes() {
+	// Peers POST url=<their advertise URL> to announce themselves. The response lists the peers
+	// known to this instance so that every instance finds all of the others
+	s.HttpRouter.HandleFunc("/webirc/_peers", func(w http.ResponseWriter, r *http.Request) {
+		if !isPrivateIP(s.GetRemoteAddressFromRequest(r)) || !isSameOriginRequest(r) {
+			w.WriteHeader(403)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			peer := normalizePeerURL(r.PostFormValue("url"))
+			if !isValidPeerURL(peer) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if peer != s.Config.ClusterAdvertise {
+				s.clusterDiscovery.sawPeer(peer)
+			}
+		}
+
+		out, _ := json.Marshal(s.knownClusterPeers(true, true))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	})
+}
+
+// startClusterAnnouncer - Periodically announce this instance to its cluster peers when it has an
+// advertise URL
+func (s *Gateway) startClusterAnnouncer() {
+	go func() {
+		for {
+			// Read the config each time so that it may be changed by reloading the config
+			interval := s.Config.ClusterAnnounceInterval
+			if s.Config.ClusterAdvertise == "" || interval <= 0 {
+				time.Sleep(time.Second * 5)
+				continue
+			}
+			s.announceToClusterPeers()
+			time.Sleep(time.Second * time.Duration(interval))
+		}
+	}()
+}
+
+// announceToClusterPeers - Announce this instance to every known peer and learn of their peers
+func (s *Gateway) announceToClusterPeers() {
+	self := s.Config.ClusterAdvertise
+	timeout := time.Second * time.Duration(s.Config.ClusterTimeout)
+
+	wg := sync.WaitGroup{}
+	for _, peer := range s.clusterPeers() {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			var peerPeers []string
+			err := s.runAux("cluster:"+peer, func() (err error) {
+				peerPeers, err = announceToPeer(peer, self, timeout)
+				return err
+			})
+			if err != nil {
+				s.Log(3, "Error announcing to cluster peer %s: %s", peer, err.Error())
+				return
+			}
+
+			s.clusterDiscovery.sawPeer(peer)
+			for _, peerPeer := range peerPeers {
+				peerPeer = normalizePeerURL(peerPeer)
+				if peerPeer != self && isValidPeerURL(peerPeer) {
+					s.clusterDiscovery.learnPeer(peerPeer)
+				}
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+// announceToPeer - Tell a peer webircgateway instance about this one and fetch the peers it knows
+func announceToPeer(peer string, self string, timeout time.Duration) ([]string, error) {
+	peersURL := peer + "/webirc/_peers"
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.PostForm(peersURL, url.Values{"url": {self}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	peers := []string{}
+	err = json.NewDecoder(resp.Body).Decode(&peers)
+	if err != nil {
+		return nil, err
+	}
+
+	return peers, nil
+}
+
+// clusterStatus - Collect the _status output from all known cluster peers
+func (s *Gateway) clusterStatus() string {
+	peers := s.clusterPeers()
+	results := make([]string, len(peers))
+	timeout := time.Second * time.Duration(s.Config.ClusterTimeout)
+
+	wg := sync.WaitGroup{}
+	for idx, peer := range peers {
+		wg.Add(1)
+		go func(idx int, peer string) {
+			defer wg.Done()
+			out := ""
+			err := s.runAux("cluster:"+peer, func() (err error) {
+				out, err = fetchPeerStatus(peer, timeout)
+				return err
+			})
+			if err != nil {
+				s.Log(3, "Error fetching status from cluster peer %s: %s", peer, err.Error())
+				return
+			}
+			results[idx] = out
+		}(idx, peer)
+	}
+	wg.Wait()
+
+	return strings.Join(results, "")
+}
+
+// fetchPeerStatus - Fetch the local client status lines from a peer webircgateway instance
+func fetchPeerStatus(peer string, timeout time.Duration) (string, error) {
+	// local=1 stops the peer from aggregating its own peers and looping back to us
+	statusURL := strings.TrimRight(peer, "/") + "/webirc/_status?local=1"
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(statusURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	out := string(body)
+	if out != "" && !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+
+	return out, nil
+}
+
+// ClusterStats - Client totals across this gateway and all of its cluster peers
+type ClusterStats struct {
+	Clients      int            `json:"clients"`
+	ClientStates map[string]int `json:"client_states"`
+	Upstreams    map[string]int `json:"upstreams"`
+	// The stats of each peer that responded, keyed by the peer URL
+	Peers map[string]*GatewayStats `json:"peers"`
+	// Peers that could not be reached
+	Unreachable []string `json:"unreachable"`
+}
+
+// clusterStats - Collect the stats from all known cluster peers and total them with local
+func (s *Gateway) clusterStats(local *GatewayStats) *ClusterStats {
+	peers := s.clusterPeers()
+	results := make([]*GatewayStats, len(peers))
+	timeout := time.Second * time.Duration(s.Config.ClusterTimeout)
+
+	wg := sync.WaitGroup{}
+	for idx, peer := range peers {
+		wg.Add(1)
+		go func(idx int, peer string) {
+			defer wg.Done()
+			var peerStats *GatewayStats
+			err := s.runAux("cluster:"+peer, func() (err error) {
+				peerStats, err = fetchPeerStats(peer, timeout)
+				return err
+			})
+			if err != nil {
+				s.Log(3, "Error fetching stats from cluster peer %s: %s", peer, err.Error())
+				return
+			}
+			results[idx] = peerStats
+		}(idx, peer)
+	}
+	wg.Wait()
+
+	cluster := &ClusterStats{
+		ClientStates: make(map[string]int),
+		Upstreams:    make(map[string]int),
+		Peers:        make(map[string]*GatewayStats),
+		Unreachable:  []string{},
+	}
+	addStats := func(stats *GatewayStats) {
+		cluster.Clients += stats.Clients
+		for state, count := range stats.ClientStates {
+			cluster.ClientStates[state] += count
+		}
+		for upstream, count := range stats.Upstreams {
+			cluster.Upstreams[upstream] += count
+		}
+	}
+
+	addStats(local)
+	for idx, peerStats := range results {
+		if peerStats == nil {
+			cluster.Unreachable = append(cluster.Unreachable, peers[idx])
+			continue
+		}
+		cluster.Peers[peers[idx]] = peerStats
+		addStats(peerStats)
+	}
+
+	return cluster
+}
+
+// fetchPeerStats - Fetch the local stats from a peer webircgateway instance
+func fetchPeerStats(peer string, timeout time.Duration) (*GatewayStats, error) {
+	statsURL := strings.TrimRight(peer, "/") + "/webirc/_stats"
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(statsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	stats := &GatewayStats{}
+	err = json.NewDecoder(resp.Body).Decode(stats)
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
@@ -1,6 +1,7 @@
 package webircgateway
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
 	"os"
@@ -8,8 +9,10 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gobwas/glob"
+	"golang.org/x/net/html/charset"
 	"gopkg.in/ini.v1"
 )
 
@@ -20,14 +23,98 @@ type ConfigUpstream struct {
 	Hostname             string
 	Port                 int
 	TLS                  bool
-	Timeout              int
-	Throttle             int
-	WebircPassword       string
-	ServerPassword       string
-	GatewayName          string
-	Proxy                *ConfigProxy
-	Protocol             string
-	LocalAddr            string
+	// Connect in plaintext then upgrade to TLS with the STARTTLS command
+	StartTLS bool
+	// The TLS server name (SNI) to send if different to Hostname
+	SNI      string
+	Timeout  int
+	Throttle int
+	// The number of lines that may be sent at once before the throttle applies
+	ThrottleBurst int
+	// How many lines each command counts as when throttling, keyed by uppercase command
+	ThrottleWeights map[string]int
+	// Throttle used before registration completes, 0 for unthrottled
+	RegistrationThrottle      int
+	RegistrationThrottleBurst int
+	WebircPassword            string
+	ServerPassword            string
+	GatewayName               string
+	Proxy                     *ConfigProxy
+	Protocol                  string
+	LocalAddr                 string
+	// The URL path of websocket upstreams, used when Protocol is ws or wss
+	WebsocketPath string
+	// The QUIT message sent when the client closes. Empty to not send one
+	SendQuitOnClientClose string
+	// Channels that every client is joined to once registered
+	Autojoin []string
+	// Replaces the NETWORK ISUPPORT token sent to clients
+	NetworkName string
+	// Extra ISUPPORT tokens sent to clients, eg. "BOUNCER" or "KEY=value"
+	ISupport []string
+	// The highest CAP LS version sent upstream, 0 for no limit
+	MaxCapVersion int
+	// Caps hidden from clients, and caps advertised to clients that the gateway ACKs itself
+	StripCaps []string
+	AddCaps   []string
+	// Encodings tried in order for lines from the IRC server that are not valid UTF-8
+	EncodingFallback []string
+	// Which client tags are sent in WEBIRC
+	WebircTags ConfigWebircTags
+	// Nicks whose presence is watched for every client, and how often ISON is polled for
+	// them in seconds when the IRCd does not support MONITOR
+	PresenceNicks    []string
+	PresenceInterval int
+	// Seconds to wait for the IRC server to complete registration, 0 to wait forever. With
+	// RegistrationRetry another upstream is tried before giving up
+	RegistrationTimeout int
+	RegistrationRetry   bool
+	// SASL login performed by the gateway for every client. The irc.sasl hook may set it per client
+	SaslMechanism string
+	SaslUsername  string
+	SaslPassword  string
+	// Client certificate presented in the TLS handshake, eg. for CertFP authentication. The
+	// irc.certificate hook may replace it per client
+	TLSCertFile    string
+	TLSKeyFile     string
+	TLSCertificate *tls.Certificate
+	// Seconds LIST replies are cached for and shared between clients on the network, 0 to disable
+	ListCacheTTL int
+	// Seconds ISON and USERHOST results are cached for and shared between clients on the network
+	NickCacheTTL int
+	// Only used by clients of this tenant when set
+	Tenant string
+	// Send the client address in a PROXY protocol header, v1 or v2. Empty to not send one
+	ProxyProtocol string
+	// ALPN protocols offered in the TLS handshake, in order of preference
+	ALPN []string
+	// How many clients this upstream gets compared to the others with the weighted strategy
+	Weight int
+	// Only clients from these ranges and with a matching Origin header may use this upstream. nil
+	// to allow any
+	AllowedClients []net.IPNet
+	AllowedOrigins []glob.Glob
+	// Seconds a browser client may be idle before it is marked as away, 0 to disable
+	AutoAway        int
+	AutoAwayMessage string
+}
+
+// TLSServerName - The server name to send in the TLS handshake. IP addresses are not sent
+func (u *ConfigUpstream) TLSServerName() string {
+	if u.SNI != "" {
+		return u.SNI
+	}
+	if net.ParseIP(u.Hostname) != nil {
+		return ""
+	}
+
+	return u.Hostname
+}
+
+// ConfigCapVersion - The highest CAP LS version for IRC servers matching a hostname pattern
+type ConfigCapVersion struct {
+	Match   glob.Glob
+	Version int
 }
 
 // ConfigServer - A web server config
@@ -39,51 +126,214 @@ type ConfigServer struct {
 	CertFile            string
 	KeyFile             string
 	LetsEncryptCacheDir string
+	// Answer http-01 challenges as well as tls-alpn-01
+	LetsEncryptHTTPChallenge bool
+	// Read a PROXY protocol header from reverse proxies connecting to tcp: servers
+	ProxyProtocol bool
 }
 
 type ConfigProxy struct {
-	Type      string
-	Hostname  string
-	Port      int
-	TLS       bool
-	Username  string
-	Interface string
+	Type     string
+	Hostname string
+	Port     int
+	TLS      bool
+	Username string
+	// Interface - The address the proxy connects out of. May be a comma separated list of
+	// addresses and CIDR ranges, with connections spread across them
+	Interface  string
+	interfaces []string
+	// A client certificate for proxies that require mutual TLS, and the CA to verify the proxy
+	// with instead of the system roots
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	// Secret - Shared with the proxy server to authenticate handshakes
+	Secret    string
+	tlsConfig *tls.Config
+}
+
+// ConfigProxyServer - Options for the kiwi proxy server that gateways may connect upstream through
+type ConfigProxyServer struct {
+	// Enabled - Run the proxy alongside the gateway. -run=proxy always runs it
+	Enabled     bool
+	ListenAddrs []string
+	CertFile    string
+	KeyFile     string
+	// ClientCAFile - Require gateways to connect with a TLS client certificate signed by this CA
+	ClientCAFile string
+	// Secret - Require handshakes to be signed with this shared secret
+	Secret string
+	// Usernames - The usernames allowed to use the proxy. Empty to allow all
+	Usernames []glob.Glob
+	// Destinations - Where the proxy may connect to. Empty to allow all
+	Destinations []ConfigProxyDestination
+	// IdentdRpc - Address of an identd RPC server to send idents to
+	IdentdRpc      string
+	LogConnections bool
+}
+
+// ConfigProxyDestination - A host and range of ports that the proxy may connect to
+type ConfigProxyDestination struct {
+	Host    glob.Glob
+	PortMin int
+	PortMax int
 }
 
 // Config - Config options for the running app
 type Config struct {
-	gateway               *Gateway
-	ConfigFile            string
-	LogLevel              int
-	Gateway               bool
-	GatewayName           string
-	GatewayWhitelist      []glob.Glob
-	GatewayThrottle       int
-	GatewayTimeout        int
-	GatewayWebircPassword map[string]string
-	GatewayProtocol       string
-	GatewayLocalAddr      string
-	Proxy                 ConfigServer
-	Upstreams             []ConfigUpstream
-	Servers               []ConfigServer
-	ServerTransports      []string
-	RemoteOrigins         []glob.Glob
-	ReverseProxies        []net.IPNet
-	Webroot               string
-	ClientRealname        string
-	ClientUsername        string
-	ClientHostname        string
-	Identd                bool
-	RequiresVerification  bool
-	SendQuitOnClientClose string
-	ReCaptchaURL          string
-	ReCaptchaSecret       string
-	ReCaptchaKey          string
-	Secret                string
-	Plugins               []string
-	DnsblServers          []string
+	gateway                 *Gateway
+	loaded                  bool
+	ConfigFile              string
+	LogLevel                int
+	Gateway                 bool
+	GatewayName             string
+	GatewayWhitelist        []glob.Glob
+	GatewayThrottle         int
+	GatewayThrottleBurst    int
+	GatewayThrottleWeights  map[string]int
+	GatewayRegThrottle      int
+	GatewayRegThrottleBurst int
+	GatewayStripCaps        []string
+	GatewayAddCaps          []string
+	GatewayEncodingFallback []string
+	GatewayTimeout          int
+	GatewayRegTimeout       int
+	GatewayListCacheTTL     int
+	GatewayNickCacheTTL     int
+	GatewayWebircPassword   map[string]string
+	GatewayMaxCapVersions   []ConfigCapVersion
+	GatewayProtocol         string
+	GatewayLocalAddr        string
+	Proxy                   ConfigProxyServer
+	Upstreams               []ConfigUpstream
+	Servers                 []ConfigServer
+	ServerTransports        []string
+	RemoteOrigins           []glob.Glob
+	ReverseProxies          []net.IPNet
+	RealIPHeader            string
+	RealIPHop               int
+	UpstreamPingInterval    int
+	UpstreamStrategy        string
+	Webroot                 string
+	ISupportTokens          []string
+	WelcomePrefix           string
+	WelcomeLines            []string
+	ClientRealname          string
+	ClientUsername          string
+	ClientHostname          string
+	ClientNickFallback      string
+	ClientNickFallbackMax   int
+	ClientNickFormat        string
+	ClientBlockedNicks      []glob.Glob
+	ClientCertFPDir         string
+	// Messages per second a client may send to a single target, 0 to disable
+	ClientTargetThrottle        float64
+	ClientTargetThrottleBurst   int
+	ClientTargetThrottlePenalty int
+	MaxConnectionsPerAccount    int
+	WebsocketBatchBytes         int
+	WebsocketBatchDelay         int
+	Identd                      bool
+	IdentdListen                []string
+	IdentdTimeout               int
+	IdentdMaxConnections        int
+	IdentdOS                    string
+	IdentdCharset               string
+	RequiresVerification        bool
+	VerifySkipIdentified        bool
+	VerifySaslGrace             int
+	VerifyHoldTimeout           int
+	VerifyAuthTokenSecret       string
+	SendQuitOnClientClose       string
+	ShutdownMessage             string
+	MaintenanceMessage          string
+	RunAsUser                   string
+	RunAsGroup                  string
+	ReCaptchaURL                string
+	ReCaptchaSecret             string
+	ReCaptchaKey                string
+	Secret                      string
+	Plugins                     []string
+	DnsblServers                []string
 	// DnsblAction - "deny" = deny the connection. "verify" = require verification
-	DnsblAction string
+	DnsblAction            string
+	ClusterAggregateStatus bool
+	MemoryMaxHeapMB        int
+	MemoryMaxRssMB         int
+	MemoryCheckInterval    int
+	MemoryShedIdle         int
+	MemoryShedBatch        int
+	ClusterTimeout         int
+	ClusterPeers           []string
+	ClusterAccountLimits   bool
+	ControlSocket          string
+	ControlSocketMode      os.FileMode
+	AdminUsername          string
+	AdminPassword          string
+	AdminDrainToken        string
+	WebhookUrls            []string
+	WebhookEvents          []string
+	WebhookSecret          string
+	WebhookTimeout         int
+	Filters                []ConfigFilter
+	// Upstream throttles that replace the upstream throttle depending on the clients status
+	ThrottleTiers         map[string]ConfigThrottleTier
+	ThrottleAdminAccounts []glob.Glob
+	// Client tags added to messages from the verified identity of the sender
+	IdentityTags []ConfigIdentityTag
+	// What is done with gateway commands such as HOST once the upstream connection has started,
+	// keyed by uppercase command
+	ReservedCommands map[string]string
+	// Origins of native app wrappers that are accepted alongside RemoteOrigins
+	NativeAppOrigins       []glob.Glob
+	NativeAppAllowNoOrigin bool
+	// Native app connections allowed from each address per minute, 0 for unlimited
+	NativeAppConnectRate  int
+	NativeAppConnectBurst int
+	// Limits on the outbound lookups made for clients, eg. DNSBL and webhooks. AuxJitter is in
+	// milliseconds and the backoffs in seconds
+	AuxMaxConcurrent int
+	AuxJitter        int
+	AuxBackoff       int
+	AuxBackoffMax    int
+	// Looks up per-user upstream secrets for clients with a verified identity
+	CredentialProvider CredentialProvider
+	// Seconds a session is kept for resuming after its client disconnects, 0 to disable
+	ResumeGrace       int
+	ResumeBufferLines int
+	// Bytes per second read from the upstream for each client, 0 for no limit
+	ClientDownstreamRate  int
+	ClientDownstreamBurst int
+	// Seconds clients are given to disconnect themselves when the gateway shuts down
+	ShutdownDrainTimeout int
+	// Sites served with their own upstreams and client settings
+	Tenants []ConfigTenant
+	// Milliseconds a hook callback may take before a slow hook warning is logged, 0 to disable
+	HookTimeBudget int
+	// Workers running async hook callbacks and the callbacks queued for them. Read at startup only
+	AsyncHookWorkers int
+	AsyncHookQueue   int
+	// Seconds a kiwiirc channel that sends heartbeats may go without one before it is treated as
+	// disconnected, 0 to only reply to heartbeats
+	HeartbeatTimeout int
+	// Seconds between health checks of the upstreams, 0 to disable. Upstreams are taken out of
+	// rotation after UpstreamHealthCheckFailures failed checks in a row
+	UpstreamHealthCheck         int
+	UpstreamHealthCheckTimeout  int
+	UpstreamHealthCheckFailures int
+	// Times a client tries another upstream after failing to connect, and the milliseconds waited
+	// before the first retry. The wait doubles with each retry
+	UpstreamRetries    int
+	UpstreamRetryDelay int
+	// "upgrade" connects to plaintext destinations given by clients with TLS instead, "deny"
+	// refuses them. "off" to connect as asked
+	GatewayForceUpstreamTLS string
+	// Only destinations in GatewayWhitelist are allowed, even when it is empty
+	GatewayDefaultDeny bool
+	// The URL cluster peers reach this instance at. When set, the instance announces itself to its
+	// peers every ClusterAnnounceInterval seconds and learns of the peers they know
+	ClusterAdvertise        string
+	ClusterAnnounceInterval int
 }
 
 func NewConfig(gateway *Gateway) *Config {
@@ -130,7 +380,7 @@ func (c *Config) Load() error {
 		configSrc = c.ConfigFile
 	}
 
-	cfg, err := ini.LoadSources(ini.LoadOptions{AllowBooleanKeys: true, SpaceBeforeInlineComment: true}, configSrc)
+	cfg, err := c.loadConfigSources(configSrc)
 	if err != nil {
 		return err
 	}
@@ -138,25 +388,108 @@ func (c *Config) Load() error {
 	// Clear the existing config
 	c.Gateway = false
 	c.GatewayWebircPassword = make(map[string]string)
-	c.Proxy = ConfigServer{}
-	c.Upstreams = []ConfigUpstream{}
+	c.GatewayMaxCapVersions = []ConfigCapVersion{}
+	c.ISupportTokens = []string{}
+	c.WelcomePrefix = ""
+	c.WelcomeLines = []string{}
+	c.Proxy = ConfigProxyServer{}
+	// Upstreams are swapped in once the whole config has loaded so that clients connecting
+	// during a reload never see a partial list. Existing clients keep their own copy
+	previousUpstreams := c.Upstreams
+	upstreams := []ConfigUpstream{}
 	c.Servers = []ConfigServer{}
 	c.ServerTransports = []string{}
 	c.RemoteOrigins = []glob.Glob{}
+	c.NativeAppOrigins = []glob.Glob{}
+	c.NativeAppAllowNoOrigin = true
+	c.NativeAppConnectRate = 0
+	c.NativeAppConnectBurst = 1
+	c.AuxMaxConcurrent = 50
+	c.AuxJitter = 0
+	c.AuxBackoff = 5
+	c.AuxBackoffMax = 300
 	c.GatewayWhitelist = []glob.Glob{}
 	c.ReverseProxies = []net.IPNet{}
+	c.RealIPHeader = "X-Forwarded-For"
+	c.RealIPHop = 0
+	c.UpstreamPingInterval = 0
+	c.UpstreamStrategy = "random"
 	c.Webroot = ""
 	c.ReCaptchaURL = ""
 	c.ReCaptchaSecret = ""
 	c.ReCaptchaKey = ""
 	c.RequiresVerification = false
+	c.VerifySkipIdentified = false
+	c.VerifySaslGrace = 0
+	c.VerifyHoldTimeout = 300
+	c.VerifyAuthTokenSecret = ""
 	c.Secret = ""
 	c.SendQuitOnClientClose = ""
 	c.ClientRealname = ""
 	c.ClientUsername = ""
 	c.ClientHostname = ""
+	c.ClientNickFallback = ""
+	c.ClientNickFallbackMax = 3
+	c.ClientNickFormat = ""
+	c.ClientBlockedNicks = []glob.Glob{}
+	c.ClientCertFPDir = ""
+	c.ClientTargetThrottle = 0
+	c.ClientTargetThrottleBurst = 5
+	c.ClientTargetThrottlePenalty = 0
+	c.MaxConnectionsPerAccount = 0
+	c.WebsocketBatchBytes = 0
+	c.WebsocketBatchDelay = 0
+	// As with upstreams, the credential provider is only replaced once the config has loaded so
+	// that a failed reload leaves the running one open
+	var credentialProvider CredentialProvider
+	c.ResumeGrace = 0
+	c.ResumeBufferLines = 200
+	c.ClientDownstreamRate = 0
+	c.ClientDownstreamBurst = 0
+	c.ShutdownDrainTimeout = 0
+	c.Tenants = []ConfigTenant{}
+	c.HookTimeBudget = 0
+	c.AsyncHookWorkers = 1
+	c.AsyncHookQueue = 10000
+	c.HeartbeatTimeout = 0
+	c.UpstreamHealthCheck = 0
+	c.UpstreamHealthCheckTimeout = 5
+	c.UpstreamHealthCheckFailures = 2
+	c.UpstreamRetries = 0
+	c.UpstreamRetryDelay = 500
+	c.GatewayForceUpstreamTLS = "off"
+	c.GatewayDefaultDeny = false
+	c.ClusterAdvertise = ""
+	c.ClusterAnnounceInterval = 30
 	c.DnsblServers = []string{}
 	c.DnsblAction = ""
+	c.IdentdListen = []string{":113"}
+	c.IdentdTimeout = 10
+	c.IdentdMaxConnections = 100
+	c.IdentdOS = "UNIX"
+	c.IdentdCharset = ""
+	c.MemoryMaxHeapMB = 0
+	c.MemoryMaxRssMB = 0
+	c.MemoryCheckInterval = 5
+	c.MemoryShedIdle = 0
+	c.MemoryShedBatch = 10
+	c.ClusterAggregateStatus = false
+	c.ClusterTimeout = 5
+	c.ClusterPeers = []string{}
+	c.ClusterAccountLimits = false
+	c.ControlSocket = ""
+	c.AdminUsername = ""
+	c.AdminPassword = ""
+	c.AdminDrainToken = ""
+	c.WebhookUrls = []string{}
+	c.WebhookEvents = []string{WebhookClientConnect, WebhookClientDisconnect, WebhookVerificationFailed}
+	c.WebhookSecret = ""
+	c.WebhookTimeout = 5
+	c.Filters = []ConfigFilter{}
+	c.ThrottleTiers = make(map[string]ConfigThrottleTier)
+	c.ThrottleAdminAccounts = []glob.Glob{}
+	c.IdentityTags = []ConfigIdentityTag{}
+	c.ReservedCommands = make(map[string]string)
 
 	for _, section := range cfg.Sections() {
 		if strings.Index(section.Name(), "DEFAULT") == 0 {
@@ -165,6 +498,7 @@ func (c *Config) Load() error {
 				c.gateway.Log(3, "Config option logLevel must be between 1-3. Setting default value of 3.")
 				c.LogLevel = 3
 			}
+			c.gateway.SetLogLevel(c.LogLevel)
 
 			c.Identd = section.Key("identd").MustBool(false)
 
@@ -176,6 +510,36 @@ func (c *Config) Load() error {
 
 			c.Secret = section.Key("secret").MustString("")
 			c.SendQuitOnClientClose = section.Key("send_quit_on_client_close").MustString("Connection closed")
+			c.ShutdownMessage = section.Key("shutdown_message").MustString("")
+			c.ShutdownDrainTimeout = section.Key("shutdown_drain_timeout").MustInt(0)
+			c.HookTimeBudget = section.Key("hook_time_budget").MustInt(500)
+			c.AsyncHookWorkers = section.Key("async_hook_workers").MustInt(1)
+			c.AsyncHookQueue = section.Key("async_hook_queue").MustInt(10000)
+			c.MaintenanceMessage = section.Key("maintenance_message").MustString("This gateway is down for maintenance, please try again later")
+			c.RunAsUser = section.Key("user").MustString("")
+			c.RunAsGroup = section.Key("group").MustString("")
+
+			c.RealIPHeader = section.Key("real_ip_header").MustString("X-Forwarded-For")
+			c.RealIPHop = section.Key("real_ip_hop").MustInt(0)
+			if c.RealIPHop < 0 {
+				c.gateway.Log(3, "Config option real_ip_hop must not be negative. Using the leftmost entry")
+				c.RealIPHop = 0
+			}
+
+			c.UpstreamPingInterval = section.Key("upstream_ping_interval").MustInt(0)
+			c.UpstreamStrategy = strings.ToLower(section.Key("upstream_strategy").MustString("random"))
+			if !stringInSlice(c.UpstreamStrategy, upstreamStrategies) {
+				c.gateway.Log(3, "Config option upstream_strategy must be one of %s. Using random", strings.Join(upstreamStrategies, ", "))
+				c.UpstreamStrategy = "random"
+			}
+			c.UpstreamHealthCheck = section.Key("upstream_health_check").MustInt(0)
+			c.UpstreamHealthCheckTimeout = section.Key("upstream_health_check_timeout").MustInt(5)
+			c.UpstreamHealthCheckFailures = section.Key("upstream_health_check_failures").MustInt(2)
+			if c.UpstreamHealthCheckFailures < 1 {
+				c.UpstreamHealthCheckFailures = 1
+			}
+			c.UpstreamRetries = section.Key("upstream_retries").MustInt(0)
+			c.UpstreamRetryDelay = section.Key("upstream_retry_delay").MustInt(500)
 		}
 
 		if section.Name() == "verify" {
@@ -186,6 +550,21 @@ func (c *Config) Load() error {
 				c.ReCaptchaSecret = captchaSecret
 			}
 			c.ReCaptchaURL = section.Key("recaptcha_url").MustString("https://www.google.com/recaptcha/api/siteverify")
+			c.VerifySkipIdentified = section.Key("skip_identified").MustBool(false)
+			c.VerifySaslGrace = section.Key("sasl_grace").MustInt(0)
+			c.VerifyHoldTimeout = section.Key("hold_timeout").MustInt(300)
+			c.VerifyAuthTokenSecret = section.Key("auth_token_secret").MustString("")
+		}
+
+		if section.Name() == "identd" {
+			listen := section.Key("listen").Strings(",")
+			if len(listen) > 0 {
+				c.IdentdListen = listen
+			}
+			c.IdentdTimeout = section.Key("timeout").MustInt(10)
+			c.IdentdMaxConnections = section.Key("max_connections").MustInt(100)
+			c.IdentdOS = section.Key("os").MustString("UNIX")
+			c.IdentdCharset = section.Key("charset").MustString("")
 		}
 
 		if section.Name() == "dnsbl" {
@@ -196,14 +575,121 @@ func (c *Config) Load() error {
 			c.DnsblServers = append(c.DnsblServers, section.KeyStrings()...)
 		}
 
+		if section.Name() == "memory" {
+			c.MemoryMaxHeapMB = section.Key("max_heap_mb").MustInt(0)
+			c.MemoryMaxRssMB = section.Key("max_rss_mb").MustInt(0)
+			c.MemoryCheckInterval = section.Key("check_interval").MustInt(5)
+			c.MemoryShedIdle = section.Key("shed_idle_after").MustInt(0)
+			c.MemoryShedBatch = section.Key("shed_batch").MustInt(10)
+		}
+
+		if section.Name() == "cluster" {
+			c.ClusterAggregateStatus = section.Key("aggregate_status").MustBool(false)
+			c.ClusterTimeout = section.Key("timeout").MustInt(5)
+			c.ClusterAccountLimits = section.Key("account_limits").MustBool(false)
+			c.ClusterAdvertise = normalizePeerURL(section.Key("advertise").MustString(""))
+			if c.ClusterAdvertise != "" && !isValidPeerURL(c.ClusterAdvertise) {
+				c.gateway.Log(3, "Config option advertise must be an http or https URL. Not announcing to cluster peers")
+				c.ClusterAdvertise = ""
+			}
+			c.ClusterAnnounceInterval = section.Key("announce_interval").MustInt(30)
+		}
+
+		if section.Name() == "cluster.peers" {
+			for _, peer := range section.KeyStrings() {
+				c.ClusterPeers = append(c.ClusterPeers, strings.Trim(peer, "\n"))
+			}
+		}
+
+		if section.Name() == "webhooks" {
+			c.WebhookSecret = confKeyAsString(section.Key("secret"), "")
+			c.WebhookTimeout = section.Key("timeout").MustInt(5)
+			events := section.Key("events").Strings(",")
+			if len(events) > 0 {
+				c.WebhookEvents = events
+			}
+		}
+
+		if section.Name() == "webhooks.urls" {
+			for _, url := range section.KeyStrings() {
+				c.WebhookUrls = append(c.WebhookUrls, strings.Trim(url, "\n"))
+			}
+		}
+
+		if section.Name() == "admin" {
+			c.AdminUsername = confKeyAsString(section.Key("username"), "admin")
+			c.AdminPassword = confKeyAsString(section.Key("password"), "")
+			c.AdminDrainToken = confKeyAsString(section.Key("drain_token"), "")
+		}
+
+		if section.Name() == "control" {
+			socketFile := confKeyAsString(section.Key("socket"), "")
+			if socketFile != "" {
+				c.ControlSocket = c.ResolvePath(socketFile)
+			}
+			rawMode := confKeyAsString(section.Key("socket_mode"), "")
+			mode, err := strconv.ParseInt(rawMode, 8, 32)
+			if err != nil {
+				mode = 0600
+			}
+			c.ControlSocketMode = os.FileMode(mode)
+		}
+
 		if section.Name() == "gateway" {
 			c.Gateway = section.Key("enabled").MustBool(false)
 			c.GatewayTimeout = section.Key("timeout").MustInt(10)
 			c.GatewayThrottle = section.Key("throttle").MustInt(2)
+			c.GatewayThrottleBurst = section.Key("throttle_burst").MustInt(1)
+			c.GatewayThrottleWeights = parseThrottleWeights(section.Key("throttle_weights").Strings(","))
+			c.GatewayRegThrottle = section.Key("registration_throttle").MustInt(0)
+			c.GatewayRegThrottleBurst = section.Key("registration_throttle_burst").MustInt(1)
+			c.GatewayRegTimeout = section.Key("registration_timeout").MustInt(60)
+			c.GatewayListCacheTTL = section.Key("list_cache").MustInt(0)
+			c.GatewayNickCacheTTL = section.Key("nick_cache").MustInt(0)
+			c.GatewayStripCaps = section.Key("strip_caps").Strings(",")
+			c.GatewayAddCaps = section.Key("add_caps").Strings(",")
+			c.GatewayEncodingFallback = c.parseEncodingList(section.Name(), section.Key("encoding_fallback").Strings(","))
 
 			validProtocols := []string{"tcp", "tcp4", "tcp6"}
 			c.GatewayProtocol = stringInSliceOrDefault(section.Key("protocol").MustString(""), "tcp", validProtocols)
 			c.GatewayLocalAddr = section.Key("localaddr").MustString("")
+			c.GatewayDefaultDeny = section.Key("default_deny").MustBool(false)
+			c.GatewayForceUpstreamTLS = stringInSliceOrDefault(section.Key("force_upstream_tls").MustString(""), "off", forceUpstreamTLSModes)
+		}
+
+		if section.Name() == "welcome" {
+			c.WelcomePrefix = section.Key("prefix").MustString("")
+		}
+
+		if section.Name() == "welcome.lines" {
+			for _, line := range section.KeyStrings() {
+				c.WelcomeLines = append(c.WelcomeLines, strings.Trim(line, "\n"))
+			}
+		}
+
+		if section.Name() == "isupport" {
+			for _, token := range section.KeyStrings() {
+				// Keys without a value are read as boolean true
+				value := section.Key(token).String()
+				if value != "" && value != "true" {
+					token += "=" + value
+				}
+				c.ISupportTokens = append(c.ISupportTokens, token)
+			}
+		}
+
+		if section.Name() == "gateway.max_cap_version" {
+			for _, hostMatch := range section.KeyStrings() {
+				match, err := glob.Compile(strings.ToLower(hostMatch))
+				if err != nil {
+					c.gateway.Log(3, "Config section gateway.max_cap_version has invalid match, "+hostMatch)
+					continue
+				}
+				c.GatewayMaxCapVersions = append(c.GatewayMaxCapVersions, ConfigCapVersion{
+					Match:   match,
+					Version: section.Key(hostMatch).MustInt(0),
+				})
+			}
 		}
 
 		if section.Name() == "gateway.webirc" {
@@ -212,10 +698,90 @@ func (c *Config) Load() error {
 			}
 		}
 
-		if strings.Index(section.Name(), "clients") == 0 {
+		if section.Name() == "throttle" {
+			for _, tier := range []string{ThrottleTierUnverified, ThrottleTierVerified, ThrottleTierAdmin} {
+				if section.HasKey(tier) {
+					c.ThrottleTiers[tier] = ConfigThrottleTier{
+						Throttle: section.Key(tier).MustInt(0),
+						Burst:    section.Key(tier + "_burst").MustInt(1),
+					}
+				}
+			}
+		}
+
+		if section.Name() == "throttle.admins" {
+			for _, account := range section.KeyStrings() {
+				match, err := glob.Compile(strings.ToLower(account))
+				if err != nil {
+					c.gateway.Log(3, "Config section throttle.admins has invalid match, "+account)
+					continue
+				}
+				c.ThrottleAdminAccounts = append(c.ThrottleAdminAccounts, match)
+			}
+		}
+
+		if section.Name() == "identity.tags" {
+			for _, tag := range section.KeyStrings() {
+				identityTag, valid := newConfigIdentityTag(tag, section.Key(tag).MustString(""))
+				if !valid {
+					c.gateway.Log(3, "Config section identity.tags has an invalid tag, "+tag)
+					continue
+				}
+				c.IdentityTags = append(c.IdentityTags, identityTag)
+			}
+		}
+
+		if section.Name() == "clients.blocked_nicks" {
+			for _, nick := range section.KeyStrings() {
+				match, err := glob.Compile(strings.ToLower(nick))
+				if err != nil {
+					c.gateway.Log(3, "Config section clients.blocked_nicks has invalid match, "+nick)
+					continue
+				}
+				c.ClientBlockedNicks = append(c.ClientBlockedNicks, match)
+			}
+		} else if section.Name() == "clients.reserved_commands" {
+			validPolicies := []string{ReservedCommandGateway, ReservedCommandForward, ReservedCommandReject}
+			for _, command := range section.KeyStrings() {
+				policy := strings.ToLower(section.Key(command).MustString(""))
+				if !stringInSlice(strings.ToUpper(command), reservedCommands) || !stringInSlice(policy, validPolicies) {
+					c.gateway.Log(3, "Config section clients.reserved_commands has an invalid entry, "+command)
+					continue
+				}
+				c.ReservedCommands[strings.ToUpper(command)] = policy
+			}
+		} else if strings.Index(section.Name(), "clients") == 0 {
 			c.ClientUsername = section.Key("username").MustString("")
 			c.ClientRealname = section.Key("realname").MustString("")
 			c.ClientHostname = section.Key("hostname").MustString("")
+			c.ClientNickFallback = section.Key("nick_fallback").MustString("")
+			c.ClientNickFallbackMax = section.Key("nick_fallback_attempts").MustInt(3)
+			c.ClientTargetThrottle = section.Key("target_throttle").MustFloat64(0)
+			c.ClientTargetThrottleBurst = section.Key("target_throttle_burst").MustInt(5)
+			// A limiter with no burst never allows a message through
+			if c.ClientTargetThrottleBurst < 1 {
+				c.ClientTargetThrottleBurst = 1
+			}
+			c.ClientTargetThrottlePenalty = section.Key("target_throttle_penalty").MustInt(0)
+			if certFPDir := confKeyAsString(section.Key("certfp_keys"), ""); certFPDir != "" {
+				c.ClientCertFPDir = c.ResolvePath(certFPDir)
+			}
+			c.MaxConnectionsPerAccount = section.Key("max_connections_per_account").MustInt(0)
+			c.WebsocketBatchBytes = section.Key("websocket_batch_bytes").MustInt(0)
+			c.WebsocketBatchDelay = section.Key("websocket_batch_delay").MustInt(0)
+			c.ResumeGrace = section.Key("resume_grace").MustInt(0)
+			c.ResumeBufferLines = section.Key("resume_buffer_lines").MustInt(200)
+			if c.ResumeBufferLines < 1 {
+				c.ResumeBufferLines = 1
+			}
+			c.HeartbeatTimeout = section.Key("heartbeat_timeout").MustInt(0)
+			c.ClientDownstreamRate = section.Key("downstream_rate").MustInt(0)
+			c.ClientDownstreamBurst = section.Key("downstream_burst").MustInt(0)
+			c.ClientNickFormat = section.Key("nick_format").MustString("")
+			if c.ClientNickFormat != "" && strings.Count(c.ClientNickFormat, "%n") != 1 {
+				c.gateway.Log(3, "Config option nick_format must contain %n exactly once")
+				c.ClientNickFormat = ""
+			}
 		}
 
 		if strings.Index(section.Name(), "fileserving") == 0 {
@@ -238,8 +804,11 @@ func (c *Config) Load() error {
 			server.CertFile = confKeyAsString(section.Key("cert"), "")
 			server.KeyFile = confKeyAsString(section.Key("key"), "")
 			server.LetsEncryptCacheDir = confKeyAsString(section.Key("letsencrypt_cache"), "")
+			server.LetsEncryptHTTPChallenge = confKeyAsBool(section.Key("letsencrypt_http_challenge"), true)
+			server.ProxyProtocol = confKeyAsBool(section.Key("proxy_protocol"), false)
 
 			if strings.HasSuffix(server.LetsEncryptCacheDir, ".cache") {
+				closeCredentialProvider(credentialProvider)
 				return errors.New("Syntax has changed. Please update letsencrypt_cache to a directory path (eg ./cache)")
 			}
 
@@ -247,17 +816,55 @@ func (c *Config) Load() error {
 		}
 
 		if section.Name() == "proxy" {
-			server := ConfigServer{}
-			server.LocalAddr = confKeyAsString(section.Key("bind"), "0.0.0.0")
-			server.Port = confKeyAsInt(section.Key("port"), 7999)
-			c.Proxy = server
+			c.Proxy.Enabled = section.Key("enabled").MustBool(false)
+			c.Proxy.Secret = confKeyAsString(section.Key("secret"), "")
+			c.Proxy.ClientCAFile = confKeyAsString(section.Key("client_ca"), "")
+			c.Proxy.ListenAddrs = []string{}
+			for _, addr := range strings.Split(confKeyAsString(section.Key("listen"), ""), ",") {
+				if addr = strings.TrimSpace(addr); addr != "" {
+					c.Proxy.ListenAddrs = append(c.Proxy.ListenAddrs, addr)
+				}
+			}
+			if len(c.Proxy.ListenAddrs) == 0 {
+				// bind and port were the only options before listen was added
+				bind := confKeyAsString(section.Key("bind"), "0.0.0.0")
+				port := confKeyAsInt(section.Key("port"), 7999)
+				c.Proxy.ListenAddrs = []string{net.JoinHostPort(bind, strconv.Itoa(port))}
+			}
+			c.Proxy.CertFile = confKeyAsString(section.Key("cert"), "")
+			c.Proxy.KeyFile = confKeyAsString(section.Key("key"), "")
+			c.Proxy.IdentdRpc = confKeyAsString(section.Key("identd_rpc"), "")
+			c.Proxy.LogConnections = section.Key("log_connections").MustBool(false)
+		}
+
+		if section.Name() == "proxy.usernames" {
+			for _, username := range section.KeyStrings() {
+				match, err := glob.Compile(username)
+				if err != nil {
+					c.gateway.Log(3, "Config section proxy.usernames has invalid match, "+username)
+					continue
+				}
+				c.Proxy.Usernames = append(c.Proxy.Usernames, match)
+			}
+		}
+
+		if section.Name() == "proxy.destinations" {
+			for _, destination := range section.KeyStrings() {
+				parsed, err := parseProxyDestination(destination)
+				if err != nil {
+					c.gateway.Log(3, "Config section proxy.destinations has invalid destination %s: %s", destination, err.Error())
+					continue
+				}
+				c.Proxy.Destinations = append(c.Proxy.Destinations, parsed)
+			}
 		}
 
 		if strings.Index(section.Name(), "upstream.") == 0 {
 			upstream := ConfigUpstream{}
 
-			validProtocols := []string{"tcp", "tcp4", "tcp6", "unix"}
+			validProtocols := []string{"tcp", "tcp4", "tcp6", "unix", "ws", "wss"}
 			upstream.Protocol = stringInSliceOrDefault(section.Key("protocol").MustString(""), "tcp", validProtocols)
+			upstream.WebsocketPath = section.Key("path").MustString("/")
 
 			hostname := section.Key("hostname").MustString("127.0.0.1")
 			if strings.HasPrefix(strings.ToLower(hostname), "unix:") {
@@ -267,10 +874,73 @@ func (c *Config) Load() error {
 				upstream.Hostname = hostname
 				upstream.Port = section.Key("port").MustInt(6667)
 				upstream.TLS = section.Key("tls").MustBool(false)
+				upstream.SNI = section.Key("sni").MustString("")
+				upstream.ALPN = section.Key("alpn").Strings(",")
+				upstream.StartTLS = section.Key("starttls").MustBool(false)
+				if upstream.StartTLS && upstream.TLS {
+					c.gateway.Log(3, "Config section %s has both tls and starttls set. Using tls", section.Name())
+					upstream.StartTLS = false
+				}
 			}
 
 			upstream.Timeout = section.Key("timeout").MustInt(10)
 			upstream.Throttle = section.Key("throttle").MustInt(2)
+			upstream.ThrottleBurst = section.Key("throttle_burst").MustInt(1)
+			upstream.ThrottleWeights = parseThrottleWeights(section.Key("throttle_weights").Strings(","))
+			upstream.RegistrationThrottle = section.Key("registration_throttle").MustInt(0)
+			upstream.RegistrationThrottleBurst = section.Key("registration_throttle_burst").MustInt(1)
+			upstream.RegistrationTimeout = section.Key("registration_timeout").MustInt(60)
+			upstream.RegistrationRetry = section.Key("registration_retry").MustBool(false)
+			upstream.ListCacheTTL = section.Key("list_cache").MustInt(0)
+			upstream.NickCacheTTL = section.Key("nick_cache").MustInt(0)
+			upstream.Tenant = section.Key("tenant").MustString("")
+			upstream.AutoAway = section.Key("auto_away").MustInt(0)
+			upstream.Weight = section.Key("weight").MustInt(1)
+			if upstream.Weight < 0 {
+				upstream.Weight = 0
+			}
+			// Set even if every entry is invalid so that the upstream stays restricted
+			if section.HasKey("allowed_clients") {
+				upstream.AllowedClients = []net.IPNet{}
+			}
+			if section.HasKey("allowed_origins") {
+				upstream.AllowedOrigins = []glob.Glob{}
+			}
+			for _, cidrRange := range section.Key("allowed_clients").Strings(",") {
+				_, validRange, cidrErr := net.ParseCIDR(cidrRange)
+				if cidrErr != nil {
+					c.gateway.Log(3, "Config section %s has invalid allowed_clients entry, %s", section.Name(), cidrRange)
+					continue
+				}
+				upstream.AllowedClients = append(upstream.AllowedClients, *validRange)
+			}
+			for _, origin := range section.Key("allowed_origins").Strings(",") {
+				match, err := glob.Compile(strings.ToLower(origin))
+				if err != nil {
+					c.gateway.Log(3, "Config section %s has invalid allowed_origins match, %s", section.Name(), origin)
+					continue
+				}
+				upstream.AllowedOrigins = append(upstream.AllowedOrigins, match)
+			}
+			upstream.AutoAwayMessage = section.Key("auto_away_message").MustString("Away")
+			upstream.ProxyProtocol = stringInSliceOrDefault(strings.ToLower(section.Key("proxy_protocol").MustString("")), "", []string{"v1", "v2"})
+			if upstream.ProxyProtocol != "" && (upstream.Protocol == "unix" || upstream.Protocol == "ws" || upstream.Protocol == "wss") {
+				c.gateway.Log(3, "Config section %s has proxy_protocol set but does not connect over TCP. proxy_protocol will not be used", section.Name())
+				upstream.ProxyProtocol = ""
+			}
+			upstream.SaslMechanism = strings.ToUpper(section.Key("sasl_mechanism").MustString(""))
+			upstream.SaslUsername = section.Key("sasl_username").MustString("")
+			upstream.SaslPassword = section.Key("sasl_password").MustString("")
+			upstream.TLSCertFile = confKeyAsString(section.Key("tls_cert"), "")
+			upstream.TLSKeyFile = confKeyAsString(section.Key("tls_key"), "")
+			if upstream.TLSCertFile != "" {
+				cert, err := c.loadUpstreamCertificate(upstream.TLSCertFile, upstream.TLSKeyFile)
+				if err != nil {
+					c.gateway.Log(3, "Config section %s has an invalid tls_cert. %s", section.Name(), err.Error())
+				} else {
+					upstream.TLSCertificate = cert
+				}
+			}
 			upstream.WebircPassword = section.Key("webirc").MustString("")
 			upstream.ServerPassword = section.Key("serverpassword").MustString("")
 			upstream.LocalAddr = section.Key("localaddr").MustString("")
@@ -281,9 +951,78 @@ func (c *Config) Load() error {
 				upstream.GatewayName = ""
 			}
 
+			// Set but empty disables the QUIT for this upstream
+			upstream.SendQuitOnClientClose = c.SendQuitOnClientClose
+			if section.HasKey("send_quit_on_client_close") {
+				upstream.SendQuitOnClientClose = section.Key("send_quit_on_client_close").String()
+			}
+
 			upstream.NetworkCommonAddress = section.Key("network_common_address").MustString("")
 
-			c.Upstreams = append(c.Upstreams, upstream)
+			if proxyAddr := confKeyAsString(section.Key("proxy"), ""); proxyAddr != "" {
+				proxyConfig, err := c.parseUpstreamProxy(proxyAddr, section)
+				if err != nil {
+					c.gateway.Log(3, "Config section %s has an invalid proxy. %s", section.Name(), err.Error())
+				} else {
+					upstream.Proxy = proxyConfig
+					if upstream.StartTLS {
+						c.gateway.Log(3, "Config section %s has starttls set but connects through a proxy. starttls will not be used", section.Name())
+					}
+					if upstream.ProxyProtocol != "" {
+						c.gateway.Log(3, "Config section %s has proxy_protocol set but connects through a proxy. proxy_protocol will not be used", section.Name())
+						upstream.ProxyProtocol = ""
+					}
+				}
+			}
+
+			upstream.MaxCapVersion = section.Key("max_cap_version").MustInt(0)
+			upstream.ISupport = section.Key("isupport").Strings(",")
+			upstream.NetworkName = section.Key("network_name").MustString("")
+			upstream.StripCaps = section.Key("strip_caps").Strings(",")
+			upstream.AddCaps = section.Key("add_caps").Strings(",")
+			upstream.EncodingFallback = c.parseEncodingList(section.Name(), section.Key("encoding_fallback").Strings(","))
+			upstream.WebircTags = c.parseWebircTags(
+				section.Name(),
+				section.Key("webirc_tags_allow").Strings(","),
+				section.Key("webirc_tags_deny").Strings(","),
+				section.Key("webirc_tags_rename").Strings(","),
+			)
+
+			upstream.PresenceNicks = section.Key("presence_nicks").Strings(",")
+			upstream.PresenceInterval = section.Key("presence_interval").MustInt(60)
+
+			for _, channel := range section.Key("autojoin").Strings(",") {
+				if channel != "" {
+					upstream.Autojoin = append(upstream.Autojoin, channel)
+				}
+			}
+
+			upstreams = append(upstreams, upstream)
+		}
+
+		if strings.Index(section.Name(), "tenant.") == 0 {
+			c.Tenants = append(c.Tenants, newConfigTenant(c, section))
+		}
+
+		if strings.Index(section.Name(), "filter.") == 0 {
+			filter := ConfigFilter{}
+			validActions := []string{FilterActionBlock, FilterActionReplace, FilterActionWarn}
+			filter.Action = stringInSliceOrDefault(section.Key("action").MustString(""), FilterActionBlock, validActions)
+			filter.Replacement = section.Key("replacement").MustString("***")
+			filter.Warning = section.Key("warning").MustString("")
+
+			match, err := newConfigFilterMatch(section.Key("words").Strings(","), section.Key("regex").MustString(""))
+			if err != nil {
+				c.gateway.Log(3, "Config section %s has an invalid regex. %s", section.Name(), err.Error())
+				continue
+			}
+			if match == nil {
+				c.gateway.Log(3, "Config section %s must have words or a regex", section.Name())
+				continue
+			}
+			filter.Match = match
+
+			c.Filters = append(c.Filters, filter)
 		}
 
 		// "engines" is now legacy naming
@@ -310,6 +1049,44 @@ func (c *Config) Load() error {
 			}
 		}
 
+		if section.Name() == "native_apps" {
+			c.NativeAppAllowNoOrigin = section.Key("allow_no_origin").MustBool(true)
+			c.NativeAppConnectRate = section.Key("connect_rate").MustInt(0)
+			c.NativeAppConnectBurst = section.Key("connect_burst").MustInt(1)
+			if c.NativeAppConnectBurst < 1 {
+				c.NativeAppConnectBurst = 1
+			}
+		}
+
+		if section.Name() == "credentials" {
+			provider, err := newConfigCredentialProvider(c, section)
+			if err != nil {
+				c.gateway.Log(3, "Config section credentials is invalid. %s", err.Error())
+			}
+			credentialProvider = provider
+		}
+
+		if section.Name() == "outbound" {
+			c.AuxMaxConcurrent = section.Key("max_concurrent").MustInt(50)
+			c.AuxJitter = section.Key("jitter").MustInt(0)
+			c.AuxBackoff = section.Key("backoff").MustInt(5)
+			c.AuxBackoffMax = section.Key("backoff_max").MustInt(300)
+			if c.AuxBackoffMax < c.AuxBackoff {
+				c.AuxBackoffMax = c.AuxBackoff
+			}
+		}
+
+		if section.Name() == "native_apps.origins" {
+			for _, origin := range section.KeyStrings() {
+				match, err := glob.Compile(strings.ToLower(origin))
+				if err != nil {
+					c.gateway.Log(3, "Config section native_apps.origins has invalid match, "+origin)
+					continue
+				}
+				c.NativeAppOrigins = append(c.NativeAppOrigins, match)
+			}
+		}
+
 		if strings.Index(section.Name(), "gateway.whitelist") == 0 {
 			for _, origin := range section.KeyStrings() {
 				match, err := glob.Compile(origin)
@@ -333,9 +1110,71 @@ func (c *Config) Load() error {
 		}
 	}
 
+	for _, upstream := range upstreams {
+		if upstream.Tenant != "" && !c.hasTenant(upstream.Tenant) {
+			c.gateway.Log(3, "Config upstream %s:%d belongs to tenant %s which is not configured", upstream.Hostname, upstream.Port, upstream.Tenant)
+		}
+	}
+
+	if c.Gateway && c.GatewayDefaultDeny && len(c.GatewayWhitelist) == 0 {
+		c.gateway.Log(3, "Config gateway default_deny is set with an empty gateway.whitelist, clients may not connect to any IRC network")
+	}
+
+	hookTimings.configure(c.gateway, time.Millisecond*time.Duration(c.HookTimeBudget))
+	asyncHooks.start(c.gateway, c.AsyncHookWorkers, c.AsyncHookQueue)
+
+	c.Upstreams = upstreams
+	previousProvider := c.CredentialProvider
+	c.CredentialProvider = credentialProvider
+	closeCredentialProvider(previousProvider)
+	if c.loaded {
+		for _, change := range c.gateway.upstreamChanges(previousUpstreams, upstreams) {
+			c.gateway.Log(2, "Config reload: %s", change)
+		}
+		c.gateway.ReloadCertificates()
+	}
+	c.loaded = true
+
 	return nil
 }
 
+// parseThrottleWeights - Parse a list of COMMAND:weight pairs
+func parseThrottleWeights(pairs []string) map[string]int {
+	weights := make(map[string]int)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		weight, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || weight < 0 {
+			continue
+		}
+		weights[strings.ToUpper(strings.TrimSpace(parts[0]))] = weight
+	}
+
+	return weights
+}
+
+// parseEncodingList - Trim and validate a list of encoding names, logging any that are unknown
+func (c *Config) parseEncodingList(sectionName string, names []string) []string {
+	encodings := []string{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if encoding, _ := charset.Lookup(name); encoding == nil {
+			c.gateway.Log(3, "Config section %s has unknown encoding %s", sectionName, name)
+			continue
+		}
+		encodings = append(encodings, name)
+	}
+
+	return encodings
+}
+
 func confKeyAsString(key *ini.Key, def string) string {
 	val := def
 
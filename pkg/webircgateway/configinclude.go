@@ -0,0 +1,94 @@
+package webircgateway
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// The directory next to the config file whose *.conf files are always loaded
+const configDropInDir = "conf.d"
+
+var configLoadOptions = ini.LoadOptions{AllowBooleanKeys: true, SpaceBeforeInlineComment: true}
+
+// loadConfigSources - Load the config along with any files it includes with the include key and
+// the *.conf files in the conf.d directory next to it. Later files add their own sections and
+// override keys of sections that were already loaded. Include paths are relative to the main
+// config file, including those in included files
+func (c *Config) loadConfigSources(configSrc interface{}) (*ini.File, error) {
+	cfg, err := ini.LoadSources(configLoadOptions, configSrc)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []string{}
+	if !strings.HasPrefix(c.ConfigFile, "$ ") {
+		dropIns, _ := filepath.Glob(filepath.Join(c.ResolvePath(configDropInDir), "*.conf"))
+		sort.Strings(dropIns)
+		pending = append(pending, dropIns...)
+	}
+	includes, err := c.configIncludes(cfg)
+	if err != nil {
+		return nil, err
+	}
+	pending = append(includes, pending...)
+
+	seen := make(map[string]bool)
+	if !strings.HasPrefix(c.ConfigFile, "$ ") {
+		seen[c.ConfigFile] = true
+	}
+	sources := []interface{}{}
+	for len(pending) > 0 {
+		file := pending[0]
+		pending = pending[1:]
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+
+		included, err := ini.LoadSources(configLoadOptions, file)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, file)
+
+		nested, err := c.configIncludes(included)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(nested, pending...)
+	}
+
+	if len(sources) == 0 {
+		return cfg, nil
+	}
+	c.gateway.Log(1, "Loading %d included config files", len(sources))
+	return ini.LoadSources(configLoadOptions, configSrc, sources...)
+}
+
+// configIncludes - The files matched by the comma separated paths or globs of the include key,
+// in sorted order. A path without a glob must exist
+func (c *Config) configIncludes(cfg *ini.File) ([]string, error) {
+	files := []string{}
+	for _, include := range cfg.Section("").Key("include").Strings(",") {
+		if include == "" {
+			continue
+		}
+
+		pattern := c.ResolvePath(include)
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 && !strings.ContainsAny(include, "*?[") {
+			return nil, errors.New("Config include " + include + " not found")
+		}
+
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
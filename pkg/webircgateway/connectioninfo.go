@@ -0,0 +1,154 @@
+package webircgateway
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ClientConnectionInfo - Details of a new connection, gathered by its transport before the
+// client is created
+type ClientConnectionInfo struct {
+	Transport string
+	// Request - The HTTP request the connection arrived with. nil for TCP connections
+	Request        *http.Request
+	RemoteAddr     string
+	RemoteHostname string
+	RemotePort     string
+	Secure         bool
+	Tags           map[string]string
+	// RequiresVerification - Ask the client for a captcha before connecting upstream
+	RequiresVerification bool
+	// Verified - Treat the client as already verified, skipping the captcha and DNSBL checks
+	Verified bool
+	// Tenant - The site the connection is for, if any
+	Tenant *ConfigTenant
+}
+
+// NewClientConnectionInfo - Gather the details of a new connection from remoteAddr, and its
+// HTTP request if it has one, then let plugins change them. Returns false if a plugin
+// rejected the connection
+func (s *Gateway) NewClientConnectionInfo(transport string, remoteAddr string, r *http.Request) (*ClientConnectionInfo, bool) {
+	info := &ClientConnectionInfo{
+		Transport:            transport,
+		Request:              r,
+		RemoteAddr:           remoteAddr,
+		Tags:                 make(map[string]string),
+		RequiresVerification: s.Config.RequiresVerification,
+	}
+	if remoteHost, remotePort, err := net.SplitHostPort(remoteAddr); err == nil {
+		info.RemoteAddr = remoteHost
+		info.RemotePort = remotePort
+	}
+
+	if r != nil {
+		info.RemoteAddr = s.GetRemoteAddressFromRequest(r).String()
+		info.Secure = s.isRequestSecure(r)
+		for name, val := range requestTags(r) {
+			info.Tags[name] = val
+		}
+
+		if !s.allowNativeAppConnection(r, info.RemoteAddr) {
+			return info, false
+		}
+
+		info.Tenant = s.requestTenant(r)
+		if info.Tenant != nil && info.Tenant.ReCaptchaSecret != "" {
+			info.RequiresVerification = info.Tenant.RequiresVerification
+		}
+	}
+
+	hook := &HookClientConnectionInfo{Info: info}
+	hook.Dispatch("client.connectioninfo")
+	if hook.Halt {
+		s.Log(2, "%s connection from %s rejected by a plugin", transport, info.RemoteAddr)
+		return info, false
+	}
+
+	if info.Tenant != nil && info.Tenant.MaxClients > 0 && s.tenantClientCount(info.Tenant.Name) >= info.Tenant.MaxClients {
+		s.Log(2, "%s connection from %s rejected, tenant %s has reached its limit of %d clients", transport, info.RemoteAddr, info.Tenant.Name, info.Tenant.MaxClients)
+		return info, false
+	}
+
+	if info.RemoteHostname == "" {
+		// Reverse DNS fails for many addresses so it is limited but never backed off
+		s.runAux("", func() error {
+			info.RemoteHostname = lookupHostname(info.RemoteAddr)
+			return nil
+		})
+	}
+
+	return info, true
+}
+
+// apply - Set up a newly created client from the connection details
+func (info *ClientConnectionInfo) apply(client *Client) {
+	client.RemoteAddr = info.RemoteAddr
+	client.RemoteHostname = info.RemoteHostname
+	client.RemotePort, _ = strconv.Atoi(info.RemotePort)
+	client.RequiresVerification = info.RequiresVerification
+	client.Verified = info.Verified
+	client.Tenant = info.Tenant
+	client.transport = info.Transport
+	if info.Request != nil {
+		client.origin = strings.ToLower(info.Request.Header.Get("Origin"))
+	}
+	client.Gateway.transportMetrics.clientStarted(info.Transport)
+
+	if info.Secure {
+		client.Tags["secure"] = ""
+	}
+	if info.RemotePort != "" {
+		client.Tags["remote-port"] = info.RemotePort
+	}
+	for name, val := range info.Tags {
+		client.Tags[name] = val
+	}
+}
+
+// applyQueryParams - Read the destination and encoding from the query string of the request
+// the client connected with, eg. ?host=irc.example.org:6697&tls=1&encoding=CP1252. Saves thin
+// clients from sending the HOST and ENCODING commands
+func (c *Client) applyQueryParams(r *http.Request) {
+	query := r.URL.Query()
+
+	// As with the HOST command, a destination is only accepted when acting as a public gateway
+	if host := query.Get("host"); host != "" && c.Gateway.Config.Gateway {
+		c.setDestination(host)
+
+		useTLS, err := strconv.ParseBool(query.Get("tls"))
+		// An explicit tls=0 is remembered as it is a mistake on a page loaded over https
+		c.destPlaintextRequested = err == nil && !useTLS
+		if useTLS && !c.DestTLS {
+			c.DestTLS = true
+			if !strings.Contains(host, ":") {
+				c.DestPort = 6697
+			}
+		}
+	}
+
+	if encoding := query.Get("encoding"); encoding != "" {
+		c.setEncoding(encoding)
+	}
+}
+
+// lookupHostname - The reverse DNS hostname of an address if it resolves back to the same
+// address, otherwise the address itself
+func lookupHostname(remoteAddr string) string {
+	clientHostnames, err := net.LookupAddr(remoteAddr)
+	if err != nil || len(clientHostnames) == 0 {
+		return remoteAddr
+	}
+
+	// FQDNs include a . at the end. Strip it out
+	potentialHostname := strings.Trim(clientHostnames[0], ".")
+
+	// Must check that the resolved hostname also resolves back to the users IP
+	addr, err := net.LookupIP(potentialHostname)
+	if err == nil && len(addr) == 1 && addr[0].String() == remoteAddr {
+		return potentialHostname
+	}
+
+	return remoteAddr
+}
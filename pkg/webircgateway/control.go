@@ -0,0 +1,341 @@
+package webircgateway
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ControlCommand - A command that can be run over the control socket. The returned string
+// is sent back to the caller
+type ControlCommand func(gateway *Gateway, args []string) (string, error)
+
+var controlCommands = make(map[string]ControlCommand)
+
+func init() {
+	ControlCommandRegister("help", controlHelp)
+	ControlCommandRegister("reload", controlReload)
+	ControlCommandRegister("stats", controlStats)
+	ControlCommandRegister("list-clients", controlListClients)
+	ControlCommandRegister("kick", controlKick)
+	ControlCommandRegister("set-loglevel", controlSetLogLevel)
+	ControlCommandRegister("drain", controlDrain)
+	ControlCommandRegister("broadcast", controlBroadcast)
+	ControlCommandRegister("maintenance", controlMaintenance)
+}
+
+// ControlCommandRegister - Make a command available over the control socket. Plugins may
+// use this to add their own commands
+func ControlCommandRegister(name string, cmd ControlCommand) {
+	controlCommands[strings.ToLower(name)] = cmd
+}
+
+func (s *Gateway) maybeStartControlSocket() {
+	socketFile := s.Config.ControlSocket
+	if socketFile == "" {
+		return
+	}
+
+	l, err := listenControlSocket(socketFile, s.Config.ControlSocketMode)
+	if err != nil {
+		s.Log(3, "Error starting control socket: %s", err.Error())
+		return
+	}
+
+	s.controlListener = l
+	s.controlSocketFile = socketFile
+	s.Log(2, "Control socket listening on %s", socketFile)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				break
+			}
+			go s.handleControlConn(conn)
+		}
+	}()
+}
+
+// ControlSocketFile - The path of the control socket, or an empty string if it is not listening
+func (s *Gateway) ControlSocketFile() string {
+	if s.controlListener == nil {
+		return ""
+	}
+	return s.controlSocketFile
+}
+
+// listenControlSocket - Listen on a unix socket with the given mode. The socket is made in a new
+// directory that only we can access and moved into place once its mode is set, so that it is
+// never reachable with the permissions given by the umask
+func listenControlSocket(socketFile string, mode os.FileMode) (net.Listener, error) {
+	privateDir, err := ioutil.TempDir(filepath.Dir(socketFile), ".control")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(privateDir)
+
+	privateSocket := filepath.Join(privateDir, "control.sock")
+	l, err := net.Listen("unix", privateSocket)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed from its final path when the gateway closes instead
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err = os.Chmod(privateSocket, mode)
+	if err == nil {
+		os.Remove(socketFile)
+		err = os.Rename(privateSocket, socketFile)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (s *Gateway) handleControlConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 30))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return
+	}
+
+	s.Log(2, "Control command: %s", strings.Join(args, " "))
+	out, err := s.RunControlCommand(args[0], args[1:])
+	if err != nil {
+		fmt.Fprintf(conn, "ERROR %s\n", err.Error())
+		return
+	}
+
+	fmt.Fprintf(conn, "OK\n%s", out)
+}
+
+// RunControlCommand - Run a control command as if it were sent over the control socket
+func (s *Gateway) RunControlCommand(name string, args []string) (string, error) {
+	cmd, exists := controlCommands[strings.ToLower(name)]
+	if !exists {
+		return "", fmt.Errorf("Unknown command '%s'", name)
+	}
+
+	return cmd(s, args)
+}
+
+// SendControlCommand - Send a command to a running gateways control socket and return its output
+func SendControlCommand(socketFile string, args []string) (string, error) {
+	conn, err := net.Dial("unix", socketFile)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "%s\n", strings.Join(args, " "))
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+
+	status := string(resp)
+	out := ""
+	if pos := strings.Index(status, "\n"); pos > -1 {
+		out = status[pos+1:]
+		status = status[:pos]
+	}
+
+	if strings.HasPrefix(status, "ERROR ") {
+		return "", errors.New(status[6:])
+	} else if status != "OK" {
+		return "", errors.New("Invalid response from the control socket")
+	}
+
+	return out, nil
+}
+
+func controlHelp(gateway *Gateway, args []string) (string, error) {
+	names := []string{}
+	for name := range controlCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return "Available commands: " + strings.Join(names, ", ") + "\n", nil
+}
+
+func controlReload(gateway *Gateway, args []string) (string, error) {
+	previousUpstreams := gateway.Config.Upstreams
+	err := gateway.Config.Load()
+	if err != nil {
+		return "", fmt.Errorf("Config file error: %s", err.Error())
+	}
+
+	out := "Config reloaded\n"
+	for _, change := range gateway.upstreamChanges(previousUpstreams, gateway.Config.Upstreams) {
+		out += change + "\n"
+	}
+	return out, nil
+}
+
+func controlStats(gateway *Gateway, args []string) (string, error) {
+	stats := gateway.Stats()
+
+	out := fmt.Sprintf("clients: %d\n", stats.Clients)
+	out += fmt.Sprintf("goroutines: %d\n", stats.Goroutines)
+	out += fmt.Sprintf("heap_inuse_kb: %d\n", stats.HeapInuseKB)
+	out += fmt.Sprintf("sys_kb: %d\n", stats.SysKB)
+	out += fmt.Sprintf("draining: %t\n", stats.Draining)
+	out += fmt.Sprintf("maintenance: %t\n", stats.Maintenance)
+	out += fmt.Sprintf("memory_pressure: %t\n", stats.MemoryPressure)
+	out += fmt.Sprintf("message_tags: %d\n", stats.MessageTags.Entries)
+	out += fmt.Sprintf("message_tags_hits: %d\n", stats.MessageTags.Hits)
+	out += fmt.Sprintf("message_tags_misses: %d\n", stats.MessageTags.Misses)
+
+	upstreams := make([]string, 0, len(stats.UpstreamLatencyMs))
+	for upstream := range stats.UpstreamLatencyMs {
+		upstreams = append(upstreams, upstream)
+	}
+	sort.Strings(upstreams)
+	for _, upstream := range upstreams {
+		out += fmt.Sprintf("upstream_latency_ms %s: %.1f\n", upstream, stats.UpstreamLatencyMs[upstream])
+	}
+
+	transports := make([]string, 0, len(stats.Transports))
+	for transport := range stats.Transports {
+		transports = append(transports, transport)
+	}
+	sort.Strings(transports)
+	for _, transport := range transports {
+		t := stats.Transports[transport]
+		out += fmt.Sprintf(
+			"transport %s: active=%d connections=%d upgrade_failures=%d origin_rejections=%d avg_session_s=%.1f\n",
+			transport,
+			t.Active,
+			t.Connections,
+			t.UpgradeFailures,
+			t.OriginRejections,
+			t.AvgSessionSeconds,
+		)
+	}
+	return out, nil
+}
+
+func controlListClients(gateway *Gateway, args []string) (string, error) {
+	out := ""
+	for _, c := range gateway.AllClients() {
+		out += fmt.Sprintf("%d %s\n", c.Id, gateway.clientStatusLine(c))
+	}
+
+	return out, nil
+}
+
+func controlKick(gateway *Gateway, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("Usage: kick <client id> [reason]")
+	}
+
+	item, exists := gateway.Clients.Get(args[0])
+	if !exists {
+		return "", fmt.Errorf("No client with ID %s", args[0])
+	}
+
+	reason := "Disconnected by an administrator"
+	if len(args) > 1 {
+		reason = strings.Join(args[1:], " ")
+	}
+
+	c := item.(*Client)
+	if err := gateway.CloseClient(c.Id, reason); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Client %d disconnected\n", c.Id), nil
+}
+
+func controlSetLogLevel(gateway *Gateway, args []string) (string, error) {
+	level, err := strconv.Atoi(strings.Join(args, ""))
+	if err != nil || level < 1 || level > 3 {
+		return "", errors.New("Usage: set-loglevel <1-3>")
+	}
+
+	gateway.SetLogLevel(level)
+	return fmt.Sprintf("Log level set to %d until the config is reloaded\n", level), nil
+}
+
+func controlDrain(gateway *Gateway, args []string) (string, error) {
+	gateway.Drain()
+	return fmt.Sprintf("Draining. %d clients still connected\n", gateway.Clients.Count()), nil
+}
+
+func controlMaintenance(gateway *Gateway, args []string) (string, error) {
+	switch strings.ToLower(strings.Join(args, "")) {
+	case "on":
+		gateway.SetMaintenance(true)
+	case "off":
+		gateway.SetMaintenance(false)
+	case "":
+	default:
+		return "", errors.New("Usage: maintenance [on|off]")
+	}
+
+	if gateway.IsInMaintenance() {
+		return "Maintenance mode is on\n", nil
+	}
+	return "Maintenance mode is off\n", nil
+}
+
+func controlBroadcast(gateway *Gateway, args []string) (string, error) {
+	usage := errors.New("Usage: broadcast [-error] [-upstream <host>] [-nick <nick>] <message>")
+	broadcastType := BroadcastNotice
+	filter := BroadcastFilter{}
+
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "-error":
+			broadcastType = BroadcastError
+			args = args[1:]
+		case "-upstream", "-nick":
+			if len(args) < 2 {
+				return "", usage
+			}
+			if args[0] == "-upstream" {
+				filter.Upstream = args[1]
+			} else {
+				filter.Nick = args[1]
+			}
+			args = args[2:]
+		default:
+			return "", usage
+		}
+	}
+
+	if len(args) == 0 {
+		return "", usage
+	}
+
+	sent, err := gateway.Broadcast(broadcastType, strings.Join(args, " "), filter)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Sent to %d clients\n", sent), nil
+}
@@ -0,0 +1,320 @@
+package webircgateway
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+const (
+	// CredentialProviderFile - Credentials read from an ini file with a section for each account
+	CredentialProviderFile = "file"
+	// CredentialProviderHTTP - Credentials fetched as JSON from a URL
+	CredentialProviderHTTP = "http"
+	// CredentialProviderSQL - Credentials read with an SQL query. The database driver must be
+	// compiled in or registered by a plugin
+	CredentialProviderSQL = "sql"
+)
+
+// UpstreamCredentials - Secrets used on the upstream for a single user. Empty fields leave the
+// upstream config as it is
+type UpstreamCredentials struct {
+	SaslMechanism    string `json:"sasl_mechanism"`
+	SaslUsername     string `json:"sasl_username"`
+	SaslPassword     string `json:"sasl_password"`
+	NickservPassword string `json:"nickserv_password"`
+	ServerPassword   string `json:"server_password"`
+}
+
+// CredentialProvider - Looks up the upstream credentials for users with a verified identity
+type CredentialProvider interface {
+	// Credentials - The credentials of the account on the upstream, nil if there are none
+	Credentials(identity *ClientIdentity, upstream *ConfigUpstream) (*UpstreamCredentials, error)
+}
+
+// SetCredentialProvider - Use a credential provider from a plugin. It is asked before the one in
+// the config. nil to remove it
+func (s *Gateway) SetCredentialProvider(provider CredentialProvider) {
+	s.credentialProviderMu.Lock()
+	s.credentialProvider = provider
+	s.credentialProviderMu.Unlock()
+}
+
+// upstreamCredentials - Ask the plugin and configured credential providers for the credentials
+// of an identity
+func (s *Gateway) upstreamCredentials(identity *ClientIdentity, upstream *ConfigUpstream) (*UpstreamCredentials, error) {
+	s.credentialProviderMu.Lock()
+	providers := []CredentialProvider{s.credentialProvider, s.Config.CredentialProvider}
+	s.credentialProviderMu.Unlock()
+
+	for _, provider := range providers {
+		if provider == nil {
+			continue
+		}
+		creds, err := provider.Credentials(identity, upstream)
+		if err != nil || creds != nil {
+			return creds, err
+		}
+	}
+	return nil, nil
+}
+
+// applyUserCredentials - Replace the secrets in the clients copy of the upstream config with the
+// users own, if it has a verified identity and a credential provider has some for it
+func (c *Client) applyUserCredentials(upstreamConfig *ConfigUpstream) {
+	c.nickservPassword = ""
+	if c.Identity == nil || c.Identity.Account == "" {
+		return
+	}
+
+	creds, err := c.Gateway.upstreamCredentials(c.Identity, upstreamConfig)
+	if err != nil {
+		c.Log(3, "Error looking up the upstream credentials of %s: %s", c.Identity.Account, err.Error())
+		return
+	}
+	if creds == nil {
+		return
+	}
+
+	c.Log(1, "Using the upstream credentials of %s", c.Identity.Account)
+	if creds.SaslUsername != "" {
+		upstreamConfig.SaslMechanism = strings.ToUpper(creds.SaslMechanism)
+		upstreamConfig.SaslUsername = creds.SaslUsername
+		upstreamConfig.SaslPassword = creds.SaslPassword
+	} else if strings.ToUpper(creds.SaslMechanism) == SaslMechanismExternal {
+		upstreamConfig.SaslMechanism = SaslMechanismExternal
+	}
+	if creds.ServerPassword != "" {
+		upstreamConfig.ServerPassword = creds.ServerPassword
+	}
+	c.nickservPassword = creds.NickservPassword
+}
+
+// identifyWithNickserv - Identify to NickServ with the users own password once registered
+func (c *Client) identifyWithNickserv() {
+	if c.nickservPassword == "" || c.upstream == nil {
+		return
+	}
+
+	c.Log(1, "->upstream: PRIVMSG NickServ :IDENTIFY <credentials>")
+	c.writeUpstream("PRIVMSG NickServ :IDENTIFY " + c.nickservPassword)
+	c.nickservPassword = ""
+}
+
+// newConfigCredentialProvider - Make the credential provider set in the [credentials] section
+func newConfigCredentialProvider(c *Config, section *ini.Section) (CredentialProvider, error) {
+	switch strings.ToLower(section.Key("provider").MustString("")) {
+	case "":
+		return nil, nil
+
+	case CredentialProviderFile:
+		file := confKeyAsString(section.Key("file"), "")
+		if file == "" {
+			return nil, errors.New("file must be set")
+		}
+		return &fileCredentialProvider{path: c.ResolvePath(file)}, nil
+
+	case CredentialProviderHTTP:
+		lookupURL := section.Key("url").MustString("")
+		if lookupURL == "" {
+			return nil, errors.New("url must be set")
+		}
+		return &httpCredentialProvider{
+			gateway: c.gateway,
+			url:     lookupURL,
+			secret:  section.Key("secret").MustString(""),
+			timeout: time.Second * time.Duration(section.Key("timeout").MustInt(5)),
+		}, nil
+
+	case CredentialProviderSQL:
+		query := section.Key("query").MustString("")
+		if query == "" {
+			return nil, errors.New("query must be set")
+		}
+		args := section.Key("query_args").Strings(",")
+		if len(args) == 0 {
+			args = []string{"account"}
+		}
+		for _, arg := range args {
+			if arg != "account" && arg != "hostname" {
+				return nil, fmt.Errorf("unknown query_args value %s", arg)
+			}
+		}
+		db, err := sql.Open(section.Key("driver").MustString(""), section.Key("dsn").MustString(""))
+		if err != nil {
+			return nil, err
+		}
+		return &sqlCredentialProvider{
+			db:      db,
+			query:   query,
+			args:    args,
+			timeout: time.Second * time.Duration(section.Key("timeout").MustInt(5)),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown provider %s", section.Key("provider").String())
+	}
+}
+
+// closeCredentialProvider - Release anything held by a provider that is being replaced
+func closeCredentialProvider(provider CredentialProvider) {
+	if sqlProvider, ok := provider.(*sqlCredentialProvider); ok {
+		sqlProvider.db.Close()
+	}
+}
+
+// fileCredentialProvider - Reads credentials from an ini file with a section for each account.
+// A section named account@upstream-hostname is used before the accounts own section. The file
+// is read again whenever it changes
+type fileCredentialProvider struct {
+	path     string
+	mu       sync.Mutex
+	modified time.Time
+	file     *ini.File
+}
+
+func (p *fileCredentialProvider) Credentials(identity *ClientIdentity, upstream *ConfigUpstream) (*UpstreamCredentials, error) {
+	file, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{identity.Account + "@" + upstream.Hostname, identity.Account} {
+		section, err := file.GetSection(name)
+		if err != nil {
+			continue
+		}
+		return &UpstreamCredentials{
+			SaslMechanism:    section.Key("sasl_mechanism").MustString(""),
+			SaslUsername:     section.Key("sasl_username").MustString(""),
+			SaslPassword:     section.Key("sasl_password").MustString(""),
+			NickservPassword: section.Key("nickserv_password").MustString(""),
+			ServerPassword:   section.Key("server_password").MustString(""),
+		}, nil
+	}
+	return nil, nil
+}
+
+func (p *fileCredentialProvider) load() (*ini.File, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return nil, err
+	}
+	if p.file != nil && info.ModTime().Equal(p.modified) {
+		return p.file, nil
+	}
+
+	file, err := ini.LoadSources(ini.LoadOptions{AllowBooleanKeys: true, SpaceBeforeInlineComment: true}, p.path)
+	if err != nil {
+		return nil, err
+	}
+	p.file = file
+	p.modified = info.ModTime()
+	return file, nil
+}
+
+// httpCredentialProvider - Fetches credentials as JSON from a URL. %a in the URL is replaced with
+// the account and %h with the upstream hostname. A 404 response means there are none
+type httpCredentialProvider struct {
+	gateway *Gateway
+	url     string
+	secret  string
+	timeout time.Duration
+}
+
+func (p *httpCredentialProvider) Credentials(identity *ClientIdentity, upstream *ConfigUpstream) (*UpstreamCredentials, error) {
+	lookupURL := strings.Replace(p.url, "%a", url.QueryEscape(identity.Account), -1)
+	lookupURL = strings.Replace(lookupURL, "%h", url.QueryEscape(upstream.Hostname), -1)
+
+	var creds *UpstreamCredentials
+	err := p.gateway.runAux("credentials:"+p.url, func() error {
+		req, err := http.NewRequest("GET", lookupURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", "webircgateway/"+Version)
+		if p.secret != "" {
+			req.Header.Set("Authorization", "Bearer "+p.secret)
+		}
+
+		client := &http.Client{Timeout: p.timeout}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected response status %d", resp.StatusCode)
+		}
+
+		creds = &UpstreamCredentials{}
+		return json.NewDecoder(resp.Body).Decode(creds)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// sqlCredentialProvider - Reads credentials with a query that selects the SASL mechanism, SASL
+// username, SASL password, NickServ password and server password. Its parameters are the account
+// and or upstream hostname in the order given by args. NULL columns are left empty. The query is
+// cancelled after timeout so a slow database cannot hold up the client's connection
+type sqlCredentialProvider struct {
+	db      *sql.DB
+	query   string
+	args    []string
+	timeout time.Duration
+}
+
+func (p *sqlCredentialProvider) Credentials(identity *ClientIdentity, upstream *ConfigUpstream) (*UpstreamCredentials, error) {
+	queryArgs := make([]interface{}, len(p.args))
+	for idx, arg := range p.args {
+		queryArgs[idx] = identity.Account
+		if arg == "hostname" {
+			queryArgs[idx] = upstream.Hostname
+		}
+	}
+
+	var mechanism, saslUsername, saslPassword, nickservPassword, serverPassword sql.NullString
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	err := p.db.QueryRowContext(ctx, p.query, queryArgs...).Scan(
+		&mechanism,
+		&saslUsername,
+		&saslPassword,
+		&nickservPassword,
+		&serverPassword,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &UpstreamCredentials{
+		SaslMechanism:    mechanism.String,
+		SaslUsername:     saslUsername.String,
+		SaslPassword:     saslPassword.String,
+		NickservPassword: nickservPassword.String,
+		ServerPassword:   serverPassword.String,
+	}, nil
+}
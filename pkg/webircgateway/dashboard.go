@@ -0,0 +1,207 @@
+package webircgateway
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func (s *Gateway) initDashboardRoutes() {
+	s.HttpRouter.HandleFunc("/webirc/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkAdminAuth(w, r) {
+			return
+		}
+
+		stats := s.Stats()
+		if s.Config.ClusterAggregateStatus {
+			stats.Cluster = s.clusterStats(stats)
+		}
+
+		out, _ := json.Marshal(stats)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	})
+
+	// The local stats, for cluster peers aggregating their admin stats
+	s.HttpRouter.HandleFunc("/webirc/_stats", func(w http.ResponseWriter, r *http.Request) {
+		if !isPrivateIP(s.GetRemoteAddressFromRequest(r)) {
+			w.WriteHeader(403)
+			return
+		}
+
+		out, _ := json.Marshal(s.Stats())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	})
+
+	s.HttpRouter.HandleFunc("/webirc/admin/dashboard", func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkAdminAuth(w, r) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(dashboardHTML))
+	})
+
+	// POST message=<text>, optionally type=error, upstream=<host glob> and nick=<nick glob>
+	s.HttpRouter.HandleFunc("/webirc/admin/broadcast", func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkAdminAuth(w, r) {
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Browsers send basic auth credentials along with requests from any page, so another site
+		// could otherwise make a logged in admin send a broadcast
+		if !isSameOriginRequest(r) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Cross origin requests are not allowed"))
+			return
+		}
+
+		broadcastType := r.FormValue("type")
+		if broadcastType == "" {
+			broadcastType = BroadcastNotice
+		}
+		filter := BroadcastFilter{
+			Upstream: r.FormValue("upstream"),
+			Nick:     r.FormValue("nick"),
+		}
+
+		sent, err := s.Broadcast(broadcastType, r.FormValue("message"), filter)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		out, _ := json.Marshal(map[string]interface{}{
+			"sent": sent,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	})
+}
+
+// checkAdminAuth - Require HTTP basic auth matching the [admin] config. Writes an error
+// response and returns false if the request is not allowed
+func (s *Gateway) checkAdminAuth(w http.ResponseWriter, r *http.Request) bool {
+	// No password = admin pages disabled
+	if s.Config.AdminPassword == "" {
+		w.WriteHeader(404)
+		return false
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if ok &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(s.Config.AdminUsername)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(s.Config.AdminPassword)) == 1 {
+		return true
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="webircgateway"`)
+	w.WriteHeader(401)
+	return false
+}
+
+// isSameOriginRequest - Check that a request made by a browser came from a page on this host.
+// The Origin header is used, or Referer when a browser does not send it. Requests with neither,
+// eg. from curl, are not made by a page
+func isSameOriginRequest(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+
+	sourceURL, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	return sourceURL.Host != "" && strings.EqualFold(sourceURL.Host, r.Host)
+}
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>webircgateway</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+h2 { font-size: 1.1em; margin-top: 1.5em; }
+table { border-collapse: collapse; }
+td, th { padding: 4px 12px; border-bottom: 1px solid #ddd; text-align: left; }
+.big { font-size: 2em; font-weight: bold; }
+.box { display: inline-block; margin-right: 3em; }
+.errors { font-family: monospace; font-size: 0.9em; white-space: pre-wrap; }
+.draining { color: #b00; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>webircgateway <span id="draining" class="draining"></span></h1>
+<div>
+	<div class="box"><div class="big" id="clients">-</div>clients</div>
+	<div class="box"><div class="big" id="heap">-</div>heap in use</div>
+	<div class="box"><div class="big" id="sys">-</div>memory from OS</div>
+	<div class="box"><div class="big" id="goroutines">-</div>goroutines</div>
+</div>
+<h2>Client states</h2>
+<table id="states"></table>
+<h2>Upstreams</h2>
+<table id="upstreams"></table>
+<h2>Recent errors</h2>
+<div class="errors" id="errors"></div>
+<script>
+function text(id, val) {
+	document.getElementById(id).textContent = val;
+}
+function table(id, obj) {
+	var el = document.getElementById(id);
+	el.innerHTML = '';
+	Object.keys(obj).sort().forEach(function(key) {
+		var tr = document.createElement('tr');
+		var name = document.createElement('td');
+		var count = document.createElement('td');
+		name.textContent = key;
+		count.textContent = obj[key];
+		tr.appendChild(name);
+		tr.appendChild(count);
+		el.appendChild(tr);
+	});
+}
+function kb(val) {
+	return (val / 1024).toFixed(1) + 'MB';
+}
+function update() {
+	var xhr = new XMLHttpRequest();
+	xhr.open('GET', 'stats');
+	xhr.onload = function() {
+		if (xhr.status !== 200) {
+			return;
+		}
+		var stats = JSON.parse(xhr.responseText);
+		text('clients', stats.clients);
+		text('heap', kb(stats.heap_inuse_kb));
+		text('sys', kb(stats.sys_kb));
+		text('goroutines', stats.goroutines);
+		text('draining', stats.draining ? '(draining)' : stats.maintenance ? '(maintenance)' : stats.memory_pressure ? '(low memory)' : '');
+		table('states', stats.client_states);
+		table('upstreams', stats.upstreams);
+		text('errors', (stats.recent_errors || []).slice().reverse().join('\n') || 'None');
+	};
+	xhr.send();
+}
+update();
+setInterval(update, 5000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,48 @@
+package webircgateway
+
+import "github.com/kiwiirc/webircgateway/pkg/irc"
+
+// Codes sent in FAIL messages for failures on the gateway side, so that clients can show their
+// own localized and actionable messages instead of the text of the ERROR that follows
+const (
+	FailNoUpstream          = "NO_UPSTREAM"
+	FailForbiddenHost       = "FORBIDDEN_HOST"
+	FailMissingHost         = "MISSING_HOST"
+	FailDnsblBlocked        = "DNSBL_BLOCKED"
+	FailVerificationNeeded  = "VERIFICATION_NEEDED"
+	FailInvalidCaptcha      = "INVALID_CAPTCHA"
+	FailVerificationTimeout = "VERIFICATION_TIMEOUT"
+	FailAccountLimit        = "ACCOUNT_LIMIT"
+	FailLowResources        = "LOW_RESOURCES"
+	FailMaintenance         = "MAINTENANCE"
+	FailUnavailable         = "UNAVAILABLE"
+	FailRegistrationTimeout = "REGISTRATION_TIMEOUT"
+	FailInsecureUpstream    = "INSECURE_UPSTREAM"
+)
+
+// gatewayFailLine - A FAIL line for a failure that is not caused by a specific command
+func gatewayFailLine(code string, description string) string {
+	failMessage := irc.Message{
+		Command: "FAIL",
+		Params:  []string{"*", code, description},
+	}
+	return failMessage.ToLine()
+}
+
+// SendGatewayError - Send a FAIL with a machine readable code followed by an ERROR with the same
+// description, for clients that do not understand FAIL
+func (c *Client) SendGatewayError(code string, description string) {
+	c.SendClientSignal("data", gatewayFailLine(code, description))
+	c.SendIrcError(description)
+}
+
+// NotAcceptingClientsCode - The FAIL code for NotAcceptingClientsMessage
+func (s *Gateway) NotAcceptingClientsCode() string {
+	if s.IsInMaintenance() && !s.IsDraining() {
+		return FailMaintenance
+	}
+	if s.IsUnderMemoryPressure() && !s.IsDraining() {
+		return FailLowResources
+	}
+	return FailUnavailable
+}
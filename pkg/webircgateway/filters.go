@@ -0,0 +1,122 @@
+package webircgateway
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+const (
+	// FilterActionBlock - Drop the message and tell the client why
+	FilterActionBlock = "block"
+	// FilterActionReplace - Replace the matching text before sending the message on
+	FilterActionReplace = "replace"
+	// FilterActionWarn - Send the message on unchanged but warn the client
+	FilterActionWarn = "warn"
+)
+
+// ConfigFilter - A word or regex filter applied to messages sent by clients
+type ConfigFilter struct {
+	Action      string
+	Match       *regexp.Regexp
+	Replacement string
+	Warning     string
+}
+
+// newConfigFilterMatch - Build a single regex matching any of the whole words or the regex
+func newConfigFilterMatch(words []string, pattern string) (*regexp.Regexp, error) {
+	parts := []string{}
+
+	quotedWords := []string{}
+	for _, word := range words {
+		if word != "" {
+			quotedWords = append(quotedWords, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quotedWords) > 0 {
+		parts = append(parts, `(?i)\b(?:`+strings.Join(quotedWords, "|")+`)\b`)
+	}
+
+	if pattern != "" {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+		parts = append(parts, "(?:"+pattern+")")
+	}
+
+	if len(parts) == 0 {
+		return nil, nil
+	}
+
+	return regexp.Compile(strings.Join(parts, "|"))
+}
+
+// filterMessage - Run a PRIVMSG or NOTICE from a client through the configured filters and the
+// client.message hook. Returns false if the message should not be sent upstream
+func (c *Client) filterMessage(message *irc.Message) bool {
+	text := message.Params[1]
+	action := ""
+	warning := ""
+
+	for _, filter := range c.Gateway.Config.Filters {
+		if !filter.Match.MatchString(text) {
+			continue
+		}
+
+		switch filter.Action {
+		case FilterActionReplace:
+			text = filter.Match.ReplaceAllString(text, filter.Replacement)
+			if action == "" {
+				action = FilterActionReplace
+			}
+		case FilterActionWarn:
+			if action != FilterActionBlock {
+				action = FilterActionWarn
+				warning = filter.Warning
+			}
+		default:
+			action = FilterActionBlock
+			warning = filter.Warning
+		}
+	}
+
+	hook := &HookMessageFilter{
+		Client:  c,
+		Message: message,
+		Target:  message.Params[0],
+		Text:    text,
+		Action:  action,
+	}
+	hook.Dispatch("client.message")
+
+	if hook.Halt || hook.Action == FilterActionBlock {
+		if warning == "" {
+			warning = "Your message was blocked"
+		}
+		c.Log(1, "Message to %s blocked by filter", hook.Target)
+		c.sendFilterWarning(hook.Target, warning)
+		return false
+	}
+
+	if hook.Action == FilterActionWarn && warning != "" {
+		c.sendFilterWarning(hook.Target, warning)
+	}
+
+	message.Params[1] = hook.Text
+	return true
+}
+
+func (c *Client) sendFilterWarning(target string, warning string) {
+	nick := c.IrcState.Nick
+	if nick == "" {
+		nick = "*"
+	}
+
+	notice := irc.Message{
+		Command: "NOTICE",
+		Prefix:  &c.ServerMessagePrefix,
+		Params:  []string{nick, "[" + target + "] " + warning},
+	}
+	c.SendClientSignal("data", notice.ToLine())
+}
@@ -1,6 +1,7 @@
 package webircgateway
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -10,6 +11,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"errors"
 
@@ -27,6 +30,7 @@ type Gateway struct {
 	HttpRouter  *http.ServeMux
 	LogOutput   chan string
 	messageTags *MessageTagManager
+	clientIndex *clientIndex
 	identdServ  identd.Server
 	Clients     cmap.ConcurrentMap
 	Acme        *LEManager
@@ -34,6 +38,42 @@ type Gateway struct {
 	httpSrvs    []*http.Server
 	httpSrvsMu  sync.Mutex
 	closeWg     sync.WaitGroup
+	closeOnce   sync.Once
+	// draining is set to 1 once the gateway stops accepting new clients
+	draining int32
+	// maintenance is set to 1 while new clients are refused with the maintenance message
+	maintenance int32
+	// memoryPressure is set to 1 while memory use is over the configured limits
+	memoryPressure    int32
+	controlListener   net.Listener
+	controlSocketFile string
+	// The level of log lines that are output. Read by every goroutine so accessed atomically
+	logLevel        int32
+	proxyServer     *proxy.KiwiProxyServer
+	proxyInterfaces *proxyInterfacePool
+	recentErrors    *logRing
+	// Shared TLS configs for upstream connections so that TLS sessions can be resumed
+	upstreamTLSConfigs   map[string]*tls.Config
+	upstreamTLSConfigsMu sync.Mutex
+	certFPStore          *CertFPStore
+	certFPStoreMu        sync.Mutex
+	latencyTracker       *upstreamLatencyTracker
+	nativeAppLimiter     *nativeAppLimiter
+	transportMetrics     *transportMetrics
+	auxScheduler         *auxScheduler
+	resumeSessions       *resumeSessionStore
+	listCache            *listCache
+	nickCache            *nickCache
+	// A credential provider set by a plugin
+	credentialProvider   CredentialProvider
+	credentialProviderMu sync.Mutex
+	// Certificates of the TLS servers, reloaded when their files change
+	certReloaders   []*certificateReloader
+	certReloadersMu sync.Mutex
+	upstreamHealth  *upstreamHealthTracker
+	// Counts the clients given an upstream by the round-robin strategy. Accessed atomically
+	upstreamRoundRobin uint32
+	clusterDiscovery   *clusterDiscovery
 }
 
 func NewGateway(function string) *Gateway {
@@ -44,20 +84,42 @@ func NewGateway(function string) *Gateway {
 	s.LogOutput = make(chan string, 5)
 	s.identdServ = identd.NewIdentdServer()
 	s.messageTags = NewMessageTagManager()
+	s.clientIndex = newClientIndex()
 	// Clients hold a map lookup for all the connected clients
 	s.Clients = cmap.New()
 	s.Acme = NewLetsEncryptManager(s)
+	s.recentErrors = newLogRing(50)
+	s.upstreamTLSConfigs = make(map[string]*tls.Config)
+	s.proxyInterfaces = newProxyInterfacePool()
+	s.latencyTracker = newUpstreamLatencyTracker()
+	s.nativeAppLimiter = newNativeAppLimiter()
+	s.transportMetrics = newTransportMetrics()
+	s.auxScheduler = newAuxScheduler()
+	s.resumeSessions = newResumeSessionStore()
+	s.listCache = newListCache()
+	s.nickCache = newNickCache()
+	s.upstreamHealth = newUpstreamHealthTracker()
+	s.clusterDiscovery = newClusterDiscovery()
 
 	return s
 }
 
+// SetLogLevel - Change the level of log lines that are output. Reloading the config sets it to
+// the configured logLevel again
+func (s *Gateway) SetLogLevel(level int) {
+	atomic.StoreInt32(&s.logLevel, int32(level))
+}
+
 func (s *Gateway) Log(level int, format string, args ...interface{}) {
-	if level < s.Config.LogLevel {
+	if level < int(atomic.LoadInt32(&s.logLevel)) {
 		return
 	}
 
 	levels := [...]string{"L_DEBUG", "L_INFO", "L_WARN"}
 	line := fmt.Sprintf(levels[level-1]+" "+format, args...)
+	if level == 3 {
+		s.recentErrors.Add(line)
+	}
 	s.LogOutput <- line
 }
 
@@ -68,21 +130,40 @@ func (s *Gateway) Start() {
 		s.maybeStartStaticFileServer()
 		s.initHttpRoutes()
 		s.maybeStartIdentd()
-
+		s.maybeStartControlSocket()
+		s.maybeStartMemoryMonitor()
+		s.startLatencyMonitor()
+		s.startHealthChecks()
+		s.startClusterAnnouncer()
+
+		// Wait until all servers are listening so that privileges may be dropped afterwards
+		listening := &sync.WaitGroup{}
 		for _, serverConfig := range s.Config.Servers {
-			go s.startServer(serverConfig)
+			listening.Add(1)
+			go s.startServer(serverConfig, listening)
 		}
+		listening.Wait()
 	}
 
 	if s.Function == "proxy" {
-		proxy.Start(fmt.Sprintf("%s:%d", s.Config.Proxy.LocalAddr, s.Config.Proxy.Port))
+		s.maybeStartIdentd()
+	}
+
+	if s.Function == "proxy" || (s.Function == "gateway" && s.Config.Proxy.Enabled) {
+		err := s.startProxyServer()
+		if err != nil {
+			s.Log(3, "Error starting the kiwi proxy server: %s", err.Error())
+		}
 	}
 }
 
+// Close - Shut down the gateway, draining clients for up to the configured drain timeout
 func (s *Gateway) Close() {
-	hook := HookGatewayClosing{}
-	hook.Dispatch("gateway.closing")
+	s.Shutdown(context.Background())
+}
 
+// closeServers - Stop all the listeners once the clients have gone
+func (s *Gateway) closeServers() {
 	defer s.closeWg.Done()
 
 	s.httpSrvsMu.Lock()
@@ -91,6 +172,15 @@ func (s *Gateway) Close() {
 	for _, httpSrv := range s.httpSrvs {
 		httpSrv.Close()
 	}
+
+	if s.controlListener != nil {
+		s.controlListener.Close()
+		os.Remove(s.controlSocketFile)
+	}
+
+	if s.proxyServer != nil {
+		s.proxyServer.Close()
+	}
 }
 
 func (s *Gateway) WaitClose() {
@@ -142,6 +232,11 @@ func (s *Gateway) initHttpRoutes() error {
 		w.Write(out)
 	})
 
+	s.initLifecycleRoutes()
+	s.initDashboardRoutes()
+	s.initAccountQuotaRoutes()
+	s.initClusterRoutes()
+
 	s.HttpRouter.HandleFunc("/webirc/_status", func(w http.ResponseWriter, r *http.Request) {
 		if !isPrivateIP(s.GetRemoteAddressFromRequest(r)) {
 			w.WriteHeader(403)
@@ -149,18 +244,8 @@ func (s *Gateway) initHttpRoutes() error {
 		}
 
 		out := ""
-		for item := range s.Clients.IterBuffered() {
-			c := item.Val.(*Client)
-			line := fmt.Sprintf(
-				"%s:%d %s %s!%s %s %s",
-				c.UpstreamConfig.Hostname,
-				c.UpstreamConfig.Port,
-				c.State,
-				c.IrcState.Nick,
-				c.IrcState.Username,
-				c.RemoteAddr,
-				c.RemoteHostname,
-			)
+		for _, c := range s.AllClients() {
+			line := s.clientStatusLine(c)
 
 			// Allow plugins to add their own status data
 			hook := HookStatus{}
@@ -173,14 +258,40 @@ func (s *Gateway) initHttpRoutes() error {
 
 		}
 
+		// Peers request their local status only so that they don't aggregate back to us
+		if s.Config.ClusterAggregateStatus && r.URL.Query().Get("local") == "" {
+			out += s.clusterStatus()
+		}
+
 		w.Write([]byte(out))
 	})
 
 	return nil
 }
 
+// clientStatusLine - A single line summary of a client as used in status output
+func (s *Gateway) clientStatusLine(c *Client) string {
+	return fmt.Sprintf(
+		"%s:%d %s %s!%s %s %s +%s",
+		c.UpstreamConfig.Hostname,
+		c.UpstreamConfig.Port,
+		c.State(),
+		c.IrcState.Nick,
+		c.IrcState.Username,
+		c.RemoteAddr,
+		c.RemoteHostname,
+		strings.Join(c.IrcState.UserModes(), ""),
+	)
+}
+
 func (s *Gateway) maybeStartIdentd() {
 	if s.Config.Identd {
+		s.identdServ.ListenAddrs = s.Config.IdentdListen
+		s.identdServ.ReadTimeout = time.Second * time.Duration(s.Config.IdentdTimeout)
+		s.identdServ.MaxConnections = s.Config.IdentdMaxConnections
+		s.identdServ.OS = s.Config.IdentdOS
+		s.identdServ.Charset = s.Config.IdentdCharset
+
 		err := s.identdServ.Run()
 		if err != nil {
 			s.Log(3, "Error starting identd server: %s", err.Error())
@@ -190,13 +301,22 @@ func (s *Gateway) maybeStartIdentd() {
 	}
 }
 
-func (s *Gateway) startServer(conf ConfigServer) {
+// startServer - Start a server and serve requests until it is closed. listening is marked as
+// done once the server has bound its address or failed to
+func (s *Gateway) startServer(conf ConfigServer, listening *sync.WaitGroup) {
+	listeningOnce := sync.Once{}
+	markListening := func() {
+		listeningOnce.Do(listening.Done)
+	}
+	defer markListening()
+
 	addr := fmt.Sprintf("%s:%d", conf.LocalAddr, conf.Port)
 
 	if strings.HasPrefix(strings.ToLower(conf.LocalAddr), "tcp:") {
 		t := &TransportTcp{}
 		t.Init(s)
-		t.Start(conf.LocalAddr[4:] + ":" + strconv.Itoa(conf.Port))
+		t.proxyProtocol = conf.ProxyProtocol
+		t.Start(conf.LocalAddr[4:]+":"+strconv.Itoa(conf.Port), markListening)
 	} else if conf.TLS && conf.LetsEncryptCacheDir == "" {
 		if conf.CertFile == "" || conf.KeyFile == "" {
 			s.Log(3, "'cert' and 'key' options must be set for TLS servers")
@@ -207,17 +327,18 @@ func (s *Gateway) startServer(conf ConfigServer) {
 		tlsKey := s.Config.ResolvePath(conf.KeyFile)
 
 		s.Log(2, "Listening with TLS on %s", addr)
-		keyPair, keyPairErr := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		certReloader, keyPairErr := newCertificateReloader(tlsCert, tlsKey)
 		if keyPairErr != nil {
 			s.Log(3, "Failed to listen with TLS, certificate error: %s", keyPairErr.Error())
 			return
 		}
+		s.addCertificateReloader(certReloader)
 		srv := &http.Server{
 			Addr: addr,
 			TLSConfig: &tls.Config{
-				Certificates: []tls.Certificate{keyPair},
+				GetCertificate: certReloader.GetCertificate,
 			},
-			Handler: s.HttpRouter,
+			Handler: http.HandlerFunc(s.serveHTTP),
 		}
 		s.httpSrvsMu.Lock()
 		s.httpSrvs = append(s.httpSrvs, srv)
@@ -226,19 +347,27 @@ func (s *Gateway) startServer(conf ConfigServer) {
 		// Don't use HTTP2 since it doesn't support websockets
 		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 
-		err := srv.ListenAndServeTLS("", "")
+		l, err := net.Listen("tcp", addr)
+		markListening()
+		if err != nil {
+			s.Log(3, "Failed to listen with TLS: %s", err.Error())
+			return
+		}
+
+		err = srv.ServeTLS(l, "", "")
 		if err != nil && err != http.ErrServerClosed {
 			s.Log(3, "Failed to listen with TLS: %s", err.Error())
 		}
 	} else if conf.TLS && conf.LetsEncryptCacheDir != "" {
 		s.Log(2, "Listening with letsencrypt TLS on %s", addr)
 		leManager := s.Acme.Get(conf.LetsEncryptCacheDir)
+		if conf.LetsEncryptHTTPChallenge {
+			s.Acme.EnableHTTPChallenge()
+		}
 		srv := &http.Server{
-			Addr: addr,
-			TLSConfig: &tls.Config{
-				GetCertificate: leManager.GetCertificate,
-			},
-			Handler: s.HttpRouter,
+			Addr:      addr,
+			TLSConfig: s.Acme.TLSConfig(leManager),
+			Handler:   http.HandlerFunc(s.serveHTTP),
 		}
 		s.httpSrvsMu.Lock()
 		s.httpSrvs = append(s.httpSrvs, srv)
@@ -247,7 +376,14 @@ func (s *Gateway) startServer(conf ConfigServer) {
 		// Don't use HTTP2 since it doesn't support websockets
 		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 
-		err := srv.ListenAndServeTLS("", "")
+		l, err := net.Listen("tcp", addr)
+		markListening()
+		if err != nil {
+			s.Log(3, "Listening with letsencrypt failed: %s", err.Error())
+			return
+		}
+
+		err = srv.ServeTLS(l, "", "")
 		if err != nil && err != http.ErrServerClosed {
 			s.Log(3, "Listening with letsencrypt failed: %s", err.Error())
 		}
@@ -261,16 +397,24 @@ func (s *Gateway) startServer(conf ConfigServer) {
 			return
 		}
 		os.Chmod(socketFile, conf.BindMode)
-		http.Serve(server, s.HttpRouter)
+		markListening()
+		http.Serve(server, http.HandlerFunc(s.serveHTTP))
 	} else {
 		s.Log(2, "Listening on %s", addr)
-		srv := &http.Server{Addr: addr, Handler: s.HttpRouter}
+		srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(s.serveHTTP)}
 
 		s.httpSrvsMu.Lock()
 		s.httpSrvs = append(s.httpSrvs, srv)
 		s.httpSrvsMu.Unlock()
 
-		err := srv.ListenAndServe()
+		l, err := net.Listen("tcp", addr)
+		markListening()
+		if err != nil {
+			s.Log(3, err.Error())
+			return
+		}
+
+		err = srv.Serve(l)
 		if err != nil && err != http.ErrServerClosed {
 			s.Log(3, err.Error())
 		}
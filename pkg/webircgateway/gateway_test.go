@@ -0,0 +1,221 @@
+package webircgateway_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+	"github.com/kiwiirc/webircgateway/pkg/webircgateway"
+	"github.com/kiwiirc/webircgateway/pkg/webircgateway/testutil"
+)
+
+const testTimeout = 5 * time.Second
+
+func newTestGateway(t *testing.T, ircd *testutil.FakeIrcd, extraConfig string) *webircgateway.Gateway {
+	t.Helper()
+
+	// Clients keep logging while they shut down after the test has finished
+	var logMu sync.Mutex
+	testDone := false
+	t.Cleanup(func() {
+		logMu.Lock()
+		testDone = true
+		logMu.Unlock()
+	})
+	logf := func(format string, args ...interface{}) {
+		logMu.Lock()
+		defer logMu.Unlock()
+		if !testDone {
+			t.Logf(format, args...)
+		}
+	}
+
+	gateway, err := testutil.NewGateway(ircd, extraConfig, logf)
+	if err != nil {
+		t.Fatalf("creating gateway: %s", err.Error())
+	}
+
+	return gateway
+}
+
+func newTestIrcd(t *testing.T, caps ...string) *testutil.FakeIrcd {
+	t.Helper()
+
+	ircd, err := testutil.NewFakeIrcd()
+	if err != nil {
+		t.Fatalf("starting fake ircd: %s", err.Error())
+	}
+	ircd.Caps = caps
+	t.Cleanup(func() { ircd.Close() })
+
+	return ircd
+}
+
+func connectTestClient(t *testing.T, gateway *webircgateway.Gateway) *testutil.ClientConn {
+	t.Helper()
+
+	client := testutil.Connect(gateway, "127.0.0.1")
+	t.Cleanup(client.Close)
+
+	return client
+}
+
+func mustSend(t *testing.T, client *testutil.ClientConn, lines ...string) {
+	t.Helper()
+
+	for _, line := range lines {
+		if err := client.Send(line); err != nil {
+			t.Fatalf("sending %q: %s", line, err.Error())
+		}
+	}
+}
+
+func mustExpect(t *testing.T, client *testutil.ClientConn, command string) *irc.Message {
+	t.Helper()
+
+	msg, err := client.Expect(command, testTimeout)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return msg
+}
+
+func hasWord(list string, word string) bool {
+	for _, item := range strings.Fields(list) {
+		if item == word {
+			return true
+		}
+	}
+	return false
+}
+
+// registerWithMessageTags - Register client as nick with message-tags enabled by the gateway
+func registerWithMessageTags(t *testing.T, client *testutil.ClientConn, nick string) {
+	t.Helper()
+
+	mustSend(t, client, "CAP LS 302", "NICK "+nick, "USER "+nick+" 0 * :"+nick)
+	mustExpect(t, client, "CAP")
+	mustSend(t, client, "CAP REQ :message-tags", "CAP END")
+	mustExpect(t, client, "CAP")
+	mustExpect(t, client, "001")
+}
+
+func TestRegistration(t *testing.T) {
+	ircd := newTestIrcd(t)
+	gateway := newTestGateway(t, ircd, "")
+	client := connectTestClient(t, gateway)
+
+	welcome, err := client.Register("tester", testTimeout)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if welcome.GetParam(0, "") != "tester" {
+		t.Errorf("001 sent to %q, expected tester", welcome.GetParam(0, ""))
+	}
+
+	conn, err := ircd.NextConn(testTimeout)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if conn.Nick() != "tester" {
+		t.Errorf("IRC server has nick %q, expected tester", conn.Nick())
+	}
+}
+
+func TestCapNegotiation(t *testing.T) {
+	ircd := newTestIrcd(t, "multi-prefix", "sasl=PLAIN")
+	gateway := newTestGateway(t, ircd, "")
+	client := connectTestClient(t, gateway)
+
+	mustSend(t, client, "CAP LS 302", "NICK tester", "USER tester 0 * :tester")
+	ls := mustExpect(t, client, "CAP")
+	lsCaps := ls.GetParam(len(ls.Params)-1, "")
+	if ls.GetParamU(1, "") != "LS" {
+		t.Fatalf("expected CAP LS, got %q", ls.ToLine())
+	}
+	for _, capability := range []string{"multi-prefix", "sasl=PLAIN", "message-tags"} {
+		if !hasWord(lsCaps, capability) {
+			t.Errorf("CAP LS %q is missing %s", lsCaps, capability)
+		}
+	}
+
+	mustSend(t, client, "CAP REQ :multi-prefix message-tags")
+	ack := mustExpect(t, client, "CAP")
+	ackCaps := ack.GetParam(len(ack.Params)-1, "")
+	if ack.GetParamU(1, "") != "ACK" || !hasWord(ackCaps, "multi-prefix") || !hasWord(ackCaps, "message-tags") {
+		t.Fatalf("expected an ACK of multi-prefix and message-tags, got %q", ack.ToLine())
+	}
+
+	mustSend(t, client, "CAP END")
+	mustExpect(t, client, "001")
+
+	conn, err := ircd.NextConn(testTimeout)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !conn.HasCap("multi-prefix") {
+		t.Error("multi-prefix was not requested from the IRC server")
+	}
+	if conn.HasCap("message-tags") {
+		t.Error("message-tags is emulated by the gateway but was requested from the IRC server")
+	}
+}
+
+func TestGatewaySasl(t *testing.T) {
+	ircd := newTestIrcd(t, "sasl=PLAIN")
+	ircd.SaslAccounts["gateway"] = "secret"
+	gateway := newTestGateway(t, ircd, "sasl_mechanism = PLAIN\nsasl_username = gateway\nsasl_password = secret\n")
+	client := connectTestClient(t, gateway)
+
+	if _, err := client.Register("tester", testTimeout); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	conn, err := ircd.NextConn(testTimeout)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if conn.Account() != "gateway" {
+		t.Errorf("logged in to account %q, expected gateway", conn.Account())
+	}
+}
+
+func TestClientTagRoundTrip(t *testing.T) {
+	ircd := newTestIrcd(t)
+	gateway := newTestGateway(t, ircd, "")
+
+	sender := connectTestClient(t, gateway)
+	registerWithMessageTags(t, sender, "sender")
+	senderConn, err := ircd.NextConn(testTimeout)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	recipient := connectTestClient(t, gateway)
+	registerWithMessageTags(t, recipient, "recipient")
+	recipientConn, err := ircd.NextConn(testTimeout)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	mustSend(t, sender, "@+example.com/colour=red PRIVMSG recipient :hello")
+	sent, err := senderConn.Expect("PRIVMSG", testTimeout)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, exists := sent.Tags["+example.com/colour"]; exists {
+		t.Errorf("client tags were sent to an IRC server without message-tags: %q", sent.ToLine())
+	}
+
+	recipientConn.Send(":sender!user@host PRIVMSG recipient :hello")
+	received := mustExpect(t, recipient, "PRIVMSG")
+	if received.Tags["+example.com/colour"] != "red" {
+		t.Errorf("client tag was not restored for the recipient: %q", received.ToLine())
+	}
+	if received.Tags["msgid"] == "" {
+		t.Errorf("message has no msgid: %q", received.ToLine())
+	}
+}
@@ -1,10 +1,12 @@
 package webircgateway
 
 import (
+	"crypto/tls"
 	"errors"
-	"math/rand"
+	"fmt"
 	"net"
 	"net/http"
+	"reflect"
 	"strings"
 )
 
@@ -20,8 +22,17 @@ func (s *Gateway) IsClientOriginAllowed(originHeader string) bool {
 		return true
 	}
 
-	// No origin header = running on the same page
+	// No origin header = running on the same page or a native app
 	if originHeader == "" {
+		return s.Config.NativeAppAllowNoOrigin
+	}
+
+	// Native app wrappers use their own schemes, eg. capacitor://localhost
+	if s.isNativeAppOrigin(originHeader) {
+		return true
+	}
+
+	if s.originTenant(strings.ToLower(originHeader)) != nil {
 		return true
 	}
 
@@ -38,9 +49,9 @@ func (s *Gateway) IsClientOriginAllowed(originHeader string) bool {
 }
 
 func (s *Gateway) isIrcAddressAllowed(addr string) bool {
-	// Empty whitelist = all destinations allowed
+	// Empty whitelist = all destinations allowed, unless only whitelisted destinations are
 	if len(s.Config.GatewayWhitelist) == 0 {
-		return true
+		return !s.Config.GatewayDefaultDeny
 	}
 
 	foundMatch := false
@@ -55,17 +66,111 @@ func (s *Gateway) isIrcAddressAllowed(addr string) bool {
 	return foundMatch
 }
 
-func (s *Gateway) findUpstream() (ConfigUpstream, error) {
+func (s *Gateway) findUpstream(client *Client) (ConfigUpstream, error) {
+	return s.findUpstreamExcluding(client, nil)
+}
+
+// findUpstreamExcluding - Pick an upstream for a client from those of its tenant that allow it,
+// skipping any in excluded keyed by "host:port" and any failing their health checks
+func (s *Gateway) findUpstreamExcluding(client *Client, excluded map[string]bool) (ConfigUpstream, error) {
 	var ret ConfigUpstream
 
-	if len(s.Config.Upstreams) == 0 {
+	// The list is replaced when the config is reloaded so keep hold of the current one
+	upstreams := []ConfigUpstream{}
+	restricted := false
+	for _, upstream := range tenantUpstreams(s.Config.Upstreams, client.tenantName()) {
+		if excluded[upstreamLatencyKey(&upstream)] {
+			continue
+		}
+		if !upstream.allowsClient(client) {
+			restricted = true
+			continue
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	if len(upstreams) == 0 && restricted {
+		return ret, errors.New("No upstreams allow this client")
+	}
+	if len(upstreams) == 0 {
 		return ret, errors.New("No upstreams available")
 	}
 
-	randIdx := rand.Intn(len(s.Config.Upstreams))
-	ret = s.Config.Upstreams[randIdx]
+	return s.pickUpstream(s.healthyUpstreams(upstreams), client.RemoteAddr), nil
+}
+
+// allowsClient - Check the clients address and origin against those the upstream is limited to
+func (u *ConfigUpstream) allowsClient(client *Client) bool {
+	if u.AllowedClients != nil {
+		remoteIP := net.ParseIP(client.RemoteAddr)
+		allowed := false
+		for _, cidrRange := range u.AllowedClients {
+			if remoteIP != nil && cidrRange.Contains(remoteIP) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
 
-	return ret, nil
+	if u.AllowedOrigins != nil {
+		allowed := false
+		for _, originMatch := range u.AllowedOrigins {
+			if client.origin != "" && originMatch.Match(client.origin) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// upstreamChanges - Describe the differences between two lists of upstreams, such as before and
+// after a config reload. Clients already connected stay on the upstream they connected to
+func (s *Gateway) upstreamChanges(previous []ConfigUpstream, current []ConfigUpstream) []string {
+	key := func(upstream *ConfigUpstream) string {
+		return fmt.Sprintf("%s://%s:%d", upstream.Protocol, upstream.Hostname, upstream.Port)
+	}
+
+	previousByKey := make(map[string]*ConfigUpstream)
+	for idx := range previous {
+		previousByKey[key(&previous[idx])] = &previous[idx]
+	}
+	currentByKey := make(map[string]*ConfigUpstream)
+	for idx := range current {
+		currentByKey[key(&current[idx])] = &current[idx]
+	}
+
+	clientCounts := make(map[string]int)
+	for _, c := range s.AllClients() {
+		if c.UpstreamConfig.Hostname != "" {
+			clientCounts[key(c.UpstreamConfig)]++
+		}
+	}
+
+	changes := []string{}
+	for idx := range current {
+		upstreamKey := key(&current[idx])
+		previousUpstream, existed := previousByKey[upstreamKey]
+		if !existed {
+			changes = append(changes, "upstream added "+upstreamKey)
+		} else if !reflect.DeepEqual(*previousUpstream, current[idx]) {
+			changes = append(changes, fmt.Sprintf("upstream changed %s, %d connected clients keep the previous settings", upstreamKey, clientCounts[upstreamKey]))
+		}
+	}
+	for idx := range previous {
+		upstreamKey := key(&previous[idx])
+		if _, exists := currentByKey[upstreamKey]; !exists {
+			changes = append(changes, fmt.Sprintf("upstream removed %s, %d connected clients stay connected", upstreamKey, clientCounts[upstreamKey]))
+		}
+	}
+
+	return changes
 }
 
 func (s *Gateway) findWebircPassword(ircHost string) string {
@@ -77,6 +182,18 @@ func (s *Gateway) findWebircPassword(ircHost string) string {
 	return pass
 }
 
+// findMaxCapVersion - The highest CAP LS version to send to an IRC server in gateway mode
+func (s *Gateway) findMaxCapVersion(ircHost string) int {
+	ircHost = strings.ToLower(ircHost)
+	for _, capVersion := range s.Config.GatewayMaxCapVersions {
+		if capVersion.Match.Match(ircHost) {
+			return capVersion.Version
+		}
+	}
+
+	return 0
+}
+
 func (s *Gateway) GetRemoteAddressFromRequest(req *http.Request) net.IP {
 	remoteIP := remoteIPFromRequest(req)
 
@@ -86,20 +203,73 @@ func (s *Gateway) GetRemoteAddressFromRequest(req *http.Request) net.IP {
 		return remoteIP
 	}
 
-	headerVal := req.Header.Get("x-forwarded-for")
-	ips := strings.Split(headerVal, ",")
-	ipStr := strings.Trim(ips[0], " ")
-	if ipStr != "" {
-		ip := net.ParseIP(ipStr)
-		if ip != nil {
-			remoteIP = ip
-		}
+	entry := s.realIPHeaderEntry(req)
+	if strings.EqualFold(s.Config.RealIPHeader, "forwarded") {
+		entry = forwardedParam(entry, "for")
+	}
+
+	ip := parseForwardedIP(entry)
+	if ip != nil {
+		remoteIP = ip
 	}
 
 	return remoteIP
 
 }
 
+// realIPHeaderEntry - The entry of the configured real IP header to take the client IP from.
+// Headers listing each proxy hop are split on commas and counted from the right, as only the
+// entries added by the trusted proxies can be relied on
+func (s *Gateway) realIPHeaderEntry(req *http.Request) string {
+	values := req.Header[http.CanonicalHeaderKey(s.Config.RealIPHeader)]
+	entries := []string{}
+	for _, val := range values {
+		for _, entry := range strings.Split(val, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	if len(entries) == 0 {
+		return ""
+	}
+	if s.Config.RealIPHop == 0 {
+		return entries[0]
+	}
+	if s.Config.RealIPHop > len(entries) {
+		// Fewer hops than expected. The request did not come through the expected proxies
+		return ""
+	}
+	return entries[len(entries)-s.Config.RealIPHop]
+}
+
+// forwardedParam - Read a parameter from an element of a RFC 7239 Forwarded header,
+// eg. for=192.0.2.60;proto=https
+func forwardedParam(element string, name string) string {
+	for _, pair := range strings.Split(element, ";") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], name) {
+			return strings.Trim(parts[1], "\"")
+		}
+	}
+	return ""
+}
+
+// parseForwardedIP - Parse an IP from a forwarding header, which may include a port
+// such as 192.0.2.60:4711 or [2001:db8::17]:4711
+func parseForwardedIP(val string) net.IP {
+	val = strings.Trim(strings.TrimSpace(val), "\"")
+	if ip := net.ParseIP(val); ip != nil {
+		return ip
+	}
+
+	if host, _, err := net.SplitHostPort(val); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.Trim(val, "[]"))
+}
+
 func (s *Gateway) isRequestSecure(req *http.Request) bool {
 	remoteIP := remoteIPFromRequest(req)
 
@@ -109,6 +279,12 @@ func (s *Gateway) isRequestSecure(req *http.Request) bool {
 		return req.TLS != nil
 	}
 
+	if strings.EqualFold(s.Config.RealIPHeader, "forwarded") {
+		if proto := forwardedParam(s.realIPHeaderEntry(req), "proto"); proto != "" {
+			return strings.EqualFold(proto, "https")
+		}
+	}
+
 	fwdProto := req.Header.Get("x-forwarded-proto")
 	return strings.EqualFold(fwdProto, "https")
 }
@@ -131,3 +307,70 @@ func remoteIPFromRequest(req *http.Request) net.IP {
 	remoteAddr, _, _ := net.SplitHostPort(req.RemoteAddr)
 	return net.ParseIP(remoteAddr)
 }
+
+// isNickBlocked - Check if a nick matches any of the blocked nick patterns
+func (s *Gateway) isNickBlocked(nick string) bool {
+	nick = strings.ToLower(nick)
+	for _, match := range s.Config.ClientBlockedNicks {
+		if match.Match(nick) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// formatNick - Apply the mandated nick format, leaving nicks that already follow it untouched
+func (s *Gateway) formatNick(nick string) string {
+	format := s.Config.ClientNickFormat
+	if format == "" {
+		return nick
+	}
+
+	parts := strings.SplitN(format, "%n", 2)
+	prefix, suffix := parts[0], parts[1]
+	if len(nick) > len(prefix)+len(suffix) &&
+		strings.HasPrefix(strings.ToLower(nick), strings.ToLower(prefix)) &&
+		strings.HasSuffix(strings.ToLower(nick), strings.ToLower(suffix)) {
+		return nick
+	}
+
+	return prefix + nick + suffix
+}
+
+// The maximum number of upstream TLS configs to keep before the cache is reset
+const maxUpstreamTLSConfigs = 1000
+
+// upstreamTLSConfig - Get the TLS config for an upstream. The same config is reused for every
+// connection to the same upstream so that its TLS session cache lets reconnecting clients resume
+// previous sessions instead of performing a full handshake
+func (s *Gateway) upstreamTLSConfig(upstream *ConfigUpstream) *tls.Config {
+	serverName := upstream.TLSServerName()
+	key := fmt.Sprintf("%s:%d/%s/%s/%s", upstream.Hostname, upstream.Port, serverName, upstream.TLSCertFile, strings.Join(upstream.ALPN, ","))
+
+	s.upstreamTLSConfigsMu.Lock()
+	defer s.upstreamTLSConfigsMu.Unlock()
+
+	tlsConfig, exists := s.upstreamTLSConfigs[key]
+	if !exists {
+		// In gateway mode clients may connect anywhere so don't let this grow forever
+		if len(s.upstreamTLSConfigs) >= maxUpstreamTLSConfigs {
+			s.upstreamTLSConfigs = make(map[string]*tls.Config)
+		}
+
+		tlsConfig = &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         serverName,
+			ClientSessionCache: tls.NewLRUClientSessionCache(64),
+		}
+		if len(upstream.ALPN) > 0 {
+			tlsConfig.NextProtos = upstream.ALPN
+		}
+		if upstream.TLSCertificate != nil {
+			tlsConfig.Certificates = []tls.Certificate{*upstream.TLSCertificate}
+		}
+		s.upstreamTLSConfigs[key] = tlsConfig
+	}
+
+	return tlsConfig
+}
@@ -0,0 +1,136 @@
+package webircgateway
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Upper bounds in seconds of the hook duration histogram buckets
+var hookDurationBuckets = []float64{0.0001, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Slow hook warnings for the same hook type are logged at most this often
+const slowHookWarningInterval = time.Minute
+
+// HookStats - How long the callbacks of one hook type have taken. Buckets are cumulative counts
+// of calls keyed by their upper bound in seconds, as used by Prometheus histograms
+type HookStats struct {
+	Calls        uint64            `json:"calls"`
+	SlowCalls    uint64            `json:"slow_calls"`
+	TotalSeconds float64           `json:"total_seconds"`
+	MaxSeconds   float64           `json:"max_seconds"`
+	Buckets      map[string]uint64 `json:"buckets"`
+	// Async callbacks dropped because the async hook queue was full
+	AsyncDropped uint64 `json:"async_dropped"`
+}
+
+type hookTiming struct {
+	stats  HookStats
+	counts []uint64
+	// Slow calls since the last warning was logged
+	slowSinceWarning uint64
+	lastWarning      time.Time
+}
+
+// hookMetrics - Times every hook callback so that slow plugins, which hold up the client they
+// were called for, can be found
+type hookMetrics struct {
+	mu      sync.Mutex
+	hooks   map[string]*hookTiming
+	gateway *Gateway
+	budget  time.Duration
+}
+
+// Hooks are registered globally so their timings are too
+var hookTimings = &hookMetrics{hooks: make(map[string]*hookTiming)}
+
+// configure - Set the gateway slow hooks are logged to and how long a callback may take before
+// it is slow. 0 to not warn about slow hooks
+func (m *hookMetrics) configure(gateway *Gateway, budget time.Duration) {
+	m.mu.Lock()
+	m.gateway = gateway
+	m.budget = budget
+	m.mu.Unlock()
+}
+
+// timeHook - Run a hook callback, recording how long it took
+func timeHook(eventType string, callback interface{}, call func()) {
+	started := time.Now()
+	call()
+	hookTimings.observe(eventType, callback, time.Since(started))
+}
+
+func (m *hookMetrics) observe(eventType string, callback interface{}, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	timing, exists := m.hooks[eventType]
+	if !exists {
+		timing = &hookTiming{counts: make([]uint64, len(hookDurationBuckets))}
+		m.hooks[eventType] = timing
+	}
+
+	seconds := duration.Seconds()
+	for idx, upper := range hookDurationBuckets {
+		if seconds <= upper {
+			timing.counts[idx]++
+		}
+	}
+	timing.stats.Calls++
+	timing.stats.TotalSeconds += seconds
+	if seconds > timing.stats.MaxSeconds {
+		timing.stats.MaxSeconds = seconds
+	}
+
+	if m.budget <= 0 || duration <= m.budget {
+		return
+	}
+
+	timing.stats.SlowCalls++
+	timing.slowSinceWarning++
+	if m.gateway == nil || time.Since(timing.lastWarning) < slowHookWarningInterval {
+		return
+	}
+
+	m.gateway.Log(
+		3,
+		"Slow %s hook: %s took %s, over the budget of %s. %d slow calls since the last warning",
+		eventType,
+		hookCallbackName(callback),
+		duration.Round(time.Microsecond),
+		m.budget,
+		timing.slowSinceWarning,
+	)
+	timing.lastWarning = time.Now()
+	timing.slowSinceWarning = 0
+}
+
+// snapshot - A copy of the timings of each hook type that has been called
+func (m *hookMetrics) snapshot() map[string]HookStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hooks := make(map[string]HookStats)
+	for eventType, timing := range m.hooks {
+		stats := timing.stats
+		stats.Buckets = make(map[string]uint64)
+		for idx, upper := range hookDurationBuckets {
+			stats.Buckets[fmt.Sprintf("%g", upper)] = timing.counts[idx]
+		}
+		stats.Buckets["+Inf"] = stats.Calls
+		stats.AsyncDropped = asyncHooks.droppedCount(eventType)
+		hooks[eventType] = stats
+	}
+	return hooks
+}
+
+// hookCallbackName - The function name of a hook callback, eg. main.Start.func1 for a plugin
+func hookCallbackName(callback interface{}) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(callback).Pointer())
+	if fn == nil {
+		return "unknown callback"
+	}
+	return fn.Name()
+}
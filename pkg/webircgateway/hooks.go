@@ -1,6 +1,13 @@
 package webircgateway
 
-import "github.com/kiwiirc/webircgateway/pkg/irc"
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
 
 var hooksRegistered map[string][]interface{}
 
@@ -48,9 +55,58 @@ type HookIrcConnectionPre struct {
 func (h *HookIrcConnectionPre) Dispatch(eventType string) {
 	for _, p := range h.getCallbacks(eventType) {
 		if f, ok := p.(func(*HookIrcConnectionPre)); ok {
-			f(h)
+			timeHook(eventType, p, func() { f(h) })
+		}
+	}
+	dispatchAsync(eventType, h)
+}
+
+/**
+ * HookIrcConnectionPost
+ * Dispatched once an IRC connection attempt has completed. Error is set if it failed
+ * Types: irc.connection.post
+ */
+type HookIrcConnectionPost struct {
+	Hook
+	Client         *Client
+	UpstreamConfig *ConfigUpstream
+	Duration       time.Duration
+	Error          error
+}
+
+func (h *HookIrcConnectionPost) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookIrcConnectionPost)); ok {
+			timeHook(eventType, p, func() { f(h) })
+		}
+	}
+	dispatchAsync(eventType, h)
+}
+
+/**
+ * HookHttpRequest
+ * Dispatched when a HTTP request arrives for a transport, before any websocket upgrade.
+ * Set Halt to reject the request with StatusCode (default 403) and Reason. Tags are added
+ * to the tags of the client created from this request
+ * Types: http.request
+ */
+type HookHttpRequest struct {
+	Hook
+	Transport  string
+	Request    *http.Request
+	RemoteAddr net.IP
+	Tags       map[string]string
+	StatusCode int
+	Reason     string
+}
+
+func (h *HookHttpRequest) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookHttpRequest)); ok {
+			timeHook(eventType, p, func() { f(h) })
 		}
 	}
+	dispatchAsync(eventType, h)
 }
 
 /**
@@ -72,9 +128,35 @@ type HookIrcLine struct {
 func (h *HookIrcLine) Dispatch(eventType string) {
 	for _, p := range h.getCallbacks(eventType) {
 		if f, ok := p.(func(*HookIrcLine)); ok {
-			f(h)
+			timeHook(eventType, p, func() { f(h) })
+		}
+	}
+	dispatchAsync(eventType, h)
+}
+
+/**
+ * HookMessageFilter
+ * Dispatched when a client sends a PRIVMSG or NOTICE, after the configured filters have run.
+ * Text may be modified, or Halt set to block the message
+ * Types: client.message
+ */
+type HookMessageFilter struct {
+	Hook
+	Client  *Client
+	Message *irc.Message
+	Target  string
+	Text    string
+	// The action taken by the configured filters. "", "block", "replace" or "warn"
+	Action string
+}
+
+func (h *HookMessageFilter) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookMessageFilter)); ok {
+			timeHook(eventType, p, func() { f(h) })
 		}
 	}
+	dispatchAsync(eventType, h)
 }
 
 /**
@@ -91,9 +173,54 @@ type HookClientState struct {
 func (h *HookClientState) Dispatch(eventType string) {
 	for _, p := range h.getCallbacks(eventType) {
 		if f, ok := p.(func(*HookClientState)); ok {
-			f(h)
+			timeHook(eventType, p, func() { f(h) })
+		}
+	}
+	dispatchAsync(eventType, h)
+}
+
+/**
+ * HookClientStateChange
+ * Dispatched after a client moves from one state to another, eg. from registering to
+ * connected. Dispatched from whichever goroutine made the change
+ * Types: client.statechange
+ */
+type HookClientStateChange struct {
+	Hook
+	Client   *Client
+	OldState string
+	NewState string
+}
+
+func (h *HookClientStateChange) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookClientStateChange)); ok {
+			timeHook(eventType, p, func() { f(h) })
+		}
+	}
+	dispatchAsync(eventType, h)
+}
+
+/**
+ * HookClientConnectionInfo
+ * Dispatched when a new connection arrives, before the client is created. RemoteAddr,
+ * RemoteHostname, Tags and verification may be changed, eg. to trust a header set by a
+ * CDN. Leaving RemoteHostname empty looks it up from RemoteAddr. Set Halt to reject the
+ * connection
+ * Types: client.connectioninfo
+ */
+type HookClientConnectionInfo struct {
+	Hook
+	Info *ClientConnectionInfo
+}
+
+func (h *HookClientConnectionInfo) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookClientConnectionInfo)); ok {
+			timeHook(eventType, p, func() { f(h) })
 		}
 	}
+	dispatchAsync(eventType, h)
 }
 
 /**
@@ -110,9 +237,80 @@ type HookClientInit struct {
 func (h *HookClientInit) Dispatch(eventType string) {
 	for _, p := range h.getCallbacks(eventType) {
 		if f, ok := p.(func(*HookClientInit)); ok {
-			f(h)
+			timeHook(eventType, p, func() { f(h) })
+		}
+	}
+	dispatchAsync(eventType, h)
+}
+
+/**
+ * HookClientPresence
+ * Dispatched when a nick watched for a client comes online or goes offline
+ * Types: client.presence
+ */
+type HookClientPresence struct {
+	Hook
+	Client *Client
+	Nick   string
+	Online bool
+}
+
+func (h *HookClientPresence) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookClientPresence)); ok {
+			timeHook(eventType, p, func() { f(h) })
+		}
+	}
+	dispatchAsync(eventType, h)
+}
+
+/**
+ * HookIrcSasl
+ * Dispatched once connected to the IRCd, before the gateway logs in with SASL on behalf of
+ * the client. The credentials start as the upstreams sasl_* options and may be set per
+ * client. Mechanism is PLAIN or EXTERNAL. Set Halt, or leave the credentials empty, to not
+ * log in
+ * Types: irc.sasl
+ */
+type HookIrcSasl struct {
+	Hook
+	Client         *Client
+	UpstreamConfig *ConfigUpstream
+	Mechanism      string
+	Username       string
+	Password       string
+}
+
+func (h *HookIrcSasl) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookIrcSasl)); ok {
+			timeHook(eventType, p, func() { f(h) })
+		}
+	}
+	dispatchAsync(eventType, h)
+}
+
+/**
+ * HookIrcClientCertificate
+ * Dispatched before the TLS handshake with the IRCd. Certificate starts as the clients CertFP
+ * certificate, or the upstreams tls_cert, and may be replaced with a per user certificate for
+ * networks that authenticate with CertFP. Set it to nil, or set Halt, to not present one
+ * Types: irc.certificate
+ */
+type HookIrcClientCertificate struct {
+	Hook
+	Client         *Client
+	UpstreamConfig *ConfigUpstream
+	Certificate    *tls.Certificate
+}
+
+func (h *HookIrcClientCertificate) Dispatch(eventType string) {
+	for _, p := range h.getCallbacks(eventType) {
+		if f, ok := p.(func(*HookIrcClientCertificate)); ok {
+			timeHook(eventType, p, func() { f(h) })
 		}
 	}
+	dispatchAsync(eventType, h)
 }
 
 /**
@@ -129,9 +327,10 @@ type HookStatus struct {
 func (h *HookStatus) Dispatch(eventType string) {
 	for _, p := range h.getCallbacks(eventType) {
 		if f, ok := p.(func(*HookStatus)); ok {
-			f(h)
+			timeHook(eventType, p, func() { f(h) })
 		}
 	}
+	dispatchAsync(eventType, h)
 }
 
 /**
@@ -146,7 +345,8 @@ type HookGatewayClosing struct {
 func (h *HookGatewayClosing) Dispatch(eventType string) {
 	for _, p := range h.getCallbacks(eventType) {
 		if f, ok := p.(func(*HookGatewayClosing)); ok {
-			f(h)
+			timeHook(eventType, p, func() { f(h) })
 		}
 	}
+	dispatchAsync(eventType, h)
 }
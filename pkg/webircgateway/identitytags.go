@@ -0,0 +1,136 @@
+package webircgateway
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// identityTagHashPrefix - Marks an identity field whose value is hashed before being sent in a
+// tag, eg. sha256:email, so that the value itself is not shown to other users
+const identityTagHashPrefix = "sha256:"
+
+// ConfigIdentityTag - A client tag added to the messages of clients with a verified identity
+type ConfigIdentityTag struct {
+	// Tag - The client tag name, eg. +kiwiirc.com/role
+	Tag string
+	// Field - The identity data field the tag value comes from. "account" is the identity account
+	Field string
+	// Hash - Send a sha256 hash of the value instead of the value
+	Hash bool
+}
+
+// newConfigIdentityTag - Parse an [identity.tags] entry, eg. +kiwiirc.com/role = roles
+func newConfigIdentityTag(tag string, field string) (ConfigIdentityTag, bool) {
+	identityTag := ConfigIdentityTag{Tag: tag, Field: field}
+	if strings.HasPrefix(field, identityTagHashPrefix) {
+		identityTag.Field = strings.TrimPrefix(field, identityTagHashPrefix)
+		identityTag.Hash = true
+	}
+
+	// Only client tags are passed between clients on this gateway
+	valid := len(tag) > 1 && tag[0] == '+' && identityTag.Field != ""
+	return identityTag, valid
+}
+
+// identityTagValue - The value of the tag for an identity. Empty if the identity does not have
+// the field
+func (t *ConfigIdentityTag) identityTagValue(identity *ClientIdentity) string {
+	if identity == nil {
+		return ""
+	}
+
+	val := identity.Data[t.Field]
+	if t.Field == "account" {
+		val = identity.Account
+	}
+	if val == "" || !t.Hash {
+		return val
+	}
+
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(val))))
+	return hex.EncodeToString(hash[:])
+}
+
+// applyIdentityTags - Set the configured identity tags on a message sent by the client, replacing
+// any the client sent itself so that they cannot be faked. Returns true if the message was changed
+func (c *Client) applyIdentityTags(m *irc.Message) bool {
+	identityTags := c.Gateway.Config.IdentityTags
+	if len(identityTags) == 0 || !c.Gateway.messageTags.CanMessageContainClientTags(m) {
+		return false
+	}
+
+	changed := false
+	for idx := range identityTags {
+		identityTag := &identityTags[idx]
+		if _, exists := m.Tags[identityTag.Tag]; exists {
+			delete(m.Tags, identityTag.Tag)
+			changed = true
+		}
+		if val := identityTag.identityTagValue(c.Identity); val != "" {
+			m.Tags[identityTag.Tag] = val
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// storeIdentityTags - Store the identity tags of a message sent by the client so that they can be
+// restored onto the copies that clients on this gateway receive, and remove them from the message
+// before it goes upstream. Any other client tags are left for the IRC server to pass on
+func (c *Client) storeIdentityTags(m *irc.Message) {
+	identityTagged := &irc.Message{
+		Command: m.Command,
+		Params:  m.Params,
+		Tags:    make(map[string]string),
+	}
+	for _, identityTag := range c.Gateway.Config.IdentityTags {
+		if val, exists := m.Tags[identityTag.Tag]; exists {
+			identityTagged.Tags[identityTag.Tag] = val
+			delete(m.Tags, identityTag.Tag)
+		}
+	}
+
+	c.Gateway.messageTags.AddTagsFromMessage(c, c.IrcState.Nick, identityTagged)
+}
+
+// restoreIdentityTags - Add back the identity tags stored for a message sent through this gateway
+// to a client that gets every other client tag from the IRC server. Returns true if any were added
+func (c *Client) restoreIdentityTags(m *irc.Message) bool {
+	if len(c.Gateway.Config.IdentityTags) == 0 {
+		return false
+	}
+
+	stored, exists := c.Gateway.messageTags.GetTagsFromMessage(c, m.Prefix.Nick, m)
+	if !exists {
+		return false
+	}
+
+	restored := false
+	for _, identityTag := range c.Gateway.Config.IdentityTags {
+		if val, exists := stored.Tags[identityTag.Tag]; exists {
+			m.Tags[identityTag.Tag] = val
+			restored = true
+		}
+	}
+
+	return restored
+}
+
+// removeIdentityTags - Remove the configured identity tags from a message received from the IRC
+// server. The real tags are restored from the messages sent through this gateway, so any others
+// were added by someone else. Returns true if any were removed
+func (s *Gateway) removeIdentityTags(m *irc.Message) bool {
+	removed := false
+	for _, identityTag := range s.Config.IdentityTags {
+		if _, exists := m.Tags[identityTag.Tag]; exists {
+			delete(m.Tags, identityTag.Tag)
+			removed = true
+		}
+	}
+
+	return removed
+}
@@ -0,0 +1,205 @@
+package webircgateway
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	ControlCommandRegister("upstream-latency", controlUpstreamLatency)
+}
+
+// latencyPingPrefix - Marks the PINGs sent by the gateway so that their PONGs are not passed
+// on to clients. The send time in unix nanoseconds follows it
+const latencyPingPrefix = "webircgateway-latency-"
+
+// How much each new round-trip time moves the smoothed latency of an upstream
+const latencySmoothing = 0.2
+
+// The latency strategy picks between upstreams within this factor of the fastest one so
+// that a slightly faster upstream does not take every new client
+const latencyTolerance = 1.5
+
+// upstreamLatency - The smoothed round-trip time to an upstream
+type upstreamLatency struct {
+	rtt     time.Duration
+	samples int
+	updated time.Time
+}
+
+// upstreamLatencyTracker - Combines the round-trip times measured by clients into a smoothed
+// latency for each upstream, keyed by "host:port"
+type upstreamLatencyTracker struct {
+	mu        sync.Mutex
+	upstreams map[string]*upstreamLatency
+}
+
+func newUpstreamLatencyTracker() *upstreamLatencyTracker {
+	return &upstreamLatencyTracker{
+		upstreams: make(map[string]*upstreamLatency),
+	}
+}
+
+func upstreamLatencyKey(upstream *ConfigUpstream) string {
+	return fmt.Sprintf("%s:%d", upstream.Hostname, upstream.Port)
+}
+
+func (t *upstreamLatencyTracker) record(key string, rtt time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	latency, exists := t.upstreams[key]
+	if !exists {
+		latency = &upstreamLatency{rtt: rtt}
+		t.upstreams[key] = latency
+	} else {
+		latency.rtt += time.Duration(float64(rtt-latency.rtt) * latencySmoothing)
+	}
+	latency.samples++
+	latency.updated = time.Now()
+}
+
+// snapshot - The latencies that have been measured since maxAge ago
+func (t *upstreamLatencyTracker) snapshot(maxAge time.Duration) map[string]upstreamLatency {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	latencies := make(map[string]upstreamLatency)
+	for key, latency := range t.upstreams {
+		if time.Since(latency.updated) <= maxAge {
+			latencies[key] = *latency
+		}
+	}
+	return latencies
+}
+
+// latencyMaxAge - How long a measurement is trusted for before the upstream counts as unmeasured
+func (s *Gateway) latencyMaxAge() time.Duration {
+	maxAge := time.Second * time.Duration(s.Config.UpstreamPingInterval*3)
+	if maxAge < time.Minute {
+		maxAge = time.Minute
+	}
+	return maxAge
+}
+
+// UpstreamLatencies - The smoothed round-trip time to each upstream that has been measured
+// recently, keyed by "host:port"
+func (s *Gateway) UpstreamLatencies() map[string]time.Duration {
+	latencies := make(map[string]time.Duration)
+	for key, latency := range s.latencyTracker.snapshot(s.latencyMaxAge()) {
+		latencies[key] = latency.rtt
+	}
+	return latencies
+}
+
+// UpstreamLatency - The last measured round-trip time to the clients upstream, 0 if not measured
+func (c *Client) UpstreamLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.upstreamLatency))
+}
+
+func (s *Gateway) startLatencyMonitor() {
+	go func() {
+		for {
+			// Read the interval each time so that it may be changed by reloading the config
+			interval := s.Config.UpstreamPingInterval
+			if interval <= 0 {
+				time.Sleep(time.Second * 5)
+				continue
+			}
+			time.Sleep(time.Second * time.Duration(interval))
+			s.pingUpstreams()
+		}
+	}()
+}
+
+// pingUpstreams - Send a timed PING to the upstream of each registered client
+func (s *Gateway) pingUpstreams() {
+	for _, c := range s.AllClients() {
+		if c.State() != ClientStateConnected {
+			continue
+		}
+		c.sendUpstreamLine("PING :" + latencyPingPrefix + strconv.FormatInt(time.Now().UnixNano(), 10))
+	}
+}
+
+// handleLatencyPong - Record the round-trip time from a PONG to one of the gateways PINGs.
+// Returns false if the PONG was not a reply to the gateway
+func (c *Client) handleLatencyPong(token string) bool {
+	if !strings.HasPrefix(token, latencyPingPrefix) {
+		return false
+	}
+
+	sent, err := strconv.ParseInt(strings.TrimPrefix(token, latencyPingPrefix), 10, 64)
+	if err != nil {
+		return false
+	}
+
+	rtt := time.Since(time.Unix(0, sent))
+	if rtt < 0 {
+		return true
+	}
+
+	atomic.StoreInt64(&c.upstreamLatency, int64(rtt))
+	c.Gateway.latencyTracker.record(upstreamLatencyKey(c.UpstreamConfig), rtt)
+	return true
+}
+
+// findUpstreamByLatency - Pick one of the upstreams that are close to the lowest latency.
+// Upstreams without a recent measurement are included so that they get measured
+func (s *Gateway) findUpstreamByLatency(upstreams []ConfigUpstream) ConfigUpstream {
+	latencies := s.UpstreamLatencies()
+
+	var best time.Duration
+	for idx := range upstreams {
+		rtt, measured := latencies[upstreamLatencyKey(&upstreams[idx])]
+		if measured && (best == 0 || rtt < best) {
+			best = rtt
+		}
+	}
+
+	candidates := []ConfigUpstream{}
+	for idx := range upstreams {
+		rtt, measured := latencies[upstreamLatencyKey(&upstreams[idx])]
+		if !measured || float64(rtt) <= float64(best)*latencyTolerance {
+			candidates = append(candidates, upstreams[idx])
+		}
+	}
+
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// controlUpstreamLatency - List the measured latency of each upstream
+func controlUpstreamLatency(gateway *Gateway, args []string) (string, error) {
+	latencies := gateway.latencyTracker.snapshot(gateway.latencyMaxAge())
+	if len(latencies) == 0 {
+		if gateway.Config.UpstreamPingInterval <= 0 {
+			return "Upstream latency is not being measured. Set upstream_ping_interval to enable it\n", nil
+		}
+		return "No upstream latency measured yet\n", nil
+	}
+
+	keys := make([]string, 0, len(latencies))
+	for key := range latencies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	out := ""
+	for _, key := range keys {
+		latency := latencies[key]
+		out += fmt.Sprintf(
+			"%s rtt=%.1fms samples=%d updated=%ds ago\n",
+			key,
+			float64(latency.rtt)/float64(time.Millisecond),
+			latency.samples,
+			int(time.Since(latency.updated).Seconds()),
+		)
+	}
+	return out, nil
+}
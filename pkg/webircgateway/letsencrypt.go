@@ -2,9 +2,11 @@ package webircgateway
 
 import (
 	"context"
+	"crypto/tls"
 	"strings"
 	"sync"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -14,6 +16,8 @@ type LEManager struct {
 	Mutex   sync.Mutex
 	Manager *autocert.Manager
 	gateway *Gateway
+	// httpChallenge is set once the http-01 challenge handler has been added
+	httpChallenge bool
 }
 
 func NewLetsEncryptManager(gateway *Gateway) *LEManager {
@@ -34,8 +38,29 @@ func (le *LEManager) Get(certCacheDir string) *autocert.Manager {
 				return nil
 			},
 		}
-		le.gateway.HttpRouter.Handle("/.well-known/", le.Manager.HTTPHandler(nil))
 	}
 
 	return le.Manager
 }
+
+// EnableHTTPChallenge - Allow the http-01 challenge type as well as tls-alpn-01. This requires a
+// HTTP server on port 80
+func (le *LEManager) EnableHTTPChallenge() {
+	le.Mutex.Lock()
+	defer le.Mutex.Unlock()
+
+	if le.Manager != nil && !le.httpChallenge {
+		le.httpChallenge = true
+		le.gateway.HttpRouter.Handle("/.well-known/", le.Manager.HTTPHandler(nil))
+	}
+}
+
+// TLSConfig - A TLS config for serving letsencrypt certificates. tls-alpn-01 challenges are
+// answered during the TLS handshake so they work on HTTPS only hosts
+func (le *LEManager) TLSConfig(manager *autocert.Manager) *tls.Config {
+	return &tls.Config{
+		GetCertificate: manager.GetCertificate,
+		// No HTTP2 since it doesn't support websockets
+		NextProtos: []string{"http/1.1", acme.ALPNProto},
+	}
+}
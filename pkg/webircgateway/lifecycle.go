@@ -0,0 +1,209 @@
+package webircgateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Drain - Stop accepting new client connections. Existing clients are left connected
+func (s *Gateway) Drain() {
+	if atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		s.Log(2, "Draining. No longer accepting new clients")
+	}
+}
+
+// Shutdown - Stop accepting new clients and close the gateway. Connected clients are sent the
+// shutdown message as a NOTICE and given up to the drain timeout to disconnect themselves, then
+// the rest are sent it as an ERROR and QUIT their upstreams. Cancelling ctx cuts the drain short
+func (s *Gateway) Shutdown(ctx context.Context) error {
+	first := false
+	s.closeOnce.Do(func() { first = true })
+	if !first {
+		return errors.New("Gateway is already shutting down")
+	}
+
+	s.Drain()
+	hook := HookGatewayClosing{}
+	hook.Dispatch("gateway.closing")
+
+	drainTimeout := time.Second * time.Duration(s.Config.ShutdownDrainTimeout)
+	if drainTimeout > 0 && s.Clients.Count() > 0 {
+		if s.Config.ShutdownMessage != "" {
+			s.Broadcast(BroadcastNotice, s.Config.ShutdownMessage, BroadcastFilter{})
+		}
+		s.Log(2, "Waiting up to %s for %d clients to disconnect", drainTimeout, s.Clients.Count())
+		drainCtx, cancel := context.WithTimeout(ctx, drainTimeout)
+		s.waitForClients(drainCtx)
+		cancel()
+	}
+
+	s.closeClients(ctx)
+	s.closeServers()
+	return ctx.Err()
+}
+
+// closeClients - Disconnect the remaining clients, quitting their upstreams, and give them a
+// moment to receive the shutdown message before the process exits
+func (s *Gateway) closeClients(ctx context.Context) {
+	clients := s.AllClients()
+	if len(clients) == 0 {
+		return
+	}
+
+	message := stripLineBreaks(s.Config.ShutdownMessage)
+	quitLine := "QUIT"
+	if message != "" {
+		quitLine = "QUIT :" + message
+	}
+
+	s.Log(2, "Closing %d clients", len(clients))
+	for _, c := range clients {
+		if message != "" {
+			c.SendIrcError(message)
+		}
+		c.SendClientSignal("state", "closed", "gateway_shutdown")
+		c.sendUpstreamLine(quitLine)
+		c.StartShutdown("gateway_shutdown")
+	}
+
+	closeCtx, cancel := context.WithTimeout(ctx, time.Second*2)
+	s.waitForClients(closeCtx)
+	cancel()
+
+	// Clients are removed before their transports have finished writing
+	time.Sleep(time.Millisecond * 250)
+}
+
+// waitForClients - Wait until every client has disconnected or ctx is done
+func (s *Gateway) waitForClients(ctx context.Context) {
+	for s.Clients.Count() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
+
+// IsDraining - Check if the gateway has been told to stop accepting new clients
+func (s *Gateway) IsDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// SetMaintenance - Turn maintenance mode on or off. New clients are refused with the
+// configured maintenance message while it is on. Existing clients are left connected
+func (s *Gateway) SetMaintenance(enabled bool) {
+	if enabled && atomic.CompareAndSwapInt32(&s.maintenance, 0, 1) {
+		s.Log(2, "Maintenance mode enabled. Refusing new clients")
+	} else if !enabled && atomic.CompareAndSwapInt32(&s.maintenance, 1, 0) {
+		s.Log(2, "Maintenance mode disabled")
+	}
+}
+
+// IsInMaintenance - Check if the gateway is in maintenance mode
+func (s *Gateway) IsInMaintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) == 1
+}
+
+// IsAcceptingClients - Check if new client connections may be made to this gateway
+func (s *Gateway) IsAcceptingClients() bool {
+	return !s.IsDraining() && !s.IsInMaintenance() && !s.IsUnderMemoryPressure()
+}
+
+// NotAcceptingClientsMessage - The message shown to clients that are refused a connection
+func (s *Gateway) NotAcceptingClientsMessage() string {
+	if s.IsInMaintenance() && !s.IsDraining() {
+		return s.Config.MaintenanceMessage
+	}
+	if s.IsUnderMemoryPressure() && !s.IsDraining() {
+		return "The server is busy, please try again later"
+	}
+	return "Not accepting new clients"
+}
+
+func (s *Gateway) initLifecycleRoutes() {
+	// Liveness. The process is up and serving HTTP requests
+	s.HttpRouter.HandleFunc("/webirc/_live", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	// Readiness. Stops reporting as ready as soon as draining starts so that load balancers
+	// stop sending new connections here before the process is terminated. Maintenance mode
+	// still reports as ready so that clients reach the gateway and see the maintenance message
+	s.HttpRouter.HandleFunc("/webirc/_ready", func(w http.ResponseWriter, r *http.Request) {
+		if s.IsDraining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("draining"))
+			return
+		}
+
+		if s.IsUnderMemoryPressure() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("memory_pressure"))
+			return
+		}
+
+		w.Write([]byte("ok"))
+	})
+
+	// Start draining. Intended for a Kubernetes preStop hook:
+	//   POST /webirc/admin/drain?wait=30 blocks for up to 30 seconds while clients disconnect
+	s.HttpRouter.HandleFunc("/webirc/admin/drain", func(w http.ResponseWriter, r *http.Request) {
+		if !isPrivateIP(s.GetRemoteAddressFromRequest(r)) {
+			w.WriteHeader(403)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !s.checkDrainAuth(w, r) {
+			return
+		}
+
+		// Browsers send basic auth credentials along with requests from any page
+		if !isSameOriginRequest(r) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Cross origin requests are not allowed"))
+			return
+		}
+
+		s.Drain()
+
+		wait, _ := strconv.Atoi(r.URL.Query().Get("wait"))
+		deadline := time.Now().Add(time.Second * time.Duration(wait))
+		for s.Clients.Count() > 0 && time.Now().Before(deadline) {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Millisecond * 500):
+			}
+		}
+
+		out, _ := json.Marshal(map[string]interface{}{
+			"draining": true,
+			"clients":  s.Clients.Count(),
+		})
+		w.Write(out)
+	})
+}
+
+// checkDrainAuth - Require the drain_token as a bearer token, or the admin login. Writes an error
+// response and returns false if the request is not allowed
+func (s *Gateway) checkDrainAuth(w http.ResponseWriter, r *http.Request) bool {
+	token := s.Config.AdminDrainToken
+	authHeader := r.Header.Get("Authorization")
+	if token != "" && subtle.ConstantTimeCompare([]byte(authHeader), []byte("Bearer "+token)) == 1 {
+		return true
+	}
+
+	return s.checkAdminAuth(w, r)
+}
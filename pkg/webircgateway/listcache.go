@@ -0,0 +1,142 @@
+package webircgateway
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// The most LIST replies kept at once, one for each network and set of LIST parameters
+const maxListCacheEntries = 100
+
+// The most channels kept in a single LIST reply. Larger replies are not cached
+const maxListCacheLines = 50000
+
+// listCacheEntry - A complete LIST reply from RPL_LISTSTART to RPL_LISTEND
+type listCacheEntry struct {
+	messages []*irc.Message
+	expires  time.Time
+}
+
+// listCache - Recent LIST replies shared between every client on the same network
+type listCache struct {
+	mu      sync.Mutex
+	entries map[string]*listCacheEntry
+}
+
+func newListCache() *listCache {
+	return &listCache{
+		entries: make(map[string]*listCacheEntry),
+	}
+}
+
+// get - The cached reply for the key. nil if there isn't one or it has expired
+func (lc *listCache) get(key string) []*irc.Message {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	entry, exists := lc.entries[key]
+	if !exists || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry.messages
+}
+
+func (lc *listCache) set(key string, messages []*irc.Message, ttl time.Duration) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	now := time.Now()
+	if len(lc.entries) >= maxListCacheEntries {
+		for entryKey, entry := range lc.entries {
+			if now.After(entry.expires) {
+				delete(lc.entries, entryKey)
+			}
+		}
+	}
+	if _, exists := lc.entries[key]; !exists && len(lc.entries) >= maxListCacheEntries {
+		return
+	}
+
+	lc.entries[key] = &listCacheEntry{
+		messages: messages,
+		expires:  now.Add(ttl),
+	}
+}
+
+// listCollector - A LIST reply being received for a client that will be cached once complete
+type listCollector struct {
+	key      string
+	messages []*irc.Message
+}
+
+// networkCacheKey - Identifies the IRC network of the clients upstream so that clients on the
+// same network share cached replies
+func (c *Client) networkCacheKey() string {
+	if c.UpstreamConfig.NetworkCommonAddress != "" {
+		return c.UpstreamConfig.NetworkCommonAddress
+	}
+	if c.UpstreamConfig.NetworkName != "" {
+		return c.UpstreamConfig.NetworkName
+	}
+	return upstreamLatencyKey(c.UpstreamConfig)
+}
+
+// listFromCache - Answer a LIST from the cache if the network has been listed recently, otherwise
+// start collecting the reply for the cache. Returns true if the LIST was answered
+func (c *Client) listFromCache(m *irc.Message) bool {
+	ttl := c.UpstreamConfig.ListCacheTTL
+	if ttl <= 0 || c.State() != ClientStateConnected {
+		return false
+	}
+
+	key := c.networkCacheKey() + " " + strings.ToLower(strings.Join(m.Params, " "))
+	messages := c.Gateway.listCache.get(key)
+	if messages == nil {
+		c.listCollect = &listCollector{key: key}
+		return false
+	}
+
+	c.Log(1, "Answering LIST from the cache with %d lines", len(messages))
+	for _, cached := range messages {
+		reply := *cached
+		reply.Params = append([]string{c.IrcState.Nick}, cached.Params[1:]...)
+		c.SendClientSignal("data", reply.ToLine())
+	}
+	return true
+}
+
+// listLineFromUpstream - Collect the LIST reply being received for the cache
+func (c *Client) listLineFromUpstream(m *irc.Message) {
+	collect := c.listCollect
+	if collect == nil || len(m.Params) == 0 {
+		return
+	}
+
+	switch m.Command {
+	case "321", "322":
+		if len(collect.messages) >= maxListCacheLines {
+			c.listCollect = nil
+			return
+		}
+	case "323":
+	case "263", "416":
+		// RPL_TRYAGAIN or ERR_TOOMANYMATCHES, there is no complete reply to cache
+		c.listCollect = nil
+		return
+	default:
+		return
+	}
+
+	cached := *m
+	cached.Tags = make(map[string]string)
+	collect.messages = append(collect.messages, &cached)
+
+	if m.Command == "323" {
+		c.listCollect = nil
+		ttl := time.Second * time.Duration(c.UpstreamConfig.ListCacheTTL)
+		c.Gateway.listCache.set(collect.key, collect.messages, ttl)
+	}
+}
@@ -0,0 +1,106 @@
+package webircgateway
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// New clients are accepted again once memory use drops below this fraction of the limits
+const memoryResumeRatio = 0.9
+
+// IsUnderMemoryPressure - Check if memory use is over the configured limits
+func (s *Gateway) IsUnderMemoryPressure() bool {
+	return atomic.LoadInt32(&s.memoryPressure) == 1
+}
+
+func (s *Gateway) maybeStartMemoryMonitor() {
+	if s.Config.MemoryMaxHeapMB <= 0 && s.Config.MemoryMaxRssMB <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			interval := s.Config.MemoryCheckInterval
+			if interval <= 0 {
+				interval = 5
+			}
+			time.Sleep(time.Second * time.Duration(interval))
+			s.checkMemory()
+		}
+	}()
+}
+
+// checkMemory - Compare the current memory use against the limits and shed load if needed
+func (s *Gateway) checkMemory() {
+	mem := &runtime.MemStats{}
+	runtime.ReadMemStats(mem)
+	heapMB := float64(mem.HeapInuse) / 1024 / 1024
+	rssMB := float64(processRss(mem)) / 1024 / 1024
+
+	maxHeap := float64(s.Config.MemoryMaxHeapMB)
+	maxRss := float64(s.Config.MemoryMaxRssMB)
+
+	overLimit := (maxHeap > 0 && heapMB > maxHeap) || (maxRss > 0 && rssMB > maxRss)
+	underResume := (maxHeap <= 0 || heapMB < maxHeap*memoryResumeRatio) &&
+		(maxRss <= 0 || rssMB < maxRss*memoryResumeRatio)
+
+	if overLimit && atomic.CompareAndSwapInt32(&s.memoryPressure, 0, 1) {
+		s.Log(3, "Memory use is over the limit (heap %.0fMB, rss %.0fMB). Not accepting new clients", heapMB, rssMB)
+	} else if underResume && atomic.CompareAndSwapInt32(&s.memoryPressure, 1, 0) {
+		s.Log(2, "Memory use is back under the limit (heap %.0fMB, rss %.0fMB). Accepting new clients", heapMB, rssMB)
+	}
+
+	if overLimit && s.Config.MemoryShedIdle > 0 {
+		s.shedIdleClients(time.Second*time.Duration(s.Config.MemoryShedIdle), s.Config.MemoryShedBatch)
+	}
+}
+
+// shedIdleClients - Disconnect up to max of the clients that have been idle the longest, as long
+// as they have been idle for at least minIdle
+func (s *Gateway) shedIdleClients(minIdle time.Duration, max int) {
+	idleSince := time.Now().Add(-minIdle).UnixNano()
+
+	idle := []*Client{}
+	for _, c := range s.AllClients() {
+		if c.State() != ClientStateEnding && atomic.LoadInt64(&c.lastActivity) < idleSince {
+			idle = append(idle, c)
+		}
+	}
+
+	sort.Slice(idle, func(i, j int) bool {
+		return atomic.LoadInt64(&idle[i].lastActivity) < atomic.LoadInt64(&idle[j].lastActivity)
+	})
+	if max > 0 && len(idle) > max {
+		idle = idle[:max]
+	}
+
+	for _, c := range idle {
+		c.Log(2, "Disconnecting idle client to free memory")
+		c.SendGatewayError(FailLowResources, "The server is low on resources, please reconnect later")
+		c.SendClientSignal("state", "closed", "err_resources")
+		c.StartShutdown("memory_pressure")
+	}
+}
+
+// processRss - The resident set size of this process in bytes. Falls back to the memory
+// obtained from the OS by the Go runtime where /proc is not available
+func processRss(mem *runtime.MemStats) uint64 {
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+	if err == nil {
+		fields := strings.Fields(string(statm))
+		if len(fields) > 1 {
+			pages, err := strconv.ParseUint(fields[1], 10, 64)
+			if err == nil {
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+
+	return mem.Sys
+}
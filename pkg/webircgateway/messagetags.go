@@ -1,6 +1,8 @@
 package webircgateway
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"strings"
 	"sync"
 	"time"
@@ -9,19 +11,34 @@ import (
 	"github.com/kiwiirc/webircgateway/pkg/irc"
 )
 
+// How long client tags are kept for so that they can be restored onto the copies of a message
+// that other clients receive from the IRC server
+const messageTagsLifetime = time.Second * 30
+
 type MessageTagManager struct {
-	Mutex     sync.Mutex
-	knownTags map[uint64]MessageTags
-	gcTimes   map[uint64]time.Time
+	Mutex sync.Mutex
+	// network > casemapped sender nick > message hash > tags
+	knownTags map[string]map[string]map[uint64]MessageTags
+	hits      uint64
+	misses    uint64
 }
 type MessageTags struct {
 	Tags map[string]string
+	// IDs of the clients this message has already been delivered to
+	recipients map[uint64]bool
+	created    time.Time
+}
+
+// MessageTagStats - Counters for the stored client message tags
+type MessageTagStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
 }
 
 func NewMessageTagManager() *MessageTagManager {
 	tm := &MessageTagManager{
-		knownTags: make(map[uint64]MessageTags),
-		gcTimes:   make(map[uint64]time.Time),
+		knownTags: make(map[string]map[string]map[uint64]MessageTags),
 	}
 
 	go tm.RunGarbageCollectionLoop()
@@ -38,17 +55,72 @@ func (tags *MessageTagManager) CanMessageContainClientTags(msg *irc.Message) boo
 
 func (tags *MessageTagManager) RunGarbageCollectionLoop() {
 	for {
-		tags.Mutex.Lock()
-		for messageHash, timeCreated := range tags.gcTimes {
-			if timeCreated.Add(time.Second * 30).After(time.Now()) {
-				delete(tags.knownTags, messageHash)
+		time.Sleep(messageTagsLifetime)
+		tags.removeExpired(time.Now().Add(-messageTagsLifetime))
+	}
+}
+
+// removeExpired - Remove any tags that were stored before expiry
+func (tags *MessageTagManager) removeExpired(expiry time.Time) {
+	tags.Mutex.Lock()
+	defer tags.Mutex.Unlock()
+
+	for network, nicks := range tags.knownTags {
+		for nick, messages := range nicks {
+			for msgHash, msgTags := range messages {
+				if msgTags.created.Before(expiry) {
+					delete(messages, msgHash)
+				}
+			}
+			if len(messages) == 0 {
+				delete(nicks, nick)
 			}
+		}
+		if len(nicks) == 0 {
+			delete(tags.knownTags, network)
+		}
+	}
+}
+
+// Stats - The number of stored messages and how often stored tags were found for a message
+func (tags *MessageTagManager) Stats() MessageTagStats {
+	tags.Mutex.Lock()
+	defer tags.Mutex.Unlock()
 
+	stats := MessageTagStats{Hits: tags.hits, Misses: tags.misses}
+	for _, nicks := range tags.knownTags {
+		for _, messages := range nicks {
+			stats.Entries += len(messages)
 		}
-		tags.Mutex.Unlock()
+	}
 
-		time.Sleep(time.Second * 30)
+	return stats
+}
+
+// get - Find the stored tags for a message. Mutex must be held
+func (tags *MessageTagManager) get(network string, nick string, msgHash uint64) (MessageTags, bool) {
+	msgTags, tagsExist := tags.knownTags[network][nick][msgHash]
+	if tagsExist {
+		tags.hits++
+	} else {
+		tags.misses++
+	}
+	return msgTags, tagsExist
+}
+
+// set - Store the tags for a message. Mutex must be held
+func (tags *MessageTagManager) set(network string, nick string, msgHash uint64, msgTags MessageTags) {
+	nicks, ok := tags.knownTags[network]
+	if !ok {
+		nicks = make(map[string]map[uint64]MessageTags)
+		tags.knownTags[network] = nicks
+	}
+	messages, ok := nicks[nick]
+	if !ok {
+		messages = make(map[uint64]MessageTags)
+		nicks[nick] = messages
 	}
+	messages[msgHash] = msgTags
 }
 
 func (tags *MessageTagManager) AddTagsFromMessage(client *Client, fromNick string, msg *irc.Message) {
@@ -56,20 +128,18 @@ func (tags *MessageTagManager) AddTagsFromMessage(client *Client, fromNick strin
 		return
 	}
 
-	clientTags := MessageTags{
-		Tags: make(map[string]string),
-	}
+	clientTags := newMessageTags()
 	for tagName, tagVal := range msg.Tags {
 		if len(tagName) > 0 && tagName[0] == '+' {
 			clientTags.Tags[tagName] = tagVal
 		}
 	}
 
-	if len(clientTags.Tags) > 0 {
+	// Only the msgid tag exists so there's nothing worth storing
+	if len(clientTags.Tags) > 1 {
+		network, nick, msgHash := tags.messageKey(client, fromNick, msg)
 		tags.Mutex.Lock()
-		msgHash := tags.messageHash(client, fromNick, msg)
-		tags.knownTags[msgHash] = clientTags
-		tags.gcTimes[msgHash] = time.Now()
+		tags.set(network, nick, msgHash, clientTags)
 		tags.Mutex.Unlock()
 	}
 }
@@ -79,25 +149,63 @@ func (tags *MessageTagManager) GetTagsFromMessage(client *Client, fromNick strin
 		return MessageTags{}, false
 	}
 
-	msgHash := tags.messageHash(client, fromNick, msg)
+	network, nick, msgHash := tags.messageKey(client, fromNick, msg)
+
+	tags.Mutex.Lock()
+	defer tags.Mutex.Unlock()
+
+	return tags.get(network, nick, msgHash)
+}
+
+// GetOrCreateTags - Get the tags for a message being delivered to client, creating a new msgid
+// if the message has not been seen before. Every recipient of the same message gets the same
+// msgid, but a client receiving an identical message a second time is given a new one.
+func (tags *MessageTagManager) GetOrCreateTags(client *Client, fromNick string, msg *irc.Message) MessageTags {
+	network, nick, msgHash := tags.messageKey(client, fromNick, msg)
 
 	tags.Mutex.Lock()
 	defer tags.Mutex.Unlock()
 
-	clientTags, tagsExist := tags.knownTags[msgHash]
-	if !tagsExist {
-		return clientTags, false
+	msgTags, tagsExist := tags.get(network, nick, msgHash)
+	if !tagsExist || msgTags.recipients[client.Id] {
+		msgTags = newMessageTags()
+		tags.set(network, nick, msgHash, msgTags)
+	}
+	msgTags.recipients[client.Id] = true
+
+	// Copy the tags so that the caller can read them without holding the lock
+	ret := MessageTags{Tags: make(map[string]string, len(msgTags.Tags))}
+	for tagName, tagVal := range msgTags.Tags {
+		ret.Tags[tagName] = tagVal
+	}
+
+	return ret
+}
+
+func newMessageTags() MessageTags {
+	return MessageTags{
+		Tags:       map[string]string{"msgid": newMsgID()},
+		recipients: make(map[uint64]bool),
+		created:    time.Now(),
 	}
+}
 
-	return clientTags, true
+// newMsgID - Generate a random, URL safe message ID
+func newMsgID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
 }
 
-func (tags *MessageTagManager) messageHash(client *Client, fromNick string, msg *irc.Message) uint64 {
+// messageKey - The network, casemapped sender nick and a hash of the target and text that a
+// message is stored under
+func (tags *MessageTagManager) messageKey(client *Client, fromNick string, msg *irc.Message) (string, string, uint64) {
 	h := xxhash.New64()
-	h.WriteString(strings.ToLower(client.UpstreamConfig.Hostname))
-	h.WriteString(strings.ToLower(fromNick))
-	// make target case insensitive
-	h.WriteString(strings.ToLower(msg.GetParam(0, "")))
+	// make the target case insensitive
+	h.WriteString(client.IrcState.ISupport.CaseFold(msg.GetParam(0, "")))
+	h.WriteString(" ")
 	h.WriteString(msg.GetParam(1, ""))
-	return h.Sum64()
+
+	network := strings.ToLower(client.UpstreamConfig.Hostname)
+	return network, client.IrcState.ISupport.CaseFold(fromNick), h.Sum64()
 }
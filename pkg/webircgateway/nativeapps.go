@@ -0,0 +1,95 @@
+package webircgateway
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// The number of addresses a native app connection limiter is kept for before full ones are removed
+const maxNativeAppLimiters = 10000
+
+// nativeAppLimiter - Limits how often native app connections may be made from each address
+type nativeAppLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newNativeAppLimiter() *nativeAppLimiter {
+	return &nativeAppLimiter{
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// allow - Take a connection from the addresses limit. Returns false if it has none left
+func (l *nativeAppLimiter) allow(addr string, perMinute int, burst int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit := rate.Every(time.Minute / time.Duration(perMinute))
+	limiter, exists := l.limiters[addr]
+	if !exists {
+		l.prune()
+		limiter = rate.NewLimiter(limit, burst)
+		l.limiters[addr] = limiter
+	} else if limiter.Limit() != limit || limiter.Burst() != burst {
+		// The limits may have been changed by reloading the config
+		limiter.SetLimit(limit)
+		limiter.SetBurst(burst)
+	}
+
+	return limiter.Allow()
+}
+
+// prune - Remove the limiters of addresses that have not connected recently
+func (l *nativeAppLimiter) prune() {
+	if len(l.limiters) < maxNativeAppLimiters {
+		return
+	}
+
+	for addr, limiter := range l.limiters {
+		if limiter.Tokens() >= float64(limiter.Burst()) {
+			delete(l.limiters, addr)
+		}
+	}
+}
+
+// isNativeAppOrigin - Check if an origin is one used by native app wrappers such as Capacitor or
+// Tauri. Native apps may also not send an origin at all
+func (s *Gateway) isNativeAppOrigin(originHeader string) bool {
+	if originHeader == "" {
+		return true
+	}
+
+	for _, originMatch := range s.Config.NativeAppOrigins {
+		if originMatch.Match(originHeader) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowNativeAppConnection - Apply the native app connection limit to a connection from remoteAddr.
+// Browser connections are not limited here. Returns false if the connection should be refused
+func (s *Gateway) allowNativeAppConnection(r *http.Request, remoteAddr string) bool {
+	perMinute := s.Config.NativeAppConnectRate
+	if perMinute <= 0 {
+		return true
+	}
+
+	originHeader := strings.ToLower(r.Header.Get("Origin"))
+	if !s.isNativeAppOrigin(originHeader) {
+		return true
+	}
+
+	if s.nativeAppLimiter.allow(remoteAddr, perMinute, s.Config.NativeAppConnectBurst) {
+		return true
+	}
+
+	s.Log(2, "Native app connection limit reached for %s (origin %#v)", remoteAddr, originHeader)
+	return false
+}
@@ -0,0 +1,180 @@
+package webircgateway
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// The most ISON and USERHOST results kept at once across every network
+const maxNickCacheEntries = 100000
+
+// nickCacheEntry - What the IRCd last replied about a nick. For ISON the nick as the IRCd
+// spells it if online, for USERHOST its reply token. Empty if the nick was offline
+type nickCacheEntry struct {
+	value   string
+	expires time.Time
+}
+
+// nickCache - Recent ISON and USERHOST results shared between every client on the same network
+// so that clients polling the same nicks don't each ask the IRCd
+type nickCache struct {
+	mu      sync.Mutex
+	entries map[string]nickCacheEntry
+}
+
+func newNickCache() *nickCache {
+	return &nickCache{
+		entries: make(map[string]nickCacheEntry),
+	}
+}
+
+// get - The cached result for the key. found is false if there isn't one or it has expired
+func (nc *nickCache) get(key string) (value string, found bool) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	entry, exists := nc.entries[key]
+	if !exists || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.value, true
+}
+
+func (nc *nickCache) set(key string, value string, ttl time.Duration) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	now := time.Now()
+	if len(nc.entries) >= maxNickCacheEntries {
+		for entryKey, entry := range nc.entries {
+			if now.After(entry.expires) {
+				delete(nc.entries, entryKey)
+			}
+		}
+	}
+	if _, exists := nc.entries[key]; !exists && len(nc.entries) >= maxNickCacheEntries {
+		return
+	}
+
+	nc.entries[key] = nickCacheEntry{value: value, expires: now.Add(ttl)}
+}
+
+// userhostRequest - A USERHOST sent upstream by the client. Nicks found in the nick cache are not
+// asked about again
+type userhostRequest struct {
+	asked        []string
+	cachedTokens []string
+}
+
+func (c *Client) nickCacheKey(kind string, nick string) string {
+	return c.networkCacheKey() + " " + kind + " " + c.IrcState.ISupport.CaseFold(nick)
+}
+
+func (c *Client) nickCacheTTL() time.Duration {
+	return time.Second * time.Duration(c.UpstreamConfig.NickCacheTTL)
+}
+
+// lookupIsonCache - Split the nicks of an ISON into those that need asking about and the cached
+// ones that are online
+func (c *Client) lookupIsonCache(nicks []string) (asked []string, cachedOnline []string) {
+	if c.UpstreamConfig.NickCacheTTL <= 0 {
+		return nicks, nil
+	}
+
+	for _, nick := range nicks {
+		value, found := c.Gateway.nickCache.get(c.nickCacheKey("ison", nick))
+		if !found {
+			asked = append(asked, nick)
+		} else if value != "" {
+			cachedOnline = append(cachedOnline, value)
+		}
+	}
+	return asked, cachedOnline
+}
+
+// storeIsonCache - Cache the reply to an ISON for the nicks that were asked about
+func (c *Client) storeIsonCache(asked []string, online []string) {
+	if c.UpstreamConfig.NickCacheTTL <= 0 {
+		return
+	}
+
+	onlineNicks := make(map[string]string)
+	for _, nick := range online {
+		onlineNicks[c.IrcState.ISupport.CaseFold(nick)] = nick
+	}
+	for _, nick := range asked {
+		c.Gateway.nickCache.set(c.nickCacheKey("ison", nick), onlineNicks[c.IrcState.ISupport.CaseFold(nick)], c.nickCacheTTL())
+	}
+}
+
+// userhostLineToUpstream - Answer what can be answered of a USERHOST from the nick cache and keep
+// track of the rest so that the reply can be cached. Returns the line to send, or an empty string
+// if it was answered without asking the IRCd
+func (c *Client) userhostLineToUpstream(m *irc.Message, line string) string {
+	if c.UpstreamConfig.NickCacheTTL <= 0 || strings.ToUpper(m.Command) != "USERHOST" || len(m.Params) == 0 {
+		return line
+	}
+
+	req := &userhostRequest{}
+	for _, nick := range isonNicks(m.Params) {
+		token, found := c.Gateway.nickCache.get(c.nickCacheKey("userhost", nick))
+		if !found {
+			req.asked = append(req.asked, nick)
+		} else if token != "" {
+			req.cachedTokens = append(req.cachedTokens, token)
+		}
+	}
+
+	if len(req.asked) == 0 {
+		c.SendClientSignal("data", c.userhostReply(req.cachedTokens))
+		return ""
+	}
+
+	c.userhostRequests = append(c.userhostRequests, req)
+	if len(req.cachedTokens) == 0 {
+		return line
+	}
+	return "USERHOST " + strings.Join(req.asked, " ")
+}
+
+// userhostLineFromUpstream - Cache a USERHOST reply and add the cached tokens of the nicks that
+// were not asked about. Returns the line to pass on to the client
+func (c *Client) userhostLineFromUpstream(m *irc.Message, line string) string {
+	if m.Command != "302" || len(c.userhostRequests) == 0 {
+		return line
+	}
+
+	req := c.userhostRequests[0]
+	c.userhostRequests = c.userhostRequests[1:]
+
+	// :server 302 nick :nick1*=+user@host nick2=-user@host
+	tokens := []string{}
+	if len(m.Params) > 1 {
+		tokens = isonNicks(m.Params[1:])
+	}
+	tokenNicks := make(map[string]string)
+	for _, token := range tokens {
+		nick := strings.TrimSuffix(strings.SplitN(token, "=", 2)[0], "*")
+		tokenNicks[c.IrcState.ISupport.CaseFold(nick)] = token
+	}
+	for _, nick := range req.asked {
+		c.Gateway.nickCache.set(c.nickCacheKey("userhost", nick), tokenNicks[c.IrcState.ISupport.CaseFold(nick)], c.nickCacheTTL())
+	}
+
+	if len(req.cachedTokens) == 0 {
+		return line
+	}
+	return c.userhostReply(append(req.cachedTokens, tokens...))
+}
+
+func (c *Client) userhostReply(tokens []string) string {
+	reply := irc.Message{
+		Command: "302", // RPL_USERHOST
+		Prefix:  &c.ServerMessagePrefix,
+		Params:  []string{c.IrcState.Nick, strings.Join(tokens, " ")},
+	}
+	return reply.ToLine()
+}
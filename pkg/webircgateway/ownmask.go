@@ -0,0 +1,116 @@
+package webircgateway
+
+import (
+	"strings"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// whoxFieldOrder - The order that WHOX replies list their fields in, regardless of the order
+// they were requested in
+const whoxFieldOrder = "tcuihsnfdlaor"
+
+// The most WHOX requests with different tokens that are remembered for parsing their replies
+const maxWhoxRequests = 16
+
+// trackWhoxRequest - Remember the fields asked for by a WHOX request from the client, eg.
+// WHO #channel %tcuhn,42, so that the 354 replies can be read
+func (c *Client) trackWhoxRequest(m *irc.Message) {
+	fields := m.GetParam(1, "")
+	if !strings.HasPrefix(fields, "%") {
+		return
+	}
+
+	token := ""
+	fields = fields[1:]
+	if sep := strings.Index(fields, ","); sep > -1 {
+		token = fields[sep+1:]
+		fields = fields[:sep]
+	}
+
+	if c.whoxRequests == nil || len(c.whoxRequests) >= maxWhoxRequests {
+		c.whoxRequests = make(map[string]string)
+	}
+	c.whoxRequests[token] = fields
+}
+
+// whoxReplyFields - The fields of a 354 reply keyed by their WHOX letter
+func (c *Client) whoxReplyFields(m *irc.Message) map[string]string {
+	params := m.Params[1:]
+	requested, ok := "", false
+	if len(params) > 0 {
+		requested, ok = c.whoxRequests[params[0]]
+	}
+	if !ok || !strings.Contains(requested, "t") {
+		requested, ok = c.whoxRequests[""]
+	}
+	if !ok {
+		return nil
+	}
+
+	fields := make(map[string]string)
+	for _, field := range whoxFieldOrder {
+		if !strings.ContainsRune(requested, field) {
+			continue
+		}
+		if len(params) == 0 {
+			break
+		}
+		fields[string(field)] = params[0]
+		params = params[1:]
+	}
+	return fields
+}
+
+// trackOwnMask - Keep track of the username and hostname that the IRCd shows to other users
+// for this client from the lines that reveal it
+func (c *Client) trackOwnMask(m *irc.Message) {
+	state := c.IrcState
+
+	switch m.Command {
+	case "JOIN", "PRIVMSG", "NOTICE":
+		// Our own JOINs, and echo-message, carry our full mask
+		if m.Prefix != nil && m.Prefix.Hostname != "" && state.IsOwnNick(m.Prefix.Nick) {
+			state.SetDisplayedMask(m.Prefix.Username, m.Prefix.Hostname)
+		}
+
+	case "CHGHOST":
+		// :nick!user@old.host CHGHOST user new.host
+		if len(m.Params) >= 2 && state.IsOwnNick(m.Prefix.Nick) {
+			state.SetDisplayedMask(m.Params[0], m.Params[1])
+		}
+
+	case "001":
+		// Some IRCds include the full mask in the welcome, eg. :Welcome to the network nick!user@host
+		words := strings.Split(m.GetParam(len(m.Params)-1, ""), " ")
+		mask := irc.ParseMask(words[len(words)-1])
+		if mask.Hostname != "" && state.IsOwnNick(mask.Nick) {
+			state.SetDisplayedMask(mask.Username, mask.Hostname)
+		}
+
+	case "396":
+		// :server 396 nick new.host :is now your displayed host. Some IRCds send user@new.host
+		displayed := m.GetParam(1, "")
+		if displayed == "" {
+			return
+		}
+		username := ""
+		if at := strings.LastIndex(displayed, "@"); at > -1 {
+			username = displayed[:at]
+			displayed = displayed[at+1:]
+		}
+		state.SetDisplayedMask(username, displayed)
+
+	case "352":
+		// :server 352 me #channel user host server nick H :0 realname
+		if len(m.Params) >= 6 && state.IsOwnNick(m.Params[5]) {
+			state.SetDisplayedMask(m.Params[2], m.Params[3])
+		}
+
+	case "354":
+		fields := c.whoxReplyFields(m)
+		if fields["h"] != "" && state.IsOwnNick(fields["n"]) {
+			state.SetDisplayedMask(fields["u"], fields["h"])
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package webircgateway
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// The longest list of nicks put into a single MONITOR or ISON line
+const presenceMaxLineNicks = 400
+
+// clientPresence - The nicks whose presence the gateway watches for a client. Uses MONITOR when
+// the IRCd supports it and polls with ISON otherwise. The client may use MONITOR and ISON
+// itself so replies are only passed on for the nicks the client asked about
+type clientPresence struct {
+	mu         sync.Mutex
+	started    bool
+	useMonitor bool
+	// Watched nicks and whether they are online, keyed by their casefolded nick
+	nicks map[string]*presenceNick
+	// Nicks the client is watching itself with MONITOR, casefolded
+	clientMonitors map[string]bool
+	// MONITOR and ISON lines the gateway has queued but not yet sent upstream
+	pending map[string]int
+	// The ISON requests sent upstream in order
+	isonRequests []*isonRequest
+}
+
+type presenceNick struct {
+	nick   string
+	online bool
+	known  bool
+}
+
+// isonRequest - An ISON sent upstream by the gateway or the client. Nicks found in the nick
+// cache are not asked about again
+type isonRequest struct {
+	fromClient   bool
+	nicks        []string
+	asked        []string
+	cachedOnline []string
+}
+
+func newClientPresence() *clientPresence {
+	return &clientPresence{
+		nicks:          make(map[string]*presenceNick),
+		clientMonitors: make(map[string]bool),
+		pending:        make(map[string]int),
+	}
+}
+
+// WatchPresence - Start tracking whether nicks are online. The client.presence hook is
+// dispatched as they come online or go offline
+func (c *Client) WatchPresence(nicks ...string) {
+	p := c.presence
+	p.mu.Lock()
+	added := []string{}
+	for _, nick := range nicks {
+		key := c.IrcState.ISupport.CaseFold(nick)
+		if nick == "" || p.nicks[key] != nil {
+			continue
+		}
+		p.nicks[key] = &presenceNick{nick: nick}
+		added = append(added, nick)
+	}
+	sendMonitor := p.started && p.useMonitor
+	p.mu.Unlock()
+
+	if sendMonitor {
+		c.sendPresenceLines("MONITOR + ", ",", added)
+	}
+}
+
+// UnwatchPresence - Stop tracking whether nicks are online
+func (c *Client) UnwatchPresence(nicks ...string) {
+	p := c.presence
+	p.mu.Lock()
+	removed := []string{}
+	for _, nick := range nicks {
+		key := c.IrcState.ISupport.CaseFold(nick)
+		if p.nicks[key] == nil {
+			continue
+		}
+		delete(p.nicks, key)
+		// Keep the IRCd watching nicks that the client monitors itself
+		if !p.clientMonitors[key] {
+			removed = append(removed, nick)
+		}
+	}
+	sendMonitor := p.started && p.useMonitor
+	p.mu.Unlock()
+
+	if sendMonitor {
+		c.sendPresenceLines("MONITOR - ", ",", removed)
+	}
+}
+
+// PresenceOnline - Check if a watched nick is online. known is false until the IRCd has
+// been asked about the nick
+func (c *Client) PresenceOnline(nick string) (online bool, known bool) {
+	p := c.presence
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	watched := p.nicks[c.IrcState.ISupport.CaseFold(nick)]
+	if watched == nil {
+		return false, false
+	}
+	return watched.online, watched.known
+}
+
+// sendPresenceLines - Send a command with a list of nicks upstream, split over as many lines
+// as needed. The lines are remembered so that they are not mistaken for the clients own
+func (c *Client) sendPresenceLines(command string, sep string, nicks []string) {
+	p := c.presence
+	lines := presenceLines(command, sep, nicks)
+	p.mu.Lock()
+	for _, line := range lines {
+		p.pending[line]++
+	}
+	p.mu.Unlock()
+
+	for _, line := range lines {
+		if c.sendUpstreamLine(line) != nil {
+			p.mu.Lock()
+			p.pending[line]--
+			p.mu.Unlock()
+		}
+	}
+}
+
+func presenceLines(command string, sep string, nicks []string) []string {
+	lines := []string{}
+	list := ""
+	for _, nick := range nicks {
+		if list != "" && len(list)+len(nick) > presenceMaxLineNicks {
+			lines = append(lines, command+list)
+			list = ""
+		}
+		if list != "" {
+			list += sep
+		}
+		list += nick
+	}
+	if list != "" {
+		lines = append(lines, command+list)
+	}
+	return lines
+}
+
+// startPresence - Start watching the configured nicks once registration has completed and
+// the ISUPPORT tokens are known
+func (c *Client) startPresence() {
+	p := c.presence
+	p.mu.Lock()
+	if p.started {
+		p.mu.Unlock()
+		return
+	}
+	p.started = true
+	p.useMonitor = c.IrcState.ISupport.HasToken("MONITOR")
+	for _, nick := range c.UpstreamConfig.PresenceNicks {
+		key := c.IrcState.ISupport.CaseFold(nick)
+		if p.nicks[key] == nil {
+			p.nicks[key] = &presenceNick{nick: nick}
+		}
+	}
+	nicks := p.watchedNicks()
+	useMonitor := p.useMonitor
+	p.mu.Unlock()
+
+	if useMonitor {
+		c.sendPresenceLines("MONITOR + ", ",", nicks)
+		return
+	}
+
+	interval := c.UpstreamConfig.PresenceInterval
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for !c.IsShuttingDown() {
+			c.pollPresence()
+			time.Sleep(time.Second * time.Duration(interval))
+		}
+	}()
+}
+
+func (p *clientPresence) watchedNicks() []string {
+	nicks := make([]string, 0, len(p.nicks))
+	for _, watched := range p.nicks {
+		nicks = append(nicks, watched.nick)
+	}
+	return nicks
+}
+
+// pollPresence - Ask the IRCd which of the watched nicks are online with ISON
+func (c *Client) pollPresence() {
+	c.presence.mu.Lock()
+	nicks := c.presence.watchedNicks()
+	c.presence.mu.Unlock()
+
+	c.sendPresenceLines("ISON ", " ", nicks)
+}
+
+// setPresence - Update a watched nick and let plugins know if it changed
+func (c *Client) setPresence(nick string, online bool) {
+	p := c.presence
+	p.mu.Lock()
+	watched := p.nicks[c.IrcState.ISupport.CaseFold(nick)]
+	changed := watched != nil && (!watched.known || watched.online != online)
+	if changed {
+		watched.known = true
+		watched.online = online
+	}
+	p.mu.Unlock()
+
+	if changed {
+		c.Log(1, "Presence of %s is now online=%t", nick, online)
+		hook := &HookClientPresence{
+			Client: c,
+			Nick:   nick,
+			Online: online,
+		}
+		hook.Dispatch("client.presence")
+	}
+}
+
+// presenceLineToUpstream - Keep track of the ISON and MONITOR lines heading upstream so that
+// their replies can be matched up. Returns the line to send, or an empty string to drop it
+func (c *Client) presenceLineToUpstream(m *irc.Message, line string) string {
+	p := c.presence
+	command := strings.ToUpper(m.Command)
+	if command != "ISON" && command != "MONITOR" {
+		return line
+	}
+
+	p.mu.Lock()
+	fromGateway := p.takePending(line)
+	if command == "ISON" {
+		p.mu.Unlock()
+		return c.isonLineToUpstream(m, line, fromGateway)
+	}
+	line, rewatch := p.trackMonitorToUpstream(c, m, line, fromGateway)
+	p.mu.Unlock()
+
+	// Clearing the MONITOR list also removes the gateways nicks from the IRCd so watch them
+	// again afterwards
+	if len(rewatch) > 0 {
+		c.sendPresenceLines("MONITOR + ", ",", rewatch)
+	}
+
+	return line
+}
+
+// takePending - Check if a line heading upstream is one the gateway queued. Must be called with
+// p.mu locked
+func (p *clientPresence) takePending(line string) bool {
+	fromGateway := p.pending[line] > 0
+	if fromGateway {
+		p.pending[line]--
+		if p.pending[line] == 0 {
+			delete(p.pending, line)
+		}
+	}
+	return fromGateway
+}
+
+// isonLineToUpstream - Track an ISON heading upstream so that its reply can be matched up, and
+// answer what it can from the nick cache. Returns the line to send, or an empty string if it was
+// answered without asking the IRCd
+func (c *Client) isonLineToUpstream(m *irc.Message, line string, fromGateway bool) string {
+	p := c.presence
+	p.mu.Lock()
+	polling := p.started && !p.useMonitor
+	p.mu.Unlock()
+	if !polling && c.UpstreamConfig.NickCacheTTL <= 0 {
+		return line
+	}
+
+	req := &isonRequest{
+		fromClient: !fromGateway,
+		nicks:      isonNicks(m.Params),
+	}
+	req.asked, req.cachedOnline = c.lookupIsonCache(req.nicks)
+	if len(req.asked) == 0 {
+		if reply := c.answerIson(req, nil); reply != "" {
+			c.SendClientSignal("data", reply)
+		}
+		return ""
+	}
+
+	p.mu.Lock()
+	p.isonRequests = append(p.isonRequests, req)
+	p.mu.Unlock()
+
+	if len(req.asked) == len(req.nicks) {
+		return line
+	}
+	return "ISON " + strings.Join(req.asked, " ")
+}
+
+// isonNicks - The nicks in ISON parameters, which may be given as separate parameters or as a
+// single space separated one
+func isonNicks(params []string) []string {
+	nicks := []string{}
+	for _, param := range params {
+		for _, nick := range strings.Split(param, " ") {
+			if nick != "" {
+				nicks = append(nicks, nick)
+			}
+		}
+	}
+	return nicks
+}
+
+// trackMonitorToUpstream - Must be called with p.mu locked. Also returns the nicks that need to
+// be monitored again
+func (p *clientPresence) trackMonitorToUpstream(c *Client, m *irc.Message, line string, fromGateway bool) (string, []string) {
+	if fromGateway || len(m.Params) == 0 {
+		return line, nil
+	}
+
+	switch m.GetParam(0, "") {
+	case "+":
+		for _, nick := range strings.Split(m.GetParam(1, ""), ",") {
+			p.clientMonitors[c.IrcState.ISupport.CaseFold(nick)] = true
+		}
+
+	case "-":
+		// Nicks the gateway is still watching stay on the IRCds list
+		keep := []string{}
+		for _, nick := range strings.Split(m.GetParam(1, ""), ",") {
+			key := c.IrcState.ISupport.CaseFold(nick)
+			delete(p.clientMonitors, key)
+			if p.nicks[key] == nil || !p.started || !p.useMonitor {
+				keep = append(keep, nick)
+			}
+		}
+		if len(keep) == 0 {
+			return "", nil
+		}
+		m.Params = []string{"-", strings.Join(keep, ",")}
+		line = m.ToLine()
+
+	case "C", "c":
+		p.clientMonitors = make(map[string]bool)
+		if p.started && p.useMonitor {
+			return line, p.watchedNicks()
+		}
+	}
+
+	return line, nil
+}
+
+// presenceLineFromUpstream - Update the watched nicks from ISON and MONITOR replies, hiding
+// the parts of them that the client did not ask for. Returns the line to pass on to the
+// client, or an empty string to drop it
+func (c *Client) presenceLineFromUpstream(m *irc.Message, line string) string {
+	switch m.Command {
+	case "376", "422":
+		// End of the MOTD, registration has completed
+		c.startPresence()
+
+	case "303":
+		return c.handleIsonReply(m, line)
+
+	case "730", "731":
+		online := m.Command == "730"
+		targets := strings.Split(m.GetParam(len(m.Params)-1, ""), ",")
+		for _, target := range targets {
+			c.setPresence(irc.ParseMask(target).Nick, online)
+		}
+		return c.filterMonitorTargets(m, len(m.Params)-1, line)
+
+	case "732":
+		return c.filterMonitorTargets(m, len(m.Params)-1, line)
+
+	case "734":
+		// :server 734 nick limit targets :Monitor list is full
+		return c.filterMonitorTargets(m, 2, line)
+	}
+
+	return line
+}
+
+func (c *Client) handleIsonReply(m *irc.Message, line string) string {
+	p := c.presence
+	p.mu.Lock()
+	if len(p.isonRequests) == 0 {
+		p.mu.Unlock()
+		return line
+	}
+	req := p.isonRequests[0]
+	p.isonRequests = p.isonRequests[1:]
+	p.mu.Unlock()
+
+	replyOnline := []string{}
+	if len(m.Params) > 1 {
+		replyOnline = isonNicks(m.Params[1:])
+	}
+	c.storeIsonCache(req.asked, replyOnline)
+
+	// A reply to the clients own ISON that was not partly answered from the cache
+	if req.fromClient && len(req.cachedOnline) == 0 {
+		return line
+	}
+	return c.answerIson(req, replyOnline)
+}
+
+// answerIson - Complete an ISON with the nicks the IRCd replied were online. Returns the reply
+// for the client if it was the clients own ISON, otherwise the watched nicks are updated
+func (c *Client) answerIson(req *isonRequest, replyOnline []string) string {
+	online := append(append([]string{}, req.cachedOnline...), replyOnline...)
+	if req.fromClient {
+		reply := irc.Message{
+			Command: "303", // RPL_ISON
+			Prefix:  &c.ServerMessagePrefix,
+			Params:  []string{c.IrcState.Nick, strings.Join(online, " ")},
+		}
+		return reply.ToLine()
+	}
+
+	isOnline := make(map[string]bool)
+	for _, nick := range online {
+		isOnline[c.IrcState.ISupport.CaseFold(nick)] = true
+	}
+	for _, nick := range req.nicks {
+		c.setPresence(nick, isOnline[c.IrcState.ISupport.CaseFold(nick)])
+	}
+	return ""
+}
+
+// filterMonitorTargets - Remove the nicks that only the gateway is monitoring from the list of
+// targets in param paramIdx
+func (c *Client) filterMonitorTargets(m *irc.Message, paramIdx int, line string) string {
+	p := c.presence
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.started || !p.useMonitor || paramIdx < 0 || paramIdx >= len(m.Params) {
+		return line
+	}
+
+	targets := strings.Split(m.Params[paramIdx], ",")
+	keep := []string{}
+	for _, target := range targets {
+		key := c.IrcState.ISupport.CaseFold(irc.ParseMask(target).Nick)
+		if p.clientMonitors[key] || p.nicks[key] == nil {
+			keep = append(keep, target)
+		}
+	}
+
+	if len(keep) == len(targets) {
+		return line
+	}
+	if len(keep) == 0 {
+		return ""
+	}
+	m.Params[paramIdx] = strings.Join(keep, ",")
+	return m.ToLine()
+}
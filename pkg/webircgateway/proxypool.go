@@ -0,0 +1,152 @@
+package webircgateway
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// maxProxyInterfaceRange - The most addresses a single CIDR range in proxy_interface may expand to
+const maxProxyInterfaceRange = 4096
+
+// proxyInterfacePool - Counts the upstream connections going out of each interface of the kiwi
+// proxies so that new connections use the least busy one. Lives on the gateway so that counts
+// survive config reloads
+type proxyInterfacePool struct {
+	mu     sync.Mutex
+	counts map[string]int
+	// Where the next search starts for each proxy so that equally busy interfaces take turns
+	next map[string]int
+}
+
+func newProxyInterfacePool() *proxyInterfacePool {
+	return &proxyInterfacePool{
+		counts: make(map[string]int),
+		next:   make(map[string]int),
+	}
+}
+
+func proxyInterfaceKey(proxyAddr string, iface string) string {
+	return proxyAddr + " " + iface
+}
+
+// acquire - Pick the interface with the fewest connections and count a new connection on it
+func (p *proxyInterfacePool) acquire(proxyAddr string, interfaces []string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	start := p.next[proxyAddr] % len(interfaces)
+	best := start
+	for i := 1; i < len(interfaces); i++ {
+		idx := (start + i) % len(interfaces)
+		if p.counts[proxyInterfaceKey(proxyAddr, interfaces[idx])] < p.counts[proxyInterfaceKey(proxyAddr, interfaces[best])] {
+			best = idx
+		}
+	}
+
+	p.next[proxyAddr] = best + 1
+	p.counts[proxyInterfaceKey(proxyAddr, interfaces[best])]++
+	return interfaces[best]
+}
+
+// release - Stop counting a connection that has closed
+func (p *proxyInterfacePool) release(proxyAddr string, iface string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := proxyInterfaceKey(proxyAddr, iface)
+	p.counts[key]--
+	if p.counts[key] <= 0 {
+		delete(p.counts, key)
+	}
+}
+
+// connections - The number of open connections on each of the interfaces
+func (p *proxyInterfacePool) connections(proxyAddr string, interfaces []string) []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	counts := make([]int, len(interfaces))
+	for i, iface := range interfaces {
+		counts[i] = p.counts[proxyInterfaceKey(proxyAddr, iface)]
+	}
+	return counts
+}
+
+// parseProxyInterfaces - Expand a comma separated list of addresses and CIDR ranges, such as
+// "192.0.2.10,198.51.100.0/28,2001:db8::/120"
+func parseProxyInterfaces(spec string) ([]string, error) {
+	interfaces := []string{}
+	seen := make(map[string]bool)
+	add := func(ip net.IP) {
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			interfaces = append(interfaces, ip.String())
+		}
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid interface address %s", item)
+			}
+			add(ip)
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface range %s", item)
+		}
+		ones, bits := ipNet.Mask.Size()
+		if bits-ones > 31 || 1<<uint(bits-ones) > maxProxyInterfaceRange {
+			return nil, fmt.Errorf("interface range %s has more than %d addresses", item, maxProxyInterfaceRange)
+		}
+
+		rangeIPs := []net.IP{}
+		for ip := append(net.IP{}, ipNet.IP...); ipNet.Contains(ip); ip = nextIP(ip) {
+			rangeIPs = append(rangeIPs, ip)
+		}
+		// The network and broadcast addresses of IPv4 ranges can not be bound to
+		if len(ipNet.IP) == net.IPv4len && len(rangeIPs) > 2 {
+			rangeIPs = rangeIPs[1 : len(rangeIPs)-1]
+		}
+		for _, ip := range rangeIPs {
+			add(ip)
+		}
+	}
+
+	if len(interfaces) == 0 {
+		return nil, fmt.Errorf("no interface addresses")
+	}
+
+	return interfaces, nil
+}
+
+// nextIP - The address after ip. Wraps around to all zeros after the last address
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP{}, ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// interfacePool - The addresses that connections through this proxy may go out of
+func (p *ConfigProxy) interfacePool() ([]string, error) {
+	// Proxy configs created by plugins will not have parsed their interfaces yet
+	if p.interfaces == nil {
+		return parseProxyInterfaces(p.Interface)
+	}
+	return p.interfaces, nil
+}
@@ -0,0 +1,185 @@
+package webircgateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The signature that starts every PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The longest a PROXY protocol v1 header may be, including the CRLF
+const proxyProtocolV1MaxLength = 107
+
+// readProxyProtocolHeader - Read a PROXY protocol v1 or v2 header, as sent by load balancers such
+// as HAProxy or ELB in front of TCP listeners. Returns the address of the real client as
+// "ip:port", or an empty string if the header does not carry one, eg. for health checks
+func readProxyProtocolHeader(reader *bufio.Reader) (string, error) {
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err == nil && bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(reader)
+	}
+
+	prefix, err := reader.Peek(6)
+	if err != nil {
+		return "", err
+	}
+	if string(prefix) != "PROXY " {
+		return "", errors.New("missing PROXY protocol header")
+	}
+	return readProxyProtocolV1(reader)
+}
+
+// readProxyProtocolV1 - PROXY TCP4 192.0.2.1 192.0.2.2 56324 6667\r\n
+func readProxyProtocolV1(reader *bufio.Reader) (string, error) {
+	line := []byte{}
+	for len(line) < proxyProtocolV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return "", errors.New("PROXY protocol v1 header too long")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return "", nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return "", errors.New("invalid PROXY protocol v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return "", errors.New("invalid PROXY protocol v1 source address")
+	}
+	return net.JoinHostPort(ip.String(), fields[4]), nil
+}
+
+func readProxyProtocolV2(reader *bufio.Reader) (string, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+
+	version := header[12] >> 4
+	command := header[12] & 0x0f
+	family := header[13] >> 4
+	transport := header[13] & 0x0f
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if version != 2 {
+		return "", errors.New("unsupported PROXY protocol version")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return "", err
+	}
+
+	// LOCAL connections are made by the proxy itself, eg. health checks
+	if command == 0x0 {
+		return "", nil
+	}
+	if command != 0x1 {
+		return "", errors.New("unsupported PROXY protocol v2 command")
+	}
+
+	// Only TCP over IPv4 or IPv6 has an address we can use, anything else keeps the proxies address
+	if transport != 0x1 {
+		return "", nil
+	}
+
+	var ip net.IP
+	var port uint16
+	switch family {
+	case 0x1:
+		if length < 12 {
+			return "", errors.New("PROXY protocol v2 address too short")
+		}
+		ip = net.IP(payload[0:4])
+		port = binary.BigEndian.Uint16(payload[8:10])
+	case 0x2:
+		if length < 36 {
+			return "", errors.New("PROXY protocol v2 address too short")
+		}
+		ip = net.IP(payload[0:16])
+		port = binary.BigEndian.Uint16(payload[32:34])
+	default:
+		return "", nil
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
+
+// proxyProtocolHeader - A PROXY protocol header for the IRCd telling it that the connection from
+// dst is really from src. version is v1 or v2
+func proxyProtocolHeader(version string, src *net.TCPAddr, dst *net.TCPAddr) []byte {
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	ipv4 := srcIP != nil && dstIP != nil
+	if !ipv4 {
+		// Both addresses must be of the same family so IPv4 addresses are mapped into IPv6
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	if version == "v1" {
+		if ipv4 {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, src.Port, dst.Port))
+		}
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", proxyProtocolIPv6(srcIP), proxyProtocolIPv6(dstIP), src.Port, dst.Port))
+	}
+
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	// Version 2, PROXY command, TCP over IPv4 or IPv6
+	header = append(header, 0x21)
+	if ipv4 {
+		header = append(header, 0x11)
+	} else {
+		header = append(header, 0x21)
+	}
+
+	addresses := append(append([]byte{}, srcIP...), dstIP...)
+	addresses = append(addresses, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	header = append(header, byte(len(addresses)>>8), byte(len(addresses)))
+	return append(header, addresses...)
+}
+
+// proxyProtocolIPv6 - Format an address as IPv6 even if it is an IPv4 address, eg. ::ffff:192.0.2.1
+func proxyProtocolIPv6(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return "::ffff:" + ipv4.String()
+	}
+	return ip.String()
+}
+
+// writeProxyProtocolHeader - Tell the IRCd the real address of the client with the PROXY
+// protocol before anything else is sent on the connection
+func (c *Client) writeProxyProtocolHeader(conn net.Conn) error {
+	dst, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return errors.New("the PROXY protocol needs a TCP connection")
+	}
+	srcIP := net.ParseIP(c.RemoteAddr)
+	if srcIP == nil {
+		return errors.New("invalid client address " + c.RemoteAddr)
+	}
+
+	src := &net.TCPAddr{IP: srcIP, Port: c.RemotePort}
+	c.Log(1, "->upstream: PROXY protocol %s header for %s", c.UpstreamConfig.ProxyProtocol, src.String())
+	_, err := conn.Write(proxyProtocolHeader(c.UpstreamConfig.ProxyProtocol, src, dst))
+	return err
+}
@@ -0,0 +1,259 @@
+package webircgateway
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobwas/glob"
+	"github.com/kiwiirc/webircgateway/pkg/identd"
+	"github.com/kiwiirc/webircgateway/pkg/proxy"
+	"gopkg.in/ini.v1"
+)
+
+func init() {
+	ControlCommandRegister("proxy-status", controlProxyStatus)
+}
+
+// parseProxyDestination - Parse a "host:port" destination. The host may be a glob and the port
+// may be a range such as 6660-6669 or * for any port
+func parseProxyDestination(destination string) (ConfigProxyDestination, error) {
+	parsed := ConfigProxyDestination{}
+
+	sep := strings.LastIndex(destination, ":")
+	if sep == -1 {
+		return parsed, errors.New("missing port")
+	}
+	host := strings.Trim(destination[:sep], "[]")
+	ports := destination[sep+1:]
+
+	match, err := glob.Compile(strings.ToLower(host))
+	if err != nil {
+		return parsed, err
+	}
+	parsed.Host = match
+
+	if ports == "*" {
+		parsed.PortMin = 1
+		parsed.PortMax = 65535
+		return parsed, nil
+	}
+
+	portRange := strings.SplitN(ports, "-", 2)
+	parsed.PortMin, err = strconv.Atoi(portRange[0])
+	if err != nil {
+		return parsed, errors.New("invalid port")
+	}
+	parsed.PortMax = parsed.PortMin
+	if len(portRange) == 2 {
+		parsed.PortMax, err = strconv.Atoi(portRange[1])
+		if err != nil || parsed.PortMax < parsed.PortMin {
+			return parsed, errors.New("invalid port range")
+		}
+	}
+
+	return parsed, nil
+}
+
+func (c *ConfigProxyServer) allowsUsername(username string) bool {
+	if len(c.Usernames) == 0 {
+		return true
+	}
+
+	for _, match := range c.Usernames {
+		if match.Match(username) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ConfigProxyServer) allowsDestination(host string, port int) bool {
+	if len(c.Destinations) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(host)
+	for _, destination := range c.Destinations {
+		if port >= destination.PortMin && port <= destination.PortMax && destination.Host.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseUpstreamProxy - Read the options for connecting to an upstream through a kiwi proxy
+func (c *Config) parseUpstreamProxy(proxyAddr string, section *ini.Section) (*ConfigProxy, error) {
+	host, portStr, err := net.SplitHostPort(proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, errors.New("invalid port")
+	}
+
+	proxyConfig := &ConfigProxy{
+		Hostname:  host,
+		Port:      port,
+		TLS:       section.Key("proxy_tls").MustBool(false),
+		Username:  confKeyAsString(section.Key("proxy_username"), "user"),
+		Interface: confKeyAsString(section.Key("proxy_interface"), "0.0.0.0"),
+		CertFile:  confKeyAsString(section.Key("proxy_cert"), ""),
+		KeyFile:   confKeyAsString(section.Key("proxy_key"), ""),
+		CAFile:    confKeyAsString(section.Key("proxy_ca"), ""),
+		Secret:    confKeyAsString(section.Key("proxy_secret"), ""),
+	}
+
+	proxyConfig.interfaces, err = parseProxyInterfaces(proxyConfig.Interface)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyConfig.TLS {
+		// Load the certificates now so that errors show when the config is loaded
+		proxyConfig.tlsConfig, err = c.proxyTLSConfig(proxyConfig.CertFile, proxyConfig.KeyFile, proxyConfig.CAFile, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return proxyConfig, nil
+}
+
+// proxyTLSConfig - TLS config for either end of a kiwi proxy connection. caFile verifies the
+// other end, either the proxy server or the client certificates of gateways
+func (c *Config) proxyTLSConfig(certFile string, keyFile string, caFile string, isServer bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if certFile != "" || keyFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(c.ResolvePath(certFile), c.ResolvePath(keyFile))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{keyPair}
+	}
+
+	if caFile != "" {
+		caPem, err := ioutil.ReadFile(c.ResolvePath(caFile))
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+
+		if isServer {
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsConfig.RootCAs = pool
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// dialTLSConfig - The TLS config used to connect to the proxy server, if it uses TLS
+func (p *ConfigProxy) dialTLSConfig(config *Config) (*tls.Config, error) {
+	if !p.TLS {
+		return nil, nil
+	}
+	// Proxy configs created by plugins will not have loaded their certificates yet
+	if p.tlsConfig == nil {
+		return config.proxyTLSConfig(p.CertFile, p.KeyFile, p.CAFile, false)
+	}
+	return p.tlsConfig, nil
+}
+
+// startProxyServer - Start the kiwi proxy server listening
+func (s *Gateway) startProxyServer() error {
+	proxyConfig := proxy.ServerConfig{
+		ListenAddrs: s.Config.Proxy.ListenAddrs,
+		// Read the config on each connection so that reloaded ACLs apply straight away
+		AllowUsername: func(username string) bool {
+			return s.Config.Proxy.allowsUsername(username)
+		},
+		AllowDestination: func(host string, port int) bool {
+			return s.Config.Proxy.allowsDestination(host, port)
+		},
+		Secret:         s.Config.Proxy.Secret,
+		LogConnections: s.Config.Proxy.LogConnections,
+		Log:            s.Log,
+	}
+
+	if s.Config.Proxy.CertFile != "" || s.Config.Proxy.KeyFile != "" {
+		tlsConfig, err := s.Config.proxyTLSConfig(s.Config.Proxy.CertFile, s.Config.Proxy.KeyFile, s.Config.Proxy.ClientCAFile, true)
+		if err != nil {
+			return err
+		}
+		proxyConfig.TLSConfig = tlsConfig
+	} else if s.Config.Proxy.ClientCAFile != "" {
+		return errors.New("client_ca needs cert and key to be set")
+	}
+
+	if s.Config.Proxy.IdentdRpc != "" {
+		rpc := identd.MakeRpcClient("kiwiproxy")
+		go rpc.ConnectAndReconnect(s.Config.Proxy.IdentdRpc)
+		proxyConfig.AddIdent = rpc.AddIdent
+		proxyConfig.RemoveIdent = rpc.RemoveIdent
+	} else if s.Config.Identd {
+		proxyConfig.AddIdent = s.identdServ.AddIdent
+		proxyConfig.RemoveIdent = func(localPort int, remotePort int, username string, iface string) {
+			s.identdServ.RemoveIdent(localPort, remotePort, iface)
+		}
+	}
+
+	s.proxyServer = proxy.NewKiwiProxyServer(proxyConfig)
+	return s.proxyServer.Listen()
+}
+
+// controlProxyStatus - Check the health of the kiwi proxy servers that upstreams connect through
+func controlProxyStatus(gateway *Gateway, args []string) (string, error) {
+	out := ""
+	checked := make(map[string]bool)
+
+	for _, upstream := range gateway.Config.Upstreams {
+		if upstream.Proxy == nil {
+			continue
+		}
+
+		proxyAddr := net.JoinHostPort(upstream.Proxy.Hostname, strconv.Itoa(upstream.Proxy.Port))
+		if checked[proxyAddr] || (len(args) > 0 && args[0] != proxyAddr) {
+			continue
+		}
+		checked[proxyAddr] = true
+
+		tlsConfig, err := upstream.Proxy.dialTLSConfig(gateway.Config)
+		if err != nil {
+			out += fmt.Sprintf("%s error: %s\n", proxyAddr, err.Error())
+			continue
+		}
+
+		status, err := proxy.FetchStatus(proxyAddr, tlsConfig, upstream.Proxy.Secret, time.Second*time.Duration(upstream.Timeout))
+		if err != nil {
+			out += fmt.Sprintf("%s error: %s\n", proxyAddr, err.Error())
+			continue
+		}
+		out += fmt.Sprintf("%s ok version=%d connections=%d uptime=%ds\n", proxyAddr, status.Version, status.Connections, status.Uptime)
+
+		interfaces, err := upstream.Proxy.interfacePool()
+		if err == nil && len(interfaces) > 1 {
+			for i, count := range gateway.proxyInterfaces.connections(proxyAddr, interfaces) {
+				out += fmt.Sprintf("  interface %s connections=%d\n", interfaces[i], count)
+			}
+		}
+	}
+
+	if len(checked) == 0 {
+		return "No kiwi proxies to check\n", nil
+	}
+	return out, nil
+}
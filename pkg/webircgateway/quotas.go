@@ -0,0 +1,155 @@
+package webircgateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accountQuotaKey - The key that connections are counted against for the per-account limit.
+// Accounts from the IRC server are only unique within that network while verified identities
+// are unique across the gateway. Empty if the account is not known
+func (c *Client) accountQuotaKey() string {
+	if c.Identity != nil && c.Identity.Account != "" {
+		return "identity:" + strings.ToLower(c.Identity.Account)
+	}
+
+	if c.IrcState.Account != "" {
+		network := strings.ToLower(c.UpstreamConfig.Hostname)
+		return "irc:" + network + ":" + c.IrcState.ISupport.CaseFold(c.IrcState.Account)
+	}
+
+	return ""
+}
+
+// CheckAccountQuota - Disconnect the client if its account already has the maximum number of
+// connections. Call this after setting Identity if it was not known when the client connected.
+// Only called from the clients own goroutine. Returns false if the client was disconnected. With
+// cluster_account_limits the peers are asked in the background, disconnecting the client later
+// if they have the rest of the connections
+func (c *Client) CheckAccountQuota() bool {
+	key := c.accountQuotaKey()
+	c.Gateway.clientIndex.SetAccount(c, key)
+
+	maxConnections := c.maxConnectionsPerAccount()
+	if maxConnections <= 0 || key == "" {
+		return true
+	}
+
+	count := c.Gateway.accountConnectionCount(key, c)
+	if count >= maxConnections {
+		c.closeForAccountLimit(maxConnections, key)
+		return false
+	}
+
+	if c.Gateway.Config.ClusterAccountLimits {
+		go func() {
+			if count+c.Gateway.clusterAccountConnectionCount(key) >= maxConnections {
+				c.closeForAccountLimit(maxConnections, key)
+			}
+		}()
+	}
+
+	return true
+}
+
+func (c *Client) closeForAccountLimit(maxConnections int, key string) {
+	if c.IsShuttingDown() {
+		return
+	}
+
+	c.Log(2, "Account connection limit of %d reached for %s", maxConnections, key)
+	c.SendGatewayError(FailAccountLimit, "Too many connections for this account")
+	c.SendClientSignal("state", "closed", "err_account_limit")
+	c.StartShutdown("account_limit")
+}
+
+// accountConnectionCount - The number of local clients connected with an account, ignoring exclude
+func (s *Gateway) accountConnectionCount(key string, exclude *Client) int {
+	count := 0
+	for _, c := range s.clientIndex.AccountClients(key) {
+		if c == exclude || c.State() == ClientStateEnding {
+			continue
+		}
+		count++
+	}
+
+	return count
+}
+
+// clusterAccountConnectionCount - The number of clients connected with an account on all cluster peers
+func (s *Gateway) clusterAccountConnectionCount(key string) int {
+	peers := s.clusterPeers()
+	timeout := time.Second * time.Duration(s.Config.ClusterTimeout)
+
+	total := 0
+	totalMu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			count := 0
+			err := s.runAux("cluster:"+peer, func() (err error) {
+				count, err = fetchPeerAccountCount(peer, key, timeout)
+				return err
+			})
+			if err != nil {
+				s.Log(3, "Error fetching account connections from cluster peer %s: %s", peer, err.Error())
+				return
+			}
+			totalMu.Lock()
+			total += count
+			totalMu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+
+	return total
+}
+
+// fetchPeerAccountCount - Fetch the number of clients connected with an account on a peer
+func fetchPeerAccountCount(peer string, key string, timeout time.Duration) (int, error) {
+	countURL := strings.TrimRight(peer, "/") + "/webirc/_accounts?key=" + url.QueryEscape(key)
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(countURL)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(body)))
+}
+
+func (s *Gateway) initAccountQuotaRoutes() {
+	// The number of local clients connected with an account, for cluster peers
+	s.HttpRouter.HandleFunc("/webirc/_accounts", func(w http.ResponseWriter, r *http.Request) {
+		if !isPrivateIP(s.GetRemoteAddressFromRequest(r)) {
+			w.WriteHeader(403)
+			return
+		}
+
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Write([]byte(strconv.Itoa(s.accountConnectionCount(key, nil))))
+	})
+}
@@ -0,0 +1,201 @@
+package webircgateway
+
+import (
+	"time"
+)
+
+// The most lines sent during registration that are kept for sending to another upstream
+const maxRegistrationLines = 50
+
+// startRegistrationTimer - Start waiting for the upstream to complete registration with 001
+func (c *Client) startRegistrationTimer() {
+	c.stopRegistrationTimer()
+	if c.UpstreamConfig.RegistrationTimeout <= 0 {
+		return
+	}
+
+	c.registrationTimer = time.NewTimer(time.Second * time.Duration(c.UpstreamConfig.RegistrationTimeout))
+}
+
+// stopRegistrationTimer - Registration has completed or the client is moving to another upstream
+func (c *Client) stopRegistrationTimer() {
+	if c.registrationTimer != nil {
+		c.registrationTimer.Stop()
+		c.registrationTimer = nil
+	}
+	c.registrationLines = nil
+}
+
+// registrationTimeout - Fires once the upstream has taken too long to complete registration. nil
+// when registration is not being timed, which never fires in a select
+func (c *Client) registrationTimeout() <-chan time.Time {
+	if c.registrationTimer == nil {
+		return nil
+	}
+	return c.registrationTimer.C
+}
+
+// trackRegistrationLine - Keep the lines sent upstream during registration so that they can be
+// sent again if registration moves to another upstream
+func (c *Client) trackRegistrationLine(line string) {
+	if c.registrationTimer == nil || !c.UpstreamConfig.RegistrationRetry {
+		return
+	}
+	if len(c.registrationLines) < maxRegistrationLines {
+		c.registrationLines = append(c.registrationLines, line)
+	}
+}
+
+// handleRegistrationTimeout - Try another upstream, or close the client if there isn't one.
+// Returns true if the client was closed
+func (c *Client) handleRegistrationTimeout() bool {
+	c.registrationTimer = nil
+	c.Log(2, "Upstream %s did not complete registration within %d seconds", upstreamLatencyKey(c.UpstreamConfig), c.UpstreamConfig.RegistrationTimeout)
+
+	if c.retryRegistration() {
+		return c.IsShuttingDown()
+	}
+
+	c.SendGatewayError(FailRegistrationTimeout, "The IRC server did not complete registration in time")
+	c.SendClientSignal("state", "closed", "err_registration_timeout")
+	c.StartShutdown("err_registration_timeout")
+	if c.upstream != nil {
+		c.upstream.Close()
+	}
+	return true
+}
+
+// retryRegistration - Move a client to an upstream it has not tried yet and send it the lines
+// sent during registration so far. Returns false if there is no other upstream to try
+func (c *Client) retryRegistration() bool {
+	// Clients that chose their own server have nowhere else to go
+	if !c.UpstreamConfig.RegistrationRetry || c.DestHost != "" {
+		return false
+	}
+
+	if c.triedUpstreams == nil {
+		c.triedUpstreams = make(map[string]bool)
+	}
+	c.triedUpstreams[upstreamLatencyKey(c.UpstreamConfig)] = true
+
+	upstreamConfig, err := c.Gateway.findUpstreamExcluding(c, c.triedUpstreams)
+	if err != nil {
+		return false
+	}
+
+	c.Log(2, "Retrying registration on upstream %s", upstreamLatencyKey(&upstreamConfig))
+	lines := c.registrationLines
+	c.registrationLines = nil
+
+	// The stalled connection closes its own UpstreamRecv once it ends. Anything it still sends
+	// is discarded
+	stalledRecv := c.UpstreamRecv
+	stalled := c.upstream
+	c.UpstreamRecv = make(chan string, cap(stalledRecv))
+	go func() {
+		for range stalledRecv {
+		}
+	}()
+	c.upstream = nil
+	if stalled != nil {
+		stalled.Close()
+	}
+
+	c.upstreamCaps = nil
+	c.upstreamNoCaps = false
+	c.proxyAddr = ""
+	c.IrcState.LocalPort = 0
+	c.IrcState.RemotePort = 0
+
+	c.registrationRetrying = true
+	c.registrationRetryLines = lines
+	if c.openUpstream(upstreamConfig) {
+		c.resendRegistrationLines()
+	}
+
+	return true
+}
+
+// resendRegistrationLines - Send the lines sent during registration so far to the upstream that
+// registration moved to
+func (c *Client) resendRegistrationLines() {
+	lines := c.registrationRetryLines
+	c.registrationRetrying = false
+	c.registrationRetryLines = nil
+
+	for _, line := range lines {
+		c.TrafficLog(true, false, line)
+		if c.writeUpstream(line) {
+			c.trackRegistrationLine(line)
+		}
+	}
+}
+
+// The longest wait between attempts to connect to an upstream
+const maxUpstreamRetryDelay = time.Second * 10
+
+// failoverUpstream - Connecting to the clients upstream failed so try another one, waiting longer
+// before each attempt. The same upstream is tried again if there is no other. The client is
+// closed once upstream_retries attempts have been made
+func (c *Client) failoverUpstream(connectErr *upstreamConnectError) {
+	retries := c.Gateway.Config.UpstreamRetries
+	// Clients that chose their own server have nowhere else to go
+	if c.DestHost == "" && c.connectRetries < retries && !c.IsShuttingDown() {
+		if c.triedUpstreams == nil {
+			c.triedUpstreams = make(map[string]bool)
+		}
+		c.triedUpstreams[upstreamLatencyKey(c.UpstreamConfig)] = true
+
+		upstreamConfig, err := c.Gateway.findUpstreamExcluding(c, c.triedUpstreams)
+		if err != nil {
+			upstreamConfig, err = c.Gateway.findUpstream(c)
+		}
+		if err == nil {
+			delay := time.Millisecond * time.Duration(c.Gateway.Config.UpstreamRetryDelay)
+			for i := 0; i < c.connectRetries && delay < maxUpstreamRetryDelay; i++ {
+				delay *= 2
+			}
+			if delay > maxUpstreamRetryDelay {
+				delay = maxUpstreamRetryDelay
+			}
+			c.connectRetries++
+			c.Log(2, "Trying upstream %s in %s, attempt %d of %d", upstreamLatencyKey(&upstreamConfig), delay, c.connectRetries, retries)
+			// The line worker keeps running while waiting so that a client closing is noticed
+			c.upstreamRetryConfig = upstreamConfig
+			c.upstreamRetryTimer = time.NewTimer(delay)
+			return
+		}
+	}
+
+	c.SendClientSignal("state", "closed", connectErr.closeReason)
+	c.StartShutdown("err_connecting_upstream")
+}
+
+// upstreamRetryTimeout - Fires once it is time to try connecting to another upstream. nil when no
+// attempt is waiting, which never fires in a select
+func (c *Client) upstreamRetryTimeout() <-chan time.Time {
+	if c.upstreamRetryTimer == nil {
+		return nil
+	}
+	return c.upstreamRetryTimer.C
+}
+
+// handleUpstreamRetry - Make the connection attempt that failoverUpstream was waiting to make.
+// Returns true if the client was closed
+func (c *Client) handleUpstreamRetry() bool {
+	c.upstreamRetryTimer = nil
+	if c.IsShuttingDown() {
+		return true
+	}
+
+	if !c.openUpstream(c.upstreamRetryConfig) {
+		return c.IsShuttingDown()
+	}
+
+	if c.registrationRetrying {
+		c.resendRegistrationLines()
+	} else {
+		c.SendClientSignal("state", "connected")
+	}
+	return false
+}
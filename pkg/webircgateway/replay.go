@@ -0,0 +1,97 @@
+package webircgateway
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// replayUpstream - A mock upstream connection that records everything written to it
+type replayUpstream struct {
+	out io.Writer
+}
+
+func (u *replayUpstream) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (u *replayUpstream) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\r\n"), "\n") {
+		fmt.Fprintf(u.out, "->Upstream %s\n", strings.TrimRight(line, "\r"))
+	}
+	return len(b), nil
+}
+
+func (u *replayUpstream) Close() error {
+	return nil
+}
+
+// Replay - Feed a traffic capture (as written by the capture control command) through the
+// client line processing against a mock upstream. Only the Client-> and Upstream-> lines are
+// replayed, everything the gateway sends as a result is written to out in the same format
+// so that it can be compared against the original capture.
+func (s *Gateway) Replay(in io.Reader, out io.Writer) error {
+	upstreamConfig := ConfigUpstream{
+		Hostname: "replay.invalid",
+		Port:     6667,
+		Protocol: "tcp",
+	}
+	if len(s.Config.Upstreams) > 0 {
+		upstreamConfig = s.Config.Upstreams[0]
+	}
+
+	c := s.NewClient()
+	c.RemoteAddr = "127.0.0.1"
+	c.RemoteHostname = "localhost"
+	c.UpstreamConfig = &upstreamConfig
+	c.UpstreamStarted = true
+	c.upstream = &replayUpstream{out: out}
+	c.setState(ClientStateConnecting)
+	c.setState(ClientStateRegistering)
+	defer c.StartShutdown("replay_complete")
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// <timestamp> <label> <line>
+		parts := strings.SplitN(scanner.Text(), " ", 3)
+		if len(parts) < 3 {
+			continue
+		}
+
+		label, line := parts[1], parts[2]
+		switch label {
+		case "Client->":
+			fmt.Fprintf(out, "Client-> %s\n", line)
+			toUpstream, err := c.ProcessLineFromClient(line)
+			if err == nil && toUpstream != "" {
+				c.processLineToUpstream(toUpstream)
+			}
+		case "Upstream->":
+			fmt.Fprintf(out, "Upstream-> %s\n", line)
+			c.handleLineFromUpstream(line)
+		default:
+			continue
+		}
+
+		replayDrainSignals(c, out)
+	}
+
+	return scanner.Err()
+}
+
+func replayDrainSignals(c *Client, out io.Writer) {
+	for {
+		select {
+		case signal := <-c.Signals:
+			if signal[0] == "data" {
+				fmt.Fprintf(out, "->Client %s\n", strings.TrimRight(signal[1], "\r\n"))
+			} else {
+				fmt.Fprintf(out, "Signal %s\n", strings.TrimSpace(strings.Join(signal[:], " ")))
+			}
+		default:
+			return
+		}
+	}
+}
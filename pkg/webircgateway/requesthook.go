@@ -0,0 +1,56 @@
+package webircgateway
+
+import (
+	"context"
+	"net/http"
+)
+
+type requestTagsKey struct{}
+
+// withRequestHook - Dispatch the http.request hook before passing requests on to a transport
+func (s *Gateway) withRequestHook(transport string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hook := &HookHttpRequest{
+			Transport:  transport,
+			Request:    r,
+			RemoteAddr: s.GetRemoteAddressFromRequest(r),
+			Tags:       make(map[string]string),
+		}
+		hook.Dispatch("http.request")
+
+		if hook.Halt {
+			status := hook.StatusCode
+			if status == 0 {
+				status = http.StatusForbidden
+			}
+			reason := hook.Reason
+			if reason == "" {
+				reason = http.StatusText(status)
+			}
+			s.Log(2, "%s request from %s rejected by a plugin: %s", transport, hook.RemoteAddr, reason)
+			http.Error(w, reason, status)
+			return
+		}
+
+		if len(hook.Tags) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), requestTagsKey{}, hook.Tags))
+		}
+
+		if !isUpgradeRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		upgradeWriter := &upgradeResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(upgradeWriter, r)
+		if upgradeWriter.failed() {
+			s.transportMetrics.upgradeFailed(transport)
+		}
+	})
+}
+
+// requestTags - Any tags set by the http.request hook for clients created from this request
+func requestTags(r *http.Request) map[string]string {
+	tags, _ := r.Context().Value(requestTagsKey{}).(map[string]string)
+	return tags
+}
@@ -0,0 +1,74 @@
+package webircgateway
+
+import (
+	"strings"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+const (
+	// ReservedCommandGateway - The gateway handles the command where it still can and replies
+	// with a FAIL where it can't
+	ReservedCommandGateway = "gateway"
+	// ReservedCommandForward - Send the command on to the IRC server unchanged
+	ReservedCommandForward = "forward"
+	// ReservedCommandReject - Reply with a FAIL and drop the command
+	ReservedCommandReject = "reject"
+)
+
+// reservedCommands - Commands that the gateway handles itself rather than the IRC server
+var reservedCommands = []string{"HOST", "ENCODING", "CAPTCHA", "AUTHTOKEN", "EXTJWT", "RESUME"}
+
+// reservedCommandPolicy - What is done with a reserved command sent once the upstream connection
+// has started. Empty if the command is not reserved
+func (s *Gateway) reservedCommandPolicy(command string) string {
+	if !stringInSlice(command, reservedCommands) {
+		return ""
+	}
+	// Without a secret AUTHTOKEN means nothing to the gateway
+	if command == "AUTHTOKEN" && s.Config.VerifyAuthTokenSecret == "" {
+		return ""
+	}
+	if command == "RESUME" && !s.resumeEnabled() {
+		return ""
+	}
+
+	if policy, exists := s.Config.ReservedCommands[command]; exists {
+		return policy
+	}
+	return ReservedCommandGateway
+}
+
+// checkReservedCommand - Apply the reserved command policy to a line from a client whose upstream
+// connection has started. Returns the line to send upstream without any further processing and
+// true, or false if the line should be processed as normal
+func (c *Client) checkReservedCommand(m *irc.Message, line string) (string, bool) {
+	if !c.UpstreamStarted {
+		return "", false
+	}
+
+	command := strings.ToUpper(m.Command)
+	switch c.Gateway.reservedCommandPolicy(command) {
+	case ReservedCommandForward:
+		return line, true
+
+	case ReservedCommandReject:
+		c.Log(1, "Rejected reserved command %s", command)
+		c.SendIrcFail(command, "DISALLOWED", command+" may not be used once connected")
+		return "", true
+
+	case ReservedCommandGateway:
+		switch command {
+		case "HOST", "AUTHTOKEN", "RESUME":
+			c.SendIrcFail(command, "ALREADY_CONNECTED", command+" must be sent before connecting")
+			return "", true
+		case "CAPTCHA":
+			if !c.RequiresVerification || c.Verified {
+				c.SendIrcFail(command, "NOT_NEEDED", "No captcha is needed")
+				return "", true
+			}
+		}
+	}
+
+	return "", false
+}
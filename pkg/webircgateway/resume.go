@@ -0,0 +1,462 @@
+package webircgateway
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+	"golang.org/x/time/rate"
+)
+
+// The most registration numerics kept for replaying to a resumed client
+const maxResumeWelcomeLines = 30
+
+// How long a RESUME waits for the detached session to take the new connection
+const resumeAttachTimeout = time.Second * 5
+
+// clientResume - A session that is kept connected to its upstream after its client disconnects
+// so that a new connection may take it over with RESUME. The new connection relays its lines to
+// the session and is sent everything the session sends
+type clientResume struct {
+	mu       sync.Mutex
+	token    string
+	detached bool
+	// The client currently relaying for this session, and the lines it sends
+	relay *Client
+	recv  *ThrottledStringChannel
+	// Lines sent while detached, replayed once the session is resumed
+	buffer     []string
+	graceTimer *time.Timer
+	attach     chan *resumeRequest
+	// The registration numerics sent to the client, replayed so the resumed client knows the network
+	welcome []string
+
+	// Set on a relaying client. The session it relays for and where its lines are sent
+	session *Client
+	send    chan string
+}
+
+// resumeRequest - A new connection asking a detached session to take it over, or with migrate a
+// session that is still connected to move over to it
+type resumeRequest struct {
+	token   string
+	migrate bool
+	relay   *Client
+	send    chan string
+	result  chan bool
+}
+
+// resumeSessionStore - The sessions that may be resumed, keyed by their current token
+type resumeSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Client
+}
+
+func newResumeSessionStore() *resumeSessionStore {
+	return &resumeSessionStore{
+		sessions: make(map[string]*Client),
+	}
+}
+
+func (store *resumeSessionStore) get(token string) *Client {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.sessions[token]
+}
+
+func (store *resumeSessionStore) set(token string, c *Client) {
+	store.mu.Lock()
+	store.sessions[token] = c
+	store.mu.Unlock()
+}
+
+func (store *resumeSessionStore) remove(token string) {
+	store.mu.Lock()
+	delete(store.sessions, token)
+	store.mu.Unlock()
+}
+
+func newResumeToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// issueResumeToken - Give the client a new token that its session may be resumed with once it
+// disconnects. Any previous token stops working
+func (c *Client) issueResumeToken() {
+	if c.Gateway.Config.ResumeGrace <= 0 {
+		return
+	}
+
+	token := newResumeToken()
+	c.resume.mu.Lock()
+	oldToken := c.resume.token
+	c.resume.token = token
+	if c.resume.attach == nil {
+		c.resume.attach = make(chan *resumeRequest)
+	}
+	c.resume.mu.Unlock()
+
+	if oldToken != "" {
+		c.Gateway.resumeSessions.remove(oldToken)
+	}
+	c.Gateway.resumeSessions.set(token, c)
+	c.SendClientSignal("data", "RESUME TOKEN "+token)
+}
+
+// isResumable - Check if the session would be kept if its client disconnected now
+func (c *Client) isResumable() bool {
+	c.resume.mu.Lock()
+	hasToken := c.resume.token != ""
+	c.resume.mu.Unlock()
+
+	return hasToken && c.Gateway.Config.ResumeGrace > 0 && c.State() == ClientStateConnected
+}
+
+// recordResumeWelcome - Keep the registration numerics sent to the client for replaying later
+func (c *Client) recordResumeWelcome(line string) {
+	if c.Gateway.Config.ResumeGrace <= 0 || len(c.resume.welcome) >= maxResumeWelcomeLines {
+		return
+	}
+
+	m, err := irc.ParseLine(line)
+	if err != nil {
+		return
+	}
+	switch m.Command {
+	case "001", "002", "003", "004", "005":
+		c.resume.welcome = append(c.resume.welcome, line)
+	}
+}
+
+// clientLines - Where lines from the client are read from. The relaying clients lines when the
+// session has been resumed, or nil while detached which never receives in a select
+func (c *Client) clientLines() <-chan string {
+	c.resume.mu.Lock()
+	defer c.resume.mu.Unlock()
+
+	if c.resume.recv != nil {
+		return c.resume.recv.Output
+	}
+	if c.resume.detached {
+		return nil
+	}
+	return c.ThrottledRecv.Output
+}
+
+// resumeAttach - Receives connections asking to resume the session. nil if the session has no
+// token, which never receives in a select
+func (c *Client) resumeAttach() chan *resumeRequest {
+	c.resume.mu.Lock()
+	defer c.resume.mu.Unlock()
+	return c.resume.attach
+}
+
+// resumeGraceExpired - Fires once a detached session has not been resumed in time
+func (c *Client) resumeGraceExpired() <-chan time.Time {
+	if c.resume.graceTimer == nil {
+		return nil
+	}
+	return c.resume.graceTimer.C
+}
+
+// divertClientSignal - Pass a signal on to the client relaying for the session, or keep it for
+// later while detached. Returns false if the signal should be sent to the clients own transport
+func (c *Client) divertClientSignal(signal string, args []string) bool {
+	c.resume.mu.Lock()
+	relay := c.resume.relay
+	if relay == nil && !c.resume.detached {
+		c.resume.mu.Unlock()
+		return false
+	}
+
+	if relay == nil {
+		// Only IRC data is worth replaying. There is no transport for anything else
+		if signal == "data" && len(args) == 1 {
+			c.resume.buffer = append(c.resume.buffer, args[0])
+			if maxLines := c.Gateway.Config.ResumeBufferLines; len(c.resume.buffer) > maxLines {
+				c.resume.buffer = c.resume.buffer[len(c.resume.buffer)-maxLines:]
+			}
+		}
+		c.resume.mu.Unlock()
+		return true
+	}
+	c.resume.mu.Unlock()
+
+	relay.SendClientSignal(signal, args...)
+	return true
+}
+
+// answerDetachedPing - Reply to the upstreams PINGs while there is no client to do it. Returns
+// true if the line was a PING that has been answered
+func (c *Client) answerDetachedPing(line string) bool {
+	if c.State() != ClientStateDetached {
+		return false
+	}
+
+	m, err := irc.ParseLine(line)
+	if err != nil || m.Command != "PING" {
+		return false
+	}
+
+	c.processLineToUpstream("PONG :" + m.GetParam(0, ""))
+	return true
+}
+
+// detachSession - Keep the upstream connection once the client has gone so that the session may
+// be resumed. Returns false if the session should end instead
+func (c *Client) detachSession() bool {
+	grace := c.Gateway.Config.ResumeGrace
+	c.resume.mu.Lock()
+	c.resume.relay = nil
+	c.resume.recv = nil
+	hasToken := c.resume.token != ""
+	c.resume.mu.Unlock()
+
+	if grace <= 0 || !hasToken || c.upstream == nil || c.SeenQuit || c.IsShuttingDown() {
+		return false
+	}
+	// Signals are kept from now on as there is no transport to send them to
+	c.resume.mu.Lock()
+	c.resume.detached = true
+	c.resume.mu.Unlock()
+
+	if !c.setState(ClientStateDetached) {
+		c.resume.mu.Lock()
+		c.resume.detached = false
+		c.resume.mu.Unlock()
+		return false
+	}
+
+	c.resume.graceTimer = time.NewTimer(time.Second * time.Duration(grace))
+	c.Log(2, "Client disconnected, keeping the session for %d seconds", grace)
+	return true
+}
+
+// handleResumeExpired - The session was not resumed in time so close it, sending the QUIT that
+// was held back when the client disconnected
+func (c *Client) handleResumeExpired() bool {
+	c.resume.graceTimer = nil
+	c.Log(2, "Session was not resumed within %d seconds", c.Gateway.Config.ResumeGrace)
+
+	c.StartShutdown("client_closed")
+	if quitMessage := c.quitMessage(); !c.SeenQuit && quitMessage != "" {
+		c.processLineToUpstream("QUIT :" + quitMessage)
+	}
+	if c.upstream != nil {
+		c.upstream.Close()
+	}
+	return true
+}
+
+// endResume - Stop the session from being resumed and close any client relaying for it. Called
+// once the session is shutting down
+func (c *Client) endResume(reason string) {
+	c.resume.mu.Lock()
+	token := c.resume.token
+	relay := c.resume.relay
+	c.resume.token = ""
+	c.resume.relay = nil
+	c.resume.detached = false
+	c.resume.buffer = nil
+	c.resume.mu.Unlock()
+
+	if token != "" {
+		c.Gateway.resumeSessions.remove(token)
+	}
+	if relay != nil {
+		relay.StartShutdown(reason)
+	}
+}
+
+// resumeSession - Hand this new connection over to the detached session with the token. The
+// client goes on to register as normal if the session could not be resumed
+func (c *Client) resumeSession(token string) {
+	c.attachToSession("RESUME", token, false)
+}
+
+// migrateSession - Move the session with the token over to this new connection while it is still
+// connected, eg. when upgrading from sockjs to a websocket. Its previous connection is closed and
+// nothing is replayed as the client has already seen everything. Sessions that are detached are
+// resumed instead
+func (c *Client) migrateSession(token string) {
+	c.attachToSession("MIGRATE", token, true)
+}
+
+func (c *Client) attachToSession(command string, token string, migrate bool) {
+	session := c.Gateway.resumeSessions.get(token)
+	if session == nil || session == c {
+		c.SendIrcFail(command, "INVALID_TOKEN", "The session could not be resumed")
+		return
+	}
+
+	req := &resumeRequest{
+		token:   token,
+		migrate: migrate,
+		relay:   c,
+		send:    make(chan string, 50),
+		result:  make(chan bool, 1),
+	}
+
+	attached := false
+	select {
+	case session.resumeAttach() <- req:
+		attached = <-req.result
+	case <-time.After(resumeAttachTimeout):
+	}
+	if !attached {
+		c.SendIrcFail(command, "INVALID_TOKEN", "The session could not be resumed")
+		return
+	}
+
+	c.Log(2, "Took over the session of client %d with %s", session.Id, command)
+	c.resume.session = session
+	c.resume.send = req.send
+	// The session throttles the lines itself
+	c.ThrottledRecv.SetLimit(rate.Inf)
+}
+
+// relayLine - Pass a line from a relaying client on to its session. Returns false if the client
+// is not relaying
+func (c *Client) relayLine(line string) bool {
+	if c.resume.send == nil {
+		return false
+	}
+
+	select {
+	case c.resume.send <- line:
+	default:
+		c.Log(2, "Session of client %d is not keeping up, dropping line", c.resume.session.Id)
+	}
+	return true
+}
+
+// endRelay - The relaying client has gone. Its session detaches again once it has read the last
+// of its lines
+func (c *Client) endRelay() {
+	if c.resume.send != nil {
+		close(c.resume.send)
+		c.resume.send = nil
+	}
+}
+
+// attachRelay - Take over a new connection asking to resume the session and replay what it
+// missed. Called from the sessions own line worker
+func (c *Client) attachRelay(req *resumeRequest) {
+	c.resume.mu.Lock()
+	migrating := req.migrate && !c.resume.detached && c.State() == ClientStateConnected
+	valid := req.token == c.resume.token && (c.resume.detached || migrating) && !c.IsShuttingDown()
+	if !valid {
+		c.resume.mu.Unlock()
+		req.result <- false
+		return
+	}
+	if migrating {
+		c.migrateRelay(req)
+		return
+	}
+
+	recv := NewThrottledStringChannel(req.send, c.ThrottledRecv.Limiter)
+	recv.Weight = c.throttleWeight
+	recv.Delay = c.targetThrottleDelay
+	recv.Dropped = c.targetThrottleDropped
+
+	buffered := c.resume.buffer
+	c.resume.buffer = nil
+	c.resume.detached = false
+	c.resume.relay = req.relay
+	c.resume.recv = recv
+	c.resume.mu.Unlock()
+
+	if c.resume.graceTimer != nil {
+		c.resume.graceTimer.Stop()
+		c.resume.graceTimer = nil
+	}
+	c.setState(ClientStateConnected)
+	req.result <- true
+
+	c.Log(2, "Session resumed by client %d, replaying %d lines", req.relay.Id, len(buffered))
+	nick := c.IrcState.Nick
+	c.SendClientSignal("data", "RESUME SUCCESS "+nick)
+
+	for _, line := range c.resume.welcome {
+		m, err := irc.ParseLine(line)
+		if err != nil || len(m.Params) == 0 {
+			continue
+		}
+		m.Params[0] = nick
+		c.SendClientSignal("data", m.ToLine())
+	}
+
+	// The IRCd may not have told us how it shows the client to others
+	mask := irc.Mask{
+		Nick:     nick,
+		Username: c.IrcState.DisplayedUsername,
+		Hostname: c.IrcState.DisplayedHostname,
+	}
+	if mask.Username == "" {
+		mask.Username = c.IrcState.Username
+	}
+	if mask.Hostname == "" {
+		mask.Hostname = c.RemoteHostname
+	}
+	channels := c.IrcState.ChannelNames()
+	for _, channel := range channels {
+		join := irc.Message{Command: "JOIN", Prefix: &mask, Params: []string{channel}}
+		c.SendClientSignal("data", join.ToLine())
+	}
+
+	for _, line := range buffered {
+		c.SendClientSignal("data", line)
+	}
+
+	// The client builds its user lists and topics from fresh replies
+	for _, channel := range channels {
+		c.processLineToUpstream("NAMES " + channel)
+		c.processLineToUpstream("TOPIC " + channel)
+	}
+
+	c.issueResumeToken()
+}
+
+// migrateRelay - Move the connected session over to the new connection, closing the connection it
+// was using. Called with resume.mu held, which it releases
+func (c *Client) migrateRelay(req *resumeRequest) {
+	recv := NewThrottledStringChannel(req.send, c.ThrottledRecv.Limiter)
+	recv.Weight = c.throttleWeight
+	recv.Delay = c.targetThrottleDelay
+	recv.Dropped = c.targetThrottleDropped
+
+	previousRelay := c.resume.relay
+	c.resume.relay = req.relay
+	c.resume.recv = recv
+	c.resume.mu.Unlock()
+	req.result <- true
+
+	// Lines still arriving on the previous connection are dropped from now on
+	if previousRelay != nil {
+		previousRelay.StartShutdown("migrated")
+	} else {
+		c.sendTransportSignal("state", "closed", "migrated")
+	}
+
+	c.Log(2, "Session migrated to client %d", req.relay.Id)
+	c.SendClientSignal("data", "MIGRATE SUCCESS "+c.IrcState.Nick)
+	c.issueResumeToken()
+}
+
+// resumeEnabled - Check if sessions are kept for resuming once their client disconnects
+func (s *Gateway) resumeEnabled() bool {
+	return s.Config.ResumeGrace > 0
+}
+
+// isResumeCommand - Check if a line from a client that has not started connecting asks to resume
+// or migrate a session
+func (c *Client) isResumeCommand(m *irc.Message) bool {
+	command := strings.ToUpper(m.Command)
+	return !c.UpstreamStarted && c.resume.send == nil && c.Gateway.resumeEnabled() && (command == "RESUME" || command == "MIGRATE")
+}
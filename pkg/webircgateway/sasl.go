@@ -0,0 +1,205 @@
+package webircgateway
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+const (
+	// SaslMechanismPlain - Authenticate with a username and password
+	SaslMechanismPlain = "PLAIN"
+	// SaslMechanismExternal - Authenticate with the TLS client certificate sent to the upstream
+	SaslMechanismExternal = "EXTERNAL"
+)
+
+// AUTHENTICATE payloads are sent in chunks of this many bytes
+const saslChunkSize = 400
+
+const (
+	saslStateRequested = iota + 1
+	saslStateAuthenticating
+	saslStateDone
+)
+
+// gatewaySasl - A SASL login the gateway performs with the upstream on behalf of a client
+// during registration. Only used on the clients line worker, which handles the lines from both
+// the client and the upstream
+type gatewaySasl struct {
+	mechanism string
+	username  string
+	password  string
+	state     int
+	// The clients CAP END is held back until the login has completed
+	capEndHeld bool
+}
+
+// startGatewaySasl - Log in with SASL for the client if the upstream or a plugin has
+// credentials for it. Called as soon as the upstream connection is made
+func (c *Client) startGatewaySasl() {
+	c.sasl = nil
+
+	hook := &HookIrcSasl{
+		Client:         c,
+		UpstreamConfig: c.UpstreamConfig,
+		Mechanism:      c.UpstreamConfig.SaslMechanism,
+		Username:       c.UpstreamConfig.SaslUsername,
+		Password:       c.UpstreamConfig.SaslPassword,
+	}
+	hook.Dispatch("irc.sasl")
+
+	mechanism := strings.ToUpper(hook.Mechanism)
+	if mechanism == "" && hook.Username != "" {
+		mechanism = SaslMechanismPlain
+	}
+	if hook.Halt || mechanism == "" {
+		return
+	}
+	if mechanism != SaslMechanismPlain && mechanism != SaslMechanismExternal {
+		c.Log(3, "Unsupported SASL mechanism %s", mechanism)
+		return
+	}
+	if mechanism == SaslMechanismPlain && hook.Username == "" {
+		return
+	}
+
+	c.sasl = &gatewaySasl{
+		mechanism: mechanism,
+		username:  hook.Username,
+		password:  hook.Password,
+		state:     saslStateRequested,
+	}
+
+	// Requesting a cap holds registration open until CAP END, even for clients that don't use CAP
+	c.Log(1, "Starting SASL %s login with the upstream", mechanism)
+	c.writeSaslLine("CAP REQ :sasl", false)
+}
+
+// writeSaslLine - Write a line of the gateways SASL exchange to the upstream, keeping
+// credentials out of the traffic logs and the irc.line hook
+func (c *Client) writeSaslLine(line string, secret bool) {
+	if c.upstream == nil {
+		return
+	}
+
+	if secret {
+		c.Log(1, "->upstream: AUTHENTICATE <credentials>")
+	} else {
+		c.Log(1, "->upstream: %s", line)
+	}
+	c.writeUpstream(line)
+}
+
+// saslActive - Check if the gateway is in the middle of logging in for the client
+func (c *Client) saslActive() bool {
+	return c.sasl != nil && c.sasl.state != saslStateDone
+}
+
+// saslLineFromClient - Note the clients own CAP negotiation and hold back its CAP END until the
+// login has completed. Returns false if the line must not be sent upstream yet
+func (c *Client) saslLineFromClient(m *irc.Message) bool {
+	if strings.ToUpper(m.Command) != "CAP" || c.State() == ClientStateConnected {
+		return true
+	}
+
+	ending := m.GetParamU(0, "") == "END"
+	c.clientCapNegotiating = !ending
+	if ending && c.saslActive() {
+		c.sasl.capEndHeld = true
+		return false
+	}
+	return true
+}
+
+// saslLineFromUpstream - Handle the replies to the gateways SASL exchange, hiding them from the
+// client. Returns the line to pass on to the client, or an empty string to drop it
+func (c *Client) saslLineFromUpstream(m *irc.Message, line string) string {
+	if !c.saslActive() {
+		return line
+	}
+	sasl := c.sasl
+
+	switch m.Command {
+	case "CAP":
+		subCommand := m.GetParamU(1, "")
+		isSaslReply := strings.TrimSpace(strings.ToLower(m.GetParam(len(m.Params)-1, ""))) == "sasl"
+		if sasl.state != saslStateRequested || !isSaslReply || (subCommand != "ACK" && subCommand != "NAK") {
+			return line
+		}
+		if subCommand == "NAK" {
+			c.Log(2, "Upstream does not support SASL, continuing without logging in")
+			c.finishGatewaySasl()
+			return ""
+		}
+		sasl.state = saslStateAuthenticating
+		c.writeSaslLine("AUTHENTICATE "+sasl.mechanism, false)
+		return ""
+
+	case "421", "451":
+		// The upstream does not know CAP at all
+		if sasl.state == saslStateRequested && isCapRejectedReply(m) {
+			c.Log(2, "Upstream does not support CAP, continuing without logging in")
+			c.finishGatewaySasl()
+			return ""
+		}
+
+	case "AUTHENTICATE":
+		if sasl.state == saslStateAuthenticating && m.GetParam(0, "") == "+" {
+			c.sendSaslCredentials()
+			return ""
+		}
+
+	case "900":
+		// RPL_LOGGEDIN is passed on so that the client knows its account
+
+	case "903":
+		c.Log(2, "Logged in to the upstream with SASL %s", sasl.mechanism)
+		c.finishGatewaySasl()
+		return ""
+
+	case "902", "904", "905", "906", "907", "908":
+		if m.Command != "908" {
+			c.Log(2, "SASL %s login with the upstream failed: %s", sasl.mechanism, m.GetParam(len(m.Params)-1, ""))
+			c.finishGatewaySasl()
+		}
+		return ""
+	}
+
+	return line
+}
+
+// sendSaslCredentials - Send the AUTHENTICATE payload for the mechanism in chunks
+func (c *Client) sendSaslCredentials() {
+	sasl := c.sasl
+	payload := "+"
+	if sasl.mechanism == SaslMechanismPlain {
+		payload = base64.StdEncoding.EncodeToString([]byte(sasl.username + "\x00" + sasl.username + "\x00" + sasl.password))
+	}
+
+	for len(payload) >= saslChunkSize {
+		c.writeSaslLine("AUTHENTICATE "+payload[:saslChunkSize], true)
+		payload = payload[saslChunkSize:]
+	}
+	// A payload that is an exact multiple of the chunk size ends with an empty chunk
+	if payload == "" {
+		payload = "+"
+	}
+	c.writeSaslLine("AUTHENTICATE "+payload, sasl.mechanism == SaslMechanismPlain)
+}
+
+// finishGatewaySasl - Let registration continue once the login has succeeded or failed
+func (c *Client) finishGatewaySasl() {
+	sasl := c.sasl
+	// CAP END is only ever sent once for the login
+	if sasl.state == saslStateDone {
+		return
+	}
+	sasl.state = saslStateDone
+	sasl.password = ""
+
+	// Clients still negotiating caps send their own CAP END later
+	if sasl.capEndHeld || !c.clientCapNegotiating {
+		c.writeSaslLine("CAP END", false)
+	}
+}
@@ -0,0 +1,73 @@
+package webircgateway
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// The most lines read while waiting for the reply to STARTTLS. Servers may send notices first
+const maxStartTLSLines = 50
+
+// upstreamStartTLS - Ask the IRC server to upgrade a plaintext connection to TLS and wait for it
+// to agree. The TLS handshake is left to the caller
+func upstreamStartTLS(conn net.Conn, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	_, err := conn.Write([]byte("STARTTLS\r\n"))
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < maxStartTLSLines; i++ {
+		line, err := readLineUnbuffered(conn)
+		if err != nil {
+			return err
+		}
+
+		msg, err := irc.ParseLine(line)
+		if err != nil {
+			continue
+		}
+
+		switch msg.Command {
+		case "670":
+			// RPL_STARTTLS
+			return nil
+		case "691":
+			// ERR_STARTTLS
+			return errors.New("the server could not start TLS: " + msg.GetParam(1, ""))
+		case "421":
+			return errors.New("the server does not support STARTTLS")
+		case "ERROR":
+			return errors.New("the server closed the connection: " + msg.GetParam(0, ""))
+		case "PING":
+			conn.Write([]byte("PONG :" + msg.GetParam(0, "") + "\r\n"))
+		}
+	}
+
+	return errors.New("no reply to STARTTLS")
+}
+
+// readLineUnbuffered - Read a single line without reading past it, so that the TLS handshake
+// that follows still has all of its data in the connection
+func readLineUnbuffered(conn net.Conn) (string, error) {
+	line := []byte{}
+	b := make([]byte, 1)
+	for len(line) < 8192 {
+		_, err := conn.Read(b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimRight(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+
+	return "", errors.New("line too long")
+}
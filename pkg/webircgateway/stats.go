@@ -0,0 +1,100 @@
+package webircgateway
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// GatewayStats - A snapshot of the gateway state, used for the dashboard and status output
+type GatewayStats struct {
+	Time           int64           `json:"time"`
+	Clients        int             `json:"clients"`
+	ClientStates   map[string]int  `json:"client_states"`
+	Upstreams      map[string]int  `json:"upstreams"`
+	Goroutines     int             `json:"goroutines"`
+	HeapInuseKB    uint64          `json:"heap_inuse_kb"`
+	HeapAllocKB    uint64          `json:"heap_alloc_kb"`
+	SysKB          uint64          `json:"sys_kb"`
+	Draining       bool            `json:"draining"`
+	Maintenance    bool            `json:"maintenance"`
+	MemoryPressure bool            `json:"memory_pressure"`
+	RecentErrors   []string        `json:"recent_errors"`
+	MessageTags    MessageTagStats `json:"message_tags"`
+	// Smoothed PING round-trip time to each upstream, in milliseconds
+	UpstreamLatencyMs map[string]float64 `json:"upstream_latency_ms"`
+	// Connection counters for each transport that has been used
+	Transports map[string]TransportStats `json:"transports"`
+	// How long the plugin callbacks of each hook type have taken
+	Hooks map[string]HookStats `json:"hooks"`
+	// Totals across all cluster peers when aggregate_status is enabled
+	Cluster *ClusterStats `json:"cluster,omitempty"`
+}
+
+// Stats - Collect a snapshot of the current gateway state
+func (s *Gateway) Stats() *GatewayStats {
+	stats := &GatewayStats{
+		Time:           time.Now().Unix(),
+		ClientStates:   make(map[string]int),
+		Upstreams:      make(map[string]int),
+		Goroutines:     runtime.NumGoroutine(),
+		Draining:       s.IsDraining(),
+		Maintenance:    s.IsInMaintenance(),
+		MemoryPressure: s.IsUnderMemoryPressure(),
+		RecentErrors:   s.recentErrors.Lines(),
+		MessageTags:    s.messageTags.Stats(),
+		Transports:     s.transportMetrics.snapshot(),
+		Hooks:          hookTimings.snapshot(),
+	}
+
+	stats.UpstreamLatencyMs = make(map[string]float64)
+	for upstream, rtt := range s.UpstreamLatencies() {
+		stats.UpstreamLatencyMs[upstream] = float64(rtt) / float64(time.Millisecond)
+	}
+
+	for _, c := range s.AllClients() {
+		stats.Clients++
+		stats.ClientStates[c.State()]++
+		if c.UpstreamConfig.Hostname != "" {
+			upstream := fmt.Sprintf("%s:%d", c.UpstreamConfig.Hostname, c.UpstreamConfig.Port)
+			stats.Upstreams[upstream]++
+		}
+	}
+
+	mem := &runtime.MemStats{}
+	runtime.ReadMemStats(mem)
+	stats.HeapInuseKB = mem.HeapInuse / 1024
+	stats.HeapAllocKB = mem.HeapAlloc / 1024
+	stats.SysKB = mem.Sys / 1024
+
+	return stats
+}
+
+// logRing - Keeps the most recent log lines in memory
+type logRing struct {
+	mu    sync.Mutex
+	size  int
+	lines []string
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{size: size}
+}
+
+func (r *logRing) Add(line string) {
+	r.mu.Lock()
+	r.lines = append(r.lines, time.Now().UTC().Format(time.RFC3339)+" "+line)
+	if len(r.lines) > r.size {
+		r.lines = r.lines[len(r.lines)-r.size:]
+	}
+	r.mu.Unlock()
+}
+
+func (r *logRing) Lines() []string {
+	r.mu.Lock()
+	lines := make([]string, len(r.lines))
+	copy(lines, r.lines)
+	r.mu.Unlock()
+	return lines
+}
@@ -0,0 +1,212 @@
+package webircgateway
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/kiwiirc/webircgateway/pkg/recaptcha"
+	"gopkg.in/ini.v1"
+)
+
+// ConfigTenant - A site served by the gateway with its own upstreams and client settings.
+// Clients belong to a tenant by the path prefix of the URL they connect to, or the Origin they
+// connect from. Options left empty or 0 use the gateway wide setting
+type ConfigTenant struct {
+	Name    string
+	Origins []glob.Glob
+	// PathPrefix - Transports are also served under this path, eg. /acme/webirc/websocket/
+	PathPrefix     string
+	WebircPassword string
+	ClientUsername string
+	ClientRealname string
+	ClientHostname string
+	// Captcha settings replace the gateway wide ones when ReCaptchaSecret is set
+	RequiresVerification     bool
+	ReCaptchaURL             string
+	ReCaptchaSecret          string
+	MaxClients               int
+	MaxConnectionsPerAccount int
+}
+
+type requestTenantKey struct{}
+
+// newConfigTenant - Read a [tenant.name] config section
+func newConfigTenant(c *Config, section *ini.Section) ConfigTenant {
+	tenant := ConfigTenant{
+		Name: strings.TrimPrefix(section.Name(), "tenant."),
+	}
+
+	for _, origin := range section.Key("origins").Strings(",") {
+		match, err := glob.Compile(strings.ToLower(origin))
+		if err != nil {
+			c.gateway.Log(3, "Config section %s has invalid origin match, %s", section.Name(), origin)
+			continue
+		}
+		tenant.Origins = append(tenant.Origins, match)
+	}
+
+	if path := strings.Trim(section.Key("path").MustString(""), "/"); path != "" {
+		tenant.PathPrefix = "/" + path
+	}
+
+	tenant.WebircPassword = section.Key("webirc").MustString("")
+	tenant.ClientUsername = section.Key("username").MustString("")
+	tenant.ClientRealname = section.Key("realname").MustString("")
+	tenant.ClientHostname = section.Key("hostname").MustString("")
+
+	tenant.ReCaptchaSecret = section.Key("recaptcha_secret").MustString("")
+	if tenant.ReCaptchaSecret != "" {
+		tenant.RequiresVerification = section.Key("verify_required").MustBool(false)
+		tenant.ReCaptchaURL = section.Key("recaptcha_url").MustString("https://www.google.com/recaptcha/api/siteverify")
+	}
+
+	tenant.MaxClients = section.Key("max_clients").MustInt(0)
+	tenant.MaxConnectionsPerAccount = section.Key("max_connections_per_account").MustInt(0)
+
+	return tenant
+}
+
+// hasTenant - Check if a tenant is configured
+func (c *Config) hasTenant(name string) bool {
+	for _, tenant := range c.Tenants {
+		if tenant.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// serveHTTP - Pass requests on to the router, first stripping the path prefix of the tenant
+// the request is for so that its transports are served by the usual routes
+func (s *Gateway) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	tenants := s.Config.Tenants
+	for idx := range tenants {
+		tenant := &tenants[idx]
+		if tenant.PathPrefix == "" || !strings.HasPrefix(r.URL.Path, tenant.PathPrefix+"/") {
+			continue
+		}
+
+		tenantRequest := r.WithContext(context.WithValue(r.Context(), requestTenantKey{}, tenant))
+		tenantURL := *r.URL
+		tenantURL.Path = strings.TrimPrefix(r.URL.Path, tenant.PathPrefix)
+		tenantURL.RawPath = ""
+		tenantRequest.URL = &tenantURL
+		s.HttpRouter.ServeHTTP(w, tenantRequest)
+		return
+	}
+
+	s.HttpRouter.ServeHTTP(w, r)
+}
+
+// requestTenant - The tenant a request is for, by its path prefix or else its Origin. nil if it
+// is not for a tenant
+func (s *Gateway) requestTenant(r *http.Request) *ConfigTenant {
+	if tenant, ok := r.Context().Value(requestTenantKey{}).(*ConfigTenant); ok {
+		return tenant
+	}
+
+	return s.originTenant(strings.ToLower(r.Header.Get("Origin")))
+}
+
+// originTenant - The first tenant with an origin matching originHeader
+func (s *Gateway) originTenant(originHeader string) *ConfigTenant {
+	if originHeader == "" {
+		return nil
+	}
+
+	tenants := s.Config.Tenants
+	for idx := range tenants {
+		for _, originMatch := range tenants[idx].Origins {
+			if originMatch.Match(originHeader) {
+				return &tenants[idx]
+			}
+		}
+	}
+
+	return nil
+}
+
+// tenantClientCount - The number of clients connected for a tenant
+func (s *Gateway) tenantClientCount(name string) int {
+	count := 0
+	for _, c := range s.AllClients() {
+		if c.Tenant != nil && c.Tenant.Name == name && c.State() != ClientStateEnding {
+			count++
+		}
+	}
+
+	return count
+}
+
+// tenantUpstreams - The upstreams that clients of a tenant may use. Upstreams belonging to a
+// tenant are only used by it, and tenants without their own use the rest
+func tenantUpstreams(upstreams []ConfigUpstream, tenant string) []ConfigUpstream {
+	matching := []ConfigUpstream{}
+	shared := []ConfigUpstream{}
+	for _, upstream := range upstreams {
+		if upstream.Tenant == "" {
+			shared = append(shared, upstream)
+		} else if upstream.Tenant == tenant {
+			matching = append(matching, upstream)
+		}
+	}
+
+	if tenant == "" || len(matching) == 0 {
+		return shared
+	}
+	return matching
+}
+
+// tenantName - The name of the clients tenant, empty if it has none
+func (c *Client) tenantName() string {
+	if c.Tenant == nil {
+		return ""
+	}
+	return c.Tenant.Name
+}
+
+// applyTenant - Replace settings in the clients copy of the upstream config with those of its tenant
+func (c *Client) applyTenant(upstreamConfig *ConfigUpstream) {
+	if c.Tenant != nil && c.Tenant.WebircPassword != "" {
+		upstreamConfig.WebircPassword = c.Tenant.WebircPassword
+	}
+}
+
+// clientTemplates - The username, realname and hostname templates for the client. Those set
+// by its tenant replace the gateway wide ones
+func (c *Client) clientTemplates() (username string, realname string, hostname string) {
+	config := c.Gateway.Config
+	username, realname, hostname = config.ClientUsername, config.ClientRealname, config.ClientHostname
+	if c.Tenant == nil {
+		return
+	}
+
+	if c.Tenant.ClientUsername != "" {
+		username = c.Tenant.ClientUsername
+	}
+	if c.Tenant.ClientRealname != "" {
+		realname = c.Tenant.ClientRealname
+	}
+	if c.Tenant.ClientHostname != "" {
+		hostname = c.Tenant.ClientHostname
+	}
+	return
+}
+
+// reCaptcha - The captcha verifier for the client
+func (c *Client) reCaptcha() recaptcha.R {
+	if c.Tenant != nil && c.Tenant.ReCaptchaSecret != "" {
+		return recaptcha.R{URL: c.Tenant.ReCaptchaURL, Secret: c.Tenant.ReCaptchaSecret}
+	}
+	return recaptcha.R{URL: c.Gateway.Config.ReCaptchaURL, Secret: c.Gateway.Config.ReCaptchaSecret}
+}
+
+// maxConnectionsPerAccount - The account connection limit for the client
+func (c *Client) maxConnectionsPerAccount() int {
+	if c.Tenant != nil && c.Tenant.MaxConnectionsPerAccount > 0 {
+		return c.Tenant.MaxConnectionsPerAccount
+	}
+	return c.Gateway.Config.MaxConnectionsPerAccount
+}
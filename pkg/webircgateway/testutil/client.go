@@ -0,0 +1,154 @@
+package testutil
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+	"github.com/kiwiirc/webircgateway/pkg/webircgateway"
+)
+
+// ClientConn - An in-memory transport connection to a gateway client. Lines sent are handled
+// as if they arrived over a real transport and lines for the client are queued to be read
+type ClientConn struct {
+	Client *webircgateway.Client
+
+	lines chan string
+
+	mu           sync.Mutex
+	closedReason string
+	closed       bool
+	recvClosed   bool
+}
+
+// Connect - Create a new client on the gateway connecting from remoteAddr
+func Connect(gateway *webircgateway.Gateway, remoteAddr string) *ClientConn {
+	client := gateway.NewClient()
+	client.RemoteAddr = remoteAddr
+	client.RemoteHostname = remoteAddr
+
+	conn := &ClientConn{
+		Client: client,
+		lines:  make(chan string, 1000),
+	}
+
+	client.Log(2, "New test client from %s", remoteAddr)
+	client.Ready()
+	go conn.readSignals()
+
+	return conn
+}
+
+func (c *ClientConn) readSignals() {
+	for signal := range c.Client.Signals {
+		switch signal[0] {
+		case "data":
+			select {
+			case c.lines <- signal[1]:
+			default:
+				c.Client.Log(3, "Test client line queue full. Dropping data")
+			}
+		case "state":
+			if signal[1] == "closed" {
+				c.mu.Lock()
+				c.closedReason = signal[2]
+				c.mu.Unlock()
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	close(c.lines)
+}
+
+// Send - Send a line to the gateway as the client
+func (c *ClientConn) Send(line string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || c.recvClosed {
+		return fmt.Errorf("client is closed")
+	}
+
+	select {
+	case c.Client.Recv <- line:
+		return nil
+	default:
+		return fmt.Errorf("client receive queue is full")
+	}
+}
+
+// ReadLine - Wait for the next line sent to the client
+func (c *ClientConn) ReadLine(timeout time.Duration) (string, error) {
+	select {
+	case line, ok := <-c.lines:
+		if !ok {
+			return "", fmt.Errorf("client closed (%s)", c.ClosedReason())
+		}
+		return line, nil
+	case <-time.After(timeout):
+		return "", fmt.Errorf("timed out waiting for a line")
+	}
+}
+
+// Expect - Wait for a message with command to be sent to the client, skipping any others
+func (c *ClientConn) Expect(command string, timeout time.Duration) (*irc.Message, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("timed out waiting for %s", command)
+		}
+
+		line, err := c.ReadLine(remaining)
+		if err != nil {
+			return nil, fmt.Errorf("waiting for %s: %s", command, err.Error())
+		}
+
+		msg, err := irc.ParseLine(line)
+		if err == nil && msg.Command == strings.ToUpper(command) {
+			return msg, nil
+		}
+	}
+}
+
+// Register - Register on the IRC server with nick and wait for the welcome message
+func (c *ClientConn) Register(nick string, timeout time.Duration) (*irc.Message, error) {
+	if err := c.Send("NICK " + nick); err != nil {
+		return nil, err
+	}
+	if err := c.Send("USER " + nick + " 0 * :" + nick); err != nil {
+		return nil, err
+	}
+
+	return c.Expect("001", timeout)
+}
+
+// IsClosed - Check if the gateway has closed the client
+func (c *ClientConn) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// ClosedReason - The reason given by the gateway when it closed the client, if any
+func (c *ClientConn) ClosedReason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closedReason
+}
+
+// Close - Disconnect the client as if its transport connection closed
+func (c *ClientConn) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.recvClosed {
+		c.recvClosed = true
+		close(c.Client.Recv)
+	}
+}
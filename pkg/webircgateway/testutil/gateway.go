@@ -0,0 +1,59 @@
+// Package testutil - Helpers for testing the gateway without real networks. A FakeIrcd acts as
+// the upstream IRC server and ClientConn drives a gateway client over an in-memory transport:
+//
+//	ircd, _ := testutil.NewFakeIrcd()
+//	ircd.Caps = []string{"message-tags", "sasl=PLAIN"}
+//	gateway, _ := testutil.NewGateway(ircd, "", t.Logf)
+//	client := testutil.Connect(gateway, "127.0.0.1")
+//	client.Register("nick", time.Second)
+package testutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/kiwiirc/webircgateway/pkg/webircgateway"
+)
+
+// NewGateway - Create a gateway that connects clients to ircd. extraConfig is appended to the
+// generated config file so that any other options may be set. Log lines are passed to logf if
+// it is not nil. The gateway is not started, so no HTTP servers or listeners are opened
+func NewGateway(ircd *FakeIrcd, extraConfig string, logf func(format string, args ...interface{})) (*webircgateway.Gateway, error) {
+	host, port := ircd.Addr()
+	config := fmt.Sprintf(
+		"logLevel = 1\n\n[upstream.1]\nhostname = %s\nport = %d\ntimeout = 5\nthrottle = 1000\n\n%s\n",
+		host,
+		port,
+		extraConfig,
+	)
+
+	configFile, err := ioutil.TempFile("", "webircgateway-test-*.conf")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(configFile.Name())
+
+	_, err = configFile.WriteString(config)
+	configFile.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	gateway := webircgateway.NewGateway("gateway")
+	go func() {
+		for line := range gateway.LogOutput {
+			if logf != nil {
+				logf("%s", line)
+			}
+		}
+	}()
+
+	gateway.Config.SetConfigFile(configFile.Name())
+	err = gateway.Config.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return gateway, nil
+}
@@ -0,0 +1,353 @@
+package testutil
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// FakeIrcdHandler - Handles a command sent to the fake IRC server. Handlers replace the
+// default handling of their command
+type FakeIrcdHandler func(conn *FakeIrcdConn, msg *irc.Message)
+
+// FakeIrcd - A scriptable IRC server listening on a local port. By default it handles just
+// enough of CAP, SASL PLAIN and registration for a client to connect
+type FakeIrcd struct {
+	ServerName string
+	// Caps - Capabilities listed in CAP LS, with an optional =value
+	Caps []string
+	// SaslAccounts - Account passwords accepted by SASL PLAIN, keyed by account name
+	SaslAccounts map[string]string
+	// ISupport - Tokens sent in RPL_ISUPPORT after registration
+	ISupport []string
+
+	listener net.Listener
+	mu       sync.Mutex
+	handlers map[string]FakeIrcdHandler
+	conns    chan *FakeIrcdConn
+}
+
+// FakeIrcdConn - A connection to the fake IRC server
+type FakeIrcdConn struct {
+	Server *FakeIrcd
+	conn   net.Conn
+
+	mu         sync.Mutex
+	nick       string
+	user       string
+	registered bool
+	capsLocked bool
+	caps       map[string]bool
+	account    string
+	saslPlain  bool
+	received   chan *irc.Message
+}
+
+// NewFakeIrcd - Start a fake IRC server listening on a random local port
+func NewFakeIrcd() (*FakeIrcd, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FakeIrcd{
+		ServerName:   "irc.test",
+		SaslAccounts: make(map[string]string),
+		ISupport:     []string{"NETWORK=TestNet", "CASEMAPPING=rfc1459", "CHANTYPES=#"},
+		listener:     listener,
+		handlers:     make(map[string]FakeIrcdHandler),
+		conns:        make(chan *FakeIrcdConn, 10),
+	}
+
+	go s.accept()
+	return s, nil
+}
+
+// Addr - The host and port the server is listening on
+func (s *FakeIrcd) Addr() (string, int) {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// Handle - Replace the handling of a command. A nil handler restores the default
+func (s *FakeIrcd) Handle(command string, handler FakeIrcdHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	command = strings.ToUpper(command)
+	if handler == nil {
+		delete(s.handlers, command)
+	} else {
+		s.handlers[command] = handler
+	}
+}
+
+// NextConn - Wait for the next connection to the server
+func (s *FakeIrcd) NextConn(timeout time.Duration) (*FakeIrcdConn, error) {
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-time.After(timeout):
+		return nil, errors.New("timed out waiting for a connection")
+	}
+}
+
+// Close - Stop listening. Existing connections are left open
+func (s *FakeIrcd) Close() error {
+	return s.listener.Close()
+}
+
+func (s *FakeIrcd) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			close(s.conns)
+			return
+		}
+
+		ircdConn := &FakeIrcdConn{
+			Server:   s,
+			conn:     conn,
+			nick:     "*",
+			caps:     make(map[string]bool),
+			received: make(chan *irc.Message, 100),
+		}
+		select {
+		case s.conns <- ircdConn:
+		default:
+		}
+
+		go ircdConn.read()
+	}
+}
+
+func (s *FakeIrcd) handler(command string) FakeIrcdHandler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.handlers[command]
+}
+
+func (c *FakeIrcdConn) read() {
+	reader := bufio.NewReader(c.conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+
+		msg, err := irc.ParseLine(strings.TrimRight(line, "\r\n"))
+		if err != nil {
+			continue
+		}
+
+		select {
+		case c.received <- msg:
+		default:
+		}
+
+		if handler := c.Server.handler(msg.Command); handler != nil {
+			handler(c, msg)
+		} else {
+			c.handleDefault(msg)
+		}
+	}
+
+	close(c.received)
+	c.conn.Close()
+}
+
+// Send - Send a raw line to the client
+func (c *FakeIrcdConn) Send(line string) error {
+	_, err := c.conn.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// Reply - Send a message from the server addressed to the client, eg. Reply("001", "Welcome")
+func (c *FakeIrcdConn) Reply(command string, params ...string) error {
+	msg := irc.Message{
+		Prefix:  &irc.Mask{Nick: c.Server.ServerName},
+		Command: command,
+		Params:  append([]string{c.Nick()}, params...),
+	}
+	return c.Send(msg.ToLine())
+}
+
+// Nick - The nick the client is using
+func (c *FakeIrcdConn) Nick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+// Account - The account the client logged in to with SASL
+func (c *FakeIrcdConn) Account() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.account
+}
+
+// HasCap - Check if the client has enabled a capability
+func (c *FakeIrcdConn) HasCap(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.caps[name]
+}
+
+// Expect - Wait for the client to send a command, skipping any others. Returns the message
+func (c *FakeIrcdConn) Expect(command string, timeout time.Duration) (*irc.Message, error) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case msg, ok := <-c.received:
+			if !ok {
+				return nil, fmt.Errorf("connection closed while waiting for %s", command)
+			}
+			if msg.Command == strings.ToUpper(command) {
+				return msg, nil
+			}
+		case <-deadline:
+			return nil, fmt.Errorf("timed out waiting for %s", command)
+		}
+	}
+}
+
+// Close - Close the connection to the client
+func (c *FakeIrcdConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *FakeIrcdConn) handleDefault(msg *irc.Message) {
+	switch msg.Command {
+	case "CAP":
+		c.handleCap(msg)
+	case "AUTHENTICATE":
+		c.handleAuthenticate(msg)
+	case "NICK":
+		c.mu.Lock()
+		oldNick := c.nick
+		c.nick = msg.GetParam(0, "")
+		registered := c.registered
+		c.mu.Unlock()
+		if registered {
+			c.Send(fmt.Sprintf(":%s NICK %s", oldNick, c.Nick()))
+		}
+		c.maybeRegister()
+	case "USER":
+		c.mu.Lock()
+		c.user = msg.GetParam(0, "")
+		c.mu.Unlock()
+		c.maybeRegister()
+	case "PING":
+		c.Send(fmt.Sprintf(":%s PONG %s :%s", c.Server.ServerName, c.Server.ServerName, msg.GetParam(0, "")))
+	case "QUIT":
+		c.Send("ERROR :Closing link")
+		c.conn.Close()
+	}
+}
+
+func (c *FakeIrcdConn) handleCap(msg *irc.Message) {
+	switch strings.ToUpper(msg.GetParam(0, "")) {
+	case "LS":
+		c.mu.Lock()
+		c.capsLocked = true
+		c.mu.Unlock()
+		c.Reply("CAP", "LS", strings.Join(c.Server.Caps, " "))
+	case "REQ":
+		requested := strings.Fields(msg.GetParam(1, ""))
+		offered := make(map[string]bool)
+		for _, capability := range c.Server.Caps {
+			offered[strings.SplitN(capability, "=", 2)[0]] = true
+		}
+		for _, capability := range requested {
+			if !offered[strings.TrimPrefix(capability, "-")] {
+				c.Reply("CAP", "NAK", msg.GetParam(1, ""))
+				return
+			}
+		}
+		c.mu.Lock()
+		// Like LS, a REQ before registration holds it open until CAP END
+		if !c.registered {
+			c.capsLocked = true
+		}
+		for _, capability := range requested {
+			if strings.HasPrefix(capability, "-") {
+				delete(c.caps, capability[1:])
+			} else {
+				c.caps[capability] = true
+			}
+		}
+		c.mu.Unlock()
+		c.Reply("CAP", "ACK", msg.GetParam(1, ""))
+	case "END":
+		c.mu.Lock()
+		c.capsLocked = false
+		c.mu.Unlock()
+		c.maybeRegister()
+	}
+}
+
+func (c *FakeIrcdConn) handleAuthenticate(msg *irc.Message) {
+	param := msg.GetParam(0, "")
+	if param == "PLAIN" {
+		c.mu.Lock()
+		c.saslPlain = true
+		c.mu.Unlock()
+		c.Send("AUTHENTICATE +")
+		return
+	}
+
+	c.mu.Lock()
+	isPlain := c.saslPlain
+	c.saslPlain = false
+	c.mu.Unlock()
+
+	if !isPlain {
+		c.Reply("908", "PLAIN", "are available SASL mechanisms")
+		c.Reply("904", "SASL authentication failed")
+		return
+	}
+
+	decoded, _ := base64.StdEncoding.DecodeString(param)
+	parts := strings.Split(string(decoded), "\x00")
+	if len(parts) != 3 {
+		c.Reply("904", "SASL authentication failed")
+		return
+	}
+
+	password, exists := c.Server.SaslAccounts[parts[1]]
+	if !exists || password != parts[2] {
+		c.Reply("904", "SASL authentication failed")
+		return
+	}
+
+	c.mu.Lock()
+	c.account = parts[1]
+	c.mu.Unlock()
+	c.Reply("900", c.Nick()+"!user@host", parts[1], "You are now logged in as "+parts[1])
+	c.Reply("903", "SASL authentication successful")
+}
+
+func (c *FakeIrcdConn) maybeRegister() {
+	c.mu.Lock()
+	if c.registered || c.capsLocked || c.nick == "*" || c.user == "" {
+		c.mu.Unlock()
+		return
+	}
+	c.registered = true
+	c.mu.Unlock()
+
+	c.Reply("001", "Welcome to the test network "+c.Nick())
+	c.Reply("002", "Your host is "+c.Server.ServerName)
+	c.Reply("003", "This server was created just now")
+	c.Reply("004", c.Server.ServerName, "fakeircd", "iow", "ntk")
+	isupport := append([]string{}, c.Server.ISupport...)
+	c.Reply("005", append(isupport, "are supported by this server")...)
+	c.Reply("422", "MOTD File is missing")
+}
@@ -0,0 +1,215 @@
+package webircgateway
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+	"golang.org/x/time/rate"
+)
+
+// The number of targets a client may have throttle state for before idle ones are removed
+const maxTargetLimiters = 50
+
+const (
+	// ThrottleTierUnverified - Clients that have not completed a captcha or logged in
+	ThrottleTierUnverified = "unverified"
+	// ThrottleTierVerified - Clients that have completed a captcha or logged in
+	ThrottleTierVerified = "verified"
+	// ThrottleTierAdmin - Clients logged in to one of the accounts in [throttle.admins]
+	ThrottleTierAdmin = "admin"
+)
+
+// ConfigThrottleTier - The upstream throttle for clients in a throttle tier
+type ConfigThrottleTier struct {
+	// Lines per second, 0 for unthrottled
+	Throttle int
+	Burst    int
+}
+
+// setThrottle - Switch the upstream throttle between the registration and registered limits.
+// Typical IRCd behavior is to not throttle registration commands so by default registration is
+// unthrottled. Once registered, the throttle tier of the client replaces the upstream throttle
+// if one is configured for it
+func (c *Client) setThrottle(registered bool) {
+	config := c.UpstreamConfig
+	throttle, burst := config.RegistrationThrottle, config.RegistrationThrottleBurst
+	if registered {
+		throttle, burst = config.Throttle, config.ThrottleBurst
+
+		tier := c.throttleTier()
+		if tierConfig, exists := c.Gateway.Config.ThrottleTiers[tier]; exists {
+			throttle, burst = tierConfig.Throttle, tierConfig.Burst
+		}
+		if tier != c.currentThrottleTier {
+			c.Log(1, "Using the %s throttle tier", tier)
+			c.currentThrottleTier = tier
+		}
+	}
+
+	limit := rate.Inf
+	if throttle > 0 {
+		limit = rate.Limit(throttle)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	// The limiter is shared with the ThrottledRecv goroutine so it is updated in place
+	c.ThrottledRecv.SetLimit(limit)
+	c.ThrottledRecv.SetBurst(burst)
+}
+
+// throttleTier - Which throttle tier the client currently falls in to
+func (c *Client) throttleTier() string {
+	account := c.IrcState.Account
+	if account == "" && c.Identity != nil {
+		account = c.Identity.Account
+	}
+
+	if account != "" {
+		for _, match := range c.Gateway.Config.ThrottleAdminAccounts {
+			if match.Match(strings.ToLower(account)) {
+				return ThrottleTierAdmin
+			}
+		}
+	}
+
+	if c.Verified || account != "" {
+		return ThrottleTierVerified
+	}
+
+	return ThrottleTierUnverified
+}
+
+// updateThrottleTier - Apply the throttle of the clients tier after its status has changed,
+// eg. after completing a captcha or logging in
+func (c *Client) updateThrottleTier() {
+	if c.State() != ClientStateConnected {
+		return
+	}
+	c.setThrottle(true)
+}
+
+// targetThrottleDelay - How long a message from the client should be held back so that messages
+// to any single target are limited, independently of the upstream throttle. A penalty is added to
+// the message each time the client goes over the burst. Only PRIVMSG, NOTICE and TAGMSG are ever
+// delayed, and other lines such as PING and QUIT are passed on while they are held back.
+// Called from the goroutine of each ThrottledStringChannel reading lines for the client.
+func (c *Client) targetThrottleDelay(line string) time.Duration {
+	config := c.Gateway.Config
+	if config.ClientTargetThrottle <= 0 {
+		return 0
+	}
+
+	message, err := irc.ParseLine(line)
+	if err != nil || len(message.Params) == 0 {
+		return 0
+	}
+	if !stringInSlice(strings.ToUpper(message.Command), []string{"PRIVMSG", "NOTICE", "TAGMSG"}) {
+		return 0
+	}
+
+	c.targetLimitersLock.Lock()
+	defer c.targetLimitersLock.Unlock()
+
+	if c.targetLimiters == nil {
+		c.targetLimiters = make(map[string]*rate.Limiter)
+	}
+
+	var delay time.Duration
+	for _, target := range strings.Split(message.Params[0], ",") {
+		target = c.IrcState.ISupport.CaseFold(target)
+		limiter, exists := c.targetLimiters[target]
+		if !exists {
+			c.pruneTargetLimiters()
+			limiter = rate.NewLimiter(rate.Limit(config.ClientTargetThrottle), config.ClientTargetThrottleBurst)
+			c.targetLimiters[target] = limiter
+		}
+
+		targetDelay := limiter.Reserve().Delay()
+		if targetDelay > delay {
+			delay = targetDelay
+		}
+	}
+
+	if delay > 0 {
+		c.Log(1, "Throttling message to %s for %s", message.Params[0], delay)
+		delay += time.Duration(config.ClientTargetThrottlePenalty) * time.Second
+	}
+
+	return delay
+}
+
+// targetThrottleDropped - Too many messages to throttled targets are already being held back
+func (c *Client) targetThrottleDropped(line string) {
+	c.Log(2, "Dropping a message to a throttled target")
+}
+
+// pruneTargetLimiters - Remove limiters for targets that have not been messaged recently. Called
+// with targetLimitersLock held
+func (c *Client) pruneTargetLimiters() {
+	if len(c.targetLimiters) < maxTargetLimiters {
+		return
+	}
+
+	for target, limiter := range c.targetLimiters {
+		if limiter.Tokens() >= float64(limiter.Burst()) {
+			delete(c.targetLimiters, target)
+		}
+	}
+}
+
+// throttleWeight - How many lines a line from the client counts as for the upstream throttle
+func (c *Client) throttleWeight(line string) int {
+	message, err := irc.ParseLine(line)
+	if err != nil {
+		return 1
+	}
+
+	command := strings.ToUpper(message.Command)
+	weight, exists := c.UpstreamConfig.ThrottleWeights[command]
+	if exists {
+		return weight
+	}
+
+	// CAP and SASL exchanges after registration (eg. re-authenticating) are part of registration
+	// so are not held up by the normal throttle
+	if command == "CAP" || command == "AUTHENTICATE" {
+		return 0
+	}
+
+	return 1
+}
+
+// newDownstreamLimiter - Limits the bytes per second read from an upstream connection so that a
+// single client fetching a large reply, eg. WHO or LIST, does not take all of the gateways
+// bandwidth. nil if downstream shaping is disabled
+func (c *Client) newDownstreamLimiter() *rate.Limiter {
+	bytesPerSecond := c.Gateway.Config.ClientDownstreamRate
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	burst := c.Gateway.Config.ClientDownstreamBurst
+	if burst < bytesPerSecond {
+		burst = bytesPerSecond
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// waitDownstream - Wait until a line read from the upstream may be passed on to the client. The
+// upstream connection is not read from while waiting so the IRC server holds the rest of the
+// reply in its send queue
+func waitDownstream(limiter *rate.Limiter, line string) {
+	if limiter == nil {
+		return
+	}
+
+	size := len(line) + 2
+	if size > limiter.Burst() {
+		size = limiter.Burst()
+	}
+	limiter.WaitN(context.Background(), size)
+}
@@ -3,11 +3,11 @@ package webircgateway
 import (
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"runtime/debug"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/igm/sockjs-go/v3/sockjs"
@@ -26,45 +26,33 @@ func (t *TransportKiwiirc) Init(g *Gateway) {
 		CheckOrigin: func(_ *http.Request) bool { return true },
 	}
 	handler := sockjs.NewHandler("/webirc/kiwiirc", sockjsOptions, t.sessionHandler)
-	t.gateway.HttpRouter.Handle("/webirc/kiwiirc/", handler)
+	t.gateway.HttpRouter.Handle("/webirc/kiwiirc/", t.gateway.withRequestHook("kiwiirc", handler))
 }
 
 func (t *TransportKiwiirc) makeChannel(chanID string, ws sockjs.Session) *TransportKiwiircChannel {
-	client := t.gateway.NewClient()
+	if !t.gateway.IsAcceptingClients() {
+		ws.Send(fmt.Sprintf(":%s %s", chanID, gatewayFailLine(t.gateway.NotAcceptingClientsCode(), t.gateway.NotAcceptingClientsMessage())))
+		ws.Send(fmt.Sprintf(":%s ERROR :%s", chanID, t.gateway.NotAcceptingClientsMessage()))
+		ws.Send(fmt.Sprintf(":%s control closed err_unavailable", chanID))
+		return nil
+	}
 
 	originHeader := strings.ToLower(ws.Request().Header.Get("Origin"))
 	if !t.gateway.IsClientOriginAllowed(originHeader) {
-		client.Log(2, "Origin %s not allowed. Closing connection", originHeader)
+		t.gateway.Log(2, "Origin %s not allowed. Closing connection", originHeader)
+		t.gateway.transportMetrics.originRejected("kiwiirc")
 		ws.Close(0, "Origin not allowed")
 		return nil
 	}
 
-	client.RemoteAddr = t.gateway.GetRemoteAddressFromRequest(ws.Request()).String()
-
-	clientHostnames, err := net.LookupAddr(client.RemoteAddr)
-	if err != nil || len(clientHostnames) == 0 {
-		client.RemoteHostname = client.RemoteAddr
-	} else {
-		// FQDNs include a . at the end. Strip it out
-		potentialHostname := strings.Trim(clientHostnames[0], ".")
-
-		// Must check that the resolved hostname also resolves back to the users IP
-		addr, err := net.LookupIP(potentialHostname)
-		if err == nil && len(addr) == 1 && addr[0].String() == client.RemoteAddr {
-			client.RemoteHostname = potentialHostname
-		} else {
-			client.RemoteHostname = client.RemoteAddr
-		}
-	}
-
-	if t.gateway.isRequestSecure(ws.Request()) {
-		client.Tags["secure"] = ""
+	info, allowed := t.gateway.NewClientConnectionInfo("kiwiirc", ws.Request().RemoteAddr, ws.Request())
+	if !allowed {
+		ws.Send(fmt.Sprintf(":%s control closed err_forbidden", chanID))
+		return nil
 	}
 
-	// This doesn't make sense to have since the remote port may change between requests. Only
-	// here for testing purposes for now.
-	_, remoteAddrPort, _ := net.SplitHostPort(ws.Request().RemoteAddr)
-	client.Tags["remote-port"] = remoteAddrPort
+	client := t.gateway.NewClient()
+	info.apply(client)
 
 	client.Log(2, "New kiwiirc channel on %s from %s %s", ws.Request().Host, client.RemoteAddr, client.RemoteHostname)
 	client.Ready()
@@ -133,7 +121,11 @@ func (t *TransportKiwiirc) sessionHandler(session sockjs.Session) {
 					channel, channelExists := channels.Get(chanID)
 					if channelExists {
 						c := channel.(*TransportKiwiircChannel)
-						c.handleIncomingLine(data)
+						if data == "control heartbeat" {
+							c.handleHeartbeat()
+						} else {
+							c.handleIncomingLine(data)
+						}
 					}
 				}
 			} else if err != nil {
@@ -143,9 +135,7 @@ func (t *TransportKiwiirc) sessionHandler(session sockjs.Session) {
 		}
 
 		for channel := range channels.IterBuffered() {
-			c := channel.Val.(*TransportKiwiircChannel)
-			c.Closed = true
-			c.Client.StartShutdown("client_closed")
+			channel.Val.(*TransportKiwiircChannel).transportClosed()
 		}
 	}()
 }
@@ -157,6 +147,9 @@ type TransportKiwiircChannel struct {
 	waitForClose chan bool
 	ClosedLock   sync.Mutex
 	Closed       bool
+	recvClosed   bool
+	// Started by the first heartbeat from the client and reset by each one after
+	heartbeatTimer *time.Timer
 }
 
 func (c *TransportKiwiircChannel) listenForSignals() {
@@ -180,15 +173,79 @@ func (c *TransportKiwiircChannel) listenForSignals() {
 		}
 	}
 
+	c.closeRecv()
+	close(c.waitForClose)
+}
+
+// transportClosed - The connection to the client has gone. The session is kept if it may be
+// resumed, otherwise the client is closed
+func (c *TransportKiwiircChannel) transportClosed() {
+	if c.Client.isResumable() {
+		// Only the transport has gone. The session is kept so that it may be resumed
+		c.closeRecv()
+		return
+	}
+
+	c.ClosedLock.Lock()
+	c.Closed = true
+	c.ClosedLock.Unlock()
+	c.Client.StartShutdown("client_closed")
+}
+
+// closeRecv - Close the clients Recv once, whether the session or its signals ended first
+func (c *TransportKiwiircChannel) closeRecv() {
 	c.ClosedLock.Lock()
 
 	c.Closed = true
-	close(c.Client.Recv)
-	close(c.waitForClose)
+	if !c.recvClosed {
+		c.recvClosed = true
+		close(c.Client.Recv)
+	}
+	if c.heartbeatTimer != nil {
+		c.heartbeatTimer.Stop()
+	}
 
 	c.ClosedLock.Unlock()
 }
 
+// handleHeartbeat - Reply to a heartbeat from the client so that it can tell the gateway is still
+// there, and give it heartbeat_timeout seconds to send the next one
+func (c *TransportKiwiircChannel) handleHeartbeat() {
+	c.ClosedLock.Lock()
+	defer c.ClosedLock.Unlock()
+
+	if c.Closed {
+		return
+	}
+	c.Conn.Send(fmt.Sprintf(":%s control heartbeat", c.Id))
+
+	timeout := c.Client.Gateway.Config.HeartbeatTimeout
+	if timeout <= 0 {
+		return
+	}
+	if c.heartbeatTimer == nil {
+		c.heartbeatTimer = time.AfterFunc(time.Second*time.Duration(timeout), c.heartbeatMissed)
+	} else {
+		c.heartbeatTimer.Reset(time.Second * time.Duration(timeout))
+	}
+}
+
+// heartbeatMissed - The client stopped sending heartbeats, most likely a backgrounded tab that
+// will not notice its connection has gone. Treat it as disconnected even though the connection
+// is still open
+func (c *TransportKiwiircChannel) heartbeatMissed() {
+	c.ClosedLock.Lock()
+	closed := c.Closed
+	c.ClosedLock.Unlock()
+	if closed {
+		return
+	}
+
+	c.Client.Log(2, "No heartbeat from the client for %d seconds, treating it as disconnected", c.Client.Gateway.Config.HeartbeatTimeout)
+	c.Conn.Send(fmt.Sprintf(":%s control closed err_heartbeat", c.Id))
+	c.transportClosed()
+}
+
 func (c *TransportKiwiircChannel) handleIncomingLine(line string) {
 	c.ClosedLock.Lock()
 
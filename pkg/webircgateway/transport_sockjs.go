@@ -1,7 +1,6 @@
 package webircgateway
 
 import (
-	"net"
 	"net/http"
 	"strings"
 
@@ -21,45 +20,34 @@ func (t *TransportSockjs) Init(g *Gateway) {
 		CheckOrigin: func(_ *http.Request) bool { return true },
 	}
 	sockjsHandler := sockjs.NewHandler("/webirc/sockjs", sockjsOptions, t.sessionHandler)
-	t.gateway.HttpRouter.Handle("/webirc/sockjs/", sockjsHandler)
+	t.gateway.HttpRouter.Handle("/webirc/sockjs/", t.gateway.withRequestHook("sockjs", sockjsHandler))
 }
 
 func (t *TransportSockjs) sessionHandler(session sockjs.Session) {
-	client := t.gateway.NewClient()
+	if !t.gateway.IsAcceptingClients() {
+		session.Send(gatewayFailLine(t.gateway.NotAcceptingClientsCode(), t.gateway.NotAcceptingClientsMessage()))
+		session.Send("ERROR :" + t.gateway.NotAcceptingClientsMessage())
+		session.Close(0, "Not accepting new clients")
+		return
+	}
 
 	originHeader := strings.ToLower(session.Request().Header.Get("Origin"))
 	if !t.gateway.IsClientOriginAllowed(originHeader) {
-		client.Log(2, "Origin %s not allowed. Closing connection", originHeader)
+		t.gateway.Log(2, "Origin %s not allowed. Closing connection", originHeader)
+		t.gateway.transportMetrics.originRejected("sockjs")
 		session.Close(0, "Origin not allowed")
 		return
 	}
 
-	client.RemoteAddr = t.gateway.GetRemoteAddressFromRequest(session.Request()).String()
-
-	clientHostnames, err := net.LookupAddr(client.RemoteAddr)
-	if err != nil {
-		client.RemoteHostname = client.RemoteAddr
-	} else {
-		// FQDNs include a . at the end. Strip it out
-		potentialHostname := strings.Trim(clientHostnames[0], ".")
-
-		// Must check that the resolved hostname also resolves back to the users IP
-		addr, err := net.LookupIP(potentialHostname)
-		if err == nil && len(addr) == 1 && addr[0].String() == client.RemoteAddr {
-			client.RemoteHostname = potentialHostname
-		} else {
-			client.RemoteHostname = client.RemoteAddr
-		}
-	}
-
-	if t.gateway.isRequestSecure(session.Request()) {
-		client.Tags["secure"] = ""
+	info, allowed := t.gateway.NewClientConnectionInfo("sockjs", session.Request().RemoteAddr, session.Request())
+	if !allowed {
+		session.Close(0, "Connection not allowed")
+		return
 	}
 
-	// This doesn't make sense to have since the remote port may change between requests. Only
-	// here for testing purposes for now.
-	_, remoteAddrPort, _ := net.SplitHostPort(session.Request().RemoteAddr)
-	client.Tags["remote-port"] = remoteAddrPort
+	client := t.gateway.NewClient()
+	info.apply(client)
+	client.applyQueryParams(session.Request())
 
 	client.Log(2, "New sockjs client on %s from %s %s", session.Request().Host, client.RemoteAddr, client.RemoteHostname)
 	client.Ready()
@@ -5,18 +5,27 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
+// How long a trusted proxy has to send the PROXY protocol header
+const proxyProtocolTimeout = time.Second * 5
+
 type TransportTcp struct {
 	gateway *Gateway
+	// Read a PROXY protocol header from connections made by the reverse_proxies
+	proxyProtocol bool
 }
 
 func (t *TransportTcp) Init(g *Gateway) {
 	t.gateway = g
 }
 
-func (t *TransportTcp) Start(lAddr string) {
+// Start - Listen on lAddr and accept clients. listening is called once the address is bound
+// or failed to bind
+func (t *TransportTcp) Start(lAddr string, listening func()) {
 	l, err := net.Listen("tcp", lAddr)
+	listening()
 	if err != nil {
 		t.gateway.Log(3, "TCP error listening: "+err.Error())
 		return
@@ -36,29 +45,56 @@ func (t *TransportTcp) Start(lAddr string) {
 	}
 }
 
-func (t *TransportTcp) handleConn(conn net.Conn) {
-	client := t.gateway.NewClient()
-
-	client.RemoteAddr = conn.RemoteAddr().String()
+// readProxyHeader - The real address of the client if the connection came through a trusted
+// proxy. Returns false if the proxy did not send a valid PROXY protocol header
+func (t *TransportTcp) readProxyHeader(conn net.Conn, reader *bufio.Reader) (string, bool) {
+	remoteAddr := conn.RemoteAddr().String()
+	remoteHost, _, _ := net.SplitHostPort(remoteAddr)
+	if !t.gateway.isTrustedProxy(net.ParseIP(remoteHost)) {
+		return remoteAddr, true
+	}
 
-	clientHostnames, err := net.LookupAddr(client.RemoteAddr)
+	conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+	proxiedAddr, err := readProxyProtocolHeader(reader)
+	conn.SetReadDeadline(time.Time{})
 	if err != nil {
-		client.RemoteHostname = client.RemoteAddr
-	} else {
-		// FQDNs include a . at the end. Strip it out
-		potentialHostname := strings.Trim(clientHostnames[0], ".")
-
-		// Must check that the resolved hostname also resolves back to the users IP
-		addr, err := net.LookupIP(potentialHostname)
-		if err == nil && len(addr) == 1 && addr[0].String() == client.RemoteAddr {
-			client.RemoteHostname = potentialHostname
-		} else {
-			client.RemoteHostname = client.RemoteAddr
+		t.gateway.Log(2, "TCP connection from %s closed, PROXY protocol error: %s", remoteAddr, err.Error())
+		return "", false
+	}
+
+	if proxiedAddr == "" {
+		return remoteAddr, true
+	}
+	return proxiedAddr, true
+}
+
+func (t *TransportTcp) handleConn(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	remoteAddr := conn.RemoteAddr().String()
+	if t.proxyProtocol {
+		var ok bool
+		remoteAddr, ok = t.readProxyHeader(conn, reader)
+		if !ok {
+			conn.Close()
+			return
 		}
 	}
 
-	_, remoteAddrPort, _ := net.SplitHostPort(conn.RemoteAddr().String())
-	client.Tags["remote-port"] = remoteAddrPort
+	if !t.gateway.IsAcceptingClients() {
+		conn.Write([]byte(gatewayFailLine(t.gateway.NotAcceptingClientsCode(), t.gateway.NotAcceptingClientsMessage()) + "\n"))
+		conn.Write([]byte("ERROR :" + t.gateway.NotAcceptingClientsMessage() + "\n"))
+		conn.Close()
+		return
+	}
+
+	info, allowed := t.gateway.NewClientConnectionInfo("tcp", remoteAddr, nil)
+	if !allowed {
+		conn.Close()
+		return
+	}
+
+	client := t.gateway.NewClient()
+	info.apply(client)
 
 	client.Log(2, "New tcp client on %s from %s %s", conn.LocalAddr().String(), client.RemoteAddr, client.RemoteHostname)
 	client.Ready()
@@ -69,7 +105,6 @@ func (t *TransportTcp) handleConn(conn net.Conn) {
 
 	// Read from TCP
 	go func() {
-		reader := bufio.NewReader(conn)
 		for {
 			data, err := reader.ReadString('\n')
 			if err == nil {
@@ -1,15 +1,23 @@
 package webircgateway
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
 
+// Websocket subprotocols from https://ircv3.net/specs/extensions/websocket
+const (
+	websocketProtocolText   = "text.ircv3.net"
+	websocketProtocolBinary = "binary.ircv3.net"
+)
+
 type TransportWebsocket struct {
 	gateway  *Gateway
 	wsServer *websocket.Server
@@ -18,10 +26,34 @@ type TransportWebsocket struct {
 func (t *TransportWebsocket) Init(g *Gateway) {
 	t.gateway = g
 	t.wsServer = &websocket.Server{Handler: t.websocketHandler, Handshake: t.checkOrigin}
-	t.gateway.HttpRouter.Handle("/webirc/websocket/", t.wsServer)
+	t.gateway.HttpRouter.Handle("/webirc/websocket/", t.gateway.withRequestHook("websocket", http.HandlerFunc(t.serveHTTP)))
+}
+
+type websocketHandshakeKey struct{}
+
+// serveHTTP - Count the upgrades that fail before the handshake is checked. The websocket server
+// writes these errors to the raw connection so they are not seen as HTTP error responses
+func (t *TransportWebsocket) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	handshaked := false
+	r = r.WithContext(context.WithValue(r.Context(), websocketHandshakeKey{}, &handshaked))
+	t.wsServer.ServeHTTP(w, r)
+	if !handshaked && isUpgradeRequest(r) {
+		t.gateway.transportMetrics.upgradeFailed("websocket")
+	}
 }
 
 func (t *TransportWebsocket) checkOrigin(config *websocket.Config, req *http.Request) (err error) {
+	if handshaked, ok := req.Context().Value(websocketHandshakeKey{}).(*bool); ok {
+		*handshaked = true
+	}
+
+	// Clients in maintenance mode are refused once connected so that they see the message
+	if t.gateway.IsDraining() {
+		err = errors.New("Not accepting new clients")
+		t.gateway.Log(1, "%s. Closing connection", err)
+		return err
+	}
+
 	config.Origin, err = websocket.Origin(config, req)
 
 	var origin string
@@ -34,39 +66,50 @@ func (t *TransportWebsocket) checkOrigin(config *websocket.Config, req *http.Req
 	if !t.gateway.IsClientOriginAllowed(origin) {
 		err = fmt.Errorf("Origin %#v not allowed", origin)
 		t.gateway.Log(2, "%s. Closing connection", err)
+		t.gateway.transportMetrics.originRejected("websocket")
 		return err
 	}
 
+	config.Protocol = selectWebsocketProtocol(config.Protocol)
+
 	return err
 }
 
-func (t *TransportWebsocket) websocketHandler(ws *websocket.Conn) {
-	client := t.gateway.NewClient()
-
-	client.RemoteAddr = t.gateway.GetRemoteAddressFromRequest(ws.Request()).String()
+// selectWebsocketProtocol - Pick the first IRCv3 subprotocol the client offered. Clients that do
+// not offer a subprotocol get plain text frames
+func selectWebsocketProtocol(offered []string) []string {
+	for _, protocol := range offered {
+		if protocol == websocketProtocolText || protocol == websocketProtocolBinary {
+			return []string{protocol}
+		}
+	}
 
-	clientHostnames, err := net.LookupAddr(client.RemoteAddr)
-	if err != nil {
-		client.RemoteHostname = client.RemoteAddr
-	} else {
-		// FQDNs include a . at the end. Strip it out
-		potentialHostname := strings.Trim(clientHostnames[0], ".")
+	return nil
+}
 
-		// Must check that the resolved hostname also resolves back to the users IP
-		addr, err := net.LookupIP(potentialHostname)
-		if err == nil && len(addr) == 1 && addr[0].String() == client.RemoteAddr {
-			client.RemoteHostname = potentialHostname
-		} else {
-			client.RemoteHostname = client.RemoteAddr
-		}
+func (t *TransportWebsocket) websocketHandler(ws *websocket.Conn) {
+	if !t.gateway.IsAcceptingClients() {
+		websocket.Message.Send(ws, gatewayFailLine(t.gateway.NotAcceptingClientsCode(), t.gateway.NotAcceptingClientsMessage()))
+		websocket.Message.Send(ws, "ERROR :"+t.gateway.NotAcceptingClientsMessage())
+		ws.Close()
+		return
 	}
 
-	if t.gateway.isRequestSecure(ws.Request()) {
-		client.Tags["secure"] = ""
+	info, allowed := t.gateway.NewClientConnectionInfo("websocket", ws.Request().RemoteAddr, ws.Request())
+	if !allowed {
+		ws.Close()
+		return
 	}
 
-	_, remoteAddrPort, _ := net.SplitHostPort(ws.Request().RemoteAddr)
-	client.Tags["remote-port"] = remoteAddrPort
+	client := t.gateway.NewClient()
+	info.apply(client)
+	client.applyQueryParams(ws.Request())
+
+	// Binary clients handle character encodings themselves so lines are passed through untouched
+	if protocols := ws.Config().Protocol; len(protocols) > 0 && protocols[0] == websocketProtocolBinary {
+		client.RawEncoding = true
+		ws.PayloadType = websocket.BinaryFrame
+	}
 
 	client.Log(2, "New websocket client on %s from %s %s", ws.Request().Host, client.RemoteAddr, client.RemoteHostname)
 	client.Ready()
@@ -102,17 +145,35 @@ func (t *TransportWebsocket) websocketHandler(ws *websocket.Conn) {
 		close(client.Recv)
 	}()
 
+	batchBytes := t.gateway.Config.WebsocketBatchBytes
+	// The IRCv3 websocket subprotocols require exactly one message per frame
+	if len(ws.Config().Protocol) > 0 {
+		batchBytes = 0
+	}
+	batchDelay := time.Millisecond * time.Duration(t.gateway.Config.WebsocketBatchDelay)
+
 	// Process signals for the client
+	var nextSignal *ClientSignal
 	for {
-		signal, ok := <-client.Signals
-		if !ok {
-			sendDrained.Done()
-			break
+		var signal ClientSignal
+		if nextSignal != nil {
+			signal = *nextSignal
+			nextSignal = nil
+		} else {
+			var ok bool
+			signal, ok = <-client.Signals
+			if !ok {
+				sendDrained.Done()
+				break
+			}
 		}
 
 		if signal[0] == "data" {
 			line := strings.Trim(signal[1], "\r\n")
 			client.Log(1, "->ws: %s", line)
+			if batchBytes > 0 {
+				line, nextSignal = batchDataSignals(client, line, batchBytes, batchDelay)
+			}
 			ws.Write([]byte(line))
 		}
 
@@ -124,3 +185,49 @@ func (t *TransportWebsocket) websocketHandler(ws *websocket.Conn) {
 	sendDrained.Wait()
 	ws.Close()
 }
+
+// batchDataSignals - Join any data signals queued behind frame into one newline separated
+// frame of up to maxBytes, waiting up to delay for more to arrive. The first signal that could
+// not be added is returned so that it can be handled next
+func batchDataSignals(client *Client, frame string, maxBytes int, delay time.Duration) (string, *ClientSignal) {
+	var deadline <-chan time.Time
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for len(frame) < maxBytes {
+		var signal ClientSignal
+		var ok bool
+
+		if deadline == nil {
+			select {
+			case signal, ok = <-client.Signals:
+			default:
+				return frame, nil
+			}
+		} else {
+			select {
+			case signal, ok = <-client.Signals:
+			case <-deadline:
+				return frame, nil
+			}
+		}
+
+		if !ok {
+			// Closed. Handled by the caller on its next read
+			return frame, nil
+		}
+
+		line := strings.Trim(signal[1], "\r\n")
+		if signal[0] != "data" || len(frame)+1+len(line) > maxBytes {
+			return frame, &signal
+		}
+
+		client.Log(1, "->ws: %s", line)
+		frame += "\n" + line
+	}
+
+	return frame, nil
+}
@@ -0,0 +1,123 @@
+package webircgateway
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TransportStats - Connection counters for one transport, eg. websocket or kiwiirc
+type TransportStats struct {
+	Active           int64 `json:"active"`
+	Connections      int64 `json:"connections"`
+	UpgradeFailures  int64 `json:"upgrade_failures"`
+	OriginRejections int64 `json:"origin_rejections"`
+	// The average time clients stayed connected for, over the clients that have disconnected
+	AvgSessionSeconds float64 `json:"avg_session_seconds"`
+}
+
+// transportMetrics - Counts the connections made over each transport so that it can be seen
+// which of the fallback transports are actually used
+type transportMetrics struct {
+	mu          sync.Mutex
+	transports  map[string]*TransportStats
+	sessionTime map[string]time.Duration
+	sessions    map[string]int64
+}
+
+func newTransportMetrics() *transportMetrics {
+	return &transportMetrics{
+		transports:  make(map[string]*TransportStats),
+		sessionTime: make(map[string]time.Duration),
+		sessions:    make(map[string]int64),
+	}
+}
+
+// stats - The counters for a transport. The lock must be held
+func (m *transportMetrics) stats(transport string) *TransportStats {
+	stats, exists := m.transports[transport]
+	if !exists {
+		stats = &TransportStats{}
+		m.transports[transport] = stats
+	}
+	return stats
+}
+
+func (m *transportMetrics) clientStarted(transport string) {
+	m.mu.Lock()
+	stats := m.stats(transport)
+	stats.Active++
+	stats.Connections++
+	m.mu.Unlock()
+}
+
+func (m *transportMetrics) clientEnded(transport string, duration time.Duration) {
+	m.mu.Lock()
+	m.stats(transport).Active--
+	m.sessionTime[transport] += duration
+	m.sessions[transport]++
+	m.mu.Unlock()
+}
+
+func (m *transportMetrics) upgradeFailed(transport string) {
+	m.mu.Lock()
+	m.stats(transport).UpgradeFailures++
+	m.mu.Unlock()
+}
+
+func (m *transportMetrics) originRejected(transport string) {
+	m.mu.Lock()
+	m.stats(transport).OriginRejections++
+	m.mu.Unlock()
+}
+
+// snapshot - A copy of the counters for each transport that has been used
+func (m *transportMetrics) snapshot() map[string]TransportStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	transports := make(map[string]TransportStats)
+	for transport, stats := range m.transports {
+		snapshot := *stats
+		if sessions := m.sessions[transport]; sessions > 0 {
+			snapshot.AvgSessionSeconds = m.sessionTime[transport].Seconds() / float64(sessions)
+		}
+		transports[transport] = snapshot
+	}
+	return transports
+}
+
+// isUpgradeRequest - Check if a request is asking to be upgraded to a websocket
+func isUpgradeRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// upgradeResponseWriter - Notes whether a websocket upgrade was answered with an HTTP error
+// instead of the connection being taken over
+type upgradeResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *upgradeResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *upgradeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Connection does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// failed - The upgrade failed. Upgrades the gateway refused with 403, eg. for a disallowed
+// origin, are counted separately
+func (w *upgradeResponseWriter) failed() bool {
+	return w.status >= 400 && w.status != http.StatusForbidden
+}
@@ -0,0 +1,20 @@
+package webircgateway
+
+import (
+	"io"
+	"strings"
+)
+
+// UpstreamDialer - Connects a client to its IRC server over a protocol other than TCP or unix
+// sockets. Lines are written to the connection ending in \r\n or \n and must be read from it
+// ending in \n
+type UpstreamDialer func(client *Client, upstream *ConfigUpstream) (io.ReadWriteCloser, error)
+
+var upstreamDialers = make(map[string]UpstreamDialer)
+
+// UpstreamDialerRegister - Make a protocol available for upstream connections. Plugins may add
+// their own protocols and use them by setting UpstreamConfig.Protocol in the irc.connection.pre
+// hook. Upstreams connecting through a kiwi proxy do not use these dialers
+func UpstreamDialerRegister(protocol string, dialer UpstreamDialer) {
+	upstreamDialers[strings.ToLower(protocol)] = dialer
+}
@@ -0,0 +1,134 @@
+package webircgateway
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func init() {
+	UpstreamDialerRegister("ws", dialWebsocketUpstream)
+	UpstreamDialerRegister("wss", dialWebsocketUpstream)
+}
+
+// dialWebsocketUpstream - Connect to an IRC server that accepts websocket connections, such as
+// another gateway, using the IRCv3 websocket subprotocols
+func dialWebsocketUpstream(client *Client, upstream *ConfigUpstream) (io.ReadWriteCloser, error) {
+	scheme := "http"
+	if upstream.Protocol == "wss" {
+		scheme = "https"
+	}
+	location := &url.URL{
+		Scheme: upstream.Protocol,
+		Host:   net.JoinHostPort(upstream.Hostname, strconv.Itoa(upstream.Port)),
+		Path:   upstream.WebsocketPath,
+	}
+	origin := &url.URL{
+		Scheme: scheme,
+		Host:   location.Host,
+	}
+
+	config, err := websocket.NewConfig(location.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{websocketProtocolText, websocketProtocolBinary}
+	config.Dialer = &net.Dialer{
+		Timeout: time.Second * time.Duration(upstream.Timeout),
+	}
+	if upstream.LocalAddr != "" {
+		if parsedIP := net.ParseIP(upstream.LocalAddr); parsedIP != nil {
+			config.Dialer.LocalAddr = &net.TCPAddr{IP: parsedIP}
+		}
+	}
+	if upstream.Protocol == "wss" {
+		config.TlsConfig = client.upstreamTLSConfig()
+	}
+
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Servers that do not pick a subprotocol send text frames
+	if protocol := ws.Config().Protocol; len(protocol) > 0 && protocol[0] == websocketProtocolBinary {
+		ws.PayloadType = websocket.BinaryFrame
+	}
+
+	client.Log(1, "Connected to websocket upstream %s", location.String())
+	return &websocketUpstreamConn{ws: ws}, nil
+}
+
+// websocketUpstreamConn - Sends each IRC line as its own websocket message and reads messages
+// back as \n terminated lines
+type websocketUpstreamConn struct {
+	ws *websocket.Conn
+
+	readBuf  []byte
+	writeMu  sync.Mutex
+	writeBuf []byte
+}
+
+func (c *websocketUpstreamConn) Read(p []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		var message []byte
+		err := websocket.Message.Receive(c.ws, &message)
+		if err != nil {
+			return 0, err
+		}
+
+		// Messages are single lines without line endings. Be lenient with servers that add them
+		for _, line := range strings.Split(string(message), "\n") {
+			line = strings.TrimRight(line, "\r")
+			if line != "" {
+				c.readBuf = append(c.readBuf, line+"\n"...)
+			}
+		}
+	}
+
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *websocketUpstreamConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.writeBuf = append(c.writeBuf, p...)
+	for {
+		lineEnd := bytes.IndexByte(c.writeBuf, '\n')
+		if lineEnd == -1 {
+			break
+		}
+
+		line := bytes.TrimRight(c.writeBuf[:lineEnd], "\r")
+		c.writeBuf = c.writeBuf[lineEnd+1:]
+		if len(line) == 0 {
+			continue
+		}
+
+		var err error
+		if c.ws.PayloadType == websocket.BinaryFrame {
+			err = websocket.Message.Send(c.ws, line)
+		} else {
+			err = websocket.Message.Send(c.ws, string(line))
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (c *websocketUpstreamConn) Close() error {
+	return c.ws.Close()
+}
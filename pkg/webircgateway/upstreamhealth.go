@@ -0,0 +1,240 @@
+package webircgateway
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	ControlCommandRegister("upstream-health", controlUpstreamHealth)
+}
+
+// upstreamHealth - The result of the recent health checks of an upstream
+type upstreamHealth struct {
+	failures  int
+	down      bool
+	changed   time.Time
+	lastError string
+}
+
+// upstreamHealthTracker - Upstreams that failed their health checks are left out when picking an
+// upstream for new clients until they pass one again. Keyed by "host:port"
+type upstreamHealthTracker struct {
+	mu        sync.Mutex
+	upstreams map[string]*upstreamHealth
+}
+
+func newUpstreamHealthTracker() *upstreamHealthTracker {
+	return &upstreamHealthTracker{
+		upstreams: make(map[string]*upstreamHealth),
+	}
+}
+
+// isDown - Check if an upstream has been taken out of rotation
+func (t *upstreamHealthTracker) isDown(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	health, exists := t.upstreams[key]
+	return exists && health.down
+}
+
+// record - Record the result of a health check. An upstream goes down after maxFailures failed
+// checks in a row and comes back after a single passed check. Returns true if it changed state
+func (t *upstreamHealthTracker) record(key string, err error, maxFailures int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	health, exists := t.upstreams[key]
+	if !exists {
+		health = &upstreamHealth{changed: time.Now()}
+		t.upstreams[key] = health
+	}
+
+	if err == nil {
+		health.failures = 0
+		health.lastError = ""
+		if health.down {
+			health.down = false
+			health.changed = time.Now()
+			return true
+		}
+		return false
+	}
+
+	health.failures++
+	health.lastError = err.Error()
+	if !health.down && health.failures >= maxFailures {
+		health.down = true
+		health.changed = time.Now()
+		return true
+	}
+	return false
+}
+
+// keep - Forget upstreams that are no longer configured
+func (t *upstreamHealthTracker) keep(keys map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key := range t.upstreams {
+		if !keys[key] {
+			delete(t.upstreams, key)
+		}
+	}
+}
+
+func (t *upstreamHealthTracker) snapshot() map[string]upstreamHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	upstreams := make(map[string]upstreamHealth)
+	for key, health := range t.upstreams {
+		upstreams[key] = *health
+	}
+	return upstreams
+}
+
+// healthyUpstreams - The upstreams that have not been taken out of rotation. If they all have
+// then all of them are returned as connecting to a failing upstream beats not trying at all
+func (s *Gateway) healthyUpstreams(upstreams []ConfigUpstream) []ConfigUpstream {
+	healthy := []ConfigUpstream{}
+	for idx := range upstreams {
+		if !s.upstreamHealth.isDown(upstreamLatencyKey(&upstreams[idx])) {
+			healthy = append(healthy, upstreams[idx])
+		}
+	}
+
+	if len(healthy) == 0 {
+		s.Log(1, "All upstreams are failing their health checks, trying them anyway")
+		return upstreams
+	}
+	return healthy
+}
+
+// startHealthChecks - Periodically check that each upstream accepts connections
+func (s *Gateway) startHealthChecks() {
+	go func() {
+		for {
+			// Read the interval each time so that it may be changed by reloading the config
+			interval := s.Config.UpstreamHealthCheck
+			if interval <= 0 {
+				time.Sleep(time.Second * 5)
+				continue
+			}
+			time.Sleep(time.Second * time.Duration(interval))
+			s.checkUpstreams()
+		}
+	}()
+}
+
+// checkUpstreams - Check every configured upstream once, waiting for all of the checks to finish
+func (s *Gateway) checkUpstreams() {
+	timeout := time.Second * time.Duration(s.Config.UpstreamHealthCheckTimeout)
+	maxFailures := s.Config.UpstreamHealthCheckFailures
+
+	checked := make(map[string]bool)
+	wg := sync.WaitGroup{}
+	for _, upstream := range s.Config.Upstreams {
+		key := upstreamLatencyKey(&upstream)
+		// Upstreams behind a kiwi proxy can only be reached by the proxy
+		if checked[key] || upstream.Proxy != nil {
+			continue
+		}
+		checked[key] = true
+
+		wg.Add(1)
+		go func(upstream ConfigUpstream, key string) {
+			defer wg.Done()
+
+			err := s.runAux("", func() error {
+				return checkUpstreamHealth(&upstream, timeout)
+			})
+			if !s.upstreamHealth.record(key, err, maxFailures) {
+				return
+			}
+			if err != nil {
+				s.Log(3, "Upstream %s failed %d health checks, taking it out of rotation: %s", key, maxFailures, err.Error())
+			} else {
+				s.Log(2, "Upstream %s passed a health check, putting it back into rotation", key)
+			}
+		}(upstream, key)
+	}
+	wg.Wait()
+
+	s.upstreamHealth.keep(checked)
+}
+
+// checkUpstreamHealth - Connect to an upstream, completing a TLS handshake if it uses TLS, without
+// registering
+func checkUpstreamHealth(upstream *ConfigUpstream, timeout time.Duration) error {
+	dialer := &net.Dialer{Timeout: timeout}
+	if upstream.LocalAddr != "" {
+		if parsedIP := net.ParseIP(upstream.LocalAddr); parsedIP != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: parsedIP}
+		}
+	}
+
+	network := upstream.Protocol
+	addr := net.JoinHostPort(upstream.Hostname, strconv.Itoa(upstream.Port))
+	switch upstream.Protocol {
+	case "unix":
+		addr = upstream.Hostname
+		dialer.LocalAddr = nil
+	case "ws", "wss", "":
+		network = "tcp"
+	}
+
+	var conn net.Conn
+	var err error
+	if upstream.TLS || upstream.Protocol == "wss" {
+		conn, err = tls.DialWithDialer(dialer, network, addr, &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         upstream.TLSServerName(),
+			NextProtos:         upstream.ALPN,
+		})
+	} else {
+		conn, err = dialer.Dial(network, addr)
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// controlUpstreamHealth - List the health check state of each upstream
+func controlUpstreamHealth(gateway *Gateway, args []string) (string, error) {
+	upstreams := gateway.upstreamHealth.snapshot()
+	if len(upstreams) == 0 {
+		if gateway.Config.UpstreamHealthCheck <= 0 {
+			return "Upstreams are not being health checked. Set upstream_health_check to enable it\n", nil
+		}
+		return "No upstreams checked yet\n", nil
+	}
+
+	keys := make([]string, 0, len(upstreams))
+	for key := range upstreams {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	out := ""
+	for _, key := range keys {
+		health := upstreams[key]
+		state := "up"
+		if health.down {
+			state = "down"
+		}
+		out += fmt.Sprintf("%s %s failures=%d since=%ds ago", key, state, health.failures, int(time.Since(health.changed).Seconds()))
+		if health.lastError != "" {
+			out += " error=" + health.lastError
+		}
+		out += "\n"
+	}
+	return out, nil
+}
@@ -0,0 +1,94 @@
+package webircgateway
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+)
+
+// The values of upstream_strategy
+var upstreamStrategies = []string{"random", "latency", "round-robin", "least-connections", "weighted", "sticky"}
+
+// pickUpstream - Pick one of upstreams for a new client with the configured strategy
+func (s *Gateway) pickUpstream(upstreams []ConfigUpstream, clientAddr string) ConfigUpstream {
+	switch s.Config.UpstreamStrategy {
+	case "latency":
+		return s.findUpstreamByLatency(upstreams)
+	case "round-robin":
+		next := atomic.AddUint32(&s.upstreamRoundRobin, 1)
+		return upstreams[next%uint32(len(upstreams))]
+	case "least-connections":
+		return s.findUpstreamByConnections(upstreams)
+	case "weighted":
+		return findUpstreamByWeight(upstreams)
+	case "sticky":
+		if clientAddr != "" {
+			return findUpstreamByAddress(upstreams, clientAddr)
+		}
+	}
+
+	return upstreams[rand.Intn(len(upstreams))]
+}
+
+// findUpstreamByConnections - Pick the upstream with the fewest connected clients, or any of them
+// if several have the fewest
+func (s *Gateway) findUpstreamByConnections(upstreams []ConfigUpstream) ConfigUpstream {
+	counts := make(map[string]int)
+	for _, c := range s.AllClients() {
+		if c.UpstreamConfig.Hostname != "" {
+			counts[upstreamLatencyKey(c.UpstreamConfig)]++
+		}
+	}
+
+	candidates := []ConfigUpstream{}
+	fewest := -1
+	for idx := range upstreams {
+		count := counts[upstreamLatencyKey(&upstreams[idx])]
+		if fewest == -1 || count < fewest {
+			fewest = count
+			candidates = candidates[:0]
+		}
+		if count == fewest {
+			candidates = append(candidates, upstreams[idx])
+		}
+	}
+
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// findUpstreamByWeight - Pick an upstream at random, in proportion to their weights
+func findUpstreamByWeight(upstreams []ConfigUpstream) ConfigUpstream {
+	total := 0
+	for idx := range upstreams {
+		total += upstreams[idx].Weight
+	}
+	if total <= 0 {
+		return upstreams[rand.Intn(len(upstreams))]
+	}
+
+	pick := rand.Intn(total)
+	for idx := range upstreams {
+		pick -= upstreams[idx].Weight
+		if pick < 0 {
+			return upstreams[idx]
+		}
+	}
+	return upstreams[len(upstreams)-1]
+}
+
+// findUpstreamByAddress - Always pick the same upstream for the same client address while it is
+// available. Each address ranks the upstreams by a hash so that when an upstream goes away only
+// its own clients move elsewhere
+func findUpstreamByAddress(upstreams []ConfigUpstream, clientAddr string) ConfigUpstream {
+	best := 0
+	var bestScore uint64
+	for idx := range upstreams {
+		hash := fnv.New64a()
+		hash.Write([]byte(clientAddr + "/" + upstreamLatencyKey(&upstreams[idx])))
+		if score := hash.Sum64(); idx == 0 || score > bestScore {
+			best = idx
+			bestScore = score
+		}
+	}
+	return upstreams[best]
+}
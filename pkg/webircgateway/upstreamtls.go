@@ -0,0 +1,52 @@
+package webircgateway
+
+import "strconv"
+
+// The values of force_upstream_tls
+var forceUpstreamTLSModes = []string{"off", "upgrade", "deny"}
+
+// checkDestinationTLS - Make sure a destination given by the client is connected to with TLS when
+// it should be. A page loaded over https that explicitly asks for a plaintext connection is almost
+// always a misconfigured client, and force_upstream_tls upgrades or denies plaintext destinations.
+// Returns false if the client has been closed
+func (c *Client) checkDestinationTLS() bool {
+	if c.DestTLS {
+		return true
+	}
+
+	mode := c.Gateway.Config.GatewayForceUpstreamTLS
+	if mode == "upgrade" {
+		c.DestTLS = true
+		if c.DestPort == 6667 {
+			c.DestPort = 6697
+		}
+		c.Log(2, "Upgrading plaintext connection to %s to TLS on port %d", c.DestHost, c.DestPort)
+		return true
+	}
+
+	_, secure := c.Tags["secure"]
+	if secure && c.destPlaintextRequested {
+		c.Log(2, "Secure client asked for a plaintext connection to %s. Closing connection", c.DestHost)
+		c.rejectInsecureDestination("This page is loaded over https but asked for a plaintext connection to " + c.DestHost + ". Remove tls=0 from the connection URL or use tls=1")
+		return false
+	}
+
+	if mode == "deny" {
+		tlsPort := c.DestHost + ":+6697"
+		if c.DestPort != 6667 {
+			tlsPort = c.DestHost + ":+" + strconv.Itoa(c.DestPort)
+		}
+
+		c.Log(2, "Plaintext connection to %s is not allowed. Closing connection", c.DestHost)
+		c.rejectInsecureDestination("Plaintext connections to IRC networks are not allowed. Connect to " + tlsPort + " or another TLS port instead")
+		return false
+	}
+
+	return true
+}
+
+func (c *Client) rejectInsecureDestination(description string) {
+	c.SendGatewayError(FailInsecureUpstream, description)
+	c.SendClientSignal("state", "closed", "err_insecure_upstream")
+	c.StartShutdown("err_no_upstream")
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"golang.org/x/net/html/charset"
@@ -36,6 +37,12 @@ func isPrivateIP(ip net.IP) bool {
 	return false
 }
 
+// IsPrivateIP - Check if ip is a loopback or private network address. For plugins that limit
+// access to their HTTP routes in the same way as the gateway
+func IsPrivateIP(ip net.IP) bool {
+	return isPrivateIP(ip)
+}
+
 // Username / realname / webirc hostname can all have configurable replacements
 func makeClientReplacements(format string, client *Client) string {
 	ret := format
@@ -69,6 +76,28 @@ func ensureUtf8(s string, fromEncoding string) string {
 	return s2
 }
 
+// decodeToUtf8 - Decode s from the first of the given encodings that decodes it cleanly. If none
+// do, the lossy result from the primary encoding is used
+func decodeToUtf8(s string, primary string, fallbacks []string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+
+	for _, fromEncoding := range append([]string{primary}, fallbacks...) {
+		encoding, _ := charset.Lookup(fromEncoding)
+		if encoding == nil {
+			continue
+		}
+
+		decoded, err := encoding.NewDecoder().String(s)
+		if err == nil && utf8.ValidString(decoded) && !strings.ContainsRune(decoded, utf8.RuneError) {
+			return decoded
+		}
+	}
+
+	return ensureUtf8(s, primary)
+}
+
 func utf8ToOther(s string, toEncoding string) string {
 	if toEncoding == "UTF-8" && utf8.ValidString(s) {
 		return s
@@ -110,12 +139,28 @@ func stringInSliceOrDefault(s, def string, validStrings []string) string {
 	return def
 }
 
+// The most lines a ThrottledStringChannel holds back with its Delay. Later delayed lines are dropped
+const maxThrottleDelayedLines = 50
+
 type ThrottledStringChannel struct {
 	in     chan string
 	Input  chan<- string
 	out    chan string
 	Output <-chan string
 	*rate.Limiter
+	// Weight - Optional number of tokens each message uses from the limiter. Defaults to 1
+	Weight func(msg string) int
+	// Delay - Optional extra delay before passing on each message, eg. for per-target throttling.
+	// Delayed messages are held back in order while messages that are not delayed pass on
+	Delay func(msg string) time.Duration
+	// Dropped - Optional, called for each delayed message dropped as too many are held back
+	Dropped func(msg string)
+}
+
+// throttleDelayedLine - A message held back by a ThrottledStringChannel Delay
+type throttleDelayedLine struct {
+	msg       string
+	releaseAt time.Time
 }
 
 func NewThrottledStringChannel(wrappedChan chan string, limiter *rate.Limiter) *ThrottledStringChannel {
@@ -135,13 +180,91 @@ func NewThrottledStringChannel(wrappedChan chan string, limiter *rate.Limiter) *
 }
 
 func (c *ThrottledStringChannel) run() {
-	for msg := range c.in {
-		// start := time.Now()
-		c.Wait(context.Background())
-		c.out <- msg
-		// elapsed := time.Since(start)
-		// fmt.Printf("waited %v to send %v\n", elapsed, msg)
+	var delayed []throttleDelayedLine
+	var delayedTimer *time.Timer
+	in := c.in
+
+	for in != nil {
+		var delayedRelease <-chan time.Time
+		if delayedTimer != nil {
+			delayedRelease = delayedTimer.C
+		}
+
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			delayed = c.handle(msg, delayed)
+
+		case <-delayedRelease:
+			delayedTimer = nil
+			delayed = c.releaseDelayed(delayed)
+		}
+
+		if delayedTimer == nil && len(delayed) > 0 {
+			delayedTimer = time.NewTimer(time.Until(delayed[0].releaseAt))
+		}
 	}
 
+	// Messages still held back are dropped as the client has gone
+	if delayedTimer != nil {
+		delayedTimer.Stop()
+	}
 	close(c.out)
 }
+
+// handle - Wait for the limiter then pass on msg, or hold it back if it is delayed. Returns the
+// messages being held back
+func (c *ThrottledStringChannel) handle(msg string, delayed []throttleDelayedLine) []throttleDelayedLine {
+	weight := 1
+	if c.Weight != nil {
+		weight = c.Weight(msg)
+	}
+	// Waiting for more tokens than the burst size would never succeed
+	if weight > c.Burst() {
+		weight = c.Burst()
+	}
+	if weight > 0 {
+		c.WaitN(context.Background(), weight)
+	}
+
+	// Anything that became due while waiting goes first
+	delayed = c.releaseDelayed(delayed)
+
+	delay := time.Duration(0)
+	if c.Delay != nil {
+		delay = c.Delay(msg)
+	}
+	if delay <= 0 {
+		c.out <- msg
+		return delayed
+	}
+
+	if len(delayed) >= maxThrottleDelayedLines {
+		if c.Dropped != nil {
+			c.Dropped(msg)
+		}
+		return delayed
+	}
+
+	// Delayed messages keep their order between themselves
+	releaseAt := time.Now().Add(delay)
+	if len(delayed) > 0 && delayed[len(delayed)-1].releaseAt.After(releaseAt) {
+		releaseAt = delayed[len(delayed)-1].releaseAt
+	}
+	return append(delayed, throttleDelayedLine{msg: msg, releaseAt: releaseAt})
+}
+
+// releaseDelayed - Pass on the held back messages that are due. Returns the rest
+func (c *ThrottledStringChannel) releaseDelayed(delayed []throttleDelayedLine) []throttleDelayedLine {
+	now := time.Now()
+	released := 0
+	for released < len(delayed) && !delayed[released].releaseAt.After(now) {
+		c.out <- delayed[released].msg
+		released++
+	}
+
+	return delayed[released:]
+}
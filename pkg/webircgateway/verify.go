@@ -0,0 +1,307 @@
+package webircgateway
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/kiwiirc/webircgateway/pkg/irc"
+)
+
+// parseGatewayAuthToken - Verify a gateway auth token and return the identity it contains.
+// Tokens are HS256 JWTs with the account name in the "account" or "sub" claim. All other
+// string claims are kept as identity data, with lists of strings such as roles joined by commas
+func parseGatewayAuthToken(secret string, tokenString string) (*ClientIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return []byte(secret), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens must expire so that a leaked token is not usable forever
+	if _, hasExpiry := claims["exp"]; !hasExpiry {
+		return nil, errors.New("token has no expiry")
+	}
+
+	identity := &ClientIdentity{Data: make(map[string]string)}
+	for name, val := range claims {
+		switch typedVal := val.(type) {
+		case string:
+			identity.Data[name] = typedVal
+		case []interface{}:
+			strVals := []string{}
+			for _, item := range typedVal {
+				if strVal, isString := item.(string); isString {
+					strVals = append(strVals, strVal)
+				}
+			}
+			identity.Data[name] = strings.Join(strVals, ",")
+		}
+	}
+
+	identity.Account = identity.Data["account"]
+	if identity.Account == "" {
+		identity.Account = identity.Data["sub"]
+	}
+	if identity.Account == "" {
+		return nil, errors.New("token has no account")
+	}
+
+	return identity, nil
+}
+
+// isIdentified - Check if the client has proven who it is, either with a gateway auth token or
+// by logging in to the IRC server
+func (c *Client) isIdentified() bool {
+	return (c.Identity != nil && c.Identity.Account != "") || c.IrcState.Account != ""
+}
+
+// runAbuseChecks - Check the client against the DNSBLs and ask for a captcha if needed.
+// Returns false if the client was disconnected
+func (c *Client) runAbuseChecks() bool {
+	dnsblAction := c.Gateway.Config.DnsblAction
+	validAction := dnsblAction == "verify" || dnsblAction == "deny"
+	dnsblTookAction := ""
+
+	if len(c.Gateway.Config.DnsblServers) > 0 && c.RemoteAddr != "" && !c.Verified && validAction {
+		dnsblTookAction = c.checkDnsBl()
+	}
+
+	if dnsblTookAction == "" && c.RequiresVerification && !c.Verified {
+		c.SendClientSignal("data", gatewayFailLine(FailVerificationNeeded, "Complete the captcha to connect"))
+		c.SendClientSignal("data", "CAPTCHA NEEDED")
+	}
+
+	return dnsblTookAction != "deny"
+}
+
+// startDeferredAbuseChecks - Called once a client has registered when abuse checks are skipped
+// for identified users. Identified clients skip the checks, others may be given time to log in
+// with SASL before they are checked. Returns false if the client was disconnected
+func (c *Client) startDeferredAbuseChecks() bool {
+	if c.isIdentified() {
+		c.Log(2, "Skipping abuse checks for an identified user")
+		c.Verified = true
+		return true
+	}
+
+	grace := c.Gateway.Config.VerifySaslGrace
+	if grace <= 0 {
+		return c.runAbuseChecks()
+	}
+
+	// Only registering and logging in reach the IRC server until the checks have run
+	c.Log(1, "Allowing %d seconds to log in before running abuse checks", grace)
+	atomic.StoreInt32(&c.verifyHold, 1)
+	c.inVerifyGrace = true
+	c.verifyGraceTimer = time.NewTimer(time.Second * time.Duration(grace))
+	return true
+}
+
+// verifyGraceTimeout - Fires when the grace period to log in is over, and again when the time
+// to complete a captcha after it is over. nil when not waiting, which never fires in a select
+func (c *Client) verifyGraceTimeout() <-chan time.Time {
+	if c.verifyGraceTimer == nil {
+		return nil
+	}
+	return c.verifyGraceTimer.C
+}
+
+// handleVerifyGraceTimeout - Run the abuse checks once the grace period is over, or close a
+// client that did not complete its captcha in time. Returns true if the client was closed
+func (c *Client) handleVerifyGraceTimeout() bool {
+	c.verifyGraceTimer = nil
+	if c.inVerifyGrace {
+		return c.endVerifyGrace()
+	}
+
+	if c.Verified || c.isIdentified() {
+		return false
+	}
+
+	c.Gateway.sendWebhook(WebhookVerificationFailed, c, "verification_timeout")
+	c.SendGatewayError(FailVerificationTimeout, "Verification timed out")
+	c.SendClientSignal("state", "closed", "unverified")
+	c.StartShutdown("unverified")
+	return true
+}
+
+// endVerifyGrace - The client did not log in during the grace period. Run the abuse checks
+// and give it the same period again to complete a captcha if one is needed, still holding its
+// lines back. Returns true if the client was closed
+func (c *Client) endVerifyGrace() bool {
+	c.inVerifyGrace = false
+	if c.isIdentified() {
+		c.Verified = true
+		c.releaseVerificationHold()
+		return false
+	}
+
+	if !c.runAbuseChecks() {
+		return true
+	}
+
+	if !c.RequiresVerification || c.Verified {
+		c.releaseVerificationHold()
+		return false
+	}
+
+	c.verifyGraceTimer = time.NewTimer(time.Second * time.Duration(c.Gateway.Config.VerifySaslGrace))
+	return false
+}
+
+// identifiedDuringGrace - The client logged in while its abuse checks were waiting
+func (c *Client) identifiedDuringGrace() {
+	if !c.inVerifyGrace && c.Verified {
+		return
+	}
+
+	if c.verifyGraceTimer != nil {
+		c.verifyGraceTimer.Stop()
+		c.verifyGraceTimer = nil
+	}
+	c.inVerifyGrace = false
+	c.Verified = true
+	c.Log(2, "Client identified, skipping abuse checks")
+	c.releaseVerificationHold()
+}
+
+// isVerifyGraceLine - Lines that registering and logging in need, which are let through while
+// the client is given time to log in
+func isVerifyGraceLine(m *irc.Message) bool {
+	command := strings.ToUpper(m.Command)
+	switch command {
+	case "CAP", "AUTHENTICATE", "NICK", "USER", "PASS", "NICKSERV", "NS":
+		return true
+	case "PRIVMSG":
+		return strings.EqualFold(m.GetParam(0, ""), "NickServ")
+	}
+	return false
+}
+
+// The most lines from a client that are held while it completes a captcha. Later lines are dropped
+const maxVerifyHoldLines = 20
+
+// RequireVerification - Ask a connected client to complete a captcha, eg. after a plugin has
+// spotted spam. Until it does, lines from the client are held back from the IRC server. Safe to
+// call from any goroutine as the request is handled by the clients line worker
+func (c *Client) RequireVerification(reason string) {
+	if c.IsShuttingDown() {
+		return
+	}
+
+	// A request that is already waiting to be handled does the same thing
+	select {
+	case c.verifyRequests <- reason:
+	default:
+	}
+}
+
+// handleRequireVerification - Start holding lines back until the client completes a captcha.
+// Runs on the clients line worker
+func (c *Client) handleRequireVerification(reason string) {
+	if !atomic.CompareAndSwapInt32(&c.verifyHold, 0, 1) {
+		return
+	}
+
+	c.Log(2, "Verification required: %s", reason)
+	c.RequiresVerification = true
+	c.Verified = false
+	c.updateThrottleTier()
+
+	// Clients that have not connected upstream yet are held back by the usual verification checks
+	if !c.UpstreamStarted {
+		atomic.StoreInt32(&c.verifyHold, 0)
+		c.SendClientSignal("data", gatewayFailLine(FailVerificationNeeded, "Complete the captcha to connect"))
+		c.SendClientSignal("data", "CAPTCHA NEEDED")
+		return
+	}
+
+	if timeout := c.Gateway.Config.VerifyHoldTimeout; timeout > 0 {
+		c.verifyHoldTimer = time.NewTimer(time.Second * time.Duration(timeout))
+	}
+
+	c.SendClientSignal("data", gatewayFailLine(FailVerificationNeeded, "Complete the captcha to continue"))
+	c.SendClientSignal("data", "CAPTCHA NEEDED")
+}
+
+// verifyHoldTimeout - Fires when a client has taken too long to complete a captcha requested
+// mid-session. nil when not waiting, which never fires in a select
+func (c *Client) verifyHoldTimeout() <-chan time.Time {
+	if c.verifyHoldTimer == nil {
+		return nil
+	}
+	return c.verifyHoldTimer.C
+}
+
+// handleVerifyHoldTimeout - Close a client that did not complete a captcha requested
+// mid-session in time. Returns true if the client was closed
+func (c *Client) handleVerifyHoldTimeout() bool {
+	c.verifyHoldTimer = nil
+	if atomic.LoadInt32(&c.verifyHold) == 0 {
+		return false
+	}
+
+	c.Gateway.sendWebhook(WebhookVerificationFailed, c, "verification_timeout")
+	c.SendGatewayError(FailVerificationTimeout, "Verification timed out")
+	c.SendClientSignal("state", "closed", "unverified")
+	c.StartShutdown("unverified")
+	return true
+}
+
+// holdForVerification - Keep a line from the client back while it is completing a captcha
+// requested mid-session, or while its abuse checks wait for it to log in. Returns false if the
+// line may be sent upstream
+func (c *Client) holdForVerification(line string) bool {
+	if atomic.LoadInt32(&c.verifyHold) == 0 {
+		return false
+	}
+
+	// Keep the connection to the IRC server alive while waiting
+	command := ""
+	m, err := irc.ParseLine(line)
+	if err == nil {
+		command = strings.ToUpper(m.Command)
+	}
+	if command == "PING" || command == "PONG" || command == "QUIT" {
+		return false
+	}
+	if c.inVerifyGrace && err == nil && isVerifyGraceLine(m) {
+		return false
+	}
+
+	if len(c.verifyHoldLines) < maxVerifyHoldLines {
+		c.verifyHoldLines = append(c.verifyHoldLines, line)
+	} else {
+		c.Log(2, "Dropping a line while waiting for verification")
+	}
+	return true
+}
+
+// releaseVerificationHold - Send the lines held back while the client completed a captcha
+func (c *Client) releaseVerificationHold() {
+	if !atomic.CompareAndSwapInt32(&c.verifyHold, 1, 0) {
+		return
+	}
+
+	if c.verifyHoldTimer != nil {
+		c.verifyHoldTimer.Stop()
+		c.verifyHoldTimer = nil
+	}
+
+	lines := c.verifyHoldLines
+	c.verifyHoldLines = nil
+	for _, line := range lines {
+		if err := c.sendUpstreamLine(line); err != nil {
+			c.Log(2, "Dropping a held line: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package webircgateway
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// WebhookClientConnect - A client has connected to the gateway
+	WebhookClientConnect = "client.connect"
+	// WebhookClientDisconnect - A client has disconnected from the gateway
+	WebhookClientDisconnect = "client.disconnect"
+	// WebhookVerificationFailed - A client failed verification (captcha or dnsbl)
+	WebhookVerificationFailed = "client.verification_failed"
+)
+
+type webhookClient struct {
+	ID             uint64 `json:"id"`
+	RemoteAddr     string `json:"remote_addr"`
+	RemoteHostname string `json:"remote_hostname"`
+	Nick           string `json:"nick"`
+	Username       string `json:"username"`
+	Account        string `json:"account"`
+	Upstream       string `json:"upstream"`
+	State          string `json:"state"`
+}
+
+type webhookPayload struct {
+	Event  string        `json:"event"`
+	Time   int64         `json:"time"`
+	Reason string        `json:"reason,omitempty"`
+	Client webhookClient `json:"client"`
+}
+
+// sendWebhook - Notify the configured webhook URLs of a client event
+func (s *Gateway) sendWebhook(event string, c *Client, reason string) {
+	if len(s.Config.WebhookUrls) == 0 || !stringInSlice(event, s.Config.WebhookEvents) {
+		return
+	}
+
+	payload := webhookPayload{
+		Event:  event,
+		Time:   time.Now().Unix(),
+		Reason: reason,
+		Client: webhookClient{
+			ID:             c.Id,
+			RemoteAddr:     c.RemoteAddr,
+			RemoteHostname: c.RemoteHostname,
+			Nick:           c.IrcState.Nick,
+			Username:       c.IrcState.Username,
+			Account:        c.IrcState.Account,
+			State:          c.State(),
+		},
+	}
+	if c.UpstreamConfig.Hostname != "" {
+		payload.Client.Upstream = fmt.Sprintf("%s:%d", c.UpstreamConfig.Hostname, c.UpstreamConfig.Port)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	signature := ""
+	if s.Config.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(s.Config.WebhookSecret))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	timeout := time.Second * time.Duration(s.Config.WebhookTimeout)
+	for _, url := range s.Config.WebhookUrls {
+		go s.queueWebhook(url, body, signature, timeout)
+	}
+}
+
+// queueWebhook - Post a webhook through the outbound scheduler. Webhooks to a URL that is failing
+// are dropped until it has had time to recover
+func (s *Gateway) queueWebhook(url string, body []byte, signature string, timeout time.Duration) {
+	err := s.runAux("webhook:"+url, func() error {
+		return s.postWebhook(url, body, signature, timeout)
+	})
+	if err == errAuxBackoff {
+		s.Log(2, "Webhook to %s dropped while it is failing", url)
+	}
+}
+
+func (s *Gateway) postWebhook(url string, body []byte, signature string, timeout time.Duration) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		s.Log(3, "Webhook error for %s: %s", url, err.Error())
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "webircgateway/"+Version)
+	if signature != "" {
+		req.Header.Set("X-Webircgateway-Signature", signature)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		s.Log(3, "Webhook error for %s: %s", url, err.Error())
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		s.Log(3, "Webhook %s responded with status %d", url, resp.StatusCode)
+		return fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package webircgateway
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// ConfigWebircTags - Which client tags are sent in WEBIRC to an upstream, and what they are called
+type ConfigWebircTags struct {
+	// Allow - Only send tags matching one of these. Empty allows all tags
+	Allow []glob.Glob
+	// Deny - Never send tags matching one of these
+	Deny []glob.Glob
+	// Rename - Send tags under a different name, keyed by the gateways name for the tag
+	Rename map[string]string
+}
+
+// parseWebircTags - Read the webirc_tags_* options of an upstream section
+func (c *Config) parseWebircTags(sectionName string, allow []string, deny []string, rename []string) ConfigWebircTags {
+	tags := ConfigWebircTags{
+		Rename: make(map[string]string),
+	}
+
+	compile := func(patterns []string) []glob.Glob {
+		compiled := []glob.Glob{}
+		for _, pattern := range patterns {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			match, err := glob.Compile(pattern)
+			if err != nil {
+				c.gateway.Log(3, "Config section %s has an invalid webirc tag pattern %s", sectionName, pattern)
+				continue
+			}
+			compiled = append(compiled, match)
+		}
+		return compiled
+	}
+	tags.Allow = compile(allow)
+	tags.Deny = compile(deny)
+
+	for _, pair := range rename {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			continue
+		}
+		tags.Rename[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return tags
+}
+
+// allows - Check if a tag may be sent to the upstream
+func (t *ConfigWebircTags) allows(name string) bool {
+	for _, match := range t.Deny {
+		if match.Match(name) {
+			return false
+		}
+	}
+
+	if len(t.Allow) == 0 {
+		return true
+	}
+	for _, match := range t.Allow {
+		if match.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// webircTags - The client tags to send in WEBIRC to the clients upstream, sorted by name
+func (c *Client) webircTags() [][2]string {
+	tagConfig := &ConfigWebircTags{}
+	if c.UpstreamConfig != nil {
+		tagConfig = &c.UpstreamConfig.WebircTags
+	}
+
+	names := make([]string, 0, len(c.Tags))
+	for name := range c.Tags {
+		if tagConfig.allows(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	tags := make([][2]string, 0, len(names))
+	for _, name := range names {
+		sendName := name
+		if renamed, exists := tagConfig.Rename[name]; exists {
+			sendName = renamed
+		}
+		tags = append(tags, [2]string{sendName, c.Tags[name]})
+	}
+
+	return tags
+}
@@ -1,52 +1,296 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"math"
-	"os"
-	"runtime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/kiwiirc/webircgateway/pkg/webircgateway"
 )
 
-func Start(gateway *webircgateway.Gateway, pluginsQuit *sync.WaitGroup) {
-	gateway.Log(2, "Stats reporting plugin loading")
-	go reportUsage(gateway)
+// Upper bounds in seconds of the latency histogram buckets
+var latencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
 
-	pluginsQuit.Done()
+// histogram - Counts of observed durations in cumulative buckets, as used by Prometheus
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+type histogramSnapshot struct {
+	Buckets map[string]uint64 `json:"buckets"`
+	Count   uint64            `json:"count"`
+	Sum     float64           `json:"sum"`
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if seconds <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
 }
 
-func reportUsage(gateway *webircgateway.Gateway) {
-	started := time.Now()
+func (h *histogram) Snapshot() histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	out := func(line string) {
-		file, _ := os.OpenFile("stats_"+fmt.Sprintf("%v", started.Unix())+".csv",
-			os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		file.WriteString(line)
-		file.Close()
+	snap := histogramSnapshot{
+		Buckets: make(map[string]uint64),
+		Count:   h.count,
+		Sum:     h.sum,
+	}
+	for i, upper := range h.buckets {
+		snap.Buckets[formatBucket(upper)] = h.counts[i]
 	}
+	snap.Buckets["+Inf"] = h.count
+
+	return snap
+}
+
+func formatBucket(upper float64) string {
+	return fmt.Sprintf("%g", upper)
+}
+
+type pluginStats struct {
+	*webircgateway.GatewayStats
+	Registration    histogramSnapshot `json:"registration_seconds"`
+	UpstreamConnect histogramSnapshot `json:"upstream_connect_seconds"`
+	UpstreamErrors  uint64            `json:"upstream_connect_errors"`
+}
+
+var (
+	registrationTimes    = newHistogram(latencyBuckets)
+	upstreamConnectTimes = newHistogram(latencyBuckets)
+
+	// When each client connected to the gateway, until it has registered on the IRC server
+	pendingMu            sync.Mutex
+	pendingRegistrations = make(map[*webircgateway.Client]time.Time)
+	upstreamErrors       uint64
+)
+
+func Start(gateway *webircgateway.Gateway, pluginsQuit *sync.WaitGroup) {
+	gateway.Log(2, "Stats reporting plugin loading")
+
+	webircgateway.HookRegister("client.state", func(hook *webircgateway.HookClientState) {
+		pendingMu.Lock()
+		defer pendingMu.Unlock()
+
+		if hook.Connected {
+			pendingRegistrations[hook.Client] = time.Now()
+		} else {
+			delete(pendingRegistrations, hook.Client)
+		}
+	})
+
+	webircgateway.HookRegister("irc.connection.post", func(hook *webircgateway.HookIrcConnectionPost) {
+		if hook.Error != nil {
+			pendingMu.Lock()
+			upstreamErrors++
+			pendingMu.Unlock()
+			return
+		}
+		upstreamConnectTimes.Observe(hook.Duration)
+	})
+
+	webircgateway.HookRegister("irc.line", func(hook *webircgateway.HookIrcLine) {
+		if hook.ToServer || hook.Message == nil || hook.Message.Command != "001" {
+			return
+		}
+
+		pendingMu.Lock()
+		connected, isPending := pendingRegistrations[hook.Client]
+		delete(pendingRegistrations, hook.Client)
+		pendingMu.Unlock()
+
+		if isPending {
+			registrationTimes.Observe(time.Since(connected))
+		}
+	})
+
+	gateway.HttpRouter.HandleFunc("/webirc/stats", func(w http.ResponseWriter, r *http.Request) {
+		if !webircgateway.IsPrivateIP(gateway.GetRemoteAddressFromRequest(r)) {
+			w.WriteHeader(403)
+			return
+		}
+
+		pendingMu.Lock()
+		errorCount := upstreamErrors
+		pendingMu.Unlock()
+
+		stats := &pluginStats{
+			GatewayStats:    gateway.Stats(),
+			Registration:    registrationTimes.Snapshot(),
+			UpstreamConnect: upstreamConnectTimes.Snapshot(),
+			UpstreamErrors:  errorCount,
+		}
+
+		if r.URL.Query().Get("format") == "prometheus" || strings.Contains(r.Header.Get("Accept"), "text/plain") {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			w.Write([]byte(prometheusFormat(stats)))
+			return
+		}
 
-	out("time,rss,heapinuse,heapalloc,numroutines,numclients\n")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
 
-	for {
-		time.Sleep(time.Second * 5)
+	pluginsQuit.Done()
+}
 
-		numClients := gateway.Clients.Count()
-		mem := &runtime.MemStats{}
-		runtime.ReadMemStats(mem)
+// prometheusFormat - Stats in the Prometheus text exposition format
+func prometheusFormat(stats *pluginStats) string {
+	out := &strings.Builder{}
 
-		line := fmt.Sprintf(
-			"%v,%v,%v,%v,%v,%v\n",
-			math.Round(time.Now().Sub(started).Seconds()),
-			mem.Sys/1024,
-			mem.HeapInuse/1024,
-			mem.HeapAlloc/1024,
-			runtime.NumGoroutine(),
-			numClients,
-		)
+	metric := func(metricType string, name string, help string, val interface{}) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, metricType, name, val)
+	}
+	gauge := func(name string, help string, val interface{}) {
+		metric("gauge", name, help, val)
+	}
+	labelled := func(name string, help string, label string, vals map[string]int) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		keys := make([]string, 0, len(vals))
+		for key := range vals {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(out, "%s{%s=%q} %d\n", name, label, key, vals[key])
+		}
+	}
+	labelledFloat := func(name string, help string, label string, vals map[string]float64) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		keys := make([]string, 0, len(vals))
+		for key := range vals {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(out, "%s{%s=%q} %g\n", name, label, key, vals[key])
+		}
+	}
+	hist := func(name string, help string, snap histogramSnapshot) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+		for _, upper := range latencyBuckets {
+			le := formatBucket(upper)
+			fmt.Fprintf(out, "%s_bucket{le=%q} %d\n", name, le, snap.Buckets[le])
+		}
+		fmt.Fprintf(out, "%s_bucket{le=\"+Inf\"} %d\n", name, snap.Count)
+		fmt.Fprintf(out, "%s_sum %g\n%s_count %d\n", name, snap.Sum, name, snap.Count)
+	}
+	perTransport := func(metricType string, name string, help string, val func(webircgateway.TransportStats) float64) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+		transports := make([]string, 0, len(stats.Transports))
+		for transport := range stats.Transports {
+			transports = append(transports, transport)
+		}
+		sort.Strings(transports)
+		for _, transport := range transports {
+			fmt.Fprintf(out, "%s{transport=%q} %g\n", name, transport, val(stats.Transports[transport]))
+		}
+	}
+	hookHist := func(name string, help string) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+		hooks := make([]string, 0, len(stats.Hooks))
+		for hook := range stats.Hooks {
+			hooks = append(hooks, hook)
+		}
+		sort.Strings(hooks)
+		for _, hook := range hooks {
+			snap := stats.Hooks[hook]
+			uppers := make([]float64, 0, len(snap.Buckets))
+			for le := range snap.Buckets {
+				if upper, err := strconv.ParseFloat(le, 64); err == nil && le != "+Inf" {
+					uppers = append(uppers, upper)
+				}
+			}
+			sort.Float64s(uppers)
+			for _, upper := range uppers {
+				le := formatBucket(upper)
+				fmt.Fprintf(out, "%s_bucket{hook=%q,le=%q} %d\n", name, hook, le, snap.Buckets[le])
+			}
+			fmt.Fprintf(out, "%s_bucket{hook=%q,le=\"+Inf\"} %d\n", name, hook, snap.Calls)
+			fmt.Fprintf(out, "%s_sum{hook=%q} %g\n%s_count{hook=%q} %d\n", name, hook, snap.TotalSeconds, name, hook, snap.Calls)
+		}
+	}
+	hookCounter := func(name string, help string, val func(webircgateway.HookStats) uint64) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		hooks := make([]string, 0, len(stats.Hooks))
+		for hook := range stats.Hooks {
+			hooks = append(hooks, hook)
+		}
+		sort.Strings(hooks)
+		for _, hook := range hooks {
+			fmt.Fprintf(out, "%s{hook=%q} %d\n", name, hook, val(stats.Hooks[hook]))
+		}
+	}
+	boolVal := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
 
-		out(line)
+	gauge("webircgateway_clients", "Connected clients", stats.Clients)
+	labelled("webircgateway_client_states", "Connected clients by state", "state", stats.ClientStates)
+	labelled("webircgateway_upstream_clients", "Connected clients by upstream", "upstream", stats.Upstreams)
+	upstreamLatency := make(map[string]float64)
+	for upstream, ms := range stats.UpstreamLatencyMs {
+		upstreamLatency[upstream] = ms / 1000
 	}
+	labelledFloat("webircgateway_upstream_latency_seconds", "Smoothed PING round-trip time to each upstream", "upstream", upstreamLatency)
+	perTransport("gauge", "webircgateway_transport_active_clients", "Connected clients by transport", func(t webircgateway.TransportStats) float64 {
+		return float64(t.Active)
+	})
+	perTransport("counter", "webircgateway_transport_connections_total", "Clients connected by transport", func(t webircgateway.TransportStats) float64 {
+		return float64(t.Connections)
+	})
+	perTransport("counter", "webircgateway_transport_upgrade_failures_total", "Failed websocket upgrades by transport", func(t webircgateway.TransportStats) float64 {
+		return float64(t.UpgradeFailures)
+	})
+	perTransport("counter", "webircgateway_transport_origin_rejections_total", "Connections refused for their origin by transport", func(t webircgateway.TransportStats) float64 {
+		return float64(t.OriginRejections)
+	})
+	perTransport("gauge", "webircgateway_transport_session_seconds_avg", "Average time clients stayed connected by transport", func(t webircgateway.TransportStats) float64 {
+		return t.AvgSessionSeconds
+	})
+	gauge("webircgateway_goroutines", "Running goroutines", stats.Goroutines)
+	gauge("webircgateway_heap_inuse_bytes", "Heap memory in use", stats.HeapInuseKB*1024)
+	gauge("webircgateway_heap_alloc_bytes", "Heap memory allocated", stats.HeapAllocKB*1024)
+	gauge("webircgateway_sys_bytes", "Memory obtained from the OS", stats.SysKB*1024)
+	gauge("webircgateway_draining", "Whether the gateway is draining", boolVal(stats.Draining))
+	gauge("webircgateway_maintenance", "Whether the gateway is in maintenance mode", boolVal(stats.Maintenance))
+	gauge("webircgateway_memory_pressure", "Whether memory use is over the limits", boolVal(stats.MemoryPressure))
+	metric("counter", "webircgateway_upstream_connect_errors_total", "Failed upstream connection attempts", stats.UpstreamErrors)
+	hist("webircgateway_registration_seconds", "Time from a client connecting to registering on the IRC server", stats.Registration)
+	hist("webircgateway_upstream_connect_seconds", "Time taken to connect to the IRC server", stats.UpstreamConnect)
+	hookHist("webircgateway_hook_duration_seconds", "Time taken by the plugin callbacks of each hook")
+	hookCounter("webircgateway_hook_slow_calls_total", "Hook callbacks that took longer than hook_time_budget", func(h webircgateway.HookStats) uint64 {
+		return h.SlowCalls
+	})
+
+	return out.String()
 }
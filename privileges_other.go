@@ -0,0 +1,77 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges - Switch to an unprivileged user and group once all listeners are bound. The
+// ownedFiles made while privileged, eg. the control socket, are given to the user and group first
+func dropPrivileges(username string, groupname string, ownedFiles ...string) error {
+	if username == "" && groupname == "" {
+		return nil
+	}
+
+	uid := -1
+	gid := -1
+
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	if gid == -1 {
+		gid = os.Getgid()
+	}
+
+	// Only root can change supplementary groups or file owners, and an unprivileged user running
+	// as itself has nothing to change
+	if os.Getuid() == 0 {
+		for _, file := range ownedFiles {
+			if file == "" {
+				continue
+			}
+			if err := os.Chown(file, uid, gid); err != nil {
+				return fmt.Errorf("chown %s: %s", file, err.Error())
+			}
+		}
+
+		// Supplementary groups would otherwise keep those of root, even when the primary group
+		// does not change
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %s", err.Error())
+		}
+	}
+
+	if gid != os.Getgid() {
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid: %s", err.Error())
+		}
+	}
+
+	if uid != -1 && uid != os.Getuid() {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid: %s", err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "errors"
+
+// dropPrivileges - Switching users is not supported on Windows. Run the service as the user instead
+func dropPrivileges(username string, groupname string, ownedFiles ...string) error {
+	if username == "" && groupname == "" {
+		return nil
+	}
+
+	return errors.New("the user and group options are not supported on Windows")
+}
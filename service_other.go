@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "errors"
+
+var errNotWindows = errors.New("Services are only supported on Windows")
+
+func runningAsService() bool {
+	return false
+}
+
+func serviceCommand(cmd string, configFile string, function string) error {
+	return errNotWindows
+}
+
+func runService(configFile string, function string) error {
+	return errNotWindows
+}
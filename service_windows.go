@@ -0,0 +1,175 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kiwiirc/webircgateway/pkg/webircgateway"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "webircgateway"
+
+// runningAsService - Check if we have been started by the Windows service control manager
+func runningAsService() bool {
+	isService, err := svc.IsWindowsService()
+	return err == nil && isService
+}
+
+// serviceCommand - Install or uninstall webircgateway as a Windows service
+func serviceCommand(cmd string, configFile string, function string) error {
+	switch cmd {
+	case "install":
+		return installService(configFile, function)
+	case "uninstall":
+		return uninstallService()
+	default:
+		return fmt.Errorf("Unknown service command '%s'. Use 'install' or 'uninstall'", cmd)
+	}
+}
+
+func installService(configFile string, function string) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	// The service does not start in the current directory so the config path must be absolute
+	if !strings.HasPrefix(configFile, "$ ") {
+		configFile, _ = filepath.Abs(configFile)
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err == nil {
+		s.Close()
+		return fmt.Errorf("Service %s already exists", serviceName)
+	}
+
+	s, err = m.CreateService(serviceName, exePath, mgr.Config{
+		DisplayName: "webircgateway",
+		Description: "HTTP/websocket gateway to IRC networks",
+		StartType:   mgr.StartAutomatic,
+	}, "-config", configFile, "-run", function)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf("Error installing the event log source: %s", err.Error())
+	}
+
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("Service %s is not installed", serviceName)
+	}
+	defer s.Close()
+
+	err = s.Delete()
+	if err != nil {
+		return err
+	}
+
+	return eventlog.Remove(serviceName)
+}
+
+// runService - Run the gateway under the Windows service control manager
+func runService(configFile string, function string) error {
+	return svc.Run(serviceName, &gatewayService{
+		configFile: configFile,
+		function:   function,
+	})
+}
+
+type gatewayService struct {
+	configFile string
+	function   string
+}
+
+func (gs *gatewayService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return true, 1
+	}
+	defer elog.Close()
+
+	gateway := webircgateway.NewGateway(gs.function)
+	go eventLogOutput(gateway, elog)
+
+	gateway.Config.SetConfigFile(gs.configFile)
+	elog.Info(1, "Using config "+gateway.Config.CurrentConfigFile())
+
+	_, err = startGateway(gateway)
+	if err != nil {
+		elog.Error(1, "Error starting: "+err.Error())
+		return true, 2
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		gateway.WaitClose()
+		close(closed)
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange}
+
+	for {
+		select {
+		case <-closed:
+			changes <- svc.Status{State: svc.Stopped}
+			return false, 0
+
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.ParamChange:
+				elog.Info(1, "Reloading config file")
+				if err := gateway.Config.Load(); err != nil {
+					elog.Error(1, "Config file error: "+err.Error())
+				}
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				gateway.Close()
+			}
+		}
+	}
+}
+
+func eventLogOutput(gateway *webircgateway.Gateway, elog *eventlog.Log) {
+	for {
+		line, _ := <-gateway.LogOutput
+		if strings.HasPrefix(line, "L_WARN") {
+			elog.Warning(1, line)
+		} else {
+			elog.Info(1, line)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// maintenanceSignals - Windows has no user signals. Use the control socket instead
+var maintenanceSignals = []os.Signal{}